@@ -0,0 +1,496 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// auditLog is the audit sink configured by initAuditLog. It is nil when
+// auditing is disabled.
+var auditLog *auditLogger
+
+const redactedValue = "[REDACTED]"
+
+// unparseableBodyValue replaces bodies that JSON path redaction can't be
+// applied to, e.g. bodies cut at AUDIT_LOG_MAX_BODY_BYTES or event streams.
+const unparseableBodyValue = "[unparseable body redacted]"
+
+var (
+	emailPattern   = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)
+	apiKeyPatterns = []*regexp.Regexp{
+		regexp.MustCompile(`\bsk-[A-Za-z0-9_-]{16,}`),           // OpenAI-style keys
+		regexp.MustCompile(`AIza[0-9A-Za-z_-]{35}`),             // Google API keys
+		regexp.MustCompile(`ya29\.[0-9A-Za-z_-]+`),              // Google OAuth access tokens
+		regexp.MustCompile(`(?i)bearer\s+[A-Za-z0-9._~+/-]+=*`), // Bearer credentials
+	}
+)
+
+// auditRecord is a single line of the audit log.
+type auditRecord struct {
+	Time         time.Time       `json:"time"`
+	TraceID      string          `json:"trace_id,omitempty"`
+	Method       string          `json:"method"`
+	Path         string          `json:"path"`
+	Status       int             `json:"status"`
+	LatencyMS    int64           `json:"latency_ms"`
+	RemoteAddr   string          `json:"remote_addr,omitempty"`
+	UserAgent    string          `json:"user_agent,omitempty"`
+	Key          string          `json:"key,omitempty"`
+	Model        string          `json:"model,omitempty"`
+	Stream       bool            `json:"stream,omitempty"`
+	Variant      string          `json:"variant,omitempty"`
+	Usage        *auditUsage     `json:"usage,omitempty"`
+	RequestBody  json.RawMessage `json:"request_body,omitempty"`
+	ResponseBody json.RawMessage `json:"response_body,omitempty"`
+}
+
+// auditUsage mirrors the OpenAI usage object.
+type auditUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+type auditLogger struct {
+	mu            sync.Mutex
+	w             io.Writer
+	includeBodies bool
+	maxBodyBytes  int
+	redactor      *redactor
+}
+
+// initAuditLog configures the audit sink from the AUDIT_LOG* environment
+// variables. Auditing stays disabled when AUDIT_LOG is not set.
+func initAuditLog() error {
+	dest := strings.TrimSpace(os.Getenv("AUDIT_LOG"))
+	if dest == "" {
+		logger.Info("initAuditLog: AUDIT_LOG not set, audit log disabled")
+		return nil
+	}
+
+	var w io.Writer
+	if dest == "stdout" || dest == "-" {
+		w = os.Stdout
+	} else {
+		maxSizeMB, err := envInt("AUDIT_LOG_MAX_SIZE_MB", 100)
+		if err != nil {
+			return err
+		}
+		maxBackups, err := envInt("AUDIT_LOG_MAX_BACKUPS", 5)
+		if err != nil {
+			return err
+		}
+		f, err := openRotatingFile(dest, int64(maxSizeMB)<<20, maxBackups)
+		if err != nil {
+			return fmt.Errorf("opening audit log %s: %w", dest, err)
+		}
+		w = f
+	}
+
+	maxBodyBytes, err := envInt("AUDIT_LOG_MAX_BODY_BYTES", 1<<20)
+	if err != nil {
+		return err
+	}
+	r, err := newRedactorFromEnv()
+	if err != nil {
+		return err
+	}
+	auditLog = &auditLogger{
+		w:             w,
+		includeBodies: envBool("AUDIT_LOG_BODIES"),
+		maxBodyBytes:  maxBodyBytes,
+		redactor:      r,
+	}
+	logger.Info("initAuditLog: Audit log enabled", "destination", dest, "include_bodies", auditLog.includeBodies)
+	return nil
+}
+
+// envInt parses an integer environment variable, returning def when unset.
+func envInt(name string, def int) (int, error) {
+	v := strings.TrimSpace(os.Getenv(name))
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %w", name, v, err)
+	}
+	return n, nil
+}
+
+// envDuration parses a duration environment variable, returning def when unset.
+func envDuration(name string, def time.Duration) (time.Duration, error) {
+	v := strings.TrimSpace(os.Getenv(name))
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %w", name, v, err)
+	}
+	return d, nil
+}
+
+// envBool reports whether a boolean environment variable is set to a true value.
+func envBool(name string) bool {
+	b, _ := strconv.ParseBool(strings.TrimSpace(os.Getenv(name)))
+	return b
+}
+
+// envFlag parses a boolean environment variable, returning def when unset
+// and an error for values that aren't booleans.
+func envFlag(name string, def bool) (bool, error) {
+	v := strings.TrimSpace(os.Getenv(name))
+	if v == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %q: %w", name, v, err)
+	}
+	return b, nil
+}
+
+// splitList splits a comma-separated list, trimming spaces and dropping empty entries.
+func splitList(s string) []string {
+	var out []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// auditMiddleware writes an audit record for every request handled by next.
+// It is a no-op when the audit log is disabled. Only the first maxBodyBytes
+// of JSON request bodies are captured, as next reads them, so uploads such
+// as multipart /v1/files requests are never buffered or logged.
+func auditMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if auditLog == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+
+		reqCapture := &auditRequestBody{limit: auditLog.maxBodyBytes}
+		if r.Body != nil && r.Body != http.NoBody && jsonContentType(r.Header.Get("Content-Type")) {
+			reqCapture.ReadCloser = r.Body
+			r.Body = reqCapture
+		}
+
+		rec := &auditResponseWriter{ResponseWriter: w, status: http.StatusOK, limit: auditLog.maxBodyBytes}
+		next.ServeHTTP(rec, r)
+		reqBody := reqCapture.body.Bytes()
+
+		record := auditRecord{
+			Time:       start.UTC(),
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			Status:     rec.status,
+			LatencyMS:  time.Since(start).Milliseconds(),
+			RemoteAddr: r.RemoteAddr,
+			UserAgent:  r.UserAgent(),
+			Key:        clientKeyName(r),
+		}
+		if sc := trace.SpanContextFromContext(r.Context()); sc.HasTraceID() {
+			record.TraceID = sc.TraceID().String()
+		}
+		var reqFields struct {
+			Model  string `json:"model"`
+			Stream bool   `json:"stream"`
+		}
+		if json.Unmarshal(reqBody, &reqFields) == nil {
+			record.Model = reqFields.Model
+			record.Stream = reqFields.Stream
+		}
+		respBody := decodeResponseBody(rec.Header(), rec.body.Bytes())
+		record.Variant = rec.Header().Get(variantHeader)
+		record.Usage = extractUsage(respBody, mediaType(rec.Header().Get("Content-Type")) == "text/event-stream")
+		if auditLog.includeBodies {
+			record.RequestBody = auditLog.redactor.redactBody(reqBody)
+			record.ResponseBody = auditLog.redactor.redactBody(respBody)
+		}
+		auditLog.write(r, &record)
+	})
+}
+
+func (a *auditLogger) write(r *http.Request, record *auditRecord) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "auditLogger: Error encoding audit record", "error", err)
+		return
+	}
+	line = append(line, '\n')
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.w.Write(line); err != nil {
+		logger.ErrorContext(r.Context(), "auditLogger: Error writing audit record", "error", err)
+	}
+}
+
+// decodeResponseBody returns a captured response body, gunzipped if needed.
+func decodeResponseBody(h http.Header, body []byte) []byte {
+	if h.Get("Content-Encoding") == "gzip" {
+		if zr, err := gzip.NewReader(bytes.NewReader(body)); err == nil {
+			// A truncated capture still yields everything decoded so far.
+			body, _ = io.ReadAll(zr)
+		}
+	}
+	return body
+}
+
+// extractUsage finds the OpenAI usage object in a JSON response or, for
+// streams, in the last SSE chunk that carries one.
+func extractUsage(body []byte, stream bool) *auditUsage {
+	var payload struct {
+		Usage *auditUsage `json:"usage"`
+	}
+	if !stream {
+		if json.Unmarshal(body, &payload) == nil {
+			return payload.Usage
+		}
+		return nil
+	}
+	var usage *auditUsage
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(make([]byte, 64*1024), len(body)+1)
+	for scanner.Scan() {
+		data, ok := bytes.CutPrefix(scanner.Bytes(), []byte("data:"))
+		if !ok {
+			continue
+		}
+		payload.Usage = nil
+		if json.Unmarshal(bytes.TrimSpace(data), &payload) == nil && payload.Usage != nil {
+			usage = payload.Usage
+		}
+	}
+	return usage
+}
+
+// jsonContentType reports whether a request Content-Type is JSON, or unset.
+func jsonContentType(contentType string) bool {
+	mt := mediaType(contentType)
+	return mt == "" || mt == "application/json" || strings.HasSuffix(mt, "+json")
+}
+
+// auditRequestBody captures up to limit bytes of a request body as it is
+// read.
+type auditRequestBody struct {
+	io.ReadCloser
+	limit int
+	body  bytes.Buffer
+}
+
+func (b *auditRequestBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if room := b.limit - b.body.Len(); room > 0 {
+		b.body.Write(p[:min(room, n)])
+	}
+	return n, err
+}
+
+// auditResponseWriter captures the status code and up to limit bytes of the
+// response body while passing everything through to the client.
+type auditResponseWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	limit       int
+	body        bytes.Buffer
+	// err is the first error writing to the client.
+	err error
+}
+
+func (w *auditResponseWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.status = code
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *auditResponseWriter) Write(p []byte) (int, error) {
+	w.wroteHeader = true
+	if room := w.limit - w.body.Len(); room > 0 {
+		w.body.Write(p[:min(room, len(p))])
+	}
+	n, err := w.ResponseWriter.Write(p)
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+	return n, err
+}
+
+func (w *auditResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *auditResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// redactor removes sensitive data from audited bodies. JSON paths are applied
+// to parsed JSON bodies first, then the patterns to the serialized text.
+type redactor struct {
+	jsonPaths [][]string
+	patterns  []*regexp.Regexp
+}
+
+// newRedactorFromEnv builds a redactor from the AUDIT_REDACT_* variables.
+// Emails and API keys are redacted unless explicitly disabled.
+func newRedactorFromEnv() (*redactor, error) {
+	r := &redactor{}
+	if v := os.Getenv("AUDIT_REDACT_EMAILS"); v == "" || envBool("AUDIT_REDACT_EMAILS") {
+		r.patterns = append(r.patterns, emailPattern)
+	}
+	if v := os.Getenv("AUDIT_REDACT_API_KEYS"); v == "" || envBool("AUDIT_REDACT_API_KEYS") {
+		r.patterns = append(r.patterns, apiKeyPatterns...)
+	}
+	for _, expr := range splitList(os.Getenv("AUDIT_REDACT_PATTERNS")) {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid AUDIT_REDACT_PATTERNS entry %q: %w", expr, err)
+		}
+		r.patterns = append(r.patterns, re)
+	}
+	for _, path := range splitList(os.Getenv("AUDIT_REDACT_JSON_PATHS")) {
+		r.jsonPaths = append(r.jsonPaths, strings.Split(path, "."))
+	}
+	return r, nil
+}
+
+// redactBody returns a redacted copy of body suitable for embedding in an
+// audit record: the JSON itself when it is valid JSON, a JSON string otherwise.
+// With JSON paths configured, bodies that aren't valid JSON are replaced by
+// a placeholder, since the paths can't be redacted in them.
+func (r *redactor) redactBody(body []byte) json.RawMessage {
+	if len(body) == 0 {
+		return nil
+	}
+	if len(r.jsonPaths) > 0 {
+		var doc any
+		if json.Unmarshal(body, &doc) != nil {
+			quoted, _ := json.Marshal(unparseableBodyValue)
+			return quoted
+		}
+		for _, path := range r.jsonPaths {
+			doc = redactJSONPath(doc, path)
+		}
+		if b, err := json.Marshal(doc); err == nil {
+			body = b
+		}
+	}
+	text := string(body)
+	for _, re := range r.patterns {
+		text = re.ReplaceAllString(text, redactedValue)
+	}
+	if json.Valid([]byte(text)) {
+		return json.RawMessage(text)
+	}
+	quoted, _ := json.Marshal(text)
+	return quoted
+}
+
+// redactJSONPath replaces the values at a dotted path in a decoded JSON
+// document. A "*" segment matches every element of an array or object.
+func redactJSONPath(doc any, path []string) any {
+	if len(path) == 0 {
+		return redactedValue
+	}
+	switch v := doc.(type) {
+	case map[string]any:
+		for k, child := range v {
+			if path[0] == "*" || path[0] == k {
+				v[k] = redactJSONPath(child, path[1:])
+			}
+		}
+	case []any:
+		for i, child := range v {
+			if path[0] == "*" || path[0] == strconv.Itoa(i) {
+				v[i] = redactJSONPath(child, path[1:])
+			}
+		}
+	}
+	return doc
+}
+
+// rotatingFile is an append-only file that is rotated to path.1, path.2, ...
+// once it grows beyond maxSize bytes.
+type rotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	f          *os.File
+	size       int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	rf := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f = f
+	rf.size = info.Size()
+	return nil
+}
+
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.maxSize > 0 && rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *rotatingFile) rotate() error {
+	if err := rf.f.Close(); err != nil {
+		return err
+	}
+	if rf.maxBackups > 0 {
+		for i := rf.maxBackups - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", rf.path, i), fmt.Sprintf("%s.%d", rf.path, i+1))
+		}
+		if err := os.Rename(rf.path, rf.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(rf.path); err != nil {
+		return err
+	}
+	return rf.open()
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRedactor_RedactBody(t *testing.T) {
+	t.Setenv("AUDIT_REDACT_PATTERNS", `secret-\d+`)
+	t.Setenv("AUDIT_REDACT_JSON_PATHS", "messages.*.content")
+	r, err := newRedactorFromEnv()
+	if err != nil {
+		t.Fatalf("newRedactorFromEnv() error = %v", err)
+	}
+
+	body := `{"model":"m","user":"jane@example.com","key":"sk-abcdefghijklmnopqrstuv","note":"secret-42","messages":[{"role":"user","content":"my prompt"}]}`
+	got := string(r.redactBody([]byte(body)))
+
+	for _, leaked := range []string{"jane@example.com", "sk-abcdefghijklmnopqrstuv", "secret-42", "my prompt"} {
+		if strings.Contains(got, leaked) {
+			t.Errorf("redacted body still contains %q: %s", leaked, got)
+		}
+	}
+	var doc map[string]any
+	if err := json.Unmarshal([]byte(got), &doc); err != nil {
+		t.Fatalf("redacted body is not valid JSON: %v: %s", err, got)
+	}
+	if doc["model"] != "m" {
+		t.Errorf("unrelated field changed: model = %v", doc["model"])
+	}
+	if doc["messages"].([]any)[0].(map[string]any)["role"] != "user" {
+		t.Errorf("sibling of redacted path changed: %v", doc["messages"])
+	}
+}
+
+func TestRedactor_NonJSONBody(t *testing.T) {
+	r, err := newRedactorFromEnv()
+	if err != nil {
+		t.Fatalf("newRedactorFromEnv() error = %v", err)
+	}
+	got := r.redactBody([]byte("data: {\"x\":\"bob@example.org\"}\n\n"))
+	var text string
+	if err := json.Unmarshal(got, &text); err != nil {
+		t.Fatalf("non-JSON body not encoded as JSON string: %s", got)
+	}
+	if strings.Contains(text, "bob@example.org") || !strings.Contains(text, redactedValue) {
+		t.Errorf("email not redacted: %q", text)
+	}
+}
+
+func TestAuditMiddleware_TruncatedBodyRedacted(t *testing.T) {
+	var buf bytes.Buffer
+	t.Setenv("AUDIT_REDACT_JSON_PATHS", "messages.*.content")
+	r, err := newRedactorFromEnv()
+	if err != nil {
+		t.Fatalf("newRedactorFromEnv() error = %v", err)
+	}
+	originalAuditLog := auditLog
+	auditLog = &auditLogger{w: &buf, includeBodies: true, maxBodyBytes: 64, redactor: r}
+	defer func() { auditLog = originalAuditLog }()
+
+	handler := auditMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.ReadAll(r.Body)
+	}))
+	body := `{"model":"m","messages":[{"role":"user","content":"my private prompt ` + strings.Repeat("x", 100) + `"}]}`
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	var record auditRecord
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("failed to decode audit record %q: %v", buf.String(), err)
+	}
+	if strings.Contains(string(record.RequestBody), "private") {
+		t.Errorf("truncated request body leaked: %s", record.RequestBody)
+	}
+	if want, _ := json.Marshal(unparseableBodyValue); string(record.RequestBody) != string(want) {
+		t.Errorf("request_body = %s, want %s", record.RequestBody, want)
+	}
+}
+
+func TestRedactor_DisableDefaults(t *testing.T) {
+	t.Setenv("AUDIT_REDACT_EMAILS", "false")
+	t.Setenv("AUDIT_REDACT_API_KEYS", "false")
+	r, err := newRedactorFromEnv()
+	if err != nil {
+		t.Fatalf("newRedactorFromEnv() error = %v", err)
+	}
+	body := `{"user":"jane@example.com"}`
+	if got := string(r.redactBody([]byte(body))); got != body {
+		t.Errorf("redactBody() = %s, want unchanged %s", got, body)
+	}
+}
+
+func TestAuditMiddleware(t *testing.T) {
+	var buf bytes.Buffer
+	r, _ := newRedactorFromEnv()
+	originalAuditLog := auditLog
+	auditLog = &auditLogger{w: &buf, includeBodies: true, maxBodyBytes: 1 << 20, redactor: r}
+	defer func() { auditLog = originalAuditLog }()
+
+	handler := auditMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("downstream handler could not read request body: %v", err)
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: {\"choices\":[]}\n\n"))
+		w.Write([]byte("data: {\"choices\":[],\"usage\":{\"prompt_tokens\":3,\"completion_tokens\":5,\"total_tokens\":8}}\n\n"))
+		w.Write([]byte("data: [DONE]\n\n"))
+	}))
+
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"google/gemini","stream":true,"messages":[{"role":"user","content":"mail me at a@b.com"}]}`))
+	req.Header.Set("Authorization", "Bearer client-key")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if !strings.Contains(rr.Body.String(), "[DONE]") {
+		t.Errorf("client response not passed through: %s", rr.Body.String())
+	}
+
+	var record auditRecord
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("failed to decode audit record %q: %v", buf.String(), err)
+	}
+	if record.Model != "google/gemini" || !record.Stream {
+		t.Errorf("record model/stream = %q/%v, want google/gemini/true", record.Model, record.Stream)
+	}
+	if record.Status != http.StatusOK || record.Path != "/v1/chat/completions" {
+		t.Errorf("record status/path = %d/%s", record.Status, record.Path)
+	}
+	if record.Key == "" || strings.Contains(record.Key, "client-key") {
+		t.Errorf("record key = %q, want fingerprint of client key", record.Key)
+	}
+	if record.Usage == nil || record.Usage.TotalTokens != 8 {
+		t.Errorf("record usage = %+v, want total_tokens 8", record.Usage)
+	}
+	if strings.Contains(string(record.RequestBody), "a@b.com") {
+		t.Errorf("request body not redacted: %s", record.RequestBody)
+	}
+}
+
+func TestAuditMiddleware_RequestBodyCapture(t *testing.T) {
+	var buf bytes.Buffer
+	r, _ := newRedactorFromEnv()
+	originalAuditLog := auditLog
+	auditLog = &auditLogger{w: &buf, includeBodies: true, maxBodyBytes: 16, redactor: r}
+	defer func() { auditLog = originalAuditLog }()
+
+	var read []byte
+	handler := auditMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		read, _ = io.ReadAll(r.Body)
+	}))
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        string
+	}{
+		{"json", "application/json", `{"model":"m"}`, `{"model":"m"}`},
+		{"truncated", "application/json", `{"model":"google/gemini-2.0-flash-001"}`, `"{\"model\":\"google"`},
+		{"multipart", "multipart/form-data; boundary=x", "--x\r\nsecret file\r\n--x--\r\n", ""},
+	}
+	for _, tt := range tests {
+		buf.Reset()
+		req := httptest.NewRequest("POST", "/v1/files", strings.NewReader(tt.body))
+		req.Header.Set("Content-Type", tt.contentType)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		if string(read) != tt.body {
+			t.Errorf("%s: downstream read %q, want %q", tt.name, read, tt.body)
+		}
+		var record auditRecord
+		if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+			t.Fatalf("%s: failed to decode audit record %q: %v", tt.name, buf.String(), err)
+		}
+		if string(record.RequestBody) != tt.want {
+			t.Errorf("%s: request_body = %s, want %s", tt.name, record.RequestBody, tt.want)
+		}
+	}
+}
+
+func TestAuditMiddleware_Disabled(t *testing.T) {
+	originalAuditLog := auditLog
+	auditLog = nil
+	defer func() { auditLog = originalAuditLog }()
+
+	called := false
+	handler := auditMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { called = true }))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/v1/models", nil))
+	if !called {
+		t.Error("next handler not called when audit log is disabled")
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	rf, err := openRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatalf("openRotatingFile() error = %v", err)
+	}
+	for _, line := range []string{"first-line\n", "second-line\n", "third-line\n", "fourth-line\n"} {
+		if _, err := rf.Write([]byte(line)); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+	}
+
+	for file, want := range map[string]string{
+		path:        "fourth-line\n",
+		path + ".1": "third-line\n",
+		path + ".2": "second-line\n",
+	} {
+		got, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatalf("ReadFile(%s) error = %v", file, err)
+		}
+		if string(got) != want {
+			t.Errorf("%s = %q, want %q", file, got, want)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expected no third backup, stat error = %v", err)
+	}
+}
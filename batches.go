@@ -0,0 +1,803 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Batch statuses, as in the OpenAI Batch API.
+const (
+	batchValidating = "validating"
+	batchInProgress = "in_progress"
+	batchFinalizing = "finalizing"
+	batchCompleted  = "completed"
+	batchFailed     = "failed"
+	batchCancelling = "cancelling"
+	batchCancelled  = "cancelled"
+)
+
+// batchEndpoints are the endpoints batch requests may call.
+var batchEndpoints = map[string]bool{
+	"/v1/chat/completions": true,
+	"/v1/embeddings":       true,
+}
+
+// batchRetryDelay is the delay before the first retry of a batch request. It
+// doubles with every further retry.
+var batchRetryDelay = time.Second
+
+// batches is the manager configured by initBatches. It is nil when the
+// /v1/batches API is disabled.
+var batches *batchManager
+
+// batchObject is an OpenAI batch object.
+type batchObject struct {
+	ID               string             `json:"id"`
+	Object           string             `json:"object"`
+	Endpoint         string             `json:"endpoint"`
+	Errors           *batchErrors       `json:"errors"`
+	InputFileID      string             `json:"input_file_id"`
+	CompletionWindow string             `json:"completion_window"`
+	Status           string             `json:"status"`
+	OutputFileID     *string            `json:"output_file_id"`
+	ErrorFileID      *string            `json:"error_file_id"`
+	CreatedAt        int64              `json:"created_at"`
+	InProgressAt     *int64             `json:"in_progress_at"`
+	ExpiresAt        int64              `json:"expires_at"`
+	FinalizingAt     *int64             `json:"finalizing_at"`
+	CompletedAt      *int64             `json:"completed_at"`
+	FailedAt         *int64             `json:"failed_at"`
+	CancellingAt     *int64             `json:"cancelling_at"`
+	CancelledAt      *int64             `json:"cancelled_at"`
+	RequestCounts    batchRequestCounts `json:"request_counts"`
+	Metadata         map[string]string  `json:"metadata"`
+}
+
+type batchErrors struct {
+	Object string       `json:"object"`
+	Data   []batchError `json:"data"`
+}
+
+type batchError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Line    int    `json:"line,omitempty"`
+}
+
+type batchRequestCounts struct {
+	Total     int `json:"total"`
+	Completed int `json:"completed"`
+	Failed    int `json:"failed"`
+}
+
+// storedBatch is the state of a batch on disk.
+type storedBatch struct {
+	batchObject
+	// Owner is the keyOwner SHA-256 hex of the client key that created the
+	// batch, not its name.
+	Owner string `json:"owner,omitempty"`
+	// VertexJob is the batch prediction job running the batch, if any.
+	VertexJob string `json:"vertex_job,omitempty"`
+}
+
+// batchJob is a batch known to the manager. Its fields are guarded by the
+// manager's mutex.
+type batchJob struct {
+	storedBatch
+	// auth is the Authorization header the requests are sent with. It isn't
+	// stored, so a batch resumed after a restart uses the configured key of
+	// its owner.
+	auth   string
+	cancel context.CancelFunc
+}
+
+// batchRequestLine is a line of a batch input file.
+type batchRequestLine struct {
+	CustomID string          `json:"custom_id"`
+	Method   string          `json:"method"`
+	URL      string          `json:"url"`
+	Body     json.RawMessage `json:"body"`
+}
+
+// batchResultLine is a line of a batch output or error file.
+type batchResultLine struct {
+	ID       string               `json:"id"`
+	CustomID string               `json:"custom_id"`
+	Response *batchResultResponse `json:"response"`
+	Error    *batchError          `json:"error"`
+}
+
+type batchResultResponse struct {
+	StatusCode int    `json:"status_code"`
+	RequestID  string `json:"request_id,omitempty"`
+	Body       any    `json:"body"`
+}
+
+// batchManager runs batches of requests from files of the files API
+// against handler, the proxy itself, and keeps their state in a directory
+// so unfinished batches resume after a restart.
+type batchManager struct {
+	files       *localFileStore
+	dir         string
+	handler     http.Handler
+	concurrency int
+	maxRetries  int
+	maxRequests int
+	// vertex runs batches as Vertex AI batch prediction jobs, if set.
+	vertex *vertexBatchBackend
+
+	mu   sync.Mutex
+	jobs map[string]*batchJob
+	wg   sync.WaitGroup
+}
+
+// initBatches enables the /v1/batches API, which needs the files API, and
+// resumes unfinished batches. Batch requests are served by handler.
+func initBatches(handler http.Handler) error {
+	if fileStore == nil {
+		return nil
+	}
+	concurrency, err := envInt("BATCH_CONCURRENCY", 4)
+	if err != nil {
+		return err
+	}
+	retries, err := envInt("BATCH_MAX_RETRIES", 3)
+	if err != nil {
+		return err
+	}
+	maxRequests, err := envInt("BATCH_MAX_REQUESTS", 50000)
+	if err != nil {
+		return err
+	}
+	m, err := newBatchManager(fileStore, filepath.Join(fileStore.dir, "batches"), handler, concurrency, retries, maxRequests)
+	if err != nil {
+		return err
+	}
+	if m.vertex, err = initVertexBatch(); err != nil {
+		return err
+	}
+	batches = m
+	logger.Info("initBatches: Batch API enabled", "concurrency", concurrency, "max_retries", retries, "resumed", m.resume())
+	return nil
+}
+
+func newBatchManager(files *localFileStore, dir string, handler http.Handler, concurrency, maxRetries, maxRequests int) (*batchManager, error) {
+	if concurrency < 1 {
+		return nil, fmt.Errorf("BATCH_CONCURRENCY must be at least 1, got %d", concurrency)
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("creating batches directory: %w", err)
+	}
+	m := &batchManager{
+		files:       files,
+		dir:         dir,
+		handler:     handler,
+		concurrency: concurrency,
+		maxRetries:  maxRetries,
+		maxRequests: maxRequests,
+		jobs:        map[string]*batchJob{},
+	}
+	matches, err := filepath.Glob(filepath.Join(dir, "batch_*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range matches {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		job := &batchJob{}
+		if err := json.Unmarshal(data, &job.storedBatch); err != nil {
+			return nil, fmt.Errorf("reading batch %s: %w", filepath.Base(path), err)
+		}
+		m.jobs[job.ID] = job
+	}
+	return m, nil
+}
+
+// resume starts the unfinished batches loaded from the directory and
+// returns their number.
+func (m *batchManager) resume() int {
+	m.mu.Lock()
+	var unfinished []*batchJob
+	for _, job := range m.jobs {
+		if !batchFinished(job.Status) && job.cancel == nil {
+			job.auth = ownerAuthorization(job.Owner)
+			unfinished = append(unfinished, job)
+		}
+	}
+	m.mu.Unlock()
+	for _, job := range unfinished {
+		logger.Info("batchManager: Resuming batch", "batch_id", job.ID, "status", job.Status)
+		m.start(job)
+	}
+	return len(unfinished)
+}
+
+// ownerAuthorization returns the Authorization header of the configured
+// key that is owner, or "" for keys not in the config file.
+func ownerAuthorization(owner string) string {
+	if k := ownerKey(owner); k != nil {
+		return "Bearer " + k.Key
+	}
+	return ""
+}
+
+// ownerKey returns the configured client key of owner, or nil.
+func ownerKey(owner string) *keyConfig {
+	for i := range config.Keys {
+		if keyOwner(config.Keys[i].Key) == owner {
+			return &config.Keys[i]
+		}
+	}
+	return nil
+}
+
+func batchFinished(status string) bool {
+	return status == batchCompleted || status == batchFailed || status == batchCancelled
+}
+
+func newBatchID(prefix string) string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return prefix + hex.EncodeToString(b)
+}
+
+// registerBatchRoutes adds the /v1/batches API of m to mux.
+func registerBatchRoutes(mux *http.ServeMux, m *batchManager) {
+	mux.HandleFunc("POST /v1/batches", requireClientKey(m.handleCreate))
+	mux.HandleFunc("GET /v1/batches", requireClientKey(m.handleList))
+	mux.HandleFunc("GET /v1/batches/{id}", requireClientKey(m.handleRetrieve))
+	mux.HandleFunc("POST /v1/batches/{id}/cancel", requireClientKey(m.handleCancel))
+}
+
+func (m *batchManager) handleCreate(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		InputFileID      string            `json:"input_file_id"`
+		Endpoint         string            `json:"endpoint"`
+		CompletionWindow string            `json:"completion_window"`
+		Metadata         map[string]string `json:"metadata"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "invalid_request", "Invalid JSON body: "+err.Error())
+		return
+	}
+	owner := clientOwner(r)
+	switch {
+	case !batchEndpoints[req.Endpoint]:
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "invalid_request", fmt.Sprintf("Unsupported endpoint %q", req.Endpoint))
+		return
+	case req.CompletionWindow != "24h":
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "invalid_request", "completion_window must be 24h")
+		return
+	}
+	input, err := m.files.get(owner, req.InputFileID)
+	if err != nil {
+		writeFileError(w, req.InputFileID, err)
+		return
+	}
+	if input.Purpose != "batch" {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "invalid_request", fmt.Sprintf("File %s has purpose %q, want batch", input.ID, input.Purpose))
+		return
+	}
+
+	now := time.Now()
+	job := &batchJob{
+		storedBatch: storedBatch{
+			batchObject: batchObject{
+				ID:               newBatchID("batch_"),
+				Object:           "batch",
+				Endpoint:         req.Endpoint,
+				InputFileID:      req.InputFileID,
+				CompletionWindow: req.CompletionWindow,
+				Status:           batchValidating,
+				CreatedAt:        now.Unix(),
+				ExpiresAt:        now.Add(24 * time.Hour).Unix(),
+				Metadata:         req.Metadata,
+			},
+			Owner: owner,
+		},
+		auth: r.Header.Get("Authorization"),
+	}
+	m.mu.Lock()
+	err = m.save(job)
+	if err == nil {
+		m.jobs[job.ID] = job
+	}
+	obj := job.batchObject
+	m.mu.Unlock()
+	if err != nil {
+		writeOpenAIError(w, http.StatusInternalServerError, "api_error", "internal_error", "Storing batch: "+err.Error())
+		return
+	}
+	logger.InfoContext(r.Context(), "handleCreate: Created batch", "batch_id", obj.ID, "input_file_id", obj.InputFileID, "endpoint", obj.Endpoint)
+	m.start(job)
+	writeJSON(w, obj)
+}
+
+func (m *batchManager) handleList(w http.ResponseWriter, r *http.Request) {
+	limit := 20
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l >= 1 && l <= 100 {
+		limit = l
+	}
+	after := r.URL.Query().Get("after")
+	owner := clientOwner(r)
+
+	m.mu.Lock()
+	var all []batchObject
+	for _, job := range m.jobs {
+		if job.Owner == owner {
+			all = append(all, job.batchObject)
+		}
+	}
+	m.mu.Unlock()
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].CreatedAt != all[j].CreatedAt {
+			return all[i].CreatedAt > all[j].CreatedAt
+		}
+		return all[i].ID > all[j].ID
+	})
+	if after != "" {
+		for i, b := range all {
+			if b.ID == after {
+				all = all[i+1:]
+				break
+			}
+		}
+	}
+	hasMore := len(all) > limit
+	if hasMore {
+		all = all[:limit]
+	}
+	resp := map[string]any{"object": "list", "data": all, "has_more": hasMore, "first_id": nil, "last_id": nil}
+	if len(all) > 0 {
+		resp["first_id"], resp["last_id"] = all[0].ID, all[len(all)-1].ID
+	} else {
+		resp["data"] = []batchObject{}
+	}
+	writeJSON(w, resp)
+}
+
+func (m *batchManager) handleRetrieve(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	job := m.jobs[r.PathValue("id")]
+	var obj batchObject
+	found := job != nil && job.Owner == clientOwner(r)
+	if found {
+		obj = job.batchObject
+	}
+	m.mu.Unlock()
+	if !found {
+		writeBatchNotFound(w, r.PathValue("id"))
+		return
+	}
+	writeJSON(w, obj)
+}
+
+func (m *batchManager) handleCancel(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	job := m.jobs[r.PathValue("id")]
+	if job == nil || job.Owner != clientOwner(r) {
+		m.mu.Unlock()
+		writeBatchNotFound(w, r.PathValue("id"))
+		return
+	}
+	if batchFinished(job.Status) {
+		status := job.Status
+		m.mu.Unlock()
+		writeOpenAIError(w, http.StatusConflict, "invalid_request_error", "invalid_request", fmt.Sprintf("Batch %s is already %s", job.ID, status))
+		return
+	}
+	if job.Status != batchCancelling {
+		job.Status = batchCancelling
+		job.CancellingAt = unixNow()
+		m.saveLogged(job)
+		if job.cancel != nil {
+			job.cancel()
+		}
+	}
+	obj := job.batchObject
+	m.mu.Unlock()
+	logger.InfoContext(r.Context(), "handleCancel: Cancelling batch", "batch_id", obj.ID)
+	writeJSON(w, obj)
+}
+
+func writeBatchNotFound(w http.ResponseWriter, id string) {
+	writeOpenAIError(w, http.StatusNotFound, "invalid_request_error", "batch_not_found", "No such Batch object: "+id)
+}
+
+func unixNow() *int64 {
+	now := time.Now().Unix()
+	return &now
+}
+
+// save stores the state of job. m.mu must be held.
+func (m *batchManager) save(job *batchJob) error {
+	data, err := json.Marshal(job.storedBatch)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(m.dir, "."+job.ID+".json")
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(m.dir, job.ID+".json"))
+}
+
+func (m *batchManager) saveLogged(job *batchJob) {
+	if err := m.save(job); err != nil {
+		logger.Error("batchManager: Error storing batch state", "batch_id", job.ID, "error", err)
+	}
+}
+
+// start runs job in the background.
+func (m *batchManager) start(job *batchJob) {
+	ctx, cancel := context.WithCancel(context.Background())
+	m.mu.Lock()
+	job.cancel = cancel
+	if job.Status == batchCancelling {
+		cancel()
+	}
+	m.mu.Unlock()
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		defer cancel()
+		m.run(ctx, job)
+	}()
+}
+
+// wait blocks until all running batches have finished.
+func (m *batchManager) wait() {
+	m.wg.Wait()
+}
+
+func (m *batchManager) partialPath(job *batchJob, kind string) string {
+	return filepath.Join(m.dir, job.ID+"."+kind+".jsonl")
+}
+
+// run validates the input of job, sends its requests and stores the
+// results. Results are appended to partial files as they come in, so a
+// resumed batch only sends the requests that have no result yet.
+func (m *batchManager) run(ctx context.Context, job *batchJob) {
+	m.mu.Lock()
+	owner, inputID, endpoint, auth := job.Owner, job.InputFileID, job.Endpoint, job.auth
+	metadata, vertexJob := job.Metadata, job.VertexJob
+	m.mu.Unlock()
+
+	lines, errs, err := m.readInput(owner, inputID, endpoint)
+	if err != nil {
+		errs = []batchError{{Code: "invalid_input_file", Message: err.Error()}}
+	}
+	if len(errs) > 0 {
+		m.mu.Lock()
+		job.Status = batchFailed
+		job.FailedAt = unixNow()
+		job.Errors = &batchErrors{Object: "list", Data: errs}
+		m.saveLogged(job)
+		m.mu.Unlock()
+		logger.Warn("batchManager: Batch input is invalid", "batch_id", job.ID, "errors", len(errs))
+		return
+	}
+
+	output, outputDone, err := openPartial(m.partialPath(job, "output"))
+	if err != nil {
+		m.fail(job, err)
+		return
+	}
+	defer output.Close()
+	errorOut, errorDone, err := openPartial(m.partialPath(job, "error"))
+	if err != nil {
+		m.fail(job, err)
+		return
+	}
+	defer errorOut.Close()
+
+	m.mu.Lock()
+	if job.Status == batchValidating {
+		job.Status = batchInProgress
+		job.InProgressAt = unixNow()
+	}
+	job.RequestCounts = batchRequestCounts{Total: len(lines), Completed: len(outputDone), Failed: len(errorDone)}
+	m.saveLogged(job)
+	m.mu.Unlock()
+
+	if m.vertex != nil {
+		useVertex, err := m.vertex.accepts(job.Owner, metadata, endpoint, lines)
+		if err != nil {
+			m.fail(job, err)
+			return
+		}
+		if useVertex || vertexJob != "" {
+			if err := m.runVertex(ctx, job, lines, output, errorOut, outputDone, errorDone); err != nil {
+				m.fail(job, err)
+				return
+			}
+			m.finalize(job, output, errorOut)
+			return
+		}
+	}
+
+	todo := make(chan batchRequestLine)
+	var wg sync.WaitGroup
+	for range m.concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for line := range todo {
+				result, ok := m.send(ctx, auth, line)
+				if ctx.Err() != nil {
+					// Cancelled requests are left out of the results.
+					continue
+				}
+				data, _ := json.Marshal(result)
+				data = append(data, '\n')
+				m.mu.Lock()
+				if ok {
+					output.Write(data)
+					job.RequestCounts.Completed++
+				} else {
+					errorOut.Write(data)
+					job.RequestCounts.Failed++
+				}
+				m.mu.Unlock()
+			}
+		}()
+	}
+feed:
+	for _, line := range lines {
+		if outputDone[line.CustomID] || errorDone[line.CustomID] {
+			continue
+		}
+		select {
+		case todo <- line:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(todo)
+	wg.Wait()
+	m.finalize(job, output, errorOut)
+}
+
+// runVertex runs the requests of job as a Vertex AI batch prediction job
+// and writes their results to the partial results files.
+func (m *batchManager) runVertex(ctx context.Context, job *batchJob, lines []batchRequestLine, output, errorOut *os.File, outputDone, errorDone map[string]bool) error {
+	m.mu.Lock()
+	jobName := job.VertexJob
+	m.mu.Unlock()
+	started := func(name string) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		job.VertexJob = name
+		m.saveLogged(job)
+	}
+	progress := func(completed, failed int) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		job.RequestCounts.Completed, job.RequestCounts.Failed = completed, failed
+	}
+	results, err := m.vertex.run(ctx, m.vertex.target(job.Owner), job.ID, jobName, lines, started, progress)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job.RequestCounts.Completed, job.RequestCounts.Failed = len(outputDone), len(errorDone)
+	for i, line := range lines {
+		resp := results[i]
+		if resp == nil || outputDone[line.CustomID] || errorDone[line.CustomID] {
+			continue
+		}
+		data, _ := json.Marshal(&batchResultLine{ID: newBatchID("batch_req_"), CustomID: line.CustomID, Response: resp})
+		data = append(data, '\n')
+		if resp.StatusCode == http.StatusOK {
+			output.Write(data)
+			job.RequestCounts.Completed++
+		} else {
+			errorOut.Write(data)
+			job.RequestCounts.Failed++
+		}
+	}
+	return nil
+}
+
+// readInput reads and validates the input file of a batch. It returns the
+// problems of invalid lines, or an error if the file can't be read.
+func (m *batchManager) readInput(owner, fileID, endpoint string) ([]batchRequestLine, []batchError, error) {
+	_, content, err := m.files.open(owner, fileID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("input file %s: %w", fileID, err)
+	}
+	defer content.Close()
+	var lines []batchRequestLine
+	var errs []batchError
+	seen := map[string]bool{}
+	scanner := bufio.NewScanner(content)
+	scanner.Buffer(nil, int(m.files.maxBytes)+1)
+	for n := 1; scanner.Scan(); n++ {
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+		var line batchRequestLine
+		var body map[string]any
+		switch {
+		case json.Unmarshal(text, &line) != nil:
+			errs = append(errs, batchError{Code: "invalid_json_line", Message: "Line is not valid JSON", Line: n})
+		case line.CustomID == "":
+			errs = append(errs, batchError{Code: "missing_required_parameter", Message: "custom_id is required", Line: n})
+		case seen[line.CustomID]:
+			errs = append(errs, batchError{Code: "duplicate_custom_id", Message: fmt.Sprintf("Duplicate custom_id %q", line.CustomID), Line: n})
+		case line.Method != http.MethodPost:
+			errs = append(errs, batchError{Code: "invalid_method", Message: "method must be POST", Line: n})
+		case line.URL != endpoint:
+			errs = append(errs, batchError{Code: "invalid_url", Message: fmt.Sprintf("url %q does not match the batch endpoint %s", line.URL, endpoint), Line: n})
+		case json.Unmarshal(line.Body, &body) != nil || body == nil:
+			errs = append(errs, batchError{Code: "invalid_request", Message: "body must be a JSON object", Line: n})
+		default:
+			seen[line.CustomID] = true
+			lines = append(lines, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	if len(lines)+len(errs) == 0 {
+		errs = append(errs, batchError{Code: "empty_file", Message: "The input file has no requests"})
+	}
+	if len(lines) > m.maxRequests {
+		errs = append(errs, batchError{Code: "too_many_requests", Message: fmt.Sprintf("The input file has %d requests, the limit is %d", len(lines), m.maxRequests)})
+	}
+	return lines, errs, nil
+}
+
+// send serves one batch request, retrying 429 and 5xx responses with
+// exponential backoff. It reports whether the request succeeded.
+func (m *batchManager) send(ctx context.Context, auth string, line batchRequestLine) (*batchResultLine, bool) {
+	var body map[string]any
+	json.Unmarshal(line.Body, &body)
+	// Batch results aren't streamed.
+	delete(body, "stream")
+	delete(body, "stream_options")
+	data, _ := json.Marshal(body)
+
+	result := &batchResultLine{ID: newBatchID("batch_req_"), CustomID: line.CustomID}
+	delay := batchRetryDelay
+	for attempt := 0; ; attempt++ {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodPost, line.URL, bytes.NewReader(data))
+		req.Header.Set("Content-Type", "application/json")
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		buf := newResponseBuffer()
+		m.handler.ServeHTTP(buf, req)
+		status := buf.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		if retryableStatus(status) && attempt < m.maxRetries {
+			logger.DebugContext(ctx, "batchManager: Retrying batch request", "custom_id", line.CustomID, "status", status, "attempt", attempt+1)
+			select {
+			case <-time.After(delay):
+				delay *= 2
+				continue
+			case <-ctx.Done():
+			}
+		}
+		var respBody any = buf.body.String()
+		if json.Valid(buf.body.Bytes()) {
+			respBody = json.RawMessage(buf.body.Bytes())
+		}
+		result.Response = &batchResultResponse{StatusCode: status, RequestID: buf.header.Get("X-Request-Id"), Body: respBody}
+		return result, status == http.StatusOK
+	}
+}
+
+// finalize turns the partial results of job into files of the files API
+// and marks the batch completed, or cancelled if it was cancelled.
+func (m *batchManager) finalize(job *batchJob, output, errorOut *os.File) {
+	m.mu.Lock()
+	cancelled := job.Status == batchCancelling
+	job.Status = batchFinalizing
+	job.FinalizingAt = unixNow()
+	m.saveLogged(job)
+	counts := job.RequestCounts
+	m.mu.Unlock()
+
+	outputID, err := m.storeResults(job, output, "output", counts.Completed)
+	if err == nil {
+		var errorID *string
+		errorID, err = m.storeResults(job, errorOut, "error", counts.Failed)
+		m.mu.Lock()
+		job.OutputFileID, job.ErrorFileID = outputID, errorID
+		m.mu.Unlock()
+	}
+	if err != nil {
+		m.fail(job, err)
+		return
+	}
+	m.mu.Lock()
+	if cancelled {
+		job.Status = batchCancelled
+		job.CancelledAt = unixNow()
+	} else {
+		job.Status = batchCompleted
+		job.CompletedAt = unixNow()
+	}
+	m.saveLogged(job)
+	m.mu.Unlock()
+	os.Remove(output.Name())
+	os.Remove(errorOut.Name())
+	logger.Info("batchManager: Batch finished", "batch_id", job.ID, "status", job.Status, "completed", counts.Completed, "failed", counts.Failed)
+}
+
+// storeResults stores a partial results file as a file of the batch owner,
+// unless it has no results.
+func (m *batchManager) storeResults(job *batchJob, partial *os.File, kind string, count int) (*string, error) {
+	if count == 0 {
+		return nil, nil
+	}
+	if _, err := partial.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	f, err := m.files.create(job.Owner, job.ID+"_"+kind+".jsonl", "batch_output", "application/jsonl", partial)
+	if err != nil {
+		return nil, fmt.Errorf("storing %s file: %w", kind, err)
+	}
+	return &f.ID, nil
+}
+
+func (m *batchManager) fail(job *batchJob, err error) {
+	logger.Error("batchManager: Batch failed", "batch_id", job.ID, "error", err)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job.Status = batchFailed
+	job.FailedAt = unixNow()
+	job.Errors = &batchErrors{Object: "list", Data: []batchError{{Code: "internal_error", Message: err.Error()}}}
+	m.saveLogged(job)
+}
+
+// openPartial opens a partial results file for appending and returns the
+// custom IDs it already has results for. A line cut short by a crash is
+// dropped.
+func openPartial(path string) (*os.File, map[string]bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, nil, err
+	}
+	done := map[string]bool{}
+	var valid bytes.Buffer
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		var result batchResultLine
+		if json.Unmarshal(line, &result) == nil && result.CustomID != "" {
+			done[result.CustomID] = true
+			valid.Write(line)
+			valid.WriteByte('\n')
+		}
+	}
+	if valid.Len() != len(data) {
+		if err := os.WriteFile(path, valid.Bytes(), 0o600); err != nil {
+			return nil, nil, err
+		}
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, done, nil
+}
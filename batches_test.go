@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestBatchManager returns a batch manager serving requests with handler,
+// and a mux with the files and batches APIs.
+func newTestBatchManager(t *testing.T, s *localFileStore, handler http.HandlerFunc) (*batchManager, *http.ServeMux) {
+	t.Helper()
+	original := batchRetryDelay
+	t.Cleanup(func() { batchRetryDelay = original })
+	batchRetryDelay = time.Millisecond
+	m, err := newBatchManager(s, filepath.Join(s.dir, "batches"), handler, 2, 2, 100)
+	if err != nil {
+		t.Fatalf("newBatchManager() error = %v", err)
+	}
+	t.Cleanup(m.wait)
+	mux := http.NewServeMux()
+	registerFileRoutes(mux, s)
+	registerBatchRoutes(mux, m)
+	return m, mux
+}
+
+func createBatch(t *testing.T, mux http.Handler, inputFileID, metadata string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest("POST", "/v1/batches", strings.NewReader(
+		`{"input_file_id":"`+inputFileID+`","endpoint":"/v1/chat/completions","completion_window":"24h","metadata":`+metadata+`}`))
+	req.Header.Set("Authorization", "Bearer key-a")
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	return rr
+}
+
+func getBatch(t *testing.T, mux http.Handler, id string) batchObject {
+	t.Helper()
+	rr := fileRequest(mux, "GET", "/v1/batches/"+id, "key-a")
+	var b batchObject
+	if err := json.Unmarshal(rr.Body.Bytes(), &b); err != nil || rr.Code != http.StatusOK {
+		t.Fatalf("retrieve got %d %s", rr.Code, rr.Body.String())
+	}
+	return b
+}
+
+func readResults(t *testing.T, s *localFileStore, owner string, id *string) map[string]batchResultLine {
+	t.Helper()
+	if id == nil {
+		return nil
+	}
+	_, content, err := s.open(owner, *id)
+	if err != nil {
+		t.Fatalf("opening results %s: %v", *id, err)
+	}
+	defer content.Close()
+	data, _ := io.ReadAll(content)
+	results := map[string]batchResultLine{}
+	for _, line := range bytes.Split(bytes.TrimSpace(data), []byte("\n")) {
+		var r batchResultLine
+		json.Unmarshal(line, &r)
+		results[r.CustomID] = r
+	}
+	return results
+}
+
+// keyName returns the owner name of files and batches created with key.
+func batchInput(ids ...string) string {
+	var b strings.Builder
+	for _, id := range ids {
+		b.WriteString(`{"custom_id":"` + id + `","method":"POST","url":"/v1/chat/completions","body":{"model":"m","stream":true,"messages":[{"role":"user","content":"` + id + `"}]}}` + "\n")
+	}
+	return b.String()
+}
+
+func TestBatches(t *testing.T) {
+	s, _ := newTestFileStore(t)
+	var mu sync.Mutex
+	attempts := map[string]int{}
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var req struct {
+			Stream   *bool `json:"stream"`
+			Messages []struct {
+				Content string `json:"content"`
+			} `json:"messages"`
+		}
+		json.Unmarshal(body, &req)
+		id := req.Messages[0].Content
+		mu.Lock()
+		attempts[id]++
+		n := attempts[id]
+		mu.Unlock()
+		switch {
+		case r.Header.Get("Authorization") != "Bearer key-a" || req.Stream != nil:
+			writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "unexpected", "unexpected request")
+		case id == "flaky" && n == 1:
+			writeOpenAIError(w, http.StatusServiceUnavailable, "api_error", "unavailable", "try again")
+		case id == "bad":
+			writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "invalid_request", "bad request")
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"id":"chatcmpl-` + id + `","object":"chat.completion"}`))
+		}
+	}
+	m, mux := newTestBatchManager(t, s, handler)
+
+	rr := uploadFile(t, mux, "key-a", "input.jsonl", "batch", []byte(batchInput("ok", "flaky", "bad")))
+	var input fileObject
+	json.Unmarshal(rr.Body.Bytes(), &input)
+	rr = createBatch(t, mux, input.ID, `{"job":"nightly"}`)
+	var created batchObject
+	json.Unmarshal(rr.Body.Bytes(), &created)
+	if rr.Code != http.StatusOK || !strings.HasPrefix(created.ID, "batch_") || created.Status != batchValidating || created.Metadata["job"] != "nightly" {
+		t.Fatalf("create got %d %s", rr.Code, rr.Body.String())
+	}
+	m.wait()
+
+	b := getBatch(t, mux, created.ID)
+	if b.Status != batchCompleted || b.CompletedAt == nil || b.RequestCounts != (batchRequestCounts{Total: 3, Completed: 2, Failed: 1}) {
+		t.Errorf("batch = %+v, want completed with 2 completed and 1 failed", b)
+	}
+	output := readResults(t, s, keyOwner("key-a"), b.OutputFileID)
+	if len(output) != 2 || output["ok"].Response.StatusCode != 200 || output["flaky"].Response.StatusCode != 200 {
+		t.Errorf("output = %+v", output)
+	}
+	if body, _ := json.Marshal(output["ok"].Response.Body); !strings.Contains(string(body), `"id":"chatcmpl-ok"`) {
+		t.Errorf("output body = %s", body)
+	}
+	errs := readResults(t, s, keyOwner("key-a"), b.ErrorFileID)
+	if len(errs) != 1 || errs["bad"].Response.StatusCode != http.StatusBadRequest {
+		t.Errorf("errors = %+v", errs)
+	}
+	if attempts["flaky"] != 2 || attempts["bad"] != 1 {
+		t.Errorf("attempts = %v, want flaky retried once and bad not retried", attempts)
+	}
+
+	if rr := fileRequest(mux, "GET", "/v1/batches/"+created.ID, "key-b"); rr.Code != http.StatusNotFound {
+		t.Errorf("retrieve with another key got %d, want 404", rr.Code)
+	}
+	rr = fileRequest(mux, "GET", "/v1/batches", "key-a")
+	if !strings.Contains(rr.Body.String(), `"first_id":"`+created.ID+`"`) {
+		t.Errorf("list got %s", rr.Body.String())
+	}
+	if rr := fileRequest(mux, "POST", "/v1/batches/"+created.ID+"/cancel", "key-a"); rr.Code != http.StatusConflict {
+		t.Errorf("cancel of a completed batch got %d, want 409", rr.Code)
+	}
+}
+
+func TestBatches_InvalidInput(t *testing.T) {
+	s, _ := newTestFileStore(t)
+	m, mux := newTestBatchManager(t, s, func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request sent for an invalid batch")
+	})
+	input := batchInput("a", "a") + "not json\n" + `{"custom_id":"c","method":"POST","url":"/v1/embeddings","body":{}}` + "\n"
+	rr := uploadFile(t, mux, "key-a", "input.jsonl", "batch", []byte(input))
+	var f fileObject
+	json.Unmarshal(rr.Body.Bytes(), &f)
+	var created batchObject
+	json.Unmarshal(createBatch(t, mux, f.ID, `{"job":"nightly"}`).Body.Bytes(), &created)
+	m.wait()
+
+	b := getBatch(t, mux, created.ID)
+	if b.Status != batchFailed || b.Errors == nil {
+		t.Fatalf("batch = %+v, want failed", b)
+	}
+	var codes []string
+	for _, e := range b.Errors.Data {
+		codes = append(codes, e.Code)
+	}
+	if got := strings.Join(codes, ","); got != "duplicate_custom_id,invalid_json_line,invalid_url" || b.Errors.Data[0].Line != 2 {
+		t.Errorf("errors = %+v", b.Errors.Data)
+	}
+}
+
+func TestBatches_CreateErrors(t *testing.T) {
+	s, _ := newTestFileStore(t)
+	_, mux := newTestBatchManager(t, s, nil)
+	rr := uploadFile(t, mux, "key-a", "input.jsonl", "user_data", []byte(batchInput("a")))
+	var f fileObject
+	json.Unmarshal(rr.Body.Bytes(), &f)
+	if rr := createBatch(t, mux, f.ID, `{"job":"nightly"}`); rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "purpose") {
+		t.Errorf("create with a user_data file got %d %s, want 400", rr.Code, rr.Body.String())
+	}
+	if rr := createBatch(t, mux, "file-00", `{"job":"nightly"}`); rr.Code != http.StatusNotFound {
+		t.Errorf("create with an unknown file got %d %s, want 404", rr.Code, rr.Body.String())
+	}
+	if rr := fileRequest(mux, "GET", "/v1/batches", ""); rr.Code != http.StatusUnauthorized {
+		t.Errorf("list without a key got %d %s, want 401", rr.Code, rr.Body.String())
+	}
+}
+
+func TestBatches_Cancel(t *testing.T) {
+	s, _ := newTestFileStore(t)
+	started := make(chan struct{}, 10)
+	m, mux := newTestBatchManager(t, s, func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-r.Context().Done()
+	})
+	rr := uploadFile(t, mux, "key-a", "input.jsonl", "batch", []byte(batchInput("a", "b", "c", "d")))
+	var f fileObject
+	json.Unmarshal(rr.Body.Bytes(), &f)
+	var created batchObject
+	json.Unmarshal(createBatch(t, mux, f.ID, `{"job":"nightly"}`).Body.Bytes(), &created)
+	<-started
+
+	rr = fileRequest(mux, "POST", "/v1/batches/"+created.ID+"/cancel", "key-a")
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"status":"cancelling"`) {
+		t.Errorf("cancel got %d %s", rr.Code, rr.Body.String())
+	}
+	m.wait()
+	b := getBatch(t, mux, created.ID)
+	if b.Status != batchCancelled || b.CancelledAt == nil || b.RequestCounts.Completed+b.RequestCounts.Failed != 0 {
+		t.Errorf("batch = %+v, want cancelled without results", b)
+	}
+}
+
+func TestBatches_Resume(t *testing.T) {
+	s, _ := newTestFileStore(t)
+	input, _ := s.create("", "input.jsonl", "batch", "application/jsonl", strings.NewReader(batchInput("done", "todo")))
+	dir := filepath.Join(s.dir, "batches")
+	os.MkdirAll(dir, 0o700)
+	state, _ := json.Marshal(storedBatch{batchObject: batchObject{
+		ID: "batch_01", Object: "batch", Endpoint: "/v1/chat/completions", InputFileID: input.ID,
+		CompletionWindow: "24h", Status: batchInProgress, CreatedAt: time.Now().Unix(),
+	}})
+	os.WriteFile(filepath.Join(dir, "batch_01.json"), state, 0o600)
+	// The second line was cut short by a crash.
+	os.WriteFile(filepath.Join(dir, "batch_01.output.jsonl"), []byte(
+		`{"id":"batch_req_1","custom_id":"done","response":{"status_code":200,"body":{}},"error":null}`+"\n"+`{"id":"batch_req_2","cus`), 0o600)
+
+	var sent []string
+	m, _ := newTestBatchManager(t, s, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		sent = append(sent, string(body))
+		w.Write([]byte(`{}`))
+	})
+	if n := m.resume(); n != 1 {
+		t.Errorf("resume() = %d, want 1", n)
+	}
+	m.wait()
+	if len(sent) != 1 || !strings.Contains(sent[0], `"todo"`) {
+		t.Errorf("sent %v, want only the request without a result", sent)
+	}
+	m.mu.Lock()
+	b := m.jobs["batch_01"].batchObject
+	m.mu.Unlock()
+	if b.Status != batchCompleted || b.RequestCounts.Completed != 2 {
+		t.Errorf("batch = %+v, want completed with 2 results", b)
+	}
+	if output := readResults(t, s, "", b.OutputFileID); len(output) != 2 {
+		t.Errorf("output = %+v, want 2 results", output)
+	}
+}
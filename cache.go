@@ -0,0 +1,448 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// cacheHeader reports whether a response was served from the response cache.
+const cacheHeader = "X-Cache"
+
+// responseCache is the cache configured by initResponseCache. It is nil when
+// caching is disabled.
+var responseCache *cacheConfig
+
+type cacheConfig struct {
+	store cacheStore
+	ttl   time.Duration
+	// maxEntryBytes bounds the size of a cached response body.
+	maxEntryBytes int
+	// allTemperatures caches requests regardless of their temperature.
+	// Otherwise only requests with temperature 0 are cached.
+	allTemperatures bool
+}
+
+// cachedResponse is a response stored in the cache.
+type cachedResponse struct {
+	Status  int         `json:"status"`
+	Header  http.Header `json:"header"`
+	Body    []byte      `json:"body"`
+	Created time.Time   `json:"created"`
+	Expires time.Time   `json:"expires"`
+}
+
+func (c *cachedResponse) size() int64 {
+	return int64(len(c.Body))
+}
+
+// cacheStore keeps cached responses by key.
+type cacheStore interface {
+	Get(key string) (*cachedResponse, bool)
+	Set(key string, resp *cachedResponse)
+}
+
+// initResponseCache configures the response cache from the RESPONSE_CACHE*
+// environment variables. Caching stays disabled when RESPONSE_CACHE is not set.
+func initResponseCache() error {
+	kind := strings.TrimSpace(os.Getenv("RESPONSE_CACHE"))
+	if kind == "" {
+		return nil
+	}
+	ttl, err := envDuration("RESPONSE_CACHE_TTL", time.Hour)
+	if err != nil {
+		return err
+	}
+	maxSizeMB, err := envInt("RESPONSE_CACHE_MAX_SIZE_MB", 256)
+	if err != nil {
+		return err
+	}
+	maxEntryBytes, err := envInt("RESPONSE_CACHE_MAX_ENTRY_BYTES", 1<<20)
+	if err != nil {
+		return err
+	}
+	allTemperatures, err := envFlag("RESPONSE_CACHE_ALL_TEMPERATURES", false)
+	if err != nil {
+		return err
+	}
+
+	var store cacheStore
+	switch kind {
+	case "memory":
+		store = newMemoryCacheStore(int64(maxSizeMB) << 20)
+	case "disk":
+		dir := os.Getenv("RESPONSE_CACHE_DIR")
+		if dir == "" {
+			return errors.New("RESPONSE_CACHE_DIR is required for the disk cache")
+		}
+		if store, err = newDiskCacheStore(dir, int64(maxSizeMB)<<20); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("invalid RESPONSE_CACHE %q, want memory or disk", kind)
+	}
+	responseCache = &cacheConfig{
+		store:           store,
+		ttl:             ttl,
+		maxEntryBytes:   maxEntryBytes,
+		allTemperatures: allTemperatures,
+	}
+	logger.Info("initResponseCache: Response cache enabled", "store", kind, "ttl", ttl, "max_size_mb", maxSizeMB)
+	return nil
+}
+
+// canonicalRequestKey returns a key identifying a JSON request body together
+// with scope, e.g. the target it is sent to. Object keys are sorted and
+// insignificant whitespace dropped, so equivalent bodies get the same key.
+func canonicalRequestKey(scope string, req map[string]any) string {
+	canonical, _ := json.Marshal(req)
+	h := sha256.New()
+	io.WriteString(h, scope)
+	h.Write([]byte{0})
+	h.Write(canonical)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// requestKeyScope returns the scope of the cache and coalescing keys of r
+// with body req: its target and the headers that change the request sent
+// upstream. Requests referencing stored files are also scoped to their
+// owner, so other keys can't get responses built from the files without
+// passing the owner check.
+func requestKeyScope(r *http.Request, upstream *upstreamTarget, req map[string]any) string {
+	scope := upstream.name + "\x00" + strings.TrimSpace(r.Header.Get(thinkingBudgetHeader))
+	if referencesFiles(req) {
+		scope += "\x00" + clientOwner(r)
+	}
+	return scope
+}
+
+// cacheable reports whether a chat completions request may be answered from
+// the cache.
+func (c *cacheConfig) cacheable(req map[string]any) bool {
+	if c.allTemperatures {
+		return true
+	}
+	temperature, ok := req["temperature"].(float64)
+	return ok && temperature == 0
+}
+
+// cacheOptOut reports whether the client asked to bypass the cache, with
+// Cache-Control: no-cache or no-store, or its key is opted out.
+func cacheOptOut(r *http.Request) bool {
+	if k := lookupClientKey(clientKey(r)); k != nil && k.NoCache {
+		return true
+	}
+	for _, directive := range strings.Split(r.Header.Get("Cache-Control"), ",") {
+		switch strings.ToLower(strings.TrimSpace(directive)) {
+		case "no-cache", "no-store":
+			return true
+		}
+	}
+	return false
+}
+
+// serveWithCache answers deterministic chat completions requests from the
+// response cache, and stores successful responses. Other requests are passed
+// to serve unchanged.
+func serveWithCache(w http.ResponseWriter, r *http.Request, upstream *upstreamTarget, serve http.HandlerFunc) {
+	c := responseCache
+	if c == nil || r.URL.Path != "/v1/chat/completions" || r.Body == nil {
+		serve(w, r)
+		return
+	}
+	ctx := r.Context()
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		serve(w, r)
+		return
+	}
+	var req map[string]any
+	if json.Unmarshal(body, &req) != nil || !c.cacheable(req) {
+		serve(w, r)
+		return
+	}
+	if cacheOptOut(r) {
+		w.Header().Set(cacheHeader, "BYPASS")
+		metrics.cacheRequests.Add(ctx, 1, metric.WithAttributes(attribute.String("proxy.cache_result", "bypass")))
+		serve(w, r)
+		return
+	}
+
+	// The user field identifies the end user for abuse monitoring only.
+	delete(req, "user")
+	key := canonicalRequestKey(requestKeyScope(r, upstream, req), req)
+	if cached, ok := c.store.Get(key); ok && time.Now().Before(cached.Expires) {
+		logger.DebugContext(ctx, "serveWithCache: Serving cached response", "key", key)
+		metrics.cacheRequests.Add(ctx, 1, metric.WithAttributes(attribute.String("proxy.cache_result", "hit")))
+		writeCachedResponse(w, cached)
+		return
+	}
+	metrics.cacheRequests.Add(ctx, 1, metric.WithAttributes(attribute.String("proxy.cache_result", "miss")))
+
+	w.Header().Set(cacheHeader, "MISS")
+	// Store responses uncompressed, they are replayed to any client.
+	r.Header.Del("Accept-Encoding")
+	cw := &auditResponseWriter{ResponseWriter: w, status: http.StatusOK, limit: c.maxEntryBytes + 1}
+	serve(cw, r)
+	if cw.status != http.StatusOK || cw.body.Len() > c.maxEntryBytes || cw.Header().Get("Content-Encoding") != "" {
+		return
+	}
+	if cw.err != nil || ctx.Err() != nil || !completeResponse(cw.Header(), cw.body.Bytes()) {
+		logger.DebugContext(ctx, "serveWithCache: Not storing incomplete response", "key", key, "error", cw.err)
+		return
+	}
+	now := time.Now()
+	header := http.Header{}
+	for _, name := range []string{"Content-Type", modelHeader} {
+		if v := cw.Header().Get(name); v != "" {
+			header.Set(name, v)
+		}
+	}
+	c.store.Set(key, &cachedResponse{
+		Status:  cw.status,
+		Header:  header,
+		Body:    bytes.Clone(cw.body.Bytes()),
+		Created: now,
+		Expires: now.Add(c.ttl),
+	})
+}
+
+// completeResponse reports whether body is a whole chat completions
+// response: a stream up to its terminal [DONE] event, or complete JSON. A
+// response cut short by a client disconnect or an upstream error is not.
+func completeResponse(header http.Header, body []byte) bool {
+	if mediaType(header.Get("Content-Type")) == "text/event-stream" {
+		return bytes.HasSuffix(bytes.TrimRight(body, "\r\n"), []byte("data: [DONE]"))
+	}
+	return json.Valid(body)
+}
+
+// writeCachedResponse replays a cached response. Streams are written event
+// by event so clients see a regular SSE stream.
+func writeCachedResponse(w http.ResponseWriter, cached *cachedResponse) {
+	h := w.Header()
+	for k, v := range cached.Header {
+		h[k] = v
+	}
+	h.Set(cacheHeader, "HIT")
+	h.Set("Age", strconv.Itoa(int(time.Since(cached.Created).Seconds())))
+	if mediaType(cached.Header.Get("Content-Type")) != "text/event-stream" {
+		h.Set("Content-Length", strconv.Itoa(len(cached.Body)))
+		w.WriteHeader(cached.Status)
+		w.Write(cached.Body)
+		return
+	}
+	w.WriteHeader(cached.Status)
+	flusher, _ := w.(http.Flusher)
+	rest := cached.Body
+	for len(rest) > 0 {
+		event, tail, found := bytes.Cut(rest, []byte("\n\n"))
+		if found {
+			event = rest[:len(event)+2]
+		}
+		w.Write(event)
+		if flusher != nil {
+			flusher.Flush()
+		}
+		rest = tail
+	}
+}
+
+// memoryCacheStore is an in-memory LRU cache bounded by the total size of
+// the cached bodies.
+type memoryCacheStore struct {
+	mu       sync.Mutex
+	maxBytes int64
+	size     int64
+	order    *list.List // of *memoryCacheEntry, most recently used first
+	entries  map[string]*list.Element
+}
+
+type memoryCacheEntry struct {
+	key  string
+	resp *cachedResponse
+}
+
+func newMemoryCacheStore(maxBytes int64) *memoryCacheStore {
+	return &memoryCacheStore{maxBytes: maxBytes, order: list.New(), entries: map[string]*list.Element{}}
+}
+
+func (s *memoryCacheStore) Get(key string) (*cachedResponse, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := el.Value.(*memoryCacheEntry)
+	if time.Now().After(entry.resp.Expires) {
+		s.remove(el)
+		return nil, false
+	}
+	s.order.MoveToFront(el)
+	return entry.resp, true
+}
+
+func (s *memoryCacheStore) Set(key string, resp *cachedResponse) {
+	if resp.size() > s.maxBytes {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if el, ok := s.entries[key]; ok {
+		s.remove(el)
+	}
+	s.entries[key] = s.order.PushFront(&memoryCacheEntry{key: key, resp: resp})
+	s.size += resp.size()
+	for s.size > s.maxBytes {
+		s.remove(s.order.Back())
+	}
+}
+
+func (s *memoryCacheStore) remove(el *list.Element) {
+	entry := s.order.Remove(el).(*memoryCacheEntry)
+	delete(s.entries, entry.key)
+	s.size -= entry.resp.size()
+}
+
+// diskCacheStore keeps cached responses as files in a directory, evicting
+// the least recently written ones when the directory exceeds its size limit.
+type diskCacheStore struct {
+	dir      string
+	maxBytes int64
+
+	mu   sync.Mutex
+	size int64
+}
+
+func newDiskCacheStore(dir string, maxBytes int64) (*diskCacheStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("creating cache directory: %w", err)
+	}
+	s := &diskCacheStore{dir: dir, maxBytes: maxBytes}
+	files, err := s.files()
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		s.size += f.size
+	}
+	return s, nil
+}
+
+type diskCacheFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// files lists the cache files, oldest first.
+func (s *diskCacheStore) files() ([]diskCacheFile, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading cache directory: %w", err)
+	}
+	var files []diskCacheFile
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, diskCacheFile{path: filepath.Join(s.dir, e.Name()), size: info.Size(), modTime: info.ModTime()})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+	return files, nil
+}
+
+func (s *diskCacheStore) path(key string) string {
+	return filepath.Join(s.dir, key+".json")
+}
+
+func (s *diskCacheStore) Get(key string) (*cachedResponse, bool) {
+	data, err := os.ReadFile(s.path(key))
+	if err != nil {
+		return nil, false
+	}
+	var resp cachedResponse
+	if err := json.Unmarshal(data, &resp); err != nil || time.Now().After(resp.Expires) {
+		s.mu.Lock()
+		s.removeFile(s.path(key), int64(len(data)))
+		s.mu.Unlock()
+		return nil, false
+	}
+	return &resp, true
+}
+
+func (s *diskCacheStore) Set(key string, resp *cachedResponse) {
+	data, err := json.Marshal(resp)
+	if err != nil || int64(len(data)) > s.maxBytes {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	path := s.path(key)
+	if info, err := os.Stat(path); err == nil {
+		s.size -= info.Size()
+	}
+	tmp, err := os.CreateTemp(s.dir, "tmp-*")
+	if err != nil {
+		logger.Error("diskCacheStore: Error creating cache file", "error", err)
+		return
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		logger.Error("diskCacheStore: Error writing cache file", "error", err)
+		return
+	}
+	s.size += int64(len(data))
+	if s.size <= s.maxBytes {
+		return
+	}
+	files, err := s.files()
+	if err != nil {
+		logger.Error("diskCacheStore: Error listing cache files", "error", err)
+		return
+	}
+	for _, f := range files {
+		if s.size <= s.maxBytes {
+			break
+		}
+		if f.path != path {
+			s.removeFile(f.path, f.size)
+		}
+	}
+}
+
+func (s *diskCacheStore) removeFile(path string, size int64) {
+	if err := os.Remove(path); err == nil {
+		s.size -= size
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useResponseCache enables an in-memory response cache for the duration of the test.
+func useResponseCache(t *testing.T) {
+	t.Helper()
+	original := responseCache
+	t.Cleanup(func() { responseCache = original })
+	responseCache = &cacheConfig{store: newMemoryCacheStore(1 << 20), ttl: time.Hour, maxEntryBytes: 1 << 10}
+}
+
+func cacheEntry(body string, ttl time.Duration) *cachedResponse {
+	now := time.Now()
+	return &cachedResponse{Status: http.StatusOK, Header: http.Header{}, Body: []byte(body), Created: now, Expires: now.Add(ttl)}
+}
+
+func TestServeWithCache(t *testing.T) {
+	setCachedToken(t, "test-token")
+	useResponseCache(t)
+	targetURL, calls := newModelUpstream(t, func(w http.ResponseWriter, model string) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"model":"` + model + `","choices":[]}`))
+	})
+	proxy := makeProxy(targetURL)
+
+	send := func(body string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "http://localhost/v1/chat/completions", strings.NewReader(body))
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		rr := httptest.NewRecorder()
+		proxy.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("status = %d, want 200: %s", rr.Code, rr.Body.String())
+		}
+		return rr
+	}
+
+	first := send(`{"model":"m","temperature":0,"messages":[{"role":"user","content":"hi"}]}`)
+	if got := first.Header().Get(cacheHeader); got != "MISS" {
+		t.Errorf("first %s = %q, want MISS", cacheHeader, got)
+	}
+	second := send(`{ "messages": [{"content":"hi", "role":"user"}], "temperature": 0, "model": "m", "user": "u1" }`)
+	if got := second.Header().Get(cacheHeader); got != "HIT" {
+		t.Errorf("equivalent request %s = %q, want HIT", cacheHeader, got)
+	}
+	if second.Body.String() != first.Body.String() {
+		t.Errorf("cached body = %q, want %q", second.Body.String(), first.Body.String())
+	}
+	if len(*calls) != 1 {
+		t.Errorf("upstream called %d times, want 1", len(*calls))
+	}
+
+	if got := send(`{"model":"m","temperature":0,"messages":[{"role":"user","content":"hi"}]}`, "Cache-Control", "no-cache").Header().Get(cacheHeader); got != "BYPASS" {
+		t.Errorf("opted out %s = %q, want BYPASS", cacheHeader, got)
+	}
+	if got := send(`{"model":"m","temperature":0.7,"messages":[{"role":"user","content":"hi"}]}`).Header().Get(cacheHeader); got != "" {
+		t.Errorf("non-deterministic request %s = %q, want none", cacheHeader, got)
+	}
+	if got := send(`{"model":"m","temperature":0,"messages":[{"role":"user","content":"bye"}]}`).Header().Get(cacheHeader); got != "MISS" {
+		t.Errorf("different request %s = %q, want MISS", cacheHeader, got)
+	}
+	if got := send(`{"model":"m","temperature":0,"messages":[{"role":"user","content":"hi"}]}`, thinkingBudgetHeader, "0").Header().Get(cacheHeader); got != "MISS" {
+		t.Errorf("request with a different thinking budget %s = %q, want MISS", cacheHeader, got)
+	}
+	if len(*calls) != 5 {
+		t.Errorf("upstream called %d times, want 5", len(*calls))
+	}
+}
+
+func TestServeWithCache_ReplaysStream(t *testing.T) {
+	setCachedToken(t, "test-token")
+	useResponseCache(t)
+	stream := "data: {\"choices\":[{\"delta\":{\"content\":\"a\"}}]}\n\ndata: {\"choices\":[{\"delta\":{\"content\":\"b\"}}]}\n\ndata: [DONE]\n\n"
+	targetURL, calls := newModelUpstream(t, func(w http.ResponseWriter, model string) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte(stream))
+	})
+	proxy := makeProxy(targetURL)
+
+	for i, want := range []string{"MISS", "HIT"} {
+		req := httptest.NewRequest("POST", "http://localhost/v1/chat/completions", strings.NewReader(`{"model":"m","stream":true,"temperature":0}`))
+		rr := httptest.NewRecorder()
+		proxy.ServeHTTP(rr, req)
+		if got := rr.Header().Get(cacheHeader); got != want {
+			t.Errorf("request %d %s = %q, want %s", i, cacheHeader, got, want)
+		}
+		if rr.Body.String() != stream {
+			t.Errorf("request %d body = %q, want %q", i, rr.Body.String(), stream)
+		}
+		if ct := rr.Header().Get("Content-Type"); ct != "text/event-stream" {
+			t.Errorf("request %d Content-Type = %q, want text/event-stream", i, ct)
+		}
+	}
+	if len(*calls) != 1 {
+		t.Errorf("upstream called %d times, want 1", len(*calls))
+	}
+}
+
+func TestServeWithCache_SkipsIncomplete(t *testing.T) {
+	setCachedToken(t, "test-token")
+	useResponseCache(t)
+	for _, tt := range []struct{ contentType, body string }{
+		{"text/event-stream", "data: {\"choices\":[{\"delta\":{\"content\":\"a\"}}]}\n\n"},
+		{"application/json", `{"choices":[{"message":{"content":"a`},
+	} {
+		targetURL, calls := newModelUpstream(t, func(w http.ResponseWriter, model string) {
+			w.Header().Set("Content-Type", tt.contentType)
+			w.Write([]byte(tt.body))
+		})
+		proxy := makeProxy(targetURL)
+		for i := 0; i < 2; i++ {
+			rr := httptest.NewRecorder()
+			proxy.ServeHTTP(rr, httptest.NewRequest("POST", "http://localhost/v1/chat/completions", strings.NewReader(`{"model":"m","temperature":0}`)))
+			if got := rr.Header().Get(cacheHeader); got != "MISS" {
+				t.Errorf("%s request %d %s = %q, want MISS", tt.contentType, i, cacheHeader, got)
+			}
+		}
+		if len(*calls) != 2 {
+			t.Errorf("%s: upstream called %d times, want 2 as the cut short response isn't stored", tt.contentType, len(*calls))
+		}
+	}
+}
+
+func TestServeWithCache_FileReferencesScopedToOwner(t *testing.T) {
+	setCachedToken(t, "test-token")
+	useResponseCache(t)
+	s, _ := newTestFileStore(t)
+	original := fileStore
+	t.Cleanup(func() { fileStore = original })
+	fileStore = s
+	png, _ := s.create(keyOwner("key-a"), "cat.png", "vision", "image/png", strings.NewReader("png"))
+	targetURL, calls := newModelUpstream(t, func(w http.ResponseWriter, model string) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"model":"` + model + `","choices":[{"message":{"content":"a cat"}}]}`))
+	})
+	proxy := makeProxy(targetURL)
+
+	body := `{"model":"m","temperature":0,"messages":[{"role":"user","content":[{"type":"file","file":{"file_id":"` + png.ID + `"}}]}]}`
+	send := func(key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "http://localhost/v1/chat/completions", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+key)
+		rr := httptest.NewRecorder()
+		proxy.ServeHTTP(rr, req)
+		return rr
+	}
+	if rr := send("key-a"); rr.Code != http.StatusOK || rr.Header().Get(cacheHeader) != "MISS" {
+		t.Fatalf("owner got %d %s %q, want 200 MISS", rr.Code, cacheHeader, rr.Header().Get(cacheHeader))
+	}
+	rr := send("key-b")
+	if rr.Code != http.StatusBadRequest || strings.Contains(rr.Body.String(), "a cat") {
+		t.Errorf("other key got %d %s %q, want 400 without the owner's cached response", rr.Code, rr.Body.String(), rr.Header().Get(cacheHeader))
+	}
+	if rr := send("key-a"); rr.Header().Get(cacheHeader) != "HIT" {
+		t.Errorf("owner's second request %s = %q, want HIT", cacheHeader, rr.Header().Get(cacheHeader))
+	}
+	if len(*calls) != 1 {
+		t.Errorf("upstream called %d times, want 1", len(*calls))
+	}
+}
+
+func TestInitResponseCache_InvalidFlag(t *testing.T) {
+	original := responseCache
+	t.Cleanup(func() { responseCache = original })
+	t.Setenv("RESPONSE_CACHE", "memory")
+	t.Setenv("RESPONSE_CACHE_ALL_TEMPERATURES", "all")
+	if err := initResponseCache(); err == nil {
+		t.Error("initResponseCache() with an invalid RESPONSE_CACHE_ALL_TEMPERATURES succeeded, want error")
+	}
+}
+
+func TestMemoryCacheStore(t *testing.T) {
+	s := newMemoryCacheStore(10)
+	s.Set("a", cacheEntry("1234", time.Hour))
+	s.Set("b", cacheEntry("1234", time.Hour))
+	s.Get("a") // a is now the most recently used
+	s.Set("c", cacheEntry("1234", time.Hour))
+
+	if _, ok := s.Get("b"); ok {
+		t.Error("least recently used entry b not evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, ok := s.Get(key); !ok {
+			t.Errorf("entry %s evicted", key)
+		}
+	}
+	s.Set("expired", cacheEntry("1", -time.Second))
+	if _, ok := s.Get("expired"); ok {
+		t.Error("expired entry returned")
+	}
+	s.Set("huge", cacheEntry("12345678901", time.Hour))
+	if _, ok := s.Get("huge"); ok {
+		t.Error("entry larger than the cache stored")
+	}
+}
+
+func TestDiskCacheStore(t *testing.T) {
+	dir := t.TempDir()
+	s, err := newDiskCacheStore(dir, 1<<20)
+	if err != nil {
+		t.Fatalf("newDiskCacheStore() error = %v", err)
+	}
+	s.Set("a", cacheEntry(`{"x":1}`, time.Hour))
+	s.Set("expired", cacheEntry(`{}`, -time.Second))
+
+	// A new store over the same directory sees the entries.
+	s, err = newDiskCacheStore(dir, 1<<20)
+	if err != nil {
+		t.Fatalf("newDiskCacheStore() error = %v", err)
+	}
+	if got, ok := s.Get("a"); !ok || string(got.Body) != `{"x":1}` {
+		t.Errorf("Get(a) = %v, %v", got, ok)
+	}
+	if _, ok := s.Get("expired"); ok {
+		t.Error("expired entry returned")
+	}
+
+	// Entries are about 150 bytes on disk: only the newest ones fit.
+	s.maxBytes = 400
+	for i := 0; i < 5; i++ {
+		s.Set(fmt.Sprintf("k%d", i), cacheEntry("0123456789", time.Hour))
+		time.Sleep(10 * time.Millisecond) // distinct modification times
+	}
+	if _, ok := s.Get("k0"); ok {
+		t.Error("oldest entry not evicted")
+	}
+	if _, ok := s.Get("k4"); !ok {
+		t.Error("newest entry evicted")
+	}
+	if s.size > s.maxBytes {
+		t.Errorf("cache size %d exceeds limit %d", s.size, s.maxBytes)
+	}
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// defaultMaxChoices is the largest n sent upstream for models without a
+// configured limit, the maximum candidateCount of Gemini models.
+const defaultMaxChoices = 8
+
+// maxN is the largest n sent upstream for models without a max_choices
+// entry, set by initChoices from VERTEXAI_MAX_N.
+var maxN = defaultMaxChoices
+
+// initChoices reads VERTEXAI_MAX_N, which must be a positive integer.
+func initChoices() error {
+	n, err := envInt("VERTEXAI_MAX_N", defaultMaxChoices)
+	if err != nil {
+		return err
+	}
+	if n <= 0 {
+		return fmt.Errorf("invalid VERTEXAI_MAX_N %d: must be positive", n)
+	}
+	maxN = n
+	logger.Info("initChoices: Configured the largest n sent upstream", "max_n", maxN)
+	return nil
+}
+
+// maxChoices returns the largest n the upstream accepts for model: the
+// max_choices entry of the config file, 1 for partner models, else maxN.
+func maxChoices(model string) int {
+	if n, ok := config.MaxChoices[model]; ok {
+		return n
+	}
+	if partnerPublisher(model) != "" {
+		return 1
+	}
+	return maxN
+}
+
+// serveWithChoices serves a chat completions request asking for more
+// choices than the upstream accepts for its model by sending parallel
+// requests for parts of them with serve, and merging the responses into one
+// with consecutive choice indexes and summed usage. Streamed chunks are
+// merged as they arrive. When one of the requests fails, its error is
+// returned.
+func serveWithChoices(w http.ResponseWriter, r *http.Request, serve http.HandlerFunc) {
+	if r.URL.Path != "/v1/chat/completions" || r.Body == nil {
+		serve(w, r)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		serve(w, r)
+		return
+	}
+	var req map[string]any
+	json.Unmarshal(body, &req)
+	model, _ := req["model"].(string)
+	n, _ := req["n"].(float64)
+	limit := maxChoices(model)
+	if int(n) <= limit {
+		serve(w, r)
+		return
+	}
+
+	var counts []int
+	for left := int(n); left > 0; left -= limit {
+		counts = append(counts, min(left, limit))
+	}
+	logger.InfoContext(r.Context(), "serveWithChoices: Splitting request for more choices than the model accepts",
+		"model", model, "n", int(n), "max_n", limit, "requests", len(counts))
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	seed, hasSeed := req["seed"].(float64)
+	subs := make([]*http.Request, len(counts))
+	for i, count := range counts {
+		sub := make(map[string]any, len(req))
+		for k, v := range req {
+			sub[k] = v
+		}
+		sub["n"] = count
+		if count == 1 {
+			delete(sub, "n")
+		}
+		if hasSeed {
+			// Requests with the same seed would return the same choices.
+			sub["seed"] = seed + float64(i)
+		}
+		subBody, _ := json.Marshal(sub)
+		sr := r.Clone(ctx)
+		sr.Body = io.NopCloser(bytes.NewReader(subBody))
+		sr.ContentLength = int64(len(subBody))
+		sr.Header.Set("Content-Length", strconv.Itoa(len(subBody)))
+		// The responses are parsed to merge them.
+		sr.Header.Del("Accept-Encoding")
+		subs[i] = sr
+	}
+
+	m := &choiceMerger{offsets: make([]int, len(counts))}
+	for i := 1; i < len(counts); i++ {
+		m.offsets[i] = m.offsets[i-1] + counts[i-1]
+	}
+	if stream, _ := req["stream"].(bool); stream {
+		m.serveStream(ctx, cancel, w, subs, serve)
+		return
+	}
+
+	bufs := make([]*responseBuffer, len(subs))
+	done := make(chan struct{})
+	for i, sr := range subs {
+		bufs[i] = newResponseBuffer()
+		go func() {
+			defer func() { done <- struct{}{} }()
+			serve(bufs[i], sr)
+		}()
+	}
+	for range subs {
+		<-done
+	}
+	for _, buf := range bufs {
+		if buf.status != http.StatusOK {
+			writeBufferedResponse(w, buf)
+			return
+		}
+	}
+	merged, err := m.merge(bufs)
+	if err != nil {
+		logger.ErrorContext(ctx, "serveWithChoices: Error merging responses", "error", err)
+		writeOpenAIError(w, http.StatusBadGateway, "api_error", "invalid_upstream_response", "merging upstream responses: "+err.Error())
+		return
+	}
+	out := &responseBuffer{header: bufs[0].header, status: http.StatusOK}
+	out.header.Del("Content-Encoding")
+	out.body.Write(merged)
+	writeBufferedResponse(w, out)
+}
+
+// choiceMerger merges the responses of the requests a chat completions
+// request was split into.
+type choiceMerger struct {
+	// offsets are the indexes of the first choice of each request.
+	offsets []int
+
+	id         any
+	usage      map[string]any
+	usageChunk map[string]any
+}
+
+// merge merges non-streaming chat completions.
+func (m *choiceMerger) merge(bufs []*responseBuffer) ([]byte, error) {
+	var merged map[string]any
+	var choices []any
+	for i, buf := range bufs {
+		var resp map[string]any
+		if err := json.Unmarshal(buf.body.Bytes(), &resp); err != nil {
+			return nil, err
+		}
+		if merged == nil {
+			merged = resp
+		}
+		choices = append(choices, m.reindex(resp["choices"], i)...)
+		m.addUsage(resp["usage"])
+	}
+	merged["choices"] = choices
+	if m.usage != nil {
+		merged["usage"] = m.usage
+	}
+	return json.Marshal(merged)
+}
+
+// reindex shifts the indexes of the choices of the i-th request.
+func (m *choiceMerger) reindex(v any, i int) []any {
+	choices, _ := v.([]any)
+	for _, c := range choices {
+		if choice, ok := c.(map[string]any); ok {
+			index, _ := choice["index"].(float64)
+			choice["index"] = int(index) + m.offsets[i]
+		}
+	}
+	return choices
+}
+
+func (m *choiceMerger) addUsage(v any) {
+	usage, ok := v.(map[string]any)
+	if !ok {
+		return
+	}
+	if m.usage == nil {
+		m.usage = map[string]any{}
+	}
+	sumUsage(m.usage, usage)
+}
+
+// sumUsage adds the token counts of src, including nested details, to dst.
+func sumUsage(dst, src map[string]any) {
+	for k, v := range src {
+		switch v := v.(type) {
+		case float64:
+			sum, _ := dst[k].(float64)
+			dst[k] = sum + v
+		case map[string]any:
+			details, _ := dst[k].(map[string]any)
+			if details == nil {
+				details = map[string]any{}
+				dst[k] = details
+			}
+			sumUsage(details, v)
+		}
+	}
+}
+
+// serveStream sends the requests and writes their chunks to w as they
+// arrive, once all of them have started successfully.
+func (m *choiceMerger) serveStream(ctx context.Context, cancel context.CancelFunc, w http.ResponseWriter, subs []*http.Request, serve http.HandlerFunc) {
+	statuses := make(chan int, len(subs))
+	events := make(chan choiceEvent)
+	writers := make([]*choiceStreamWriter, len(subs))
+	done := make([]chan struct{}, len(subs))
+	finished := make(chan struct{}, len(subs))
+	for i, sr := range subs {
+		writers[i] = &choiceStreamWriter{ctx: ctx, index: i, header: http.Header{}, statuses: statuses, events: events}
+		done[i] = make(chan struct{})
+		go func() {
+			defer func() { finished <- struct{}{} }()
+			defer close(done[i])
+			serve(writers[i], sr)
+			writers[i].finish()
+		}()
+	}
+	go func() {
+		for range subs {
+			<-finished
+		}
+		close(events)
+	}()
+
+	for range subs {
+		var i int
+		select {
+		case i = <-statuses:
+		case <-ctx.Done():
+			return
+		}
+		if sw := writers[i]; sw.status != http.StatusOK {
+			cancel()
+			<-done[i]
+			writeBufferedResponse(w, &responseBuffer{header: sw.header, status: sw.status, body: sw.buf})
+			return
+		}
+	}
+
+	h := w.Header()
+	for k, v := range writers[0].header {
+		h[k] = v
+	}
+	h.Del("Content-Length")
+	h.Del("Content-Encoding")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	for ev := range events {
+		if out := m.rewriteEvent(ev); out != nil {
+			w.Write(out)
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+	if m.usage != nil {
+		chunk := m.usageChunk
+		chunk["id"] = m.id
+		chunk["choices"] = []any{}
+		chunk["usage"] = m.usage
+		data, _ := json.Marshal(chunk)
+		w.Write([]byte("data: " + string(data) + "\n\n"))
+	}
+	w.Write([]byte("data: [DONE]\n\n"))
+	if flusher != nil {
+		flusher.Flush()
+	}
+}
+
+// rewriteEvent returns the SSE event of the i-th request to write to the
+// client, or nil to drop it. Chunks get the id of the first chunk and
+// shifted choice indexes, usage is held back to be reported once at the end,
+// and the [DONE] events of the requests are dropped.
+func (m *choiceMerger) rewriteEvent(ev choiceEvent) []byte {
+	var out bytes.Buffer
+	for _, line := range bytes.SplitAfter(ev.data, []byte("\n")) {
+		data, ok := bytes.CutPrefix(line, []byte("data:"))
+		if !ok {
+			out.Write(line)
+			continue
+		}
+		data = bytes.TrimSpace(data)
+		if string(data) == "[DONE]" {
+			return nil
+		}
+		var chunk map[string]any
+		if json.Unmarshal(data, &chunk) != nil {
+			out.Write(line)
+			continue
+		}
+		if m.id == nil {
+			m.id = chunk["id"]
+		}
+		chunk["id"] = m.id
+		if usage, ok := chunk["usage"].(map[string]any); ok {
+			m.addUsage(usage)
+			m.usageChunk = chunk
+			delete(chunk, "usage")
+		}
+		choices := m.reindex(chunk["choices"], ev.index)
+		if len(choices) == 0 {
+			return nil
+		}
+		rewritten, _ := json.Marshal(chunk)
+		out.WriteString("data: ")
+		out.Write(rewritten)
+		out.WriteByte('\n')
+	}
+	return out.Bytes()
+}
+
+// choiceEvent is an SSE event of the index-th request.
+type choiceEvent struct {
+	index int
+	data  []byte
+}
+
+// choiceStreamWriter receives the response of one request of a split
+// streaming request. It reports the status to statuses, then sends the
+// events of a successful response to events and buffers other responses.
+type choiceStreamWriter struct {
+	ctx      context.Context
+	index    int
+	header   http.Header
+	statuses chan<- int
+	events   chan<- choiceEvent
+
+	status int
+	buf    bytes.Buffer
+}
+
+func (s *choiceStreamWriter) Header() http.Header {
+	return s.header
+}
+
+func (s *choiceStreamWriter) WriteHeader(status int) {
+	if s.status != 0 {
+		return
+	}
+	s.status = status
+	s.statuses <- s.index
+}
+
+func (s *choiceStreamWriter) Write(p []byte) (int, error) {
+	s.WriteHeader(http.StatusOK)
+	s.buf.Write(p)
+	if s.status != http.StatusOK {
+		return len(p), nil
+	}
+	for {
+		i := bytes.Index(s.buf.Bytes(), []byte("\n\n"))
+		if i < 0 {
+			return len(p), nil
+		}
+		if err := s.send(bytes.Clone(s.buf.Next(i + 2))); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Flush is a no-op, events are sent as soon as they are complete.
+func (s *choiceStreamWriter) Flush() {}
+
+// finish sends an incomplete last event, and reports a failure if no
+// response was written at all.
+func (s *choiceStreamWriter) finish() {
+	s.WriteHeader(http.StatusBadGateway)
+	if s.status == http.StatusOK && s.buf.Len() > 0 {
+		s.send(append(bytes.Clone(s.buf.Bytes()), '\n', '\n'))
+		s.buf.Reset()
+	}
+}
+
+func (s *choiceStreamWriter) send(data []byte) error {
+	select {
+	case s.events <- choiceEvent{index: s.index, data: data}:
+		return nil
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// newChoicesUpstream returns a server answering chat completions with n
+// choices whose content is the request's seed and the choice index.
+func newChoicesUpstream(t *testing.T) (*url.URL, *[]int) {
+	t.Helper()
+	var mu sync.Mutex
+	var ns []int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			N      *int `json:"n"`
+			Seed   int  `json:"seed"`
+			Stream bool `json:"stream"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		n := 1
+		if req.N != nil {
+			n = *req.N
+		}
+		mu.Lock()
+		ns = append(ns, n)
+		mu.Unlock()
+		usage := fmt.Sprintf(`{"prompt_tokens":10,"completion_tokens":%d,"total_tokens":%d,"completion_tokens_details":{"reasoning_tokens":1}}`, n, 10+n)
+		if req.Stream {
+			w.Header().Set("Content-Type", "text/event-stream")
+			for i := range n {
+				fmt.Fprintf(w, "data: {\"id\":\"chatcmpl-%d\",\"choices\":[{\"index\":%d,\"delta\":{\"content\":\"%d-%d\"}}]}\n\n", req.Seed, i, req.Seed, i)
+			}
+			fmt.Fprintf(w, "data: {\"id\":\"chatcmpl-%d\",\"choices\":[],\"usage\":%s}\n\ndata: [DONE]\n\n", req.Seed, usage)
+			return
+		}
+		var choices []string
+		for i := range n {
+			choices = append(choices, fmt.Sprintf(`{"index":%d,"message":{"content":"%d-%d"}}`, i, req.Seed, i))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"id":"chatcmpl-%d","choices":[%s],"usage":%s}`, req.Seed, strings.Join(choices, ","), usage)
+	}))
+	t.Cleanup(server.Close)
+	u, _ := url.Parse(server.URL)
+	return u, &ns
+}
+
+func TestServeWithChoices(t *testing.T) {
+	setCachedToken(t, "test-token")
+	useConfig(t, &proxyConfig{MaxChoices: map[string]int{"m": 2}})
+	target, ns := newChoicesUpstream(t)
+	proxy := makeProxy(target)
+
+	rr := httptest.NewRecorder()
+	proxy.ServeHTTP(rr, httptest.NewRequest("POST", "http://localhost/v1/chat/completions",
+		strings.NewReader(`{"model":"m","n":5,"seed":100,"messages":[]}`)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", rr.Code, rr.Body.String())
+	}
+	slices.Sort(*ns)
+	if !slices.Equal(*ns, []int{1, 2, 2}) {
+		t.Errorf("upstream n = %v, want [1 2 2]", *ns)
+	}
+	var resp struct {
+		ID      string `json:"id"`
+		Choices []struct {
+			Index   int `json:"index"`
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		} `json:"choices"`
+		Usage map[string]any `json:"usage"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	var got []string
+	for i, c := range resp.Choices {
+		if c.Index != i {
+			t.Errorf("choices[%d].index = %d", i, c.Index)
+		}
+		got = append(got, c.Message.Content)
+	}
+	if want := []string{"100-0", "100-1", "101-0", "101-1", "102-0"}; !slices.Equal(got, want) {
+		t.Errorf("choices = %v, want %v", got, want)
+	}
+	if resp.ID != "chatcmpl-100" {
+		t.Errorf("id = %q, want chatcmpl-100", resp.ID)
+	}
+	if usage, _ := json.Marshal(resp.Usage); string(usage) != `{"completion_tokens":5,"completion_tokens_details":{"reasoning_tokens":3},"prompt_tokens":30,"total_tokens":35}` {
+		t.Errorf("usage = %s", usage)
+	}
+
+	// Requests within the limit are sent unchanged.
+	*ns = nil
+	rr = httptest.NewRecorder()
+	proxy.ServeHTTP(rr, httptest.NewRequest("POST", "http://localhost/v1/chat/completions",
+		strings.NewReader(`{"model":"m","n":2,"messages":[]}`)))
+	if !slices.Equal(*ns, []int{2}) {
+		t.Errorf("upstream n = %v, want [2]", *ns)
+	}
+}
+
+func TestServeWithChoices_Stream(t *testing.T) {
+	setCachedToken(t, "test-token")
+	useConfig(t, &proxyConfig{MaxChoices: map[string]int{"m": 1}})
+	target, ns := newChoicesUpstream(t)
+	proxy := makeProxy(target)
+
+	rr := httptest.NewRecorder()
+	proxy.ServeHTTP(rr, httptest.NewRequest("POST", "http://localhost/v1/chat/completions",
+		strings.NewReader(`{"model":"m","n":3,"seed":7,"stream":true,"messages":[]}`)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", rr.Code, rr.Body.String())
+	}
+	if len(*ns) != 3 {
+		t.Errorf("upstream called %d times, want 3", len(*ns))
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Content-Type = %q, want text/event-stream", ct)
+	}
+
+	contents := map[int]string{}
+	var usage, done int
+	ids := map[string]bool{}
+	for _, event := range strings.Split(strings.TrimSuffix(rr.Body.String(), "\n\n"), "\n\n") {
+		data := strings.TrimPrefix(event, "data: ")
+		if data == "[DONE]" {
+			done++
+			continue
+		}
+		var chunk struct {
+			ID      string `json:"id"`
+			Choices []struct {
+				Index int `json:"index"`
+				Delta struct {
+					Content string `json:"content"`
+				} `json:"delta"`
+			} `json:"choices"`
+			Usage *auditUsage `json:"usage"`
+		}
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			t.Fatalf("decoding chunk %q: %v", data, err)
+		}
+		ids[chunk.ID] = true
+		for _, c := range chunk.Choices {
+			contents[c.Index] = c.Delta.Content
+		}
+		if chunk.Usage != nil {
+			usage++
+			if *chunk.Usage != (auditUsage{PromptTokens: 30, CompletionTokens: 3, TotalTokens: 33}) {
+				t.Errorf("usage = %+v", *chunk.Usage)
+			}
+		}
+	}
+	if want := map[int]string{0: "7-0", 1: "8-0", 2: "9-0"}; fmt.Sprint(contents) != fmt.Sprint(want) {
+		t.Errorf("choices = %v, want %v", contents, want)
+	}
+	if len(ids) != 1 {
+		t.Errorf("chunk ids = %v, want a single id", ids)
+	}
+	if usage != 1 || done != 1 {
+		t.Errorf("got %d usage chunks and %d [DONE], want 1 each", usage, done)
+	}
+}
+
+func TestServeWithChoices_Error(t *testing.T) {
+	setCachedToken(t, "test-token")
+	useConfig(t, &proxyConfig{MaxChoices: map[string]int{"m": 1}})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Seed int `json:"seed"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Seed == 1 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"error":{"message":"quota"}}`))
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: {\"choices\":[{\"index\":0,\"delta\":{}}]}\n\ndata: [DONE]\n\n"))
+	}))
+	defer server.Close()
+	target, _ := url.Parse(server.URL)
+	proxy := makeProxy(target)
+
+	for _, stream := range []bool{false, true} {
+		rr := httptest.NewRecorder()
+		proxy.ServeHTTP(rr, httptest.NewRequest("POST", "http://localhost/v1/chat/completions",
+			strings.NewReader(fmt.Sprintf(`{"model":"m","n":2,"seed":0,"stream":%t,"messages":[]}`, stream))))
+		if rr.Code != http.StatusTooManyRequests || !strings.Contains(rr.Body.String(), "quota") {
+			t.Errorf("stream=%t: got %d %q, want the 429 of the failed request", stream, rr.Code, rr.Body.String())
+		}
+	}
+}
+
+func TestMaxChoices(t *testing.T) {
+	useConfig(t, &proxyConfig{MaxChoices: map[string]int{"google/gemini-2.5-pro": 4}})
+	original := maxN
+	t.Cleanup(func() { maxN = original })
+	t.Setenv("VERTEXAI_MAX_N", "")
+	if err := initChoices(); err != nil {
+		t.Fatalf("initChoices() error = %v", err)
+	}
+	tests := map[string]int{
+		"google/gemini-2.5-pro":        4,
+		"google/gemini-2.5-flash":      defaultMaxChoices,
+		"anthropic/claude-sonnet-4@v1": 1,
+	}
+	for model, want := range tests {
+		if got := maxChoices(model); got != want {
+			t.Errorf("maxChoices(%q) = %d, want %d", model, got, want)
+		}
+	}
+	t.Setenv("VERTEXAI_MAX_N", "2")
+	if err := initChoices(); err != nil {
+		t.Fatalf("initChoices() error = %v", err)
+	}
+	if got := maxChoices("google/gemini-2.5-flash"); got != 2 {
+		t.Errorf("maxChoices() with VERTEXAI_MAX_N=2 = %d, want 2", got)
+	}
+	for _, invalid := range []string{"0", "-1", "many"} {
+		t.Setenv("VERTEXAI_MAX_N", invalid)
+		if err := initChoices(); err == nil {
+			t.Errorf("initChoices() with VERTEXAI_MAX_N=%s succeeded, want error", invalid)
+		}
+	}
+}
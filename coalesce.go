@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// coalescedHeader marks responses shared from an identical in-flight request.
+const coalescedHeader = "X-Coalesced"
+
+// coalescer shares upstream calls among identical concurrent requests. It is
+// nil when coalescing is disabled.
+var coalescer *singleflight.Group
+
+// initCoalescing enables request coalescing when REQUEST_COALESCING is true.
+func initCoalescing() error {
+	enabled, err := envFlag("REQUEST_COALESCING", false)
+	if err != nil || !enabled {
+		return err
+	}
+	coalescer = &singleflight.Group{}
+	logger.Info("initCoalescing: Request coalescing enabled")
+	return nil
+}
+
+// serveWithCoalescing serves a non-streaming chat completions request with
+// serve, unless an identical request of the same client key to the same
+// target is already in flight: then it waits for that request and writes a
+// copy of its response. The shared call is not canceled when its first
+// client goes away, since others may be waiting for it.
+func serveWithCoalescing(w http.ResponseWriter, r *http.Request, upstream *upstreamTarget, serve http.HandlerFunc) {
+	g := coalescer
+	if g == nil || r.URL.Path != "/v1/chat/completions" || r.Body == nil || cacheOptOut(r) {
+		serve(w, r)
+		return
+	}
+	ctx := r.Context()
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		serve(w, r)
+		return
+	}
+	var req map[string]any
+	if json.Unmarshal(body, &req) != nil {
+		serve(w, r)
+		return
+	}
+	if stream, _ := req["stream"].(bool); stream {
+		serve(w, r)
+		return
+	}
+
+	key := canonicalRequestKey(requestKeyScope(r, upstream, req)+"\x00"+clientKey(r), req)
+	leader := false
+	ch := g.DoChan(key, func() (any, error) {
+		leader = true
+		sr := r.WithContext(context.WithoutCancel(ctx))
+		// Share responses uncompressed, the waiters may not accept gzip.
+		sr.Header.Del("Accept-Encoding")
+		buf := newResponseBuffer()
+		serve(buf, sr)
+		return buf, nil
+	})
+	var buf *responseBuffer
+	select {
+	case res := <-ch:
+		buf = res.Val.(*responseBuffer)
+	case <-ctx.Done():
+		return
+	}
+	if !leader {
+		logger.DebugContext(ctx, "serveWithCoalescing: Serving response of identical in-flight request", "key", key)
+		metrics.coalescedRequests.Add(ctx, 1)
+		w.Header().Set(coalescedHeader, "true")
+	}
+	writeBufferedResponse(w, buf)
+}
+
+// writeBufferedResponse writes a response kept in a responseBuffer to w.
+func writeBufferedResponse(w http.ResponseWriter, buf *responseBuffer) {
+	h := w.Header()
+	for k, v := range buf.header {
+		h[k] = slices.Clone(v)
+	}
+	h.Set("Content-Length", strconv.Itoa(buf.body.Len()))
+	status := buf.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	w.WriteHeader(status)
+	w.Write(buf.body.Bytes())
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// useCoalescing enables request coalescing for the duration of the test.
+func useCoalescing(t *testing.T) {
+	t.Helper()
+	original := coalescer
+	t.Cleanup(func() { coalescer = original })
+	coalescer = &singleflight.Group{}
+}
+
+func TestInitCoalescing_InvalidFlag(t *testing.T) {
+	original := coalescer
+	t.Cleanup(func() { coalescer = original })
+	t.Setenv("REQUEST_COALESCING", "on")
+	if err := initCoalescing(); err == nil {
+		t.Error("initCoalescing() with REQUEST_COALESCING=on succeeded, want error")
+	}
+}
+
+func TestServeWithCoalescing(t *testing.T) {
+	setCachedToken(t, "test-token")
+	useCoalescing(t)
+	reader := recordMetrics(t)
+	var calls atomic.Int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		<-release
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"choices":[{"message":{"content":"Title"}}]}`))
+	}))
+	defer server.Close()
+	target, _ := url.Parse(server.URL + "/v1/projects/p/locations/l/endpoints/openapi")
+	proxy := makeProxy(target)
+
+	bodies := []string{
+		`{"model":"m","messages":[{"role":"user","content":"title?"}]}`,
+		`{ "messages": [{"content":"title?", "role":"user"}], "model": "m" }`,
+		`{"model":"m","messages":[{"role":"user","content":"title?"}]}`,
+		`{"model":"m","stream":true,"messages":[{"role":"user","content":"title?"}]}`,
+	}
+	responses := make([]*httptest.ResponseRecorder, len(bodies))
+	var wg sync.WaitGroup
+	for i, body := range bodies {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rr := httptest.NewRecorder()
+			proxy.ServeHTTP(rr, httptest.NewRequest("POST", "http://localhost/v1/chat/completions", strings.NewReader(body)))
+			responses[i] = rr
+		}()
+	}
+	// Wait for the shared call and the streaming request to reach the
+	// upstream, and give the identical requests time to join.
+	for calls.Load() < 2 {
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if got := calls.Load(); got != 2 {
+		t.Errorf("upstream called %d times, want 2", got)
+	}
+	shared := 0
+	for i, rr := range responses[:3] {
+		if rr.Code != http.StatusOK || rr.Body.String() != `{"choices":[{"message":{"content":"Title"}}]}` {
+			t.Errorf("response %d = %d %q", i, rr.Code, rr.Body.String())
+		}
+		if rr.Header().Get(coalescedHeader) == "true" {
+			shared++
+		}
+	}
+	if shared != 2 {
+		t.Errorf("%d responses marked %s, want 2", shared, coalescedHeader)
+	}
+	if got := responses[3].Header().Get(coalescedHeader); got != "" {
+		t.Errorf("streaming response %s = %q, want none", coalescedHeader, got)
+	}
+	var saved int64
+	for _, n := range sumByAttr(t, reader, "proxy.coalesce.saved_requests", "") {
+		saved += n
+	}
+	if saved != 2 {
+		t.Errorf("proxy.coalesce.saved_requests = %d, want 2", saved)
+	}
+}
+
+func TestServeWithCoalescing_DifferentKeys(t *testing.T) {
+	setCachedToken(t, "test-token")
+	useCoalescing(t)
+	var calls atomic.Int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		<-release
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+	target, _ := url.Parse(server.URL + "/v1/projects/p/locations/l/endpoints/openapi")
+	proxy := makeProxy(target)
+
+	var wg sync.WaitGroup
+	for _, key := range []string{"key-a", "key-b"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest("POST", "http://localhost/v1/chat/completions", strings.NewReader(`{"model":"m","messages":[]}`))
+			req.Header.Set("Authorization", "Bearer "+key)
+			proxy.ServeHTTP(httptest.NewRecorder(), req)
+		}()
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for calls.Load() < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+	if got := calls.Load(); got != 2 {
+		t.Errorf("upstream called %d times, want 2: requests of different keys must not be shared", got)
+	}
+}
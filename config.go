@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// proxyConfig is the optional JSON configuration file named by the
+// PROXY_CONFIG environment variable. It holds settings that are too
+// structured for plain environment variables.
+type proxyConfig struct {
+	// DefaultCredentials names the entry of Credentials used for requests
+	// that are not routed elsewhere. Empty means Application Default Credentials.
+	DefaultCredentials string `json:"default_credentials,omitempty"`
+	// Credentials defines named credential sources.
+	Credentials map[string]credentialConfig `json:"credentials,omitempty"`
+	// Targets defines named project/location/credentials tuples.
+	Targets map[string]targetConfig `json:"targets,omitempty"`
+	// Keys maps client API keys to names and targets.
+	Keys []keyConfig `json:"keys,omitempty"`
+	// Endpoints maps model names to endpoints deployed in Vertex AI.
+	Endpoints map[string]endpointConfig `json:"endpoints,omitempty"`
+	// Fallbacks maps model names to the models tried when they fail.
+	Fallbacks map[string]*fallbackConfig `json:"fallbacks,omitempty"`
+	// Splits maps model aliases to weighted variants for A/B testing.
+	Splits map[string]*splitConfig `json:"splits,omitempty"`
+	// Shadows maps model names to candidates that get a mirrored sample of
+	// their requests.
+	Shadows map[string]shadowConfig `json:"shadows,omitempty"`
+	// MaxChoices maps model names to the largest n their upstream accepts.
+	// Requests for more choices are split into several requests.
+	MaxChoices map[string]int `json:"max_choices,omitempty"`
+	// Parameters maps model names, or prefixes ending in "*", to actions
+	// for request fields their upstream doesn't support.
+	Parameters map[string]map[string]string `json:"parameters,omitempty"`
+	// ContextLimits maps model names, or prefixes ending in "*", to their
+	// context window in tokens.
+	ContextLimits map[string]int `json:"context_limits,omitempty"`
+	// Prompts defines named prompts injected into chat completions requests.
+	Prompts map[string]*promptConfig `json:"prompts,omitempty"`
+	// ModelPrompts maps model names, or prefixes ending in "*", to the
+	// prompts of their requests from keys without a prompt.
+	ModelPrompts map[string]string `json:"model_prompts,omitempty"`
+
+	keysByValue map[string]*keyConfig
+}
+
+// config is the loaded configuration. It is empty when PROXY_CONFIG is not set.
+var config = &proxyConfig{}
+
+// loadConfig reads and validates the configuration file at path.
+// Unknown fields are rejected to catch typos early.
+func loadConfig(path string) (*proxyConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	cfg := &proxyConfig{}
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+func (c *proxyConfig) validate() error {
+	for name, cred := range c.Credentials {
+		if err := cred.validate(c, name); err != nil {
+			return fmt.Errorf("credentials %q: %w", name, err)
+		}
+	}
+	for name, target := range c.Targets {
+		if err := target.validate(c); err != nil {
+			return fmt.Errorf("target %q: %w", name, err)
+		}
+	}
+	for model, ep := range c.Endpoints {
+		if err := ep.validate(c); err != nil {
+			return fmt.Errorf("endpoint %q: %w", model, err)
+		}
+	}
+	for model, fb := range c.Fallbacks {
+		if fb == nil {
+			return fmt.Errorf("fallback %q: models are required", model)
+		}
+		if err := fb.validate(); err != nil {
+			return fmt.Errorf("fallback %q: %w", model, err)
+		}
+	}
+	for alias, split := range c.Splits {
+		if split == nil {
+			return fmt.Errorf("split %q: variants are required", alias)
+		}
+		if err := split.validate(); err != nil {
+			return fmt.Errorf("split %q: %w", alias, err)
+		}
+	}
+	for model, shadow := range c.Shadows {
+		if err := shadow.validate(c); err != nil {
+			return fmt.Errorf("shadow %q: %w", model, err)
+		}
+	}
+	for model, n := range c.MaxChoices {
+		if n < 1 {
+			return fmt.Errorf("max_choices %q: must be at least 1, got %d", model, n)
+		}
+	}
+	for model, actions := range c.Parameters {
+		if err := validateParameterActions(actions); err != nil {
+			return fmt.Errorf("parameters %q: %w", model, err)
+		}
+	}
+	for model, limit := range c.ContextLimits {
+		if limit < 1 {
+			return fmt.Errorf("context_limits %q: must be at least 1, got %d", model, limit)
+		}
+	}
+	for name, prompt := range c.Prompts {
+		if prompt == nil {
+			return fmt.Errorf("prompt %q: system, prefix or suffix is required", name)
+		}
+		if err := prompt.validate(); err != nil {
+			return fmt.Errorf("prompt %q: %w", name, err)
+		}
+	}
+	for model, name := range c.ModelPrompts {
+		if _, ok := c.Prompts[name]; !ok {
+			return fmt.Errorf("model_prompts %q: prompt %q is not defined", model, name)
+		}
+	}
+	c.keysByValue = make(map[string]*keyConfig, len(c.Keys))
+	for i := range c.Keys {
+		k := &c.Keys[i]
+		if k.Key == "" || k.Name == "" {
+			return fmt.Errorf("keys[%d]: key and name are required", i)
+		}
+		if _, dup := c.keysByValue[k.Key]; dup {
+			return fmt.Errorf("keys[%d] (%s): duplicate key", i, k.Name)
+		}
+		if _, ok := c.Targets[k.Target]; k.Target != "" && !ok && k.Target != defaultTargetName {
+			return fmt.Errorf("keys[%d] (%s): target %q is not defined", i, k.Name, k.Target)
+		}
+		if _, ok := c.Prompts[k.Prompt]; k.Prompt != "" && !ok {
+			return fmt.Errorf("keys[%d] (%s): prompt %q is not defined", i, k.Name, k.Prompt)
+		}
+		c.keysByValue[k.Key] = k
+	}
+	if c.DefaultCredentials != "" {
+		if _, ok := c.Credentials[c.DefaultCredentials]; !ok && c.DefaultCredentials != defaultCredentialsName {
+			return fmt.Errorf("default_credentials %q is not defined", c.DefaultCredentials)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := writeConfig(t, `{
+		"default_credentials": "team-a",
+		"credentials": {
+			"team-a": {"type": "impersonate", "target_principal": "a@p.iam.gserviceaccount.com", "source": "meta"},
+			"meta": {"type": "metadata"}
+		}
+	}`)
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("loadConfig() error = %v", err)
+	}
+	if cfg.DefaultCredentials != "team-a" || cfg.Credentials["team-a"].Source != "meta" {
+		t.Errorf("loadConfig() = %+v", cfg)
+	}
+}
+
+func TestLoadConfig_Invalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{"unknown field", `{"credentails": {}}`, "unknown field"},
+		{"unknown type", `{"credentials": {"a": {"type": "magic"}}}`, "unknown type"},
+		{"missing file", `{"credentials": {"a": {"type": "service_account"}}}`, "requires file"},
+		{"missing principal", `{"credentials": {"a": {"type": "impersonate"}}}`, "target_principal"},
+		{"undefined source", `{"credentials": {"a": {"type": "impersonate", "target_principal": "x", "source": "b"}}}`, "not defined"},
+		{"source cycle", `{"credentials": {
+			"a": {"type": "impersonate", "target_principal": "x", "source": "b"},
+			"b": {"type": "impersonate", "target_principal": "y", "source": "a"}}}`, "cycle"},
+		{"undefined default", `{"default_credentials": "nope"}`, "not defined"},
+		{"target without project", `{"targets": {"t": {"location": "us-central1"}}}`, "project and location"},
+		{"target with undefined credentials", `{"targets": {"t": {"project": "p", "location": "l", "credentials": "c"}}}`, "not defined"},
+		{"key without name", `{"keys": [{"key": "k"}]}`, "key and name"},
+		{"duplicate key", `{"keys": [{"key": "k", "name": "a"}, {"key": "k", "name": "b"}]}`, "duplicate key"},
+		{"key with undefined target", `{"keys": [{"key": "k", "name": "a", "target": "t"}]}`, "not defined"},
+		{"endpoint without id", `{"endpoints": {"ours/llama-ft": {"location": "us-central1"}}}`, "endpoint_id"},
+		{"endpoint with undefined credentials", `{"endpoints": {"ours/llama-ft": {"endpoint_id": "1", "credentials": "c"}}}`, "not defined"},
+		{"fallback without models", `{"fallbacks": {"google/gemini-2.5-pro": {}}}`, "models are required"},
+		{"fallback with invalid timeout", `{"fallbacks": {"google/gemini-2.5-pro": {"models": ["m"], "timeout": "soon"}}}`, "invalid timeout"},
+		{"split without variants", `{"splits": {"chat": {"variants": []}}}`, "variants are required"},
+		{"split without weight", `{"splits": {"chat": {"variants": [{"model": "a", "weight": 0}]}}}`, "positive weight"},
+		{"shadow without sample rate", `{"shadows": {"m": {"model": "c"}}}`, "sample_rate"},
+		{"shadow with undefined target", `{"shadows": {"m": {"model": "c", "sample_rate": 0.1, "target": "t"}}}`, "not defined"},
+		{"max_choices below 1", `{"max_choices": {"m": 0}}`, "at least 1"},
+		{"parameters with unknown action", `{"parameters": {"m": {"user": "ignore"}}}`, "unknown action"},
+		{"parameters without translation", `{"parameters": {"m": {"user": "translate"}}}`, "no translation"},
+		{"context_limits below 1", `{"context_limits": {"gemini-*": 0}}`, "at least 1"},
+		{"prompt without messages", `{"prompts": {"p": {}}}`, "system, prefix or suffix"},
+		{"prompt with unknown override", `{"prompts": {"p": {"system": "s", "override": "never"}}}`, "unknown override"},
+		{"prompt with unknown variable", `{"prompts": {"p": {"system": "Today is {{today}}"}}}`, "unknown variable"},
+		{"prompt with unknown role", `{"prompts": {"p": {"suffix": [{"role": "tool", "content": "c"}]}}}`, "unknown role"},
+		{"model_prompts with undefined prompt", `{"model_prompts": {"gemini-*": "p"}}`, "not defined"},
+		{"key with undefined prompt", `{"keys": [{"key": "k", "name": "a", "prompt": "p"}]}`, "not defined"},
+		{"split with duplicate variant", `{"splits": {"chat": {"variants": [{"model": "a", "weight": 1}, {"model": "a", "weight": 1}]}}}`, "duplicate name"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := loadConfig(writeConfig(t, tc.content))
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("loadConfig() error = %v, want containing %q", err, tc.wantErr)
+			}
+		})
+	}
+}
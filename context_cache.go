@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// contextCacheRenewMargin is how long before expiry a context cache is
+	// no longer referenced, so requests don't race its deletion.
+	contextCacheRenewMargin = time.Minute
+	// contextCacheRetryInterval is how long a prefix isn't cached again
+	// after creating its context cache failed.
+	contextCacheRetryInterval = 10 * time.Minute
+	// contextCacheMaxTracked bounds the number of prefixes counted.
+	contextCacheMaxTracked = 1024
+	// contextCacheCreateTimeout bounds a cachedContents create call.
+	contextCacheCreateTimeout = time.Minute
+)
+
+// contextCaches is the manager configured by initContextCache. It is nil
+// when context caching is disabled.
+var contextCaches *contextCacheManager
+
+// contextCacheManager creates Vertex AI context caches (cachedContents) for
+// long system prompts that are sent repeatedly, and makes chat completions
+// requests reference them instead of sending the prompt again.
+type contextCacheManager struct {
+	ttl        time.Duration
+	minChars   int
+	minRepeats int
+	client     *http.Client
+
+	mu      sync.Mutex
+	seen    map[string]int
+	entries map[string]*contextCacheEntry
+}
+
+// contextCacheEntry is a cachedContents resource of a prefix, or the state
+// of its creation.
+type contextCacheEntry struct {
+	name         string
+	expires      time.Time
+	cachedTokens int
+	creating     bool
+	failedAt     time.Time
+}
+
+// initContextCache configures context caching from the CONTEXT_CACHE*
+// environment variables. It stays disabled unless CONTEXT_CACHE is true.
+func initContextCache() error {
+	enabled, err := envFlag("CONTEXT_CACHE", false)
+	if err != nil || !enabled {
+		return err
+	}
+	ttl, err := envDuration("CONTEXT_CACHE_TTL", time.Hour)
+	if err != nil {
+		return err
+	}
+	if ttl <= contextCacheRenewMargin {
+		return fmt.Errorf("CONTEXT_CACHE_TTL must be longer than %s", contextCacheRenewMargin)
+	}
+	minChars, err := envInt("CONTEXT_CACHE_MIN_CHARS", 16384)
+	if err != nil {
+		return err
+	}
+	minRepeats, err := envInt("CONTEXT_CACHE_MIN_REPEATS", 2)
+	if err != nil {
+		return err
+	}
+	contextCaches = newContextCacheManager(ttl, minChars, minRepeats)
+	logger.Info("initContextCache: Context caching enabled", "ttl", ttl, "min_chars", minChars, "min_repeats", minRepeats)
+	return nil
+}
+
+func newContextCacheManager(ttl time.Duration, minChars, minRepeats int) *contextCacheManager {
+	return &contextCacheManager{
+		ttl:        ttl,
+		minChars:   minChars,
+		minRepeats: minRepeats,
+		client:     &http.Client{Transport: upstreamTransport(http.DefaultTransport)},
+		seen:       map[string]int{},
+		entries:    map[string]*contextCacheEntry{},
+	}
+}
+
+// apply makes a chat completions request for a Gemini model on the OpenAI
+// endpoint of upstream reference the context cache of its leading system
+// messages. The cache is created in the background once the prefix has been
+// seen often enough, or right away when a system message is marked with
+// cache_control. It returns the body to send and the number of cached tokens,
+// which is 0 when no cache is referenced.
+func (m *contextCacheManager) apply(ctx context.Context, upstream *upstreamTarget, body []byte) ([]byte, int) {
+	base, ok := strings.CutSuffix(upstream.url.Path, "/endpoints/openapi")
+	if !ok {
+		return body, 0
+	}
+	var req map[string]any
+	if json.Unmarshal(body, &req) != nil {
+		return body, 0
+	}
+	model, _ := req["model"].(string)
+	messages, _ := req["messages"].([]any)
+	if model == "" || req["tools"] != nil {
+		// Vertex AI rejects requests combining cached content and tools.
+		return body, 0
+	}
+
+	var system []string
+	marked := false
+	n := 0
+	for ; n < len(messages); n++ {
+		msg, _ := messages[n].(map[string]any)
+		if role, _ := msg["role"].(string); role != "system" && role != "developer" {
+			break
+		}
+		marked = marked || hasCacheControl(msg)
+		content, _ := json.Marshal(msg["content"])
+		text, err := contentText(content)
+		if err != nil {
+			return body, 0
+		}
+		system = append(system, text)
+	}
+	prompt := strings.Join(system, "\n\n")
+	if n == 0 || n == len(messages) || (!marked && len(prompt) < m.minChars) {
+		return body, 0
+	}
+
+	publisher, modelID, found := strings.Cut(model, "/")
+	if !found {
+		publisher, modelID = "google", model
+	}
+	modelName := fmt.Sprintf("%s/publishers/%s/models/%s", strings.TrimPrefix(base, "/v1/"), publisher, modelID)
+	sum := sha256.Sum256([]byte(upstream.name + "\x00" + modelName + "\x00" + prompt))
+	key := hex.EncodeToString(sum[:])
+
+	entry := m.lookup(ctx, key, marked, func() {
+		endpoint := &url.URL{Scheme: upstream.url.Scheme, Host: upstream.url.Host, Path: base + "/cachedContents"}
+		m.create(context.WithoutCancel(ctx), key, endpoint.String(), upstream.credentials, modelName, prompt)
+	})
+	if entry == nil {
+		return body, 0
+	}
+
+	req["messages"] = messages[n:]
+	extra, _ := req["extra_body"].(map[string]any)
+	if extra == nil {
+		extra = map[string]any{}
+	}
+	google, _ := extra["google"].(map[string]any)
+	if google == nil {
+		google = map[string]any{}
+	}
+	google["cached_content"] = entry.name
+	extra["google"] = google
+	req["extra_body"] = extra
+	out, err := json.Marshal(req)
+	if err != nil {
+		return body, 0
+	}
+	logger.DebugContext(ctx, "contextCacheManager: Referencing context cache", "cached_content", entry.name, "cached_tokens", entry.cachedTokens)
+	return out, entry.cachedTokens
+}
+
+// lookup returns the usable context cache of key. When there is none, it
+// counts the request and calls create in the background once the prefix
+// qualifies for caching.
+func (m *contextCacheManager) lookup(ctx context.Context, key string, marked bool, create func()) *contextCacheEntry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	entry := m.entries[key]
+	if entry != nil && entry.name != "" && now.Before(entry.expires.Add(-contextCacheRenewMargin)) {
+		e := *entry
+		return &e
+	}
+	if entry != nil && (entry.creating || now.Sub(entry.failedAt) < contextCacheRetryInterval) {
+		return nil
+	}
+	if len(m.seen) >= contextCacheMaxTracked {
+		m.seen = map[string]int{}
+	}
+	m.seen[key]++
+	if !marked && m.seen[key] < m.minRepeats {
+		return nil
+	}
+	delete(m.seen, key)
+	m.entries[key] = &contextCacheEntry{creating: true}
+	logger.InfoContext(ctx, "contextCacheManager: Creating context cache for repeated prefix", "key", key[:12], "marked", marked)
+	go create()
+	return nil
+}
+
+// create creates the cachedContents resource of a prefix.
+func (m *contextCacheManager) create(ctx context.Context, key, endpoint, credentials, modelName, prompt string) {
+	ctx, cancel := context.WithTimeout(ctx, contextCacheCreateTimeout)
+	defer cancel()
+	entry, err := m.createCachedContent(ctx, endpoint, credentials, modelName, prompt)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err != nil {
+		logger.WarnContext(ctx, "contextCacheManager: Error creating context cache", "model", modelName, "error", err)
+		m.entries[key] = &contextCacheEntry{failedAt: time.Now()}
+		return
+	}
+	logger.InfoContext(ctx, "contextCacheManager: Created context cache", "cached_content", entry.name, "cached_tokens", entry.cachedTokens, "expires", entry.expires)
+	for k, e := range m.entries {
+		if e.name != "" && time.Now().After(e.expires) {
+			delete(m.entries, k)
+		}
+	}
+	m.entries[key] = entry
+}
+
+func (m *contextCacheManager) createCachedContent(ctx context.Context, endpoint, credentials, modelName, prompt string) (*contextCacheEntry, error) {
+	reqBody, err := json.Marshal(map[string]any{
+		"model":             modelName,
+		"displayName":       "vertexai-openapi-proxy",
+		"systemInstruction": map[string]any{"parts": []map[string]string{{"text": prompt}}},
+		"ttl":               strconv.Itoa(int(m.ttl.Seconds())) + "s",
+	})
+	if err != nil {
+		return nil, err
+	}
+	tok, err := getTokenFor(ctx, credentials)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+tok)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("cachedContents.create returned %s: %s", resp.Status, respBody)
+	}
+	var created struct {
+		Name          string    `json:"name"`
+		ExpireTime    time.Time `json:"expireTime"`
+		UsageMetadata struct {
+			TotalTokenCount int `json:"totalTokenCount"`
+		} `json:"usageMetadata"`
+	}
+	if err := json.Unmarshal(respBody, &created); err != nil {
+		return nil, fmt.Errorf("parsing cachedContents.create response: %w", err)
+	}
+	if created.Name == "" {
+		return nil, fmt.Errorf("cachedContents.create response has no name: %s", respBody)
+	}
+	if created.ExpireTime.IsZero() {
+		created.ExpireTime = time.Now().Add(m.ttl)
+	}
+	return &contextCacheEntry{name: created.Name, expires: created.ExpireTime, cachedTokens: created.UsageMetadata.TotalTokenCount}, nil
+}
+
+// hasCacheControl reports whether a message, or one of its content parts,
+// carries a cache_control marker.
+func hasCacheControl(msg map[string]any) bool {
+	if msg["cache_control"] != nil {
+		return true
+	}
+	parts, _ := msg["content"].([]any)
+	for _, p := range parts {
+		if part, _ := p.(map[string]any); part["cache_control"] != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// reportCachedTokens sets usage.prompt_tokens_details.cached_tokens of a chat
+// completion or chunk unless the upstream already reported cached tokens.
+func reportCachedTokens(data []byte, cachedTokens int) []byte {
+	var payload map[string]any
+	if json.Unmarshal(data, &payload) != nil {
+		return data
+	}
+	usage, _ := payload["usage"].(map[string]any)
+	if usage == nil {
+		return data
+	}
+	details, _ := usage["prompt_tokens_details"].(map[string]any)
+	if details == nil {
+		details = map[string]any{}
+	}
+	if n, _ := details["cached_tokens"].(float64); n > 0 {
+		return data
+	}
+	if prompt, ok := usage["prompt_tokens"].(float64); ok && float64(cachedTokens) > prompt {
+		cachedTokens = int(prompt)
+	}
+	details["cached_tokens"] = cachedTokens
+	usage["prompt_tokens_details"] = details
+	out, err := json.Marshal(payload)
+	if err != nil {
+		return data
+	}
+	return out
+}
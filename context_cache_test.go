@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// useContextCache enables context caching for the duration of the test.
+func useContextCache(t *testing.T) *contextCacheManager {
+	t.Helper()
+	original := contextCaches
+	t.Cleanup(func() { contextCaches = original })
+	contextCaches = newContextCacheManager(time.Hour, 20, 2)
+	return contextCaches
+}
+
+// waitForContextCache waits until the manager has created a context cache.
+func waitForContextCache(t *testing.T, m *contextCacheManager) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		m.mu.Lock()
+		for _, e := range m.entries {
+			if e.name != "" {
+				m.mu.Unlock()
+				return
+			}
+		}
+		m.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("context cache not created")
+}
+
+type contextCacheUpstream struct {
+	mu      sync.Mutex
+	creates []map[string]any
+	chats   []map[string]any
+}
+
+func newContextCacheUpstream(t *testing.T) (*url.URL, *contextCacheUpstream) {
+	t.Helper()
+	u := &contextCacheUpstream{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		json.NewDecoder(r.Body).Decode(&body)
+		u.mu.Lock()
+		defer u.mu.Unlock()
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/cachedContents"):
+			u.creates = append(u.creates, body)
+			w.Write([]byte(`{"name":"projects/p/locations/l/cachedContents/123","expireTime":"` +
+				time.Now().Add(time.Hour).Format(time.RFC3339) + `","usageMetadata":{"totalTokenCount":4000}}`))
+		case strings.HasSuffix(r.URL.Path, "/chat/completions"):
+			u.chats = append(u.chats, body)
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"choices":[],"usage":{"prompt_tokens":4010,"completion_tokens":5,"total_tokens":4015}}`))
+		default:
+			t.Errorf("unexpected upstream path %s", r.URL.Path)
+		}
+	}))
+	t.Cleanup(server.Close)
+	target, _ := url.Parse(server.URL + "/v1/projects/p/locations/l/endpoints/openapi")
+	return target, u
+}
+
+func TestInitContextCache_InvalidFlag(t *testing.T) {
+	original := contextCaches
+	t.Cleanup(func() { contextCaches = original })
+	t.Setenv("CONTEXT_CACHE", "yes")
+	if err := initContextCache(); err == nil {
+		t.Error("initContextCache() with CONTEXT_CACHE=yes succeeded, want error")
+	}
+}
+
+func TestContextCache_RepeatedPrefix(t *testing.T) {
+	setCachedToken(t, "test-token")
+	m := useContextCache(t)
+	target, upstream := newContextCacheUpstream(t)
+	proxy := makeProxy(target)
+	const body = `{"model":"google/gemini-2.5-flash","messages":[{"role":"system","content":"You are a very long system prompt."},{"role":"user","content":"hi"}]}`
+
+	send := func() map[string]any {
+		rr := httptest.NewRecorder()
+		proxy.ServeHTTP(rr, httptest.NewRequest("POST", "http://localhost/v1/chat/completions", strings.NewReader(body)))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("status = %d, want 200: %s", rr.Code, rr.Body.String())
+		}
+		var resp map[string]any
+		json.Unmarshal(rr.Body.Bytes(), &resp)
+		return resp
+	}
+
+	send()
+	send() // the second sighting creates the cache
+	waitForContextCache(t, m)
+	resp := send()
+
+	upstream.mu.Lock()
+	defer upstream.mu.Unlock()
+	if len(upstream.creates) != 1 {
+		t.Fatalf("cachedContents created %d times, want 1", len(upstream.creates))
+	}
+	create := upstream.creates[0]
+	if create["model"] != "projects/p/locations/l/publishers/google/models/gemini-2.5-flash" || create["ttl"] != "3600s" {
+		t.Errorf("unexpected cachedContents request: %v", create)
+	}
+	if instruction, _ := json.Marshal(create["systemInstruction"]); !strings.Contains(string(instruction), "very long system prompt") {
+		t.Errorf("systemInstruction = %s, want the system prompt", instruction)
+	}
+
+	if len(upstream.chats) != 3 {
+		t.Fatalf("chat completions called %d times, want 3", len(upstream.chats))
+	}
+	if _, ok := upstream.chats[1]["extra_body"]; ok {
+		t.Error("request referenced a cache before it was created")
+	}
+	last := upstream.chats[2]
+	if ref, _ := json.Marshal(last["extra_body"]); string(ref) != `{"google":{"cached_content":"projects/p/locations/l/cachedContents/123"}}` {
+		t.Errorf("extra_body = %s, want cached_content reference", ref)
+	}
+	if messages, _ := json.Marshal(last["messages"]); string(messages) != `[{"content":"hi","role":"user"}]` {
+		t.Errorf("messages = %s, want the system prompt removed", messages)
+	}
+	if details, _ := json.Marshal(resp["usage"].(map[string]any)["prompt_tokens_details"]); string(details) != `{"cached_tokens":4000}` {
+		t.Errorf("prompt_tokens_details = %s, want 4000 cached tokens", details)
+	}
+}
+
+func TestContextCache_Marker(t *testing.T) {
+	setCachedToken(t, "test-token")
+	m := useContextCache(t)
+	upstreamTarget := &upstreamTarget{name: "default", url: &url.URL{Scheme: "http", Host: "unused", Path: "/v1/projects/p/locations/l/endpoints/openapi"}}
+	created := make(chan struct{})
+	m.client = &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		close(created)
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(`{"name":"c/1"}`)), Header: http.Header{}}, nil
+	})}
+
+	// Short, but marked: cached on first sight.
+	body := `{"model":"gemini-2.5-flash","messages":[{"role":"system","content":[{"type":"text","text":"short","cache_control":{"type":"ephemeral"}}]},{"role":"user","content":"hi"}]}`
+	if _, n := m.apply(t.Context(), upstreamTarget, []byte(body)); n != 0 {
+		t.Errorf("apply() referenced a cache before it was created")
+	}
+	select {
+	case <-created:
+	case <-time.After(5 * time.Second):
+		t.Fatal("marked prefix not cached")
+	}
+	waitForContextCache(t, m)
+	out, _ := m.apply(t.Context(), upstreamTarget, []byte(body))
+	if !strings.Contains(string(out), `"cached_content":"c/1"`) {
+		t.Errorf("apply() = %s, want cached_content reference", out)
+	}
+
+	// Requests with tools can't use cached content.
+	withTools := `{"model":"m","tools":[{"type":"function"}],"messages":[{"role":"system","content":"x","cache_control":{}},{"role":"user","content":"hi"}]}`
+	if out, _ := m.apply(t.Context(), upstreamTarget, []byte(withTools)); string(out) != withTools {
+		t.Errorf("apply() changed a request with tools: %s", out)
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestReportCachedTokens_Stream(t *testing.T) {
+	stream := "data: {\"choices\":[]}\n\ndata: {\"choices\":[],\"usage\":{\"prompt_tokens\":10,\"completion_tokens\":1}}\n\ndata: [DONE]\n\n"
+	out, err := io.ReadAll(newSSETransformReader(io.NopCloser(strings.NewReader(stream)), func(data []byte) []byte {
+		return reportCachedTokens(data, 8)
+	}))
+	if err != nil {
+		t.Fatalf("ReadAll() error = %v", err)
+	}
+	want := "data: {\"choices\":[]}\n\ndata: {\"choices\":[],\"usage\":{\"completion_tokens\":1,\"prompt_tokens\":10,\"prompt_tokens_details\":{\"cached_tokens\":8}}}\n\ndata: [DONE]\n\n"
+	if string(out) != want {
+		t.Errorf("stream = %q\nwant %q", out, want)
+	}
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+	// defaultCredentialsName is the always-available credential source
+	// backed by Application Default Credentials.
+	defaultCredentialsName = "default"
+)
+
+// googleFindDefaultCredentialsWrapper wraps google.FindDefaultCredentials to allow mocking in tests.
+var googleFindDefaultCredentials = google.FindDefaultCredentials
+
+// iamCredentialsBaseURL is the IAM Credentials API used for service account
+// impersonation. It's a variable to allow overriding for testing.
+var iamCredentialsBaseURL = "https://iamcredentials.googleapis.com/v1"
+
+// credentialConfig describes a named credential source in the config file.
+type credentialConfig struct {
+	// Type is one of "default" (Application Default Credentials),
+	// "service_account" (key file), "external_account" (workload identity
+	// federation config file), "impersonate" or "metadata".
+	Type string `json:"type"`
+	// File is the JSON key or external account config for the file-based types.
+	File string `json:"file,omitempty"`
+	// TargetPrincipal is the service account email to impersonate.
+	TargetPrincipal string `json:"target_principal,omitempty"`
+	// Delegates is the optional delegation chain for impersonation.
+	Delegates []string `json:"delegates,omitempty"`
+	// Source names the credentials used to call the IAM Credentials API when
+	// impersonating. Defaults to Application Default Credentials.
+	Source string `json:"source,omitempty"`
+	// ServiceAccount selects a non-default service account attached to the
+	// instance for the metadata type.
+	ServiceAccount string `json:"service_account,omitempty"`
+	// Scopes overrides the OAuth scopes. Defaults to cloud-platform.
+	Scopes []string `json:"scopes,omitempty"`
+}
+
+func (c credentialConfig) validate(cfg *proxyConfig, name string) error {
+	switch c.Type {
+	case "", "default", "metadata":
+	case "service_account", "external_account":
+		if c.File == "" {
+			return fmt.Errorf("type %s requires file", c.Type)
+		}
+	case "impersonate":
+		if c.TargetPrincipal == "" {
+			return errors.New("type impersonate requires target_principal")
+		}
+		// Follow the source chain to reject undefined sources and cycles.
+		seen := map[string]bool{name: true}
+		for source := c.Source; source != "" && source != defaultCredentialsName; {
+			next, ok := cfg.Credentials[source]
+			if !ok {
+				return fmt.Errorf("source %q is not defined", source)
+			}
+			if seen[source] {
+				return fmt.Errorf("source %q forms a cycle", source)
+			}
+			seen[source] = true
+			source = next.Source
+		}
+	default:
+		return fmt.Errorf("unknown type %q", c.Type)
+	}
+	return nil
+}
+
+// tokenProvider caches the access token of one credential source.
+//
+// Tokens are renewed in the background well before they expire, so requests
+// normally never wait for a token fetch. Concurrent fetches are coalesced,
+// and a failed renewal keeps the current token in use while it is valid.
+type tokenProvider struct {
+	name   string
+	source func(ctx context.Context) (oauth2.TokenSource, error)
+
+	mu      sync.RWMutex
+	token   string
+	expiry  time.Time
+	fetched time.Time
+
+	group         singleflight.Group
+	refresherOnce sync.Once
+	// retryInterval overrides tokenRetryInterval in tests.
+	retryInterval time.Duration
+}
+
+const (
+	// tokenExpiryDelta is how long before expiry a token stops being handed
+	// out, so that it stays valid while the request using it is in flight.
+	tokenExpiryDelta = 30 * time.Second
+	// tokenRefreshMargin is how long before expiry a token is renewed in the
+	// background. Tokens with a shorter lifetime are renewed at half-life.
+	tokenRefreshMargin = 10 * time.Minute
+	// tokenFetchTimeout bounds a single token fetch.
+	tokenFetchTimeout = 30 * time.Second
+	// tokenRetryInterval is the delay between background renewal attempts
+	// after a failure, and the minimum delay between renewals.
+	tokenRetryInterval = 10 * time.Second
+)
+
+var (
+	// adcTokenProvider serves Application Default Credentials.
+	adcTokenProvider = &tokenProvider{name: defaultCredentialsName, source: adcTokenSource}
+
+	tokenProvidersMu sync.RWMutex
+	tokenProviders   = map[string]*tokenProvider{defaultCredentialsName: adcTokenProvider}
+)
+
+func adcTokenSource(ctx context.Context) (oauth2.TokenSource, error) {
+	// Use the wrapper variable so it can be mocked in tests
+	creds, err := googleFindDefaultCredentials(ctx, cloudPlatformScope)
+	if err != nil {
+		return nil, fmt.Errorf("finding default credentials: %w", err)
+	}
+	return creds.TokenSource, nil
+}
+
+// initCredentials registers a token provider for every credential source in cfg.
+func initCredentials(cfg *proxyConfig) error {
+	providers := map[string]*tokenProvider{defaultCredentialsName: adcTokenProvider}
+	for name, c := range cfg.Credentials {
+		source, err := newTokenSourceFunc(c)
+		if err != nil {
+			return fmt.Errorf("credentials %q: %w", name, err)
+		}
+		providers[name] = &tokenProvider{name: name, source: source}
+		logger.Info("initCredentials: Registered credential source", "name", name, "type", c.Type)
+	}
+	tokenProvidersMu.Lock()
+	tokenProviders = providers
+	tokenProvidersMu.Unlock()
+	return nil
+}
+
+// newTokenSourceFunc returns a function creating a fresh token source for c.
+func newTokenSourceFunc(c credentialConfig) (func(ctx context.Context) (oauth2.TokenSource, error), error) {
+	scopes := c.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{cloudPlatformScope}
+	}
+	switch c.Type {
+	case "", "default":
+		return func(ctx context.Context) (oauth2.TokenSource, error) {
+			creds, err := googleFindDefaultCredentials(ctx, scopes...)
+			if err != nil {
+				return nil, fmt.Errorf("finding default credentials: %w", err)
+			}
+			return creds.TokenSource, nil
+		}, nil
+	case "service_account", "external_account":
+		// Read the file eagerly so that a bad path fails at startup.
+		data, err := os.ReadFile(c.File)
+		if err != nil {
+			return nil, err
+		}
+		var header struct {
+			Type string `json:"type"`
+		}
+		if err := json.Unmarshal(data, &header); err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", c.File, err)
+		}
+		if header.Type != c.Type {
+			return nil, fmt.Errorf("%s has type %q, want %q", c.File, header.Type, c.Type)
+		}
+		return func(ctx context.Context) (oauth2.TokenSource, error) {
+			creds, err := google.CredentialsFromJSON(ctx, data, scopes...)
+			if err != nil {
+				return nil, err
+			}
+			return creds.TokenSource, nil
+		}, nil
+	case "metadata":
+		// A new source per fetch, since ComputeTokenSource caches tokens itself.
+		return func(context.Context) (oauth2.TokenSource, error) {
+			return google.ComputeTokenSource(c.ServiceAccount, scopes...), nil
+		}, nil
+	case "impersonate":
+		return func(ctx context.Context) (oauth2.TokenSource, error) {
+			return &impersonatedTokenSource{
+				ctx:             ctx,
+				source:          c.Source,
+				targetPrincipal: c.TargetPrincipal,
+				delegates:       c.Delegates,
+				scopes:          scopes,
+			}, nil
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown type %q", c.Type)
+}
+
+// tokenProviderFor returns the provider for the named credential source.
+// An empty name selects the configured default credentials.
+func tokenProviderFor(name string) (*tokenProvider, error) {
+	if name == "" {
+		name = config.DefaultCredentials
+	}
+	if name == "" {
+		name = defaultCredentialsName
+	}
+	tokenProvidersMu.RLock()
+	defer tokenProvidersMu.RUnlock()
+	p, ok := tokenProviders[name]
+	if !ok {
+		return nil, fmt.Errorf("credentials %q are not configured", name)
+	}
+	return p, nil
+}
+
+// getToken returns an access token of the default credentials.
+func getToken(ctx context.Context) (string, error) {
+	return getTokenFor(ctx, "")
+}
+
+// getTokenFor returns an access token of the named credential source.
+func getTokenFor(ctx context.Context, credentials string) (string, error) {
+	p, err := tokenProviderFor(credentials)
+	if err != nil {
+		return "", err
+	}
+	return p.Token(ctx)
+}
+
+// Token returns the cached access token, fetching a new one only when there
+// is no token that is valid for at least tokenExpiryDelta.
+func (p *tokenProvider) Token(ctx context.Context) (string, error) {
+	ctx, span := tracer.Start(ctx, "getToken")
+	defer span.End()
+	span.SetAttributes(attribute.String("token.credentials", p.name))
+
+	if tok, ok := p.cached(); ok {
+		logger.DebugContext(ctx, "getToken: Using cached token.", "credentials", p.name)
+		span.SetAttributes(attribute.Bool("token.cached", true))
+		return tok, nil
+	}
+
+	logger.InfoContext(ctx, "getToken: Cache expired or empty, fetching new token.", "credentials", p.name)
+	span.SetAttributes(attribute.Bool("token.cached", false))
+	tok, err := p.refresh(ctx)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return "", err
+	}
+	return tok, nil
+}
+
+// cached returns the current token if it is valid for at least tokenExpiryDelta.
+// A zero expiry means the token does not expire.
+func (p *tokenProvider) cached() (string, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.token == "" {
+		return "", false
+	}
+	return p.token, p.expiry.IsZero() || time.Now().Before(p.expiry.Add(-tokenExpiryDelta))
+}
+
+// refresh fetches a new token and stores it in the cache. Concurrent calls
+// share a single fetch. The fetch is not canceled with ctx, since other
+// callers may be waiting for it.
+func (p *tokenProvider) refresh(ctx context.Context) (string, error) {
+	ch := p.group.DoChan("token", func() (any, error) {
+		fetchCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), tokenFetchTimeout)
+		defer cancel()
+
+		ts, err := p.source(fetchCtx)
+		if err != nil {
+			logger.ErrorContext(ctx, "getToken: Error creating token source", "credentials", p.name, "error", err)
+			return "", err
+		}
+		tok, err := ts.Token()
+		if err != nil {
+			logger.ErrorContext(ctx, "getToken: Error getting token from source", "credentials", p.name, "error", err)
+			return "", err
+		}
+
+		p.mu.Lock()
+		p.token = tok.AccessToken
+		p.expiry = tok.Expiry
+		p.fetched = time.Now()
+		p.mu.Unlock()
+		logger.InfoContext(ctx, "getToken: Successfully fetched new token.", "credentials", p.name, "expiry", tok.Expiry)
+
+		p.refresherOnce.Do(func() { go p.refreshLoop() })
+		return tok.AccessToken, nil
+	})
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return "", res.Err
+		}
+		return res.Val.(string), nil
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// refreshLoop renews the token in the background before it expires. On
+// failure it retries every tokenRetryInterval while the current token keeps
+// being served.
+func (p *tokenProvider) refreshLoop() {
+	ctx := context.Background()
+	for {
+		wait, ok := p.nextRefresh()
+		if !ok {
+			logger.Info("tokenProvider: Token does not expire, background refresh stopped", "credentials", p.name)
+			return
+		}
+		time.Sleep(wait)
+
+		for {
+			_, err := p.refresh(ctx)
+			if err == nil {
+				break
+			}
+			p.mu.RLock()
+			expiry := p.expiry
+			p.mu.RUnlock()
+			logger.Warn("tokenProvider: Background token refresh failed, serving current token until it expires",
+				"credentials", p.name, "expires_in", time.Until(expiry).Round(time.Second), "retry_in", p.retryDelay(), "error", err)
+			time.Sleep(p.retryDelay())
+		}
+	}
+}
+
+// nextRefresh returns how long to wait before renewing the current token,
+// and false if the token does not expire.
+func (p *tokenProvider) nextRefresh() (time.Duration, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.expiry.IsZero() {
+		return 0, false
+	}
+	margin := min(tokenRefreshMargin, p.expiry.Sub(p.fetched)/2)
+	return max(time.Until(p.expiry.Add(-margin)), p.retryDelay()), true
+}
+
+func (p *tokenProvider) retryDelay() time.Duration {
+	if p.retryInterval > 0 {
+		return p.retryInterval
+	}
+	return tokenRetryInterval
+}
+
+// impersonatedTokenSource mints access tokens for a target service account
+// via the IAM Credentials generateAccessToken API, authenticating with the
+// token of another credential source.
+type impersonatedTokenSource struct {
+	ctx             context.Context
+	source          string
+	targetPrincipal string
+	delegates       []string
+	scopes          []string
+}
+
+func (s *impersonatedTokenSource) Token() (*oauth2.Token, error) {
+	sourceToken, err := getTokenFor(s.ctx, s.source)
+	if err != nil {
+		return nil, fmt.Errorf("getting source token for impersonation: %w", err)
+	}
+
+	delegates := make([]string, len(s.delegates))
+	for i, d := range s.delegates {
+		delegates[i] = "projects/-/serviceAccounts/" + d
+	}
+	reqBody, err := json.Marshal(map[string]any{
+		"delegates": delegates,
+		"scope":     s.scopes,
+		"lifetime":  "3600s",
+	})
+	if err != nil {
+		return nil, err
+	}
+	endpoint := iamCredentialsBaseURL + "/projects/-/serviceAccounts/" + url.PathEscape(s.targetPrincipal) + ":generateAccessToken"
+	req, err := http.NewRequestWithContext(s.ctx, http.MethodPost, endpoint, bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+sourceToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("calling generateAccessToken: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading generateAccessToken response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("generateAccessToken for %s returned %s: %s", s.targetPrincipal, resp.Status, body)
+	}
+	var out struct {
+		AccessToken string    `json:"accessToken"`
+		ExpireTime  time.Time `json:"expireTime"`
+	}
+	if err := json.Unmarshal(body, &out); err != nil {
+		return nil, fmt.Errorf("parsing generateAccessToken response: %w", err)
+	}
+	return &oauth2.Token{AccessToken: out.AccessToken, TokenType: "Bearer", Expiry: out.ExpireTime}, nil
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// mockADC makes Application Default Credentials return tok for the duration of the test.
+func mockADC(t *testing.T, tok string) {
+	t.Helper()
+	original := googleFindDefaultCredentials
+	t.Cleanup(func() { googleFindDefaultCredentials = original })
+	googleFindDefaultCredentials = func(ctx context.Context, scopes ...string) (*google.Credentials, error) {
+		return &google.Credentials{
+			TokenSource: &MockTokenSource{AccessTokenString: tok, ExpiryTime: time.Now().Add(time.Hour)},
+		}, nil
+	}
+	adcTokenProvider.mu.Lock()
+	adcTokenProvider.token = ""
+	adcTokenProvider.expiry = time.Time{}
+	adcTokenProvider.mu.Unlock()
+}
+
+// useConfig installs cfg and its credential sources for the duration of the test.
+func useConfig(t *testing.T, cfg *proxyConfig) {
+	t.Helper()
+	if err := cfg.validate(); err != nil {
+		t.Fatalf("validate() error = %v", err)
+	}
+	originalConfig := config
+	tokenProvidersMu.RLock()
+	originalProviders := tokenProviders
+	tokenProvidersMu.RUnlock()
+	t.Cleanup(func() {
+		config = originalConfig
+		tokenProvidersMu.Lock()
+		tokenProviders = originalProviders
+		tokenProvidersMu.Unlock()
+	})
+	config = cfg
+	if err := initCredentials(cfg); err != nil {
+		t.Fatalf("initCredentials() error = %v", err)
+	}
+}
+
+func TestGetTokenFor_Impersonation(t *testing.T) {
+	mockADC(t, "source-token")
+
+	calls := 0
+	iamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if got := r.Header.Get("Authorization"); got != "Bearer source-token" {
+			t.Errorf("IAM request Authorization = %q, want source token", got)
+		}
+		if want := "/projects/-/serviceAccounts/team-a@proj.iam.gserviceaccount.com:generateAccessToken"; r.URL.Path != want {
+			t.Errorf("IAM request path = %s, want %s", r.URL.Path, want)
+		}
+		var body struct {
+			Delegates []string `json:"delegates"`
+			Scope     []string `json:"scope"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		if len(body.Delegates) != 1 || body.Delegates[0] != "projects/-/serviceAccounts/hop@proj.iam.gserviceaccount.com" {
+			t.Errorf("IAM request delegates = %v", body.Delegates)
+		}
+		if len(body.Scope) != 1 || body.Scope[0] != cloudPlatformScope {
+			t.Errorf("IAM request scope = %v", body.Scope)
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"accessToken": "impersonated-token",
+			"expireTime":  time.Now().Add(time.Hour).Format(time.RFC3339),
+		})
+	}))
+	defer iamServer.Close()
+	originalIAM := iamCredentialsBaseURL
+	iamCredentialsBaseURL = iamServer.URL
+	defer func() { iamCredentialsBaseURL = originalIAM }()
+
+	useConfig(t, &proxyConfig{Credentials: map[string]credentialConfig{
+		"team-a": {
+			Type:            "impersonate",
+			TargetPrincipal: "team-a@proj.iam.gserviceaccount.com",
+			Delegates:       []string{"hop@proj.iam.gserviceaccount.com"},
+		},
+	}})
+
+	for i := 0; i < 2; i++ {
+		got, err := getTokenFor(context.Background(), "team-a")
+		if err != nil {
+			t.Fatalf("getTokenFor() error = %v", err)
+		}
+		if got != "impersonated-token" {
+			t.Errorf("getTokenFor() = %q, want impersonated-token", got)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("IAM API called %d times, want 1 (second call should be cached)", calls)
+	}
+
+	// The default credentials keep their own cache.
+	if got, _ := getToken(context.Background()); got != "source-token" {
+		t.Errorf("getToken() = %q, want source-token", got)
+	}
+}
+
+func TestGetTokenFor_DefaultCredentialsFromConfig(t *testing.T) {
+	mockADC(t, "adc-token")
+	useConfig(t, &proxyConfig{
+		DefaultCredentials: "scoped",
+		Credentials: map[string]credentialConfig{
+			"scoped": {Type: "default", Scopes: []string{"https://example.com/scope"}},
+		},
+	})
+
+	p, err := tokenProviderFor("")
+	if err != nil {
+		t.Fatalf("tokenProviderFor() error = %v", err)
+	}
+	if p.name != "scoped" {
+		t.Errorf("tokenProviderFor(\"\") = %s, want scoped", p.name)
+	}
+	if _, err := tokenProviderFor("missing"); err == nil {
+		t.Error("tokenProviderFor(missing) expected error")
+	}
+}
+
+func TestNewTokenSourceFunc_FileTypeMismatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "key.json")
+	if err := os.WriteFile(path, []byte(`{"type":"authorized_user"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_, err := newTokenSourceFunc(credentialConfig{Type: "service_account", File: path})
+	if err == nil || !strings.Contains(err.Error(), "authorized_user") {
+		t.Errorf("newTokenSourceFunc() error = %v, want type mismatch", err)
+	}
+}
+
+func TestTokenProvider_CoalescesConcurrentFetches(t *testing.T) {
+	var fetches atomic.Int32
+	p := &tokenProvider{name: "test", source: func(ctx context.Context) (oauth2.TokenSource, error) {
+		fetches.Add(1)
+		time.Sleep(50 * time.Millisecond)
+		return &MockTokenSource{AccessTokenString: "shared", ExpiryTime: time.Now().Add(time.Hour)}, nil
+	}}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if got, err := p.Token(context.Background()); err != nil || got != "shared" {
+				t.Errorf("Token() = %q, %v, want shared", got, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("token fetched %d times, want 1", n)
+	}
+}
+
+func TestTokenProvider_KeepsValidTokenOnRefreshFailure(t *testing.T) {
+	p := &tokenProvider{name: "test", source: func(ctx context.Context) (oauth2.TokenSource, error) {
+		return &MockTokenSource{Error: errors.New("metadata server unavailable")}, nil
+	}}
+	p.token = "still-valid"
+	p.expiry = time.Now().Add(5 * time.Minute) // inside the refresh margin
+	p.fetched = time.Now().Add(-55 * time.Minute)
+
+	if _, err := p.refresh(context.Background()); err == nil {
+		t.Fatal("refresh() expected error")
+	}
+	got, err := p.Token(context.Background())
+	if err != nil || got != "still-valid" {
+		t.Errorf("Token() = %q, %v, want still-valid", got, err)
+	}
+}
+
+func TestTokenProvider_ExpiredTokenFails(t *testing.T) {
+	p := &tokenProvider{name: "test", source: func(ctx context.Context) (oauth2.TokenSource, error) {
+		return &MockTokenSource{Error: errors.New("metadata server unavailable")}, nil
+	}}
+	p.token = "expired"
+	p.expiry = time.Now().Add(10 * time.Second) // inside tokenExpiryDelta
+
+	if got, err := p.Token(context.Background()); err == nil {
+		t.Errorf("Token() = %q, want error for expired token", got)
+	}
+}
+
+func TestTokenProvider_NextRefresh(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name     string
+		fetched  time.Time
+		expiry   time.Time
+		wantWait time.Duration
+		wantOK   bool
+	}{
+		{"one hour token renewed ten minutes early", now, now.Add(time.Hour), 50 * time.Minute, true},
+		{"short token renewed at half-life", now, now.Add(10 * time.Minute), 5 * time.Minute, true},
+		{"overdue renewal waits the retry interval", now.Add(-time.Hour), now.Add(time.Minute), tokenRetryInterval, true},
+		{"token without expiry is not renewed", now, time.Time{}, 0, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &tokenProvider{token: "t", fetched: tc.fetched, expiry: tc.expiry}
+			wait, ok := p.nextRefresh()
+			if ok != tc.wantOK {
+				t.Fatalf("nextRefresh() ok = %v, want %v", ok, tc.wantOK)
+			}
+			if diff := wait - tc.wantWait; diff < -time.Second || diff > time.Second {
+				t.Errorf("nextRefresh() wait = %v, want about %v", wait, tc.wantWait)
+			}
+		})
+	}
+}
+
+func TestTokenProvider_BackgroundRefresh(t *testing.T) {
+	var fetches atomic.Int32
+	p := &tokenProvider{name: "test", retryInterval: 10 * time.Millisecond, source: func(ctx context.Context) (oauth2.TokenSource, error) {
+		if fetches.Add(1) == 1 {
+			// A token that is due for renewal right away.
+			return &MockTokenSource{AccessTokenString: "first", ExpiryTime: time.Now().Add(40 * time.Millisecond)}, nil
+		}
+		return &MockTokenSource{AccessTokenString: "renewed", ExpiryTime: time.Now().Add(time.Hour)}, nil
+	}}
+
+	if _, err := p.refresh(context.Background()); err != nil {
+		t.Fatalf("refresh() error = %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for fetches.Load() < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got, err := p.Token(context.Background()); err != nil || got != "renewed" {
+		t.Errorf("Token() = %q, %v, want token renewed in the background", got, err)
+	}
+}
+
+func TestMakeProxy_NoTokenReturns503(t *testing.T) {
+	original := googleFindDefaultCredentials
+	defer func() { googleFindDefaultCredentials = original }()
+	googleFindDefaultCredentials = func(ctx context.Context, scopes ...string) (*google.Credentials, error) {
+		return nil, errors.New("no credentials")
+	}
+	adcTokenProvider.mu.Lock()
+	adcTokenProvider.token = ""
+	adcTokenProvider.expiry = time.Time{}
+	adcTokenProvider.mu.Unlock()
+
+	upstreamCalled := false
+	targetServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamCalled = true
+	}))
+	defer targetServer.Close()
+	targetURL, _ := url.Parse(targetServer.URL)
+
+	req := httptest.NewRequest("POST", "http://localhost/v1/chat/completions", strings.NewReader(`{}`))
+	rr := httptest.NewRecorder()
+	makeProxy(targetURL).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want 503", rr.Code)
+	}
+	var body openAIError
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil || body.Error.Code != "credentials_unavailable" {
+		t.Errorf("body = %s, want OpenAI error with code credentials_unavailable", rr.Body.String())
+	}
+	if upstreamCalled {
+		t.Error("request was forwarded upstream without credentials")
+	}
+}
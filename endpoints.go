@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+)
+
+// endpointConfig routes a model name to a Vertex AI endpoint deployed by the
+// user, e.g. a fine-tuned open model from Model Garden, which serves its own
+// OpenAI-compatible chat completions route.
+type endpointConfig struct {
+	// EndpointID is the numeric ID of the deployed endpoint.
+	EndpointID string `json:"endpoint_id"`
+	// Project and Location of the endpoint. Empty means the project and
+	// location of the request's target, so they match its credentials.
+	Project  string `json:"project,omitempty"`
+	Location string `json:"location,omitempty"`
+	// Credentials names the credential source. Empty means the credentials
+	// of the request's target.
+	Credentials string `json:"credentials,omitempty"`
+	// Model replaces the model name in requests sent to the endpoint. Empty
+	// keeps the name the client sent.
+	Model string `json:"model,omitempty"`
+}
+
+func (e endpointConfig) validate(cfg *proxyConfig) error {
+	if e.EndpointID == "" {
+		return errors.New("endpoint_id is required")
+	}
+	if e.Credentials != "" && e.Credentials != defaultCredentialsName {
+		if _, ok := cfg.Credentials[e.Credentials]; !ok {
+			return fmt.Errorf("credentials %q are not defined", e.Credentials)
+		}
+	}
+	return nil
+}
+
+// chatRequestModel returns the model of a chat completions request body.
+func chatRequestModel(body []byte) string {
+	var req struct {
+		Model string `json:"model"`
+	}
+	json.Unmarshal(body, &req)
+	return req.Model
+}
+
+// endpointTarget returns the target of a chat completions request for a
+// model mapped to a deployed endpoint, with the body to send to it. It
+// returns a nil target for other models.
+func endpointTarget(body []byte, current *upstreamTarget) (*upstreamTarget, []byte, error) {
+	model := chatRequestModel(body)
+	ep, ok := config.Endpoints[model]
+	if model == "" || !ok {
+		return nil, body, nil
+	}
+	project, loc := ep.Project, ep.Location
+	if project == "" {
+		project = current.project
+	}
+	if loc == "" {
+		loc = current.location
+	}
+	u, err := url.Parse(vertexAIEndpointURL(project, loc, ep.EndpointID))
+	if err != nil {
+		return nil, nil, fmt.Errorf("building URL for endpoint of %q: %w", model, err)
+	}
+	credentials := ep.Credentials
+	if credentials == "" {
+		credentials = current.credentials
+	}
+	if ep.Model != "" {
+		var req map[string]any
+		if err := json.Unmarshal(body, &req); err != nil {
+			return nil, nil, err
+		}
+		req["model"] = ep.Model
+		if body, err = json.Marshal(req); err != nil {
+			return nil, nil, err
+		}
+	}
+	return &upstreamTarget{name: "endpoint:" + ep.EndpointID, url: u, credentials: credentials}, body, nil
+}
+
+// endpointModelIDs returns the model names mapped to deployed endpoints.
+func endpointModelIDs() []string {
+	ids := make([]string, 0, len(config.Endpoints))
+	for id := range config.Endpoints {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
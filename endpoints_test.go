@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestMakeProxy_RoutesModelToDeployedEndpoint(t *testing.T) {
+	var gotPath, gotAuth, gotModel string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		gotAuth = r.Header.Get("Authorization")
+		var body struct {
+			Model string `json:"model"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		gotModel = body.Model
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+	routeVertexAITo(t, server)
+	useConfig(t, &proxyConfig{
+		Credentials: map[string]credentialConfig{"ft-creds": {Type: "metadata"}, "team-b-creds": {Type: "metadata"}},
+		Targets:     map[string]targetConfig{"team-b": {Project: "proj-b", Location: "us-east5", Credentials: "team-b-creds"}},
+		Keys:        []keyConfig{{Key: "sk-team-b", Name: "team-b", Target: "team-b"}},
+		Endpoints: map[string]endpointConfig{
+			"ours/llama-ft": {EndpointID: "1234", Project: "ft-proj", Location: "europe-west4", Credentials: "ft-creds", Model: "llama-ft"},
+			"ours/mistral":  {EndpointID: "5678", Project: "ft-proj", Location: "us-central1"},
+			"ours/gemma":    {EndpointID: "9012"},
+		},
+	})
+	setProviderToken(t, "ft-creds", "ft-token")
+	setProviderToken(t, "team-b-creds", "team-b-token")
+	setCachedToken(t, "adc-token")
+	defaultURL, _ := url.Parse(server.URL + "/v1/projects/default-proj/locations/us-central1/endpoints/openapi")
+	proxy := makeProxy(defaultURL)
+
+	tests := []struct {
+		model, key, wantPath, wantBearer, wantModel string
+	}{
+		{"ours/llama-ft", "", "/v1/projects/ft-proj/locations/europe-west4/endpoints/1234/chat/completions", "ft-token", "llama-ft"},
+		{"ours/mistral", "", "/v1/projects/ft-proj/locations/us-central1/endpoints/5678/chat/completions", "adc-token", "ours/mistral"},
+		{"google/gemini-2.5-pro", "", "/v1/projects/default-proj/locations/us-central1/endpoints/openapi/chat/completions", "adc-token", "google/gemini-2.5-pro"},
+		// The endpoint is looked up in the project of the key's target.
+		{"ours/gemma", "sk-team-b", "/v1/projects/proj-b/locations/us-east5/endpoints/9012/chat/completions", "team-b-token", "ours/gemma"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.model, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "http://localhost/v1/chat/completions", strings.NewReader(`{"model":"`+tc.model+`"}`))
+			if tc.key != "" {
+				req.Header.Set("Authorization", "Bearer "+tc.key)
+			}
+			rr := httptest.NewRecorder()
+			proxy.ServeHTTP(rr, req)
+
+			if rr.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200: %s", rr.Code, rr.Body.String())
+			}
+			if gotPath != tc.wantPath {
+				t.Errorf("upstream path = %s, want %s", gotPath, tc.wantPath)
+			}
+			if gotAuth != "Bearer "+tc.wantBearer {
+				t.Errorf("upstream Authorization = %q, want Bearer %s", gotAuth, tc.wantBearer)
+			}
+			if gotModel != tc.wantModel {
+				t.Errorf("upstream model = %q, want %q", gotModel, tc.wantModel)
+			}
+		})
+	}
+}
+
+func TestHandleModels_DeployedEndpoints(t *testing.T) {
+	t.Setenv("VERTEXAI_AVAILABLE_MODELS", "google/gemini-2.5-pro")
+	useConfig(t, &proxyConfig{
+		Endpoints: map[string]endpointConfig{
+			"ours/mistral":  {EndpointID: "5678", Project: "ft-proj"},
+			"ours/llama-ft": {EndpointID: "1234", Project: "ft-proj"},
+		},
+	})
+
+	rr := httptest.NewRecorder()
+	handleModels(rr, httptest.NewRequest("GET", "/v1/models", nil))
+
+	var list ModelList
+	if err := json.NewDecoder(rr.Body).Decode(&list); err != nil {
+		t.Fatalf("Failed to decode response body: %v", err)
+	}
+	var ids []string
+	for _, m := range list.Data {
+		ids = append(ids, m.ID+"@"+m.OwnedBy)
+	}
+	if got, want := strings.Join(ids, ","), "google/gemini-2.5-pro@google,ours/llama-ft@ft-proj,ours/mistral@ft-proj"; got != want {
+		t.Errorf("models = %s, want %s", got, want)
+	}
+}
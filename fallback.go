@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// modelHeader reports which model answered a chat completions request.
+const modelHeader = "X-Vertex-Model"
+
+// fallbackConfig is the fallback chain of a model in the config file.
+type fallbackConfig struct {
+	// Models are tried in order when the previous model fails.
+	Models []string `json:"models"`
+	// Timeout bounds the wait for the response headers of each attempt,
+	// e.g. "20s". Empty means no timeout.
+	Timeout string `json:"timeout,omitempty"`
+
+	timeout time.Duration
+}
+
+func (f *fallbackConfig) validate() error {
+	if len(f.Models) == 0 {
+		return errors.New("models are required")
+	}
+	if f.Timeout != "" {
+		d, err := time.ParseDuration(f.Timeout)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid timeout %q", f.Timeout)
+		}
+		f.timeout = d
+	}
+	return nil
+}
+
+// safetyFinishReasons are the finish_reason values of responses blocked by
+// safety filters, which are retried with the next model of the chain.
+var safetyFinishReasons = map[string]bool{
+	"content_filter":     true,
+	"safety":             true,
+	"prohibited_content": true,
+	"blocklist":          true,
+	"spii":               true,
+}
+
+// retryableStatus reports whether a response status moves on to the next
+// model of a fallback chain.
+func retryableStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+// serveWithFallback serves a chat completions request for a model with a
+// fallback chain: on 429 and 5xx responses, timeouts and safety blocks the
+// request is sent again with the next model. Other requests are passed to
+// serve unchanged.
+func serveWithFallback(w http.ResponseWriter, r *http.Request, serve http.HandlerFunc) {
+	if r.URL.Path != "/v1/chat/completions" || len(config.Fallbacks) == 0 || r.Body == nil {
+		serve(w, r)
+		return
+	}
+	ctx := r.Context()
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "invalid_body", "Error reading request body")
+		return
+	}
+	var req map[string]any
+	json.Unmarshal(body, &req)
+	model, _ := req["model"].(string)
+	fb, ok := config.Fallbacks[model]
+	if !ok {
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		serve(w, r)
+		return
+	}
+	stream, _ := req["stream"].(bool)
+
+	models := append([]string{model}, fb.Models...)
+	for i, m := range models {
+		last := i == len(models)-1
+		if i > 0 {
+			req["model"] = m
+			body, _ = json.Marshal(req)
+		}
+		fw := &fallbackWriter{w: w, header: http.Header{}, model: m, stream: stream, last: last}
+		attemptCtx, cancel := context.WithCancel(ctx)
+		if fb.timeout > 0 {
+			fw.timer = time.AfterFunc(fb.timeout, func() {
+				if fw.expire() {
+					cancel()
+				}
+			})
+		}
+		ar := r.Clone(attemptCtx)
+		ar.Body = io.NopCloser(bytes.NewReader(body))
+		ar.ContentLength = int64(len(body))
+		ar.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		// Responses are inspected or rewritten, let the transport decompress them.
+		ar.Header.Del("Accept-Encoding")
+		serve(fw, ar)
+		if fw.timer != nil {
+			fw.timer.Stop()
+		}
+		cancel()
+
+		reason := fw.finish()
+		if reason == "" {
+			if i > 0 {
+				trace.SpanFromContext(ctx).SetAttributes(attribute.String("proxy.fallback_model", m))
+			}
+			return
+		}
+		if last {
+			// Only timeouts fail the last attempt, everything else is passed on.
+			writeOpenAIError(w, http.StatusGatewayTimeout, "api_error", "upstream_timeout",
+				fmt.Sprintf("No response from %s within %s", m, fb.timeout))
+			return
+		}
+		logger.WarnContext(ctx, "serveWithFallback: Falling back to next model", "model", m, "next_model", models[i+1], "reason", reason)
+		trace.SpanFromContext(ctx).AddEvent("proxy.fallback", trace.WithAttributes(
+			attribute.String("proxy.model", m),
+			attribute.String("proxy.next_model", models[i+1]),
+			attribute.String("proxy.fallback_reason", reason),
+		))
+	}
+}
+
+// fallbackWriter receives the response of one attempt of a fallback chain.
+// Failed responses are discarded, non-streaming responses are buffered to
+// check for safety blocks, and the rest is written through to w. The model
+// of completions and stream chunks is set to the model of the attempt.
+type fallbackWriter struct {
+	w      http.ResponseWriter
+	header http.Header
+	model  string
+	stream bool
+	last   bool
+	timer  *time.Timer
+
+	mu          sync.Mutex
+	wroteHeader bool
+	timedOut    bool
+	failed      string // the reason the attempt failed
+	status      int
+	buf         bytes.Buffer
+	// events holds the incomplete SSE event of a successful stream.
+	events bytes.Buffer
+}
+
+func (f *fallbackWriter) Header() http.Header {
+	return f.header
+}
+
+// expire marks the attempt as timed out unless the response has started.
+func (f *fallbackWriter) expire() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.wroteHeader {
+		return false
+	}
+	f.timedOut = true
+	f.failed = "timeout"
+	return true
+}
+
+func (f *fallbackWriter) WriteHeader(status int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.wroteHeader {
+		return
+	}
+	f.wroteHeader = true
+	f.status = status
+	if f.timer != nil {
+		f.timer.Stop()
+	}
+	switch {
+	case f.timedOut:
+	case retryableStatus(status) && !f.last:
+		f.failed = "status " + strconv.Itoa(status)
+	case f.stream || status >= 300:
+		f.writeHeaderThrough(status)
+	}
+}
+
+func (f *fallbackWriter) writeHeaderThrough(status int) {
+	h := f.w.Header()
+	for k, v := range f.header {
+		h[k] = v
+	}
+	h.Set(modelHeader, f.model)
+	f.w.WriteHeader(status)
+}
+
+// passthrough reports whether the response is written through to the client.
+func (f *fallbackWriter) passthrough() bool {
+	return f.failed == "" && !f.timedOut && (f.stream || f.status >= 300)
+}
+
+func (f *fallbackWriter) Write(b []byte) (int, error) {
+	f.WriteHeader(http.StatusOK)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case f.failed != "":
+		return len(b), nil
+	case f.passthrough() && f.stream && f.status < 300:
+		f.events.Write(b)
+		for {
+			i := bytes.Index(f.events.Bytes(), []byte("\n\n"))
+			if i < 0 {
+				return len(b), nil
+			}
+			if _, err := f.w.Write(rewriteEventModel(f.events.Next(i+2), f.model)); err != nil {
+				return 0, err
+			}
+		}
+	case f.passthrough():
+		return f.w.Write(b)
+	default:
+		return f.buf.Write(b)
+	}
+}
+
+func (f *fallbackWriter) Flush() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.passthrough() {
+		if fl, ok := f.w.(http.Flusher); ok {
+			fl.Flush()
+		}
+	}
+}
+
+// finish completes the attempt. It returns the reason the attempt failed,
+// or "" when the response was sent to the client.
+func (f *fallbackWriter) finish() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failed != "" {
+		return f.failed
+	}
+	if !f.wroteHeader {
+		f.wroteHeader = true
+		f.status = http.StatusOK
+	}
+	if f.passthrough() {
+		if f.events.Len() > 0 {
+			f.w.Write(rewriteEventModel(f.events.Bytes(), f.model))
+			f.events.Reset()
+		}
+		return ""
+	}
+
+	body := f.buf.Bytes()
+	var resp map[string]any
+	if json.Unmarshal(body, &resp) == nil {
+		if !f.last && blockedBySafety(resp) {
+			return "safety"
+		}
+		if _, ok := resp["model"]; ok {
+			resp["model"] = f.model
+			if b, err := json.Marshal(resp); err == nil {
+				body = b
+			}
+		}
+	}
+	f.header.Set("Content-Length", strconv.Itoa(len(body)))
+	f.writeHeaderThrough(f.status)
+	f.w.Write(body)
+	return ""
+}
+
+// rewriteEventModel sets the model of the chunks in the data lines of an
+// SSE event to model.
+func rewriteEventModel(event []byte, model string) []byte {
+	lines := bytes.SplitAfter(event, []byte("\n"))
+	for i, line := range lines {
+		data, ok := bytes.CutPrefix(line, []byte("data:"))
+		if !ok {
+			continue
+		}
+		var chunk map[string]any
+		if json.Unmarshal(data, &chunk) != nil {
+			continue
+		}
+		if _, ok := chunk["model"]; !ok {
+			continue
+		}
+		chunk["model"] = model
+		if b, err := json.Marshal(chunk); err == nil {
+			ending := line[len(bytes.TrimRight(line, "\r\n")):]
+			lines[i] = append(append([]byte("data: "), b...), ending...)
+		}
+	}
+	return bytes.Join(lines, nil)
+}
+
+// blockedBySafety reports whether a chat completion was stopped by safety filters.
+func blockedBySafety(resp map[string]any) bool {
+	choices, _ := resp["choices"].([]any)
+	for _, c := range choices {
+		choice, _ := c.(map[string]any)
+		reason, _ := choice["finish_reason"].(string)
+		if safetyFinishReasons[strings.ToLower(reason)] {
+			return true
+		}
+	}
+	return false
+}
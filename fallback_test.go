@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newModelUpstream returns a server answering chat completions with the
+// response respond returns for the requested model.
+func newModelUpstream(t *testing.T, respond func(w http.ResponseWriter, model string)) (*url.URL, *[]string) {
+	t.Helper()
+	var mu sync.Mutex
+	var models []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Model string `json:"model"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		mu.Lock()
+		models = append(models, body.Model)
+		mu.Unlock()
+		respond(w, body.Model)
+	}))
+	t.Cleanup(server.Close)
+	u, _ := url.Parse(server.URL)
+	return u, &models
+}
+
+func completion(model, finishReason string) string {
+	return fmt.Sprintf(`{"object":"chat.completion","model":%q,"choices":[{"index":0,"message":{"role":"assistant","content":"ok"},"finish_reason":%q}]}`, model, finishReason)
+}
+
+func TestServeWithFallback(t *testing.T) {
+	setCachedToken(t, "test-token")
+	useConfig(t, &proxyConfig{Fallbacks: map[string]*fallbackConfig{
+		"google/gemini-2.5-pro": {Models: []string{"google/gemini-2.5-flash", "google/gemini-2.0-flash"}, Timeout: "200ms"},
+	}})
+
+	tests := []struct {
+		name       string
+		respond    func(w http.ResponseWriter, model string)
+		wantStatus int
+		wantModel  string
+		wantCalls  int
+	}{
+		{
+			name: "first model answers",
+			respond: func(w http.ResponseWriter, model string) {
+				w.Write([]byte(completion("gemini-2.5-pro", "stop")))
+			},
+			wantStatus: http.StatusOK, wantModel: "google/gemini-2.5-pro", wantCalls: 1,
+		},
+		{
+			name: "falls back on 429",
+			respond: func(w http.ResponseWriter, model string) {
+				if model == "google/gemini-2.5-pro" {
+					w.WriteHeader(http.StatusTooManyRequests)
+					return
+				}
+				w.Write([]byte(completion(model, "stop")))
+			},
+			wantStatus: http.StatusOK, wantModel: "google/gemini-2.5-flash", wantCalls: 2,
+		},
+		{
+			name: "falls back on safety block",
+			respond: func(w http.ResponseWriter, model string) {
+				reason := "content_filter"
+				if model == "google/gemini-2.0-flash" {
+					reason = "stop"
+				}
+				w.Write([]byte(completion(model, reason)))
+			},
+			wantStatus: http.StatusOK, wantModel: "google/gemini-2.0-flash", wantCalls: 3,
+		},
+		{
+			name: "falls back on timeout",
+			respond: func(w http.ResponseWriter, model string) {
+				if model == "google/gemini-2.5-pro" {
+					time.Sleep(time.Second)
+				}
+				w.Write([]byte(completion(model, "stop")))
+			},
+			wantStatus: http.StatusOK, wantModel: "google/gemini-2.5-flash", wantCalls: 2,
+		},
+		{
+			name: "last failure is returned",
+			respond: func(w http.ResponseWriter, model string) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				w.Write([]byte(`{"error":{"message":"overloaded"}}`))
+			},
+			wantStatus: http.StatusServiceUnavailable, wantModel: "google/gemini-2.0-flash", wantCalls: 3,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			targetURL, calls := newModelUpstream(t, tc.respond)
+			req := httptest.NewRequest("POST", "http://localhost/v1/chat/completions", strings.NewReader(`{"model":"google/gemini-2.5-pro","messages":[]}`))
+			rr := httptest.NewRecorder()
+			makeProxy(targetURL).ServeHTTP(rr, req)
+
+			if rr.Code != tc.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rr.Code, tc.wantStatus, rr.Body.String())
+			}
+			if got := rr.Header().Get(modelHeader); got != tc.wantModel {
+				t.Errorf("%s = %q, want %q", modelHeader, got, tc.wantModel)
+			}
+			if len(*calls) != tc.wantCalls {
+				t.Errorf("upstream called with %v, want %d calls", *calls, tc.wantCalls)
+			}
+			if tc.wantStatus == http.StatusOK {
+				var resp struct {
+					Model string `json:"model"`
+				}
+				json.Unmarshal(rr.Body.Bytes(), &resp)
+				if resp.Model != tc.wantModel {
+					t.Errorf("response model = %q, want %q", resp.Model, tc.wantModel)
+				}
+			}
+		})
+	}
+}
+
+func TestServeWithFallback_Streaming(t *testing.T) {
+	setCachedToken(t, "test-token")
+	useConfig(t, &proxyConfig{Fallbacks: map[string]*fallbackConfig{
+		"google/gemini-2.5-pro": {Models: []string{"google/gemini-2.5-flash"}},
+	}})
+	targetURL, calls := newModelUpstream(t, func(w http.ResponseWriter, model string) {
+		if model == "google/gemini-2.5-pro" {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":{"message":"boom"}}`))
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		// The upstream names the model without its publisher, in events
+		// split across writes.
+		fmt.Fprintf(w, "data: {\"model\":%q}\n", strings.TrimPrefix(model, "google/"))
+		w.(http.Flusher).Flush()
+		fmt.Fprint(w, "\ndata: [DONE]\n\n")
+	})
+
+	req := httptest.NewRequest("POST", "http://localhost/v1/chat/completions", strings.NewReader(`{"model":"google/gemini-2.5-pro","stream":true}`))
+	rr := httptest.NewRecorder()
+	makeProxy(targetURL).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", rr.Code, rr.Body.String())
+	}
+	if len(*calls) != 2 {
+		t.Errorf("upstream called with %v, want 2 calls", *calls)
+	}
+	if got := rr.Header().Get(modelHeader); got != "google/gemini-2.5-flash" {
+		t.Errorf("%s = %q, want google/gemini-2.5-flash", modelHeader, got)
+	}
+	if want := "data: {\"model\":\"google/gemini-2.5-flash\"}\n\ndata: [DONE]\n\n"; rr.Body.String() != want {
+		t.Errorf("body = %q, want %q", rr.Body.String(), want)
+	}
+}
+
+func TestServeWithFallback_NoChain(t *testing.T) {
+	setCachedToken(t, "test-token")
+	useConfig(t, &proxyConfig{Fallbacks: map[string]*fallbackConfig{
+		"google/gemini-2.5-pro": {Models: []string{"google/gemini-2.5-flash"}},
+	}})
+	targetURL, calls := newModelUpstream(t, func(w http.ResponseWriter, model string) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+
+	req := httptest.NewRequest("POST", "http://localhost/v1/chat/completions", strings.NewReader(`{"model":"google/gemini-2.0-flash"}`))
+	rr := httptest.NewRecorder()
+	makeProxy(targetURL).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusTooManyRequests {
+		t.Errorf("status = %d, want 429", rr.Code)
+	}
+	if len(*calls) != 1 {
+		t.Errorf("upstream called with %v, want 1 call", *calls)
+	}
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// fileStore is the store configured by initFileStore. It is nil when the
+// /v1/files API is disabled.
+var fileStore *localFileStore
+
+// errFileNotFound is returned for unknown files and files of other keys.
+var errFileNotFound = errors.New("file not found")
+
+// fileObject is an OpenAI file object.
+type fileObject struct {
+	ID        string `json:"id"`
+	Object    string `json:"object"`
+	Bytes     int64  `json:"bytes"`
+	CreatedAt int64  `json:"created_at"`
+	Filename  string `json:"filename"`
+	Purpose   string `json:"purpose"`
+	Status    string `json:"status"`
+}
+
+// storedFile is the metadata of a file on disk.
+type storedFile struct {
+	fileObject
+	// Owner is the keyOwner SHA-256 hex of the client key that uploaded the
+	// file, not its name. Files are only visible to the same key.
+	Owner    string `json:"owner,omitempty"`
+	MimeType string `json:"mime_type"`
+}
+
+// localFileStore keeps uploaded files in a directory: the content in a file
+// named by the file ID, and the metadata next to it with a .json suffix.
+type localFileStore struct {
+	dir      string
+	maxBytes int64
+}
+
+// initFileStore enables the /v1/files API when FILES_DIR is set.
+func initFileStore() error {
+	dir := strings.TrimSpace(os.Getenv("FILES_DIR"))
+	if dir == "" {
+		return nil
+	}
+	maxMB, err := envInt("FILES_MAX_SIZE_MB", 100)
+	if err != nil {
+		return err
+	}
+	s, err := newLocalFileStore(dir, int64(maxMB)<<20)
+	if err != nil {
+		return err
+	}
+	fileStore = s
+	logger.Info("initFileStore: Files API enabled", "dir", dir, "max_size_mb", maxMB)
+	return nil
+}
+
+func newLocalFileStore(dir string, maxBytes int64) (*localFileStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("creating files directory: %w", err)
+	}
+	return &localFileStore{dir: dir, maxBytes: maxBytes}, nil
+}
+
+func newFileID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return "file-" + hex.EncodeToString(b)
+}
+
+// validFileID reports whether id can be a file of the store, so it can't
+// point outside the directory.
+func validFileID(id string) bool {
+	hexID, ok := strings.CutPrefix(id, "file-")
+	_, err := hex.DecodeString(hexID)
+	return ok && err == nil && hexID != ""
+}
+
+// create stores the content of r as a new file of owner.
+func (s *localFileStore) create(owner, filename, purpose, mimeType string, r io.Reader) (*storedFile, error) {
+	id := newFileID()
+	tmp, err := os.CreateTemp(s.dir, ".upload-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	n, err := io.Copy(tmp, io.LimitReader(r, s.maxBytes+1))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	if n > s.maxBytes {
+		return nil, fmt.Errorf("file is larger than %d bytes", s.maxBytes)
+	}
+	f := &storedFile{
+		fileObject: fileObject{
+			ID:        id,
+			Object:    "file",
+			Bytes:     n,
+			CreatedAt: time.Now().Unix(),
+			Filename:  filename,
+			Purpose:   purpose,
+			Status:    "processed",
+		},
+		Owner:    owner,
+		MimeType: mimeType,
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(s.dir, id)); err != nil {
+		return nil, err
+	}
+	if err := s.writeMetadata(f); err != nil {
+		os.Remove(filepath.Join(s.dir, id))
+		return nil, err
+	}
+	return f, nil
+}
+
+func (s *localFileStore) writeMetadata(f *storedFile) error {
+	meta, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(s.dir, f.ID+".json"), meta, 0o600)
+}
+
+// get returns the metadata of a file of owner.
+func (s *localFileStore) get(owner, id string) (*storedFile, error) {
+	if !validFileID(id) {
+		return nil, errFileNotFound
+	}
+	meta, err := os.ReadFile(filepath.Join(s.dir, id+".json"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, errFileNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var f storedFile
+	if err := json.Unmarshal(meta, &f); err != nil {
+		return nil, err
+	}
+	if f.Owner != owner {
+		return nil, errFileNotFound
+	}
+	return &f, nil
+}
+
+// open returns the metadata and content of a file of owner.
+func (s *localFileStore) open(owner, id string) (*storedFile, *os.File, error) {
+	f, err := s.get(owner, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	content, err := os.Open(filepath.Join(s.dir, id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, errFileNotFound
+	}
+	return f, content, err
+}
+
+// list returns the files of owner with the given purpose, or all of them
+// if purpose is empty, newest first.
+func (s *localFileStore) list(owner, purpose string) ([]*storedFile, error) {
+	matches, err := filepath.Glob(filepath.Join(s.dir, "file-*.json"))
+	if err != nil {
+		return nil, err
+	}
+	files := []*storedFile{}
+	for _, m := range matches {
+		f, err := s.get(owner, strings.TrimSuffix(filepath.Base(m), ".json"))
+		if err != nil {
+			continue
+		}
+		if purpose == "" || f.Purpose == purpose {
+			files = append(files, f)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].CreatedAt != files[j].CreatedAt {
+			return files[i].CreatedAt > files[j].CreatedAt
+		}
+		return files[i].ID < files[j].ID
+	})
+	return files, nil
+}
+
+// delete removes a file of owner.
+func (s *localFileStore) delete(owner, id string) error {
+	if _, err := s.get(owner, id); err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(s.dir, id+".json")); err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(s.dir, id)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// registerFileRoutes adds the /v1/files API of s to mux.
+func registerFileRoutes(mux *http.ServeMux, s *localFileStore) {
+	mux.HandleFunc("POST /v1/files", requireClientKey(s.handleUpload))
+	mux.HandleFunc("GET /v1/files", requireClientKey(s.handleList))
+	mux.HandleFunc("GET /v1/files/{id}", requireClientKey(s.handleRetrieve))
+	mux.HandleFunc("DELETE /v1/files/{id}", requireClientKey(s.handleDelete))
+	mux.HandleFunc("GET /v1/files/{id}/content", requireClientKey(s.handleContent))
+}
+
+// handleUpload stores the file of a multipart/form-data upload with the
+// file and purpose fields. The file is streamed to disk.
+func (s *localFileStore) handleUpload(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	r.Body = http.MaxBytesReader(w, r.Body, s.maxBytes+1<<20)
+	mr, err := r.MultipartReader()
+	if err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "invalid_request", "Expected a multipart/form-data upload: "+err.Error())
+		return
+	}
+	var f *storedFile
+	var purpose string
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "invalid_request", "Reading upload: "+err.Error())
+			return
+		}
+		switch part.FormName() {
+		case "purpose":
+			b, _ := io.ReadAll(io.LimitReader(part, 256))
+			purpose = strings.TrimSpace(string(b))
+		case "file":
+			if f != nil {
+				writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "invalid_request", "Only one file can be uploaded at a time")
+				return
+			}
+			head := make([]byte, 512)
+			n, _ := io.ReadFull(part, head)
+			head = head[:n]
+			name := filepath.Base(part.FileName())
+			mimeType := fileMimeType(name, part.Header.Get("Content-Type"), head)
+			f, err = s.create(clientOwner(r), name, "", mimeType, io.MultiReader(bytes.NewReader(head), part))
+			if err != nil {
+				logger.WarnContext(ctx, "handleUpload: Error storing file", "error", err)
+				writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "invalid_file", "Storing file: "+err.Error())
+				return
+			}
+		}
+	}
+	if f == nil {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "invalid_request", "Missing file")
+		return
+	}
+	if purpose == "" {
+		s.delete(f.Owner, f.ID)
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "invalid_request", "Missing purpose")
+		return
+	}
+	f.Purpose = purpose
+	if err := s.writeMetadata(f); err != nil {
+		s.delete(f.Owner, f.ID)
+		writeOpenAIError(w, http.StatusInternalServerError, "api_error", "internal_error", "Storing file: "+err.Error())
+		return
+	}
+	logger.InfoContext(ctx, "handleUpload: Stored file", "file_id", f.ID, "filename", f.Filename, "bytes", f.Bytes, "purpose", f.Purpose, "mime_type", f.MimeType)
+	writeJSON(w, f.fileObject)
+}
+
+func (s *localFileStore) handleList(w http.ResponseWriter, r *http.Request) {
+	files, err := s.list(clientOwner(r), r.URL.Query().Get("purpose"))
+	if err != nil {
+		writeOpenAIError(w, http.StatusInternalServerError, "api_error", "internal_error", err.Error())
+		return
+	}
+	data := make([]fileObject, len(files))
+	for i, f := range files {
+		data[i] = f.fileObject
+	}
+	writeJSON(w, map[string]any{"object": "list", "data": data, "has_more": false})
+}
+
+func (s *localFileStore) handleRetrieve(w http.ResponseWriter, r *http.Request) {
+	f, err := s.get(clientOwner(r), r.PathValue("id"))
+	if err != nil {
+		writeFileError(w, r.PathValue("id"), err)
+		return
+	}
+	writeJSON(w, f.fileObject)
+}
+
+func (s *localFileStore) handleDelete(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if err := s.delete(clientOwner(r), id); err != nil {
+		writeFileError(w, id, err)
+		return
+	}
+	logger.InfoContext(r.Context(), "handleDelete: Deleted file", "file_id", id)
+	writeJSON(w, map[string]any{"id": id, "object": "file", "deleted": true})
+}
+
+func (s *localFileStore) handleContent(w http.ResponseWriter, r *http.Request) {
+	f, content, err := s.open(clientOwner(r), r.PathValue("id"))
+	if err != nil {
+		writeFileError(w, r.PathValue("id"), err)
+		return
+	}
+	defer content.Close()
+	w.Header().Set("Content-Type", f.MimeType)
+	http.ServeContent(w, r, f.Filename, time.Unix(f.CreatedAt, 0), content)
+}
+
+func writeFileError(w http.ResponseWriter, id string, err error) {
+	if errors.Is(err, errFileNotFound) {
+		writeOpenAIError(w, http.StatusNotFound, "invalid_request_error", "file_not_found", "No such File object: "+id)
+		return
+	}
+	writeOpenAIError(w, http.StatusInternalServerError, "api_error", "internal_error", err.Error())
+}
+
+// writeJSON writes v as a 200 JSON response.
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// fileMimeType returns the MIME type of an uploaded file: by its extension,
+// else its Content-Type, else sniffed from its first bytes.
+func fileMimeType(filename, contentType string, head []byte) string {
+	if t := mime.TypeByExtension(strings.ToLower(filepath.Ext(filename))); t != "" {
+		return mediaType(t)
+	}
+	if t := mediaType(contentType); t != "" && t != "application/octet-stream" {
+		return t
+	}
+	return mediaType(http.DetectContentType(head))
+}
+
+// fileReference returns the file_id of a chat message content part that
+// references a stored file, or "".
+func fileReference(part map[string]any) string {
+	ref, _ := part["file"].(map[string]any)
+	id, _ := ref["file_id"].(string)
+	if part["type"] != "file" {
+		return ""
+	}
+	return id
+}
+
+// referencesFiles reports whether a chat completions request references
+// stored files.
+func referencesFiles(req map[string]any) bool {
+	messages, _ := req["messages"].([]any)
+	for _, m := range messages {
+		msg, _ := m.(map[string]any)
+		parts, _ := msg["content"].([]any)
+		for _, p := range parts {
+			part, _ := p.(map[string]any)
+			if fileReference(part) != "" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// expandFileReferences replaces the content parts of chat messages that
+// reference files of owner by file_id with the file content inline: audio
+// as input_audio parts, anything else, e.g. images and PDFs, as image_url
+// parts with a data URL, which Vertex AI accepts for any MIME type. It
+// returns the body unchanged when no files are referenced.
+func (s *localFileStore) expandFileReferences(ctx context.Context, owner string, body []byte) ([]byte, error) {
+	var req map[string]any
+	if json.Unmarshal(body, &req) != nil {
+		return body, nil
+	}
+	messages, _ := req["messages"].([]any)
+	expanded := 0
+	for _, m := range messages {
+		msg, _ := m.(map[string]any)
+		parts, _ := msg["content"].([]any)
+		for i, p := range parts {
+			part, _ := p.(map[string]any)
+			id := fileReference(part)
+			if id == "" {
+				continue
+			}
+			inline, err := s.inlinePart(owner, id)
+			if err != nil {
+				return nil, fmt.Errorf("file %s: %w", id, err)
+			}
+			parts[i] = inline
+			expanded++
+		}
+	}
+	if expanded == 0 {
+		return body, nil
+	}
+	logger.DebugContext(ctx, "expandFileReferences: Inlined referenced files", "files", expanded)
+	return json.Marshal(req)
+}
+
+func (s *localFileStore) inlinePart(owner, id string) (map[string]any, error) {
+	f, content, err := s.open(owner, id)
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return nil, err
+	}
+	encoded := base64.StdEncoding.EncodeToString(data)
+	if format, ok := strings.CutPrefix(f.MimeType, "audio/"); ok {
+		switch format {
+		case "mpeg", "mp3":
+			format = "mp3"
+		case "wav", "wave", "x-wav":
+			format = "wav"
+		}
+		return map[string]any{"type": "input_audio", "input_audio": map[string]any{"data": encoded, "format": format}}, nil
+	}
+	return map[string]any{"type": "image_url", "image_url": map[string]any{"url": "data:" + f.MimeType + ";base64," + encoded}}, nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func newTestFileStore(t *testing.T) (*localFileStore, *http.ServeMux) {
+	t.Helper()
+	s, err := newLocalFileStore(t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatalf("newLocalFileStore() error = %v", err)
+	}
+	mux := http.NewServeMux()
+	registerFileRoutes(mux, s)
+	return s, mux
+}
+
+// uploadFile uploads content with the given key and returns the response.
+func uploadFile(t *testing.T, mux http.Handler, key, filename, purpose string, content []byte) *httptest.ResponseRecorder {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, _ := mw.CreateFormFile("file", filename)
+	fw.Write(content)
+	if purpose != "" {
+		mw.WriteField("purpose", purpose)
+	}
+	mw.Close()
+	req := httptest.NewRequest("POST", "/v1/files", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	return rr
+}
+
+func fileRequest(mux http.Handler, method, path, key string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestFilesAPI(t *testing.T) {
+	_, mux := newTestFileStore(t)
+	pdf := []byte("%PDF-1.4 test document")
+
+	rr := uploadFile(t, mux, "key-a", "doc.pdf", "user_data", pdf)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("upload got %d %s, want 200", rr.Code, rr.Body.String())
+	}
+	var f fileObject
+	json.Unmarshal(rr.Body.Bytes(), &f)
+	if !strings.HasPrefix(f.ID, "file-") || f.Object != "file" || f.Bytes != int64(len(pdf)) ||
+		f.Filename != "doc.pdf" || f.Purpose != "user_data" || f.CreatedAt == 0 {
+		t.Errorf("upload got %+v", f)
+	}
+	if strings.Contains(rr.Body.String(), "owner") || strings.Contains(rr.Body.String(), "mime_type") {
+		t.Errorf("upload response %s exposes stored metadata", rr.Body.String())
+	}
+	uploadFile(t, mux, "key-a", "notes.txt", "assistants", []byte("notes"))
+	uploadFile(t, mux, "key-b", "other.txt", "user_data", []byte("other"))
+
+	rr = fileRequest(mux, "GET", "/v1/files", "key-a")
+	var list struct {
+		Object string       `json:"object"`
+		Data   []fileObject `json:"data"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &list)
+	if list.Object != "list" || len(list.Data) != 2 {
+		t.Errorf("list got %s, want the 2 files of key-a", rr.Body.String())
+	}
+	rr = fileRequest(mux, "GET", "/v1/files?purpose=user_data", "key-a")
+	json.Unmarshal(rr.Body.Bytes(), &list)
+	if len(list.Data) != 1 || list.Data[0].ID != f.ID {
+		t.Errorf("list by purpose got %s, want %s only", rr.Body.String(), f.ID)
+	}
+
+	rr = fileRequest(mux, "GET", "/v1/files/"+f.ID, "key-a")
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"filename":"doc.pdf"`) {
+		t.Errorf("retrieve got %d %s", rr.Code, rr.Body.String())
+	}
+	rr = fileRequest(mux, "GET", "/v1/files/"+f.ID+"/content", "key-a")
+	if rr.Code != http.StatusOK || !bytes.Equal(rr.Body.Bytes(), pdf) || rr.Header().Get("Content-Type") != "application/pdf" {
+		t.Errorf("content got %d %q %s", rr.Code, rr.Header().Get("Content-Type"), rr.Body.String())
+	}
+	if rr := fileRequest(mux, "GET", "/v1/files/"+f.ID, "key-b"); rr.Code != http.StatusNotFound {
+		t.Errorf("retrieve with another key got %d, want 404", rr.Code)
+	}
+
+	rr = fileRequest(mux, "DELETE", "/v1/files/"+f.ID, "key-a")
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"deleted":true`) {
+		t.Errorf("delete got %d %s", rr.Code, rr.Body.String())
+	}
+	if rr := fileRequest(mux, "GET", "/v1/files/"+f.ID+"/content", "key-a"); rr.Code != http.StatusNotFound {
+		t.Errorf("content after delete got %d, want 404", rr.Code)
+	}
+	if rr := fileRequest(mux, "DELETE", "/v1/files/"+f.ID, "key-a"); rr.Code != http.StatusNotFound {
+		t.Errorf("second delete got %d, want 404", rr.Code)
+	}
+}
+
+func TestFilesAPI_InvalidUploads(t *testing.T) {
+	s, mux := newTestFileStore(t)
+	if rr := uploadFile(t, mux, "key-a", "a.txt", "", []byte("x")); rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "Missing purpose") {
+		t.Errorf("upload without purpose got %d %s", rr.Code, rr.Body.String())
+	}
+	if rr := uploadFile(t, mux, "key-a", "big.bin", "user_data", make([]byte, 2<<20)); rr.Code != http.StatusBadRequest {
+		t.Errorf("oversized upload got %d %s, want 400", rr.Code, rr.Body.String())
+	}
+	if rr := uploadFile(t, mux, "", "a.txt", "user_data", []byte("x")); rr.Code != http.StatusUnauthorized {
+		t.Errorf("upload without a key got %d %s, want 401", rr.Code, rr.Body.String())
+	}
+	if rr := fileRequest(mux, "GET", "/v1/files/..%2Fsecret", "key-a"); rr.Code != http.StatusNotFound {
+		t.Errorf("retrieve of invalid id got %d, want 404", rr.Code)
+	}
+	if files, _ := s.list(keyOwner("key-a"), ""); len(files) != 0 {
+		t.Errorf("rejected uploads left %d files", len(files))
+	}
+}
+
+func TestFileMimeType(t *testing.T) {
+	tests := []struct {
+		filename, contentType string
+		head                  []byte
+		want                  string
+	}{
+		{"a.pdf", "application/octet-stream", nil, "application/pdf"},
+		{"a", "audio/mpeg", nil, "audio/mpeg"},
+		{"a", "application/octet-stream", []byte("\x89PNG\r\n\x1a\n"), "image/png"},
+		{"a.MP3", "", nil, "audio/mpeg"},
+	}
+	for _, tt := range tests {
+		if got := fileMimeType(tt.filename, tt.contentType, tt.head); got != tt.want {
+			t.Errorf("fileMimeType(%q, %q) = %q, want %q", tt.filename, tt.contentType, got, tt.want)
+		}
+	}
+}
+
+func TestExpandFileReferences(t *testing.T) {
+	s, _ := newTestFileStore(t)
+	pdf, _ := s.create("key-a", "doc.pdf", "user_data", "application/pdf", strings.NewReader("%PDF"))
+	wav, _ := s.create("key-a", "a.wav", "user_data", "audio/wav", strings.NewReader("RIFF"))
+
+	body := `{"model":"m","messages":[{"role":"user","content":[` +
+		`{"type":"text","text":"summarise"},` +
+		`{"type":"file","file":{"file_id":"` + pdf.ID + `"}},` +
+		`{"type":"file","file":{"file_id":"` + wav.ID + `"}}]}]}`
+	got, err := s.expandFileReferences(context.Background(), "key-a", []byte(body))
+	if err != nil {
+		t.Fatalf("expandFileReferences() error = %v", err)
+	}
+	var req struct {
+		Messages []struct {
+			Content []map[string]any `json:"content"`
+		} `json:"messages"`
+	}
+	json.Unmarshal(got, &req)
+	parts := req.Messages[0].Content
+	image, _ := parts[1]["image_url"].(map[string]any)
+	if parts[1]["type"] != "image_url" || image["url"] != "data:application/pdf;base64,"+base64.StdEncoding.EncodeToString([]byte("%PDF")) {
+		t.Errorf("pdf part = %v", parts[1])
+	}
+	audio, _ := parts[2]["input_audio"].(map[string]any)
+	if parts[2]["type"] != "input_audio" || audio["format"] != "wav" || audio["data"] != base64.StdEncoding.EncodeToString([]byte("RIFF")) {
+		t.Errorf("audio part = %v", parts[2])
+	}
+
+	if _, err := s.expandFileReferences(context.Background(), "key-b", []byte(body)); err == nil {
+		t.Error("expandFileReferences() of another key's file succeeded, want error")
+	}
+	plain := `{"model":"m","messages":[{"role":"user","content":"hi"}]}`
+	if got, _ := s.expandFileReferences(context.Background(), "key-a", []byte(plain)); string(got) != plain {
+		t.Errorf("expandFileReferences() changed a request without files: %s", got)
+	}
+}
+
+func TestProxy_FileReferences(t *testing.T) {
+	setCachedToken(t, "test-token")
+	s, _ := newTestFileStore(t)
+	original := fileStore
+	t.Cleanup(func() { fileStore = original })
+	fileStore = s
+	png, _ := s.create("", "cat.png", "vision", "image/png", strings.NewReader("png"))
+
+	var upstreamBody []byte
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamBody, _ = io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{}`))
+	}))
+	t.Cleanup(upstream.Close)
+	target, _ := url.Parse(upstream.URL)
+	proxy := makeProxy(target)
+
+	rr := httptest.NewRecorder()
+	proxy.ServeHTTP(rr, httptest.NewRequest("POST", "http://localhost/v1/chat/completions", strings.NewReader(
+		`{"model":"m","messages":[{"role":"user","content":[{"type":"file","file":{"file_id":"`+png.ID+`"}}]}]}`)))
+	if rr.Code != http.StatusOK || !strings.Contains(string(upstreamBody), "data:image/png;base64,") {
+		t.Errorf("got %d, upstream body %s, want the image inlined", rr.Code, upstreamBody)
+	}
+
+	upstreamBody = nil
+	rr = httptest.NewRecorder()
+	proxy.ServeHTTP(rr, httptest.NewRequest("POST", "http://localhost/v1/chat/completions", strings.NewReader(
+		`{"model":"m","messages":[{"role":"user","content":[{"type":"file","file":{"file_id":"file-00"}}]}]}`)))
+	if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), `"code":"invalid_file"`) {
+		t.Errorf("got %d %s, want 400 invalid_file", rr.Code, rr.Body.String())
+	}
+	if upstreamBody != nil {
+		t.Errorf("upstream called with %s, want no call", upstreamBody)
+	}
+}
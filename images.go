@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"golang.org/x/sync/errgroup"
+)
+
+// imageFetchConcurrency is the number of images of a request fetched at
+// once.
+const imageFetchConcurrency = 4
+
+// nonPublicPrefixes are the address ranges outside the ones netip
+// classifies as private, loopback or link-local that images are never
+// fetched from.
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+}
+
+// imageFetcher is the fetcher configured by initImageFetch. It is nil when
+// remote images are passed through unchanged.
+var imageFetcher *remoteImageFetcher
+
+// remoteImageFetcher downloads the images chat messages reference by URL
+// and inlines them as data URLs, for images Vertex AI can't fetch itself.
+type remoteImageFetcher struct {
+	// allowedHosts are host names, "*.domain" patterns, or "*" for any host.
+	allowedHosts []string
+	maxBytes     int64
+	ttl          time.Duration
+	client       *http.Client
+	cache        cacheStore
+}
+
+// initImageFetch configures image fetching from the IMAGE_FETCH_*
+// environment variables. It stays disabled unless IMAGE_FETCH_ALLOWED_HOSTS
+// is set.
+func initImageFetch() error {
+	hosts := splitList(os.Getenv("IMAGE_FETCH_ALLOWED_HOSTS"))
+	if len(hosts) == 0 {
+		return nil
+	}
+	maxMB, err := envInt("IMAGE_FETCH_MAX_SIZE_MB", 10)
+	if err != nil {
+		return err
+	}
+	timeout, err := envDuration("IMAGE_FETCH_TIMEOUT", 10*time.Second)
+	if err != nil {
+		return err
+	}
+	ttl, err := envDuration("IMAGE_FETCH_CACHE_TTL", 5*time.Minute)
+	if err != nil {
+		return err
+	}
+	cacheMB, err := envInt("IMAGE_FETCH_CACHE_SIZE_MB", 64)
+	if err != nil {
+		return err
+	}
+	imageFetcher = newRemoteImageFetcher(hosts, int64(maxMB)<<20, timeout, ttl, int64(cacheMB)<<20)
+	logger.Info("initImageFetch: Remote image fetching enabled", "allowed_hosts", hosts, "max_size_mb", maxMB, "timeout", timeout, "cache_ttl", ttl)
+	return nil
+}
+
+func newRemoteImageFetcher(hosts []string, maxBytes int64, timeout, ttl time.Duration, cacheBytes int64) *remoteImageFetcher {
+	f := &remoteImageFetcher{
+		allowedHosts: hosts,
+		maxBytes:     maxBytes,
+		ttl:          ttl,
+		cache:        newMemoryCacheStore(cacheBytes),
+	}
+	// Connections are checked after DNS resolution, so allowed host names
+	// can't resolve to internal addresses. The environment proxy is not used,
+	// since it would resolve the names instead.
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = (&net.Dialer{Timeout: timeout, Control: publicAddressControl}).DialContext
+	f.client = &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 5 {
+				return errors.New("too many redirects")
+			}
+			if !f.allowed(req.URL) {
+				return fmt.Errorf("redirect to %s is not allowed", req.URL.Host)
+			}
+			return nil
+		},
+	}
+	return f
+}
+
+// allowed reports whether images may be fetched from u: https URLs of the
+// allowed hosts only.
+func (f *remoteImageFetcher) allowed(u *url.URL) bool {
+	if u.Scheme != "https" {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, pattern := range f.allowedHosts {
+		pattern = strings.ToLower(pattern)
+		switch {
+		case pattern == "*", pattern == host:
+			return true
+		case strings.HasPrefix(pattern, "*.") && strings.HasSuffix(host, pattern[1:]):
+			return true
+		}
+	}
+	return false
+}
+
+// publicAddressControl is a net.Dialer Control function refusing
+// connections to private, loopback, link-local (e.g. the 169.254.169.254
+// metadata server) and other non-public addresses.
+func publicAddressControl(network, address string, _ syscall.RawConn) error {
+	ap, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if !publicAddress(ap.Addr()) {
+		return fmt.Errorf("address %s is not allowed", ap.Addr())
+	}
+	return nil
+}
+
+func publicAddress(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() || addr.IsLoopback() || addr.IsLinkLocalUnicast() {
+		return false
+	}
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// inline replaces the URLs of the image_url parts of a chat completions
+// request that point to allowed hosts by data URLs of the downloaded
+// images, fetched concurrently. Other URLs are left for the upstream. It
+// returns the body unchanged when there is nothing to fetch.
+func (f *remoteImageFetcher) inline(ctx context.Context, body []byte) ([]byte, error) {
+	var req map[string]any
+	if json.Unmarshal(body, &req) != nil {
+		return body, nil
+	}
+	messages, _ := req["messages"].([]any)
+	var images []map[string]any
+	for _, m := range messages {
+		msg, _ := m.(map[string]any)
+		parts, _ := msg["content"].([]any)
+		for _, p := range parts {
+			part, _ := p.(map[string]any)
+			image, _ := part["image_url"].(map[string]any)
+			raw, _ := image["url"].(string)
+			u, err := url.Parse(raw)
+			if part["type"] != "image_url" || err != nil || !f.allowed(u) {
+				continue
+			}
+			images = append(images, image)
+		}
+	}
+	if len(images) == 0 {
+		return body, nil
+	}
+	// Each URL is fetched once, however often the request repeats it.
+	dataURLs := map[string]string{}
+	var urls []string
+	for _, image := range images {
+		if raw := image["url"].(string); !slices.Contains(urls, raw) {
+			urls = append(urls, raw)
+		}
+	}
+	var mu sync.Mutex
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(imageFetchConcurrency)
+	for _, raw := range urls {
+		g.Go(func() error {
+			dataURL, err := f.fetch(gctx, raw)
+			if err != nil {
+				return fmt.Errorf("fetching image %s: %w", raw, err)
+			}
+			mu.Lock()
+			dataURLs[raw] = dataURL
+			mu.Unlock()
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	for _, image := range images {
+		image["url"] = dataURLs[image["url"].(string)]
+	}
+	out, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// fetch returns the image at rawURL as a data URL, from the cache if it was
+// fetched recently.
+func (f *remoteImageFetcher) fetch(ctx context.Context, rawURL string) (string, error) {
+	if cached, ok := f.cache.Get(rawURL); ok && time.Now().Before(cached.Expires) {
+		return string(cached.Body), nil
+	}
+	ctx, span := tracer.Start(ctx, "proxy.fetch_image")
+	defer span.End()
+	dataURL, err := f.download(ctx, rawURL)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		logger.WarnContext(ctx, "remoteImageFetcher: Error fetching image", "url", rawURL, "error", err)
+		return "", err
+	}
+	span.SetAttributes(attribute.Int("proxy.image_data_url_bytes", len(dataURL)))
+	now := time.Now()
+	f.cache.Set(rawURL, &cachedResponse{Body: []byte(dataURL), Created: now, Expires: now.Add(f.ttl)})
+	return dataURL, nil
+}
+
+func (f *remoteImageFetcher) download(ctx context.Context, rawURL string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "image/*")
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("server returned %s", resp.Status)
+	}
+	if resp.ContentLength > f.maxBytes {
+		return "", fmt.Errorf("image is larger than %d bytes", f.maxBytes)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, f.maxBytes+1))
+	if err != nil {
+		return "", err
+	}
+	if int64(len(data)) > f.maxBytes {
+		return "", fmt.Errorf("image is larger than %d bytes", f.maxBytes)
+	}
+	// Trust the content over the Content-Type header, but fall back to the
+	// header for formats the sniffer doesn't know, e.g. HEIC.
+	mimeType := mediaType(http.DetectContentType(data))
+	if mimeType == "application/octet-stream" {
+		mimeType = mediaType(resp.Header.Get("Content-Type"))
+	}
+	if !strings.HasPrefix(mimeType, "image/") {
+		return "", fmt.Errorf("content is not an image (%s)", mimeType)
+	}
+	logger.DebugContext(ctx, "remoteImageFetcher: Fetched image", "url", rawURL, "type", mimeType, "bytes", len(data))
+	return "data:" + mimeType + ";base64," + base64.StdEncoding.EncodeToString(data), nil
+}
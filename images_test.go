@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newImageServer serves a PNG at /cat.png, HTML at /page and redirects
+// /elsewhere to another host.
+func newImageServer(t *testing.T) (*httptest.Server, []byte, *atomic.Int32) {
+	t.Helper()
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewGray(image.Rect(0, 0, 1, 1)))
+	img := buf.Bytes()
+	var fetches atomic.Int32
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		switch r.URL.Path {
+		case "/cat.png":
+			// The sniffed type wins over a wrong header.
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write(img)
+		case "/page":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte("<html><body>not an image</body></html>"))
+		case "/elsewhere":
+			http.Redirect(w, r, "https://example.invalid/cat.png", http.StatusFound)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, img, &fetches
+}
+
+func testImageFetcher(server *httptest.Server, maxBytes int64) *remoteImageFetcher {
+	f := newRemoteImageFetcher([]string{"127.0.0.1"}, maxBytes, time.Second, time.Minute, 1<<20)
+	f.client.Transport = server.Client().Transport
+	return f
+}
+
+func TestRemoteImageFetcher_Inline(t *testing.T) {
+	server, img, fetches := newImageServer(t)
+	f := testImageFetcher(server, 1<<20)
+
+	body := `{"model":"m","messages":[{"role":"user","content":[` +
+		`{"type":"text","text":"what is it?"},` +
+		`{"type":"image_url","image_url":{"url":"` + server.URL + `/cat.png"}},` +
+		`{"type":"image_url","image_url":{"url":"` + server.URL + `/cat.png","detail":"low"}},` +
+		`{"type":"image_url","image_url":{"url":"https://other.example.com/dog.png"}},` +
+		`{"type":"image_url","image_url":{"url":"gs://bucket/cow.png"}}]}]}`
+	got, err := f.inline(context.Background(), []byte(body))
+	if err != nil {
+		t.Fatalf("inline() error = %v", err)
+	}
+	dataURL := "data:image/png;base64," + base64.StdEncoding.EncodeToString(img)
+	if n := strings.Count(string(got), dataURL); n != 2 {
+		t.Errorf("inline() = %s, want 2 inlined images", got)
+	}
+	for _, kept := range []string{"https://other.example.com/dog.png", "gs://bucket/cow.png", `"detail":"low"`} {
+		if !strings.Contains(string(got), kept) {
+			t.Errorf("inline() = %s, want %s kept", got, kept)
+		}
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("image fetched %d times, want 1 (cached)", n)
+	}
+
+	plain := `{"model":"m","messages":[{"role":"user","content":"hi"}]}`
+	if got, _ := f.inline(context.Background(), []byte(plain)); string(got) != plain {
+		t.Errorf("inline() changed a request without images: %s", got)
+	}
+}
+
+func TestRemoteImageFetcher_Errors(t *testing.T) {
+	server, _, _ := newImageServer(t)
+	tests := []struct {
+		path     string
+		maxBytes int64
+		wantErr  string
+	}{
+		{"/page", 1 << 20, "not an image (text/html)"},
+		{"/missing", 1 << 20, "404 Not Found"},
+		{"/elsewhere", 1 << 20, "redirect to example.invalid is not allowed"},
+		{"/cat.png", 10, "larger than 10 bytes"},
+	}
+	for _, tt := range tests {
+		f := testImageFetcher(server, tt.maxBytes)
+		body := `{"messages":[{"role":"user","content":[{"type":"image_url","image_url":{"url":"` + server.URL + tt.path + `"}}]}]}`
+		if _, err := f.inline(context.Background(), []byte(body)); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("inline(%s) error = %v, want %q", tt.path, err, tt.wantErr)
+		}
+	}
+}
+
+func TestRemoteImageFetcher_Allowed(t *testing.T) {
+	f := newRemoteImageFetcher([]string{"images.example.com", "*.cdn.example.org"}, 1, time.Second, time.Second, 1)
+	tests := map[string]bool{
+		"https://images.example.com/a.png":       true,
+		"https://IMAGES.example.com/a.png":       true,
+		"http://images.example.com/a.png":        false,
+		"https://evil.example.com/a.png":         false,
+		"https://a.cdn.example.org/a.png":        true,
+		"https://cdn.example.org.evil.com/a.png": false,
+	}
+	for raw, want := range tests {
+		u, _ := url.Parse(raw)
+		if got := f.allowed(u); got != want {
+			t.Errorf("allowed(%s) = %v, want %v", raw, got, want)
+		}
+	}
+}
+
+func TestPublicAddress(t *testing.T) {
+	tests := map[string]bool{
+		"8.8.8.8":                true,
+		"2001:4860::8888":        true,
+		"127.0.0.1":              false,
+		"::1":                    false,
+		"10.1.2.3":               false,
+		"172.16.0.1":             false,
+		"192.168.1.1":            false,
+		"169.254.169.254":        false,
+		"fe80::1":                false,
+		"fd00:ec2::254":          false,
+		"100.64.0.1":             false,
+		"0.0.0.0":                false,
+		"::ffff:169.254.169.254": false,
+	}
+	for addr, want := range tests {
+		if got := publicAddress(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("publicAddress(%s) = %v, want %v", addr, got, want)
+		}
+	}
+}
+
+func TestRemoteImageFetcher_RefusesInternalAddresses(t *testing.T) {
+	server, _, fetches := newImageServer(t)
+	f := newRemoteImageFetcher([]string{"*"}, 1<<20, time.Second, time.Minute, 1<<20)
+	_, err := f.fetch(context.Background(), server.URL+"/cat.png")
+	if err == nil || !strings.Contains(err.Error(), "is not allowed") {
+		t.Errorf("fetch() error = %v, want address not allowed", err)
+	}
+	if n := fetches.Load(); n != 0 {
+		t.Errorf("image fetched %d times, want 0", n)
+	}
+}
+
+func TestProxy_InvalidImageURL(t *testing.T) {
+	setCachedToken(t, "test-token")
+	server, _, _ := newImageServer(t)
+	original := imageFetcher
+	t.Cleanup(func() { imageFetcher = original })
+	imageFetcher = testImageFetcher(server, 1<<20)
+	upstream, calls := newRecordingUpstream(t)
+	target, _ := url.Parse(upstream.URL)
+	proxy := makeProxy(target)
+
+	rr := httptest.NewRecorder()
+	proxy.ServeHTTP(rr, httptest.NewRequest("POST", "http://localhost/v1/chat/completions", strings.NewReader(
+		`{"model":"m","messages":[{"role":"user","content":[{"type":"image_url","image_url":{"url":"`+server.URL+`/page"}}]}]}`)))
+	if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), `"code":"invalid_image_url"`) {
+		t.Errorf("got %d %s, want 400 invalid_image_url", rr.Code, rr.Body.String())
+	}
+	if len(*calls) != 0 {
+		t.Errorf("upstream called %d times, want 0", len(*calls))
+	}
+}
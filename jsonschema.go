@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxSchemaValidationDepth bounds $ref resolution while validating, so
+// recursive schemas can't loop forever on malformed references.
+const maxSchemaValidationDepth = 64
+
+// validateJSONSchema checks a decoded JSON value against a JSON schema. It
+// supports the keywords structured outputs use in practice: type, nullable,
+// enum, const, properties, required, additionalProperties, items, the
+// length, size and range limits, pattern, anyOf, oneOf, allOf and $refs
+// within the schema. Unknown keywords are ignored.
+func validateJSONSchema(schema map[string]any, value any) error {
+	v := &schemaValidator{root: schema}
+	return v.validate(schema, value, "$", 0)
+}
+
+type schemaValidator struct {
+	root map[string]any
+}
+
+func (v *schemaValidator) validate(s any, value any, path string, depth int) error {
+	if b, ok := s.(bool); ok {
+		if !b {
+			return fmt.Errorf("%s: no value is allowed here", path)
+		}
+		return nil
+	}
+	schema, ok := s.(map[string]any)
+	if !ok {
+		return nil
+	}
+	if ref, ok := schema["$ref"].(string); ok {
+		if depth >= maxSchemaValidationDepth {
+			return fmt.Errorf("%s: $ref %s nested too deeply", path, ref)
+		}
+		resolved, err := v.resolve(ref)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if err := v.validate(resolved, value, path, depth+1); err != nil {
+			return err
+		}
+	}
+	if nullable, _ := schema["nullable"].(bool); nullable && value == nil {
+		return nil
+	}
+
+	if t, ok := schema["type"]; ok && !matchesSchemaType(t, value) {
+		return fmt.Errorf("%s: expected %v, got %s", path, t, jsonTypeName(value))
+	}
+	if enum, ok := schema["enum"].([]any); ok {
+		found := false
+		for _, e := range enum {
+			if reflect.DeepEqual(e, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: value must be one of %v", path, enum)
+		}
+	}
+	if c, ok := schema["const"]; ok && !reflect.DeepEqual(c, value) {
+		return fmt.Errorf("%s: value must be %v", path, c)
+	}
+
+	switch val := value.(type) {
+	case map[string]any:
+		if err := v.validateObject(schema, val, path, depth); err != nil {
+			return err
+		}
+	case []any:
+		if n, ok := schema["minItems"].(float64); ok && float64(len(val)) < n {
+			return fmt.Errorf("%s: expected at least %v items, got %d", path, n, len(val))
+		}
+		if n, ok := schema["maxItems"].(float64); ok && float64(len(val)) > n {
+			return fmt.Errorf("%s: expected at most %v items, got %d", path, n, len(val))
+		}
+		if items, ok := schema["items"]; ok {
+			for i, item := range val {
+				if err := v.validate(items, item, fmt.Sprintf("%s[%d]", path, i), depth); err != nil {
+					return err
+				}
+			}
+		}
+	case string:
+		n := float64(utf8.RuneCountInString(val))
+		if limit, ok := schema["minLength"].(float64); ok && n < limit {
+			return fmt.Errorf("%s: expected at least %v characters", path, limit)
+		}
+		if limit, ok := schema["maxLength"].(float64); ok && n > limit {
+			return fmt.Errorf("%s: expected at most %v characters", path, limit)
+		}
+		if pattern, ok := schema["pattern"].(string); ok {
+			if re, err := regexp.Compile(pattern); err == nil && !re.MatchString(val) {
+				return fmt.Errorf("%s: %q doesn't match pattern %s", path, val, pattern)
+			}
+		}
+	case float64:
+		if limit, ok := schema["minimum"].(float64); ok && val < limit {
+			return fmt.Errorf("%s: %v is less than the minimum %v", path, val, limit)
+		}
+		if limit, ok := schema["maximum"].(float64); ok && val > limit {
+			return fmt.Errorf("%s: %v is greater than the maximum %v", path, val, limit)
+		}
+		if limit, ok := schema["exclusiveMinimum"].(float64); ok && val <= limit {
+			return fmt.Errorf("%s: %v must be greater than %v", path, val, limit)
+		}
+		if limit, ok := schema["exclusiveMaximum"].(float64); ok && val >= limit {
+			return fmt.Errorf("%s: %v must be less than %v", path, val, limit)
+		}
+	}
+
+	if all, ok := schema["allOf"].([]any); ok {
+		for _, sub := range all {
+			if err := v.validate(sub, value, path, depth); err != nil {
+				return err
+			}
+		}
+	}
+	if anyOf, ok := schema["anyOf"].([]any); ok {
+		var errs []string
+		for _, sub := range anyOf {
+			err := v.validate(sub, value, path, depth)
+			if err == nil {
+				errs = nil
+				break
+			}
+			errs = append(errs, err.Error())
+		}
+		if len(errs) > 0 {
+			return fmt.Errorf("%s: value matches none of anyOf: %s", path, strings.Join(errs, "; "))
+		}
+	}
+	if oneOf, ok := schema["oneOf"].([]any); ok {
+		matched := 0
+		for _, sub := range oneOf {
+			if v.validate(sub, value, path, depth) == nil {
+				matched++
+			}
+		}
+		if matched != 1 {
+			return fmt.Errorf("%s: value matches %d of oneOf, expected exactly 1", path, matched)
+		}
+	}
+	return nil
+}
+
+func (v *schemaValidator) validateObject(schema, obj map[string]any, path string, depth int) error {
+	if required, ok := schema["required"].([]any); ok {
+		for _, r := range required {
+			name, _ := r.(string)
+			if _, ok := obj[name]; !ok {
+				return fmt.Errorf("%s: missing required property %q", path, name)
+			}
+		}
+	}
+	props, _ := schema["properties"].(map[string]any)
+	for name, value := range obj {
+		if prop, ok := props[name]; ok {
+			if err := v.validate(prop, value, path+"."+name, depth); err != nil {
+				return err
+			}
+			continue
+		}
+		if additional, ok := schema["additionalProperties"]; ok {
+			if b, isBool := additional.(bool); isBool && !b {
+				return fmt.Errorf("%s: unexpected property %q", path, name)
+			}
+			if err := v.validate(additional, value, path+"."+name, depth); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// resolve returns the part of the root schema a local $ref points to.
+func (v *schemaValidator) resolve(ref string) (any, error) {
+	pointer, ok := strings.CutPrefix(ref, "#")
+	if !ok {
+		return nil, fmt.Errorf("unsupported $ref %s", ref)
+	}
+	var node any = v.root
+	for _, token := range strings.Split(strings.TrimPrefix(pointer, "/"), "/") {
+		if token == "" {
+			continue
+		}
+		token = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+		m, ok := node.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("unresolvable $ref %s", ref)
+		}
+		if node, ok = m[token]; !ok {
+			return nil, fmt.Errorf("unresolvable $ref %s", ref)
+		}
+	}
+	return node, nil
+}
+
+// matchesSchemaType reports whether value has the JSON Schema type t, a
+// type name or a list of them.
+func matchesSchemaType(t any, value any) bool {
+	if types, ok := t.([]any); ok {
+		for _, t := range types {
+			if matchesSchemaType(t, value) {
+				return true
+			}
+		}
+		return false
+	}
+	name, _ := t.(string)
+	if name == "integer" {
+		f, ok := value.(float64)
+		return ok && f == math.Trunc(f)
+	}
+	return name == jsonTypeName(value)
+}
+
+// jsonTypeName returns the JSON Schema type name of a decoded JSON value.
+func jsonTypeName(value any) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
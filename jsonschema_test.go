@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestValidateJSONSchema(t *testing.T) {
+	schema := `{
+	  "$defs": {"Tag": {"type": "string", "enum": ["a", "b"]}},
+	  "type": "object",
+	  "additionalProperties": false,
+	  "required": ["name", "age"],
+	  "properties": {
+	    "name": {"type": "string", "minLength": 1, "pattern": "^[A-Z]"},
+	    "age": {"type": "integer", "minimum": 0},
+	    "nickname": {"anyOf": [{"type": "string"}, {"type": "null"}]},
+	    "tags": {"type": "array", "items": {"$ref": "#/$defs/Tag"}, "maxItems": 2},
+	    "kind": {"const": "person"}
+	  }
+	}`
+	var s map[string]any
+	if err := json.Unmarshal([]byte(schema), &s); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		value   string
+		wantErr string
+	}{
+		{`{"name":"Ann","age":3,"nickname":null,"tags":["a"],"kind":"person"}`, ""},
+		{`{"name":"Ann","age":3,"nickname":"A"}`, ""},
+		{`{"name":"Ann"}`, `missing required property "age"`},
+		{`{"name":"Ann","age":3.5}`, "$.age: expected integer, got number"},
+		{`{"name":"Ann","age":-1}`, "less than the minimum"},
+		{`{"name":"ann","age":1}`, "doesn't match pattern"},
+		{`{"name":"Ann","age":1,"extra":true}`, `unexpected property "extra"`},
+		{`{"name":"Ann","age":1,"tags":["c"]}`, "$.tags[0]: value must be one of"},
+		{`{"name":"Ann","age":1,"tags":["a","b","a"]}`, "at most 2 items"},
+		{`{"name":"Ann","age":1,"nickname":1}`, "matches none of anyOf"},
+		{`{"name":"Ann","age":1,"kind":"robot"}`, "value must be person"},
+		{`[]`, "expected object, got array"},
+	}
+	for _, tt := range tests {
+		var value any
+		if err := json.Unmarshal([]byte(tt.value), &value); err != nil {
+			t.Fatal(err)
+		}
+		err := validateJSONSchema(s, value)
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("validateJSONSchema(%s) error = %v", tt.value, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("validateJSONSchema(%s) error = %v, want %q", tt.value, err, tt.wantErr)
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"compress/gzip"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -14,10 +15,11 @@ import (
 	"os"
 	"log/slog"
 	"strings"
-	"sync"
 	"time"
 
-	"golang.org/x/oauth2/google"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 )
 
 var logger *slog.Logger
@@ -74,6 +76,14 @@ func initSlogLogger() {
 		}
 	}
 
+	// Attach trace/span IDs from the request context to every record logged
+	// with a *Context method. In JSON mode use the Cloud Logging field names.
+	handler = &traceLogHandler{
+		Handler:      handler,
+		cloudLogging: logFormatStr == "json",
+		projectID:    os.Getenv("VERTEXAI_PROJECT"),
+	}
+
 	logger = slog.New(handler)
 
 	// Redirect standard log package to slog
@@ -83,8 +93,18 @@ func initSlogLogger() {
 	log.SetFlags(0) // Disable standard log prefixes as slog handles formatting
 }
 
-// googleFindDefaultCredentialsWrapper wraps google.FindDefaultCredentials to allow mocking in tests.
-var googleFindDefaultCredentials = google.FindDefaultCredentials
+// maxLoggedBodyBytes bounds the request and response bodies logged at debug
+// level.
+const maxLoggedBodyBytes = 4096
+
+// loggedBody returns body for a debug log record, truncated to
+// maxLoggedBodyBytes.
+func loggedBody(body []byte) string {
+	if len(body) <= maxLoggedBodyBytes {
+		return string(body)
+	}
+	return fmt.Sprintf("%s... (%d bytes)", body[:maxLoggedBodyBytes], len(body))
+}
 
 var (
 	projectID string
@@ -93,6 +113,11 @@ var (
 	// It's a variable to allow overriding for testing.
 	// Example: "%s-aiplatform.googleapis.com" where %s is the location.
 	vertexAIAPIHostFormat = "%s-aiplatform.googleapis.com"
+	// vertexAIGlobalHost is the host of the global Vertex AI endpoint.
+	vertexAIGlobalHost = "aiplatform.googleapis.com"
+	// vertexAIScheme is the URL scheme used for Vertex AI. It's a variable to
+	// allow pointing the proxy at a plain HTTP server in tests.
+	vertexAIScheme = "https"
 )
 
 // Model structure for /v1/models response (OpenAI compatible)
@@ -109,77 +134,183 @@ type ModelList struct {
 	Data   []Model `json:"data"`
 }
 
-var (
-	token      string
-	tokenMutex sync.RWMutex
-	expiry     time.Time
-)
-
-func getToken(ctx context.Context) (string, error) {
-	tokenMutex.RLock()
-	if time.Now().Before(expiry.Add(-time.Minute)) { // cached token still valid
-		logger.Debug("getToken: Using cached token.")
-		defer tokenMutex.RUnlock()
-		return token, nil
-	}
-	tokenMutex.RUnlock()
-
-	tokenMutex.Lock()
-	defer tokenMutex.Unlock()
-	logger.Info("getToken: Cache expired or empty, fetching new token.")
+// vertexAIBaseURL returns the OpenAI-compatible endpoint URL of Vertex AI
+// for project and location.
+func vertexAIBaseURL(project, location string) string {
+	return vertexAIEndpointURL(project, location, "openapi")
+}
 
-	// Use the wrapper variable so it can be mocked in tests
-	creds, err := googleFindDefaultCredentials(ctx, "https://www.googleapis.com/auth/cloud-platform")
-	if err != nil {
-		logger.Error("getToken: Error finding default credentials", "error", err)
-		return "", err
-	}
-	tok, err := creds.TokenSource.Token()
-	if err != nil {
-		logger.Error("getToken: Error getting token from source", "error", err)
-		return "", err
+// vertexAIEndpointURL returns the URL of a Vertex AI endpoint: "openapi" for
+// the shared OpenAI-compatible endpoint, or the ID of a deployed endpoint.
+func vertexAIEndpointURL(project, location, endpoint string) string {
+	if location == "global" {
+		// Use the global endpoint format
+		return fmt.Sprintf(
+			"%s://%s/v1/projects/%s/locations/global/endpoints/%s",
+			vertexAIScheme, vertexAIGlobalHost, project, endpoint,
+		)
 	}
-	token = tok.AccessToken
-	expiry = tok.Expiry
-	logger.Info("getToken: Successfully fetched new token.")
-	return token, nil
+	// Construct the target URL for regional endpoints
+	proxyHost := fmt.Sprintf(vertexAIAPIHostFormat, location)
+	return fmt.Sprintf(
+		"%s://%s/v1/projects/%s/locations/%s/endpoints/%s",
+		vertexAIScheme, proxyHost, project, location, endpoint,
+	)
 }
 
-func makeProxy(target *url.URL) *httputil.ReverseProxy {
-	return &httputil.ReverseProxy{
+// makeProxy returns the handler proxying /v1/ requests to Vertex AI. Requests
+// go to defaultTarget unless the client key or the X-Vertex-Target header
+// routes them to a target from the config file.
+func makeProxy(defaultTarget *url.URL) http.Handler {
+	proxy := &httputil.ReverseProxy{
+		Transport: &abortTransport{next: upstreamTransport(http.DefaultTransport)},
 		Director: func(req *http.Request) {
+			ctx := req.Context()
 			// Log basic request info. Avoid logging full headers here to prevent excessive log volume.
 			// Specific headers like Authorization are logged when set.
-			logger.Debug("makeProxy Director: Processing request", "method", req.Method, "path", req.URL.Path, "remote_addr", req.RemoteAddr)
+			logger.DebugContext(ctx, "makeProxy Director: Processing request", "method", req.Method, "path", req.URL.Path, "remote_addr", req.RemoteAddr)
+
+			pr := proxyRequestFrom(ctx)
+			upstream := pr.target
+			target := upstream.url
+			req.Header.Del(targetHeader)
+			thinkingBudget := req.Header.Get(thinkingBudgetHeader)
+			req.Header.Del(thinkingBudgetHeader)
+			logger.DebugContext(ctx, "makeProxy Director: Routing to target", "target", upstream.name, "credentials", upstream.credentials)
 
 			req.URL.Scheme = target.Scheme
 			req.URL.Host = target.Host
 			req.Host = target.Host
 
 			originalPath := req.URL.Path // e.g., /v1/models, /v1/chat/completions
-			logger.Debug("makeProxy Director: Original path for proxying", "path", originalPath)
+			logger.DebugContext(ctx, "makeProxy Director: Original path for proxying", "path", originalPath)
 
-			// For specific paths like /v1/chat/completions, we might need to inspect/modify the body.
-			// Currently, no body modifications are performed by default.
-			// If body processing is needed for certain paths, it can be added here.
+			// Chat completions bodies are rewritten for the upstream, in order:
+			// deployed endpoints, file references, remote images, partner
+			// models, thinking, parameters, schemas and context caches.
 			if originalPath == "/v1/chat/completions" {
 				if req.Body != nil && req.Body != http.NoBody {
+					_, span := tracer.Start(ctx, "proxy.transform_body")
 					bodyBytes, readErr := io.ReadAll(req.Body)
 					// After ReadAll, the original req.Body is consumed. We must always replace it.
 					// req.Body.Close() is typically handled by ReadAll on success or by the server processing the request.
 
 					if readErr != nil {
-						logger.Error("makeProxy Director: Error reading request body", "path", originalPath, "error", readErr)
+						logger.ErrorContext(ctx, "makeProxy Director: Error reading request body", "path", originalPath, "error", readErr)
+						span.SetStatus(codes.Error, readErr.Error())
 						// bodyBytes will contain what was read before the error.
 						// Replace req.Body with what was read. ContentLength might be inaccurate if read was partial.
 						req.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
 						req.ContentLength = int64(len(bodyBytes))
 					} else {
-						// Body read successfully. Log the body before passing it through.
-						logger.Debug("makeProxy Director: Outgoing request body", "path", originalPath, "body", string(bodyBytes))
+						if ep, body, err := endpointTarget(bodyBytes, upstream); err != nil {
+							logger.WarnContext(ctx, "makeProxy Director: Error routing to deployed endpoint", "error", err)
+							pr.abort(&proxyError{
+								status:  http.StatusBadRequest,
+								errType: "invalid_request_error",
+								code:    "invalid_request",
+								message: err.Error(),
+							})
+						} else if ep != nil {
+							logger.DebugContext(ctx, "makeProxy Director: Routing to deployed endpoint", "target", ep.name, "url", ep.url.String())
+							bodyBytes = body
+							pr.target, upstream, target = ep, ep, ep.url
+							req.URL.Scheme = target.Scheme
+							req.URL.Host = target.Host
+							req.Host = target.Host
+						}
+						if fileStore != nil && pr.err == nil {
+							if expanded, err := fileStore.expandFileReferences(ctx, clientOwner(req), bodyBytes); err != nil {
+								logger.WarnContext(ctx, "makeProxy Director: Error expanding file reference", "error", err)
+								pr.abort(&proxyError{
+									status:  http.StatusBadRequest,
+									errType: "invalid_request_error",
+									code:    "invalid_file",
+									message: err.Error(),
+								})
+							} else {
+								bodyBytes = expanded
+							}
+						}
+						if imageFetcher != nil && pr.err == nil {
+							if inlined, err := imageFetcher.inline(ctx, bodyBytes); err != nil {
+								logger.WarnContext(ctx, "makeProxy Director: Error inlining remote image", "error", err)
+								pr.abort(&proxyError{
+									status:  http.StatusBadRequest,
+									errType: "invalid_request_error",
+									code:    "invalid_image_url",
+									message: err.Error(),
+								})
+							} else {
+								bodyBytes = inlined
+							}
+						}
+						if route, err := newPartnerRoute(bodyBytes); err != nil {
+							logger.WarnContext(ctx, "makeProxy Director: Rejected partner model request", "error", err)
+							pr.abort(&proxyError{
+								status:  http.StatusBadRequest,
+								errType: "invalid_request_error",
+								code:    "invalid_model",
+								message: err.Error(),
+							})
+						} else if route != nil {
+							translated, err := route.translateRequest(bodyBytes)
+							if err != nil {
+								logger.WarnContext(ctx, "makeProxy Director: Error translating partner model request", "model", route.requestedModel, "error", err)
+								pr.abort(&proxyError{
+									status:  http.StatusBadRequest,
+									errType: "invalid_request_error",
+									code:    "unsupported_request",
+									message: fmt.Sprintf("Request can't be sent to %s: %v", route.requestedModel, err),
+								})
+							} else {
+								bodyBytes = translated
+								pr.partner = route
+								// Let the transport decompress responses, they are rewritten.
+								req.Header.Del("Accept-Encoding")
+							}
+						}
+						if pr.partner == nil && pr.err == nil && strings.HasSuffix(upstream.url.Path, "/endpoints/openapi") {
+							if thinking, reasoning, err := applyThinking(thinkingBudget, bodyBytes); err != nil {
+								logger.WarnContext(ctx, "makeProxy Director: Invalid thinking configuration", "error", err)
+								pr.abort(&proxyError{
+									status:  http.StatusBadRequest,
+									errType: "invalid_request_error",
+									code:    "invalid_request",
+									message: err.Error(),
+								})
+							} else if adapted, err := adaptParameters(ctx, thinking); err != nil {
+								logger.WarnContext(ctx, "makeProxy Director: Rejecting unsupported request parameter", "error", err)
+								pr.abort(&proxyError{
+									status:  http.StatusBadRequest,
+									errType: "invalid_request_error",
+									code:    "unsupported_parameter",
+									message: err.Error(),
+								})
+							} else {
+								bodyBytes = sanitizeSchemas(ctx, adapted)
+								if reasoning {
+									pr.reasoning = true
+									// Let the transport decompress responses, thoughts are moved to reasoning_content.
+									req.Header.Del("Accept-Encoding")
+								}
+							}
+						}
+						if contextCaches != nil && pr.partner == nil && pr.err == nil {
+							bodyBytes, pr.cachedTokens = contextCaches.apply(ctx, upstream, bodyBytes)
+							if pr.cachedTokens > 0 {
+								// Let the transport decompress responses, their usage is rewritten.
+								req.Header.Del("Accept-Encoding")
+							}
+						}
+						if logger.Enabled(ctx, slog.LevelDebug) {
+							logger.DebugContext(ctx, "makeProxy Director: Outgoing request body", "path", originalPath, "body", loggedBody(bodyBytes))
+						}
 						req.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
 						req.ContentLength = int64(len(bodyBytes))
 					}
+					span.SetAttributes(attribute.Int("proxy.request_body_bytes", len(bodyBytes)))
+					span.End()
 				}
 			}
 
@@ -191,10 +322,10 @@ func makeProxy(target *url.URL) *httputil.ReverseProxy {
 			if strings.HasPrefix(originalPath, "/v1/") {
 				suffixPath := strings.TrimPrefix(originalPath, "/v1")
 				req.URL.Path = target.Path + suffixPath
-				logger.Debug("makeProxy Director: Rewriting path", "original_path", originalPath, "suffix_path", suffixPath, "new_target_path", req.URL.Path)
+				logger.DebugContext(ctx, "makeProxy Director: Rewriting path", "original_path", originalPath, "suffix_path", suffixPath, "new_target_path", req.URL.Path)
 			} else {
 				// Should not happen if router is configured for /v1/
-				logger.Warn("makeProxy Director: Path does not start with /v1/", "path", originalPath)
+				logger.WarnContext(ctx, "makeProxy Director: Path does not start with /v1/", "path", originalPath)
 				// This will effectively make req.URL.Path = target.Path + originalPath
 				// For example, if target.Path is /foo and originalPath is /bar, it becomes /foo/bar.
 				// If originalPath is just "bar", it becomes /foobar (if target.Path ends with /) or /foo/bar (if target.Path does not end with /)
@@ -203,30 +334,46 @@ func makeProxy(target *url.URL) *httputil.ReverseProxy {
 				// This behavior is kept for robustness but ideally all requests to this proxy handler start with /v1/.
 				req.URL.Path = target.Path + originalPath
 			}
+			if pr.partner != nil {
+				req.URL.Path = pr.partner.path(target)
+				logger.DebugContext(ctx, "makeProxy Director: Routing to partner model", "publisher", pr.partner.publisher, "model", pr.partner.model, "path", req.URL.Path)
+			}
 
-			logger.Debug("makeProxy Director: Final target URL for upstream", "url", req.URL.String())
+			logger.DebugContext(ctx, "makeProxy Director: Final target URL for upstream", "url", req.URL.String())
 
-			if tok, err := getToken(req.Context()); err == nil {
+			authCtx, authSpan := tracer.Start(ctx, "proxy.auth")
+			if tok, err := getTokenFor(authCtx, upstream.credentials); err == nil {
 				req.Header.Set("Authorization", "Bearer "+tok)
-				logger.Debug("makeProxy Director: Authorization header set", "path", req.URL.Path)
+				logger.DebugContext(ctx, "makeProxy Director: Authorization header set", "path", req.URL.Path)
 			} else {
-				logger.Error("Error getting token for request", "path", originalPath, "error", err)
+				// Never forward the request without credentials: abort it with a 503.
+				logger.ErrorContext(ctx, "Error getting token for request", "path", originalPath, "error", err)
+				authSpan.SetStatus(codes.Error, err.Error())
+				req.Header.Del("Authorization")
+				pr.abort(&proxyError{
+					status:  http.StatusServiceUnavailable,
+					errType: "api_error",
+					code:    "credentials_unavailable",
+					message: fmt.Sprintf("No valid Google Cloud access token is available: %v", err),
+				})
 			}
+			authSpan.End()
 		},
 		ModifyResponse: func(resp *http.Response) error {
-			logger.Debug("makeProxy ModifyResponse: Received response from upstream", "host", resp.Request.URL.Host, "method", resp.Request.Method, "path", resp.Request.URL.Path, "status", resp.Status)
+			ctx := resp.Request.Context()
+			logger.DebugContext(ctx, "makeProxy ModifyResponse: Received response from upstream", "host", resp.Request.URL.Host, "method", resp.Request.Method, "path", resp.Request.URL.Path, "status", resp.Status)
 			var upstreamHeaders strings.Builder
 			for k, v := range resp.Header {
 				upstreamHeaders.WriteString(fmt.Sprintf("\n  %s: %s", k, strings.Join(v, ", ")))
 			}
 			if upstreamHeaders.Len() > 0 {
-				logger.Debug("makeProxy ModifyResponse: Upstream response headers", "headers", upstreamHeaders.String())
+				logger.DebugContext(ctx, "makeProxy ModifyResponse: Upstream response headers", "headers", upstreamHeaders.String())
 			}
 
 			if resp.StatusCode >= 400 {
 				bodyBytes, err := io.ReadAll(resp.Body)
 				if err != nil {
-					logger.Error("makeProxy ModifyResponse: Error reading error response body from upstream", "error", err)
+					logger.ErrorContext(ctx, "makeProxy ModifyResponse: Error reading error response body from upstream", "error", err)
 					// Body is already consumed or errored, replace with empty to avoid client issues.
 					resp.Body = io.NopCloser(bytes.NewBuffer(nil))
 				} else {
@@ -238,36 +385,102 @@ func makeProxy(target *url.URL) *httputil.ReverseProxy {
 					if resp.Header.Get("Content-Encoding") == "gzip" {
 						gzipReader, err := gzip.NewReader(bytes.NewReader(bodyBytes))
 						if err != nil {
-							logger.Error("makeProxy ModifyResponse: Error creating gzip reader for error response body", "error", err, "detail", "Logging raw body.")
-							logger.Debug("makeProxy ModifyResponse: Upstream error response body (raw gzipped)", "body", string(bodyBytes))
+							logger.ErrorContext(ctx, "makeProxy ModifyResponse: Error creating gzip reader for error response body", "error", err, "detail", "Logging raw body.")
+							logger.DebugContext(ctx, "makeProxy ModifyResponse: Upstream error response body (raw gzipped)", "body", loggedBody(bodyBytes))
 						} else {
 							decompressedBodyBytes, err := io.ReadAll(gzipReader)
 							if err != nil {
-								logger.Error("makeProxy ModifyResponse: Error decompressing gzip error response body", "error", err, "detail", "Logging raw body.")
-								logger.Debug("makeProxy ModifyResponse: Upstream error response body (raw gzipped)", "body", string(bodyBytes))
+								logger.ErrorContext(ctx, "makeProxy ModifyResponse: Error decompressing gzip error response body", "error", err, "detail", "Logging raw body.")
+								logger.DebugContext(ctx, "makeProxy ModifyResponse: Upstream error response body (raw gzipped)", "body", loggedBody(bodyBytes))
 							} else {
-								logger.Debug("makeProxy ModifyResponse: Upstream error response body (decompressed)", "body", string(decompressedBodyBytes))
+								logger.DebugContext(ctx, "makeProxy ModifyResponse: Upstream error response body (decompressed)", "body", loggedBody(decompressedBodyBytes))
 							}
 							gzipReader.Close()
 						}
 					} else {
-						logger.Debug("makeProxy ModifyResponse: Upstream error response body", "body", string(bodyBytes))
+						logger.DebugContext(ctx, "makeProxy ModifyResponse: Upstream error response body", "body", loggedBody(bodyBytes))
 					}
 				}
 			}
+
+			if n := proxyRequestFrom(ctx).cachedTokens; n > 0 {
+				if err := transformResponse(resp, func(data []byte) []byte { return reportCachedTokens(data, n) }); err != nil {
+					logger.ErrorContext(ctx, "makeProxy ModifyResponse: Error reporting cached tokens", "error", err)
+					return err
+				}
+			}
+			if proxyRequestFrom(ctx).reasoning {
+				rw := newReasoningRewriter()
+				if err := transformResponse(resp, rw.rewrite); err != nil {
+					logger.ErrorContext(ctx, "makeProxy ModifyResponse: Error surfacing reasoning content", "error", err)
+					return err
+				}
+			}
+			if partner := proxyRequestFrom(ctx).partner; partner != nil {
+				if err := partner.translateResponse(resp); err != nil {
+					logger.ErrorContext(ctx, "makeProxy ModifyResponse: Error translating partner model response", "model", partner.requestedModel, "error", err)
+					return err
+				}
+			}
 			return nil
 		},
 		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			var perr *proxyError
+			if errors.As(err, &perr) {
+				logger.WarnContext(r.Context(), "makeProxy: Request aborted", "status", perr.status, "code", perr.code, "error", perr.message)
+				writeOpenAIError(w, perr.status, perr.errType, perr.code, perr.message)
+				return
+			}
 			// r.URL here is the *target* URL.
-			logger.Error("HTTP proxy error", "method", r.Method, "target_url", r.URL.String(), "error", err)
+			logger.ErrorContext(r.Context(), "HTTP proxy error", "method", r.Method, "target_url", r.URL.String(), "error", err)
 			w.WriteHeader(http.StatusBadGateway)
 			io.WriteString(w, fmt.Sprintf("Proxy error connecting to upstream service: %v", err))
 		},
 	}
+
+	// forward sends a request to upstream through the reverse proxy.
+	forward := func(upstream *upstreamTarget) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			pr := &proxyRequest{target: upstream}
+			proxy.ServeHTTP(w, r.WithContext(withProxyRequest(r.Context(), pr)))
+		}
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream, err := resolveTarget(r, defaultTarget)
+		if err != nil {
+			logger.WarnContext(r.Context(), "makeProxy: Error resolving upstream target", "error", err)
+			writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "invalid_target", err.Error())
+			return
+		}
+		if r.URL.Path == "/v1/tokenize" {
+			handleTokenize(w, r, upstream)
+			return
+		}
+		serveWithPrompts(w, r, func(w http.ResponseWriter, r *http.Request) {
+			serveWithSplit(w, r, func(w http.ResponseWriter, r *http.Request) {
+				serveWithTrimming(w, r, upstream, func(w http.ResponseWriter, r *http.Request) {
+					serveWithContextCheck(w, r, upstream, func(w http.ResponseWriter, r *http.Request) {
+						serveWithCache(w, r, upstream, func(w http.ResponseWriter, r *http.Request) {
+							serveWithCoalescing(w, r, upstream, func(w http.ResponseWriter, r *http.Request) {
+								serveWithShadow(w, r, upstream, forward, func(w http.ResponseWriter, r *http.Request) {
+									serveWithChoices(w, r, func(w http.ResponseWriter, r *http.Request) {
+										serveWithValidation(w, r, func(w http.ResponseWriter, r *http.Request) {
+											serveWithFallback(w, r, forward(upstream))
+										})
+									})
+								})
+							})
+						})
+					})
+				})
+			})
+		})
+	})
 }
 
 func handleModels(w http.ResponseWriter, r *http.Request) {
-	logger.Debug("handleModels: Received request", "method", r.Method, "path", r.URL.Path, "remote_addr", r.RemoteAddr)
+	logger.DebugContext(r.Context(), "handleModels: Received request", "method", r.Method, "path", r.URL.Path, "remote_addr", r.RemoteAddr)
 
 	defaultModelIDs := []string{
 		"google/gemini-2.5-pro-preview-03-25",
@@ -288,22 +501,39 @@ func handleModels(w http.ResponseWriter, r *http.Request) {
 
 		if len(customModelIDsFiltered) > 0 {
 			modelIDs = customModelIDsFiltered
-			logger.Info("handleModels: Using custom models from VERTEXAI_AVAILABLE_MODELS", "models", modelIDs)
+			logger.InfoContext(r.Context(), "handleModels: Using custom models from VERTEXAI_AVAILABLE_MODELS", "models", modelIDs)
 		} else {
-			logger.Warn("handleModels: VERTEXAI_AVAILABLE_MODELS set but empty", "env_var_value", availableModelsStr, "using_default_models", modelIDs)
+			logger.WarnContext(r.Context(), "handleModels: VERTEXAI_AVAILABLE_MODELS set but empty", "env_var_value", availableModelsStr, "using_default_models", modelIDs)
 		}
 	} else {
-		logger.Info("handleModels: VERTEXAI_AVAILABLE_MODELS not set or empty", "using_default_models", modelIDs)
+		logger.InfoContext(r.Context(), "handleModels: VERTEXAI_AVAILABLE_MODELS not set or empty", "using_default_models", modelIDs)
 	}
 
+	// Partner models, e.g. Claude, are listed along with the Gemini models.
+	partnerModelIDs := splitList(os.Getenv("VERTEXAI_PARTNER_MODELS"))
+	modelIDs = append(modelIDs[:len(modelIDs):len(modelIDs)], partnerModelIDs...)
+	// So are the models of endpoints deployed by the user.
+	endpointModels := endpointModelIDs()
+	modelIDs = append(modelIDs, endpointModels...)
+
 	currentTime := time.Now().Unix()
 	responseModels := make([]Model, len(modelIDs))
 	for i, id := range modelIDs {
+		ownedBy := "google" // Assuming all models specified this way are "ownedBy: google"
+		if publisher := partnerPublisher(id); publisher != "" {
+			ownedBy = publisher
+		}
+		if ep, ok := config.Endpoints[id]; ok {
+			ownedBy = ep.Project
+			if ownedBy == "" {
+				ownedBy = projectID
+			}
+		}
 		responseModels[i] = Model{
 			ID:      id,
 			Object:  "model",
 			Created: currentTime,
-			OwnedBy: "google", // Assuming all models specified this way are "ownedBy: google"
+			OwnedBy: ownedBy,
 		}
 	}
 
@@ -314,17 +544,100 @@ func handleModels(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(response); err != nil {
-		logger.Error("Error encoding models list response", "error", err)
+		logger.ErrorContext(r.Context(), "Error encoding models list response", "error", err)
 		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
 		return
 	}
-	logger.Info("handleModels: Successfully sent models list", "count", len(responseModels))
+	logger.InfoContext(r.Context(), "handleModels: Successfully sent models list", "count", len(responseModels))
 }
 
 func main() {
 	initSlogLogger() // Initialize logger first
 
 	logger.Info("Starting proxy server...")
+
+	if err := initAuditLog(); err != nil {
+		log.Fatalf("main: Error initializing audit log: %v", err)
+	}
+
+	if configPath := os.Getenv("PROXY_CONFIG"); configPath != "" {
+		cfg, err := loadConfig(configPath)
+		if err != nil {
+			log.Fatalf("main: Error loading config: %v", err)
+		}
+		config = cfg
+		logger.Info("main: Loaded config file", "path", configPath)
+	}
+	if err := initCredentials(config); err != nil {
+		log.Fatalf("main: Error initializing credentials: %v", err)
+	}
+	if err := initShadowLog(); err != nil {
+		log.Fatalf("main: Error initializing shadow log: %v", err)
+	}
+	if err := initResponseCache(); err != nil {
+		log.Fatalf("main: Error initializing response cache: %v", err)
+	}
+	if err := initContextCache(); err != nil {
+		log.Fatalf("main: Error initializing context cache: %v", err)
+	}
+	if err := initCoalescing(); err != nil {
+		log.Fatalf("main: Error initializing request coalescing: %v", err)
+	}
+	if err := initPartnerPrefixes(); err != nil {
+		log.Fatalf("main: Error initializing partner models: %v", err)
+	}
+	if err := initChoices(); err != nil {
+		log.Fatalf("main: Error initializing choices: %v", err)
+	}
+	if err := initParameters(); err != nil {
+		log.Fatalf("main: Error initializing parameter adaptation: %v", err)
+	}
+	if err := initSchemaSanitizing(); err != nil {
+		log.Fatalf("main: Error initializing schema sanitizing: %v", err)
+	}
+	if err := initValidation(); err != nil {
+		log.Fatalf("main: Error initializing structured output validation: %v", err)
+	}
+	if err := initThinking(); err != nil {
+		log.Fatalf("main: Error initializing thinking: %v", err)
+	}
+	if err := initImageFetch(); err != nil {
+		log.Fatalf("main: Error initializing image fetching: %v", err)
+	}
+	if err := initFileStore(); err != nil {
+		log.Fatalf("main: Error initializing files API: %v", err)
+	}
+	if err := initTokenCounting(); err != nil {
+		log.Fatalf("main: Error initializing token counting: %v", err)
+	}
+	if err := initTrimming(); err != nil {
+		log.Fatalf("main: Error initializing context trimming: %v", err)
+	}
+
+	shutdownTracing, err := initTracing(context.Background())
+	if err != nil {
+		log.Fatalf("main: Error initializing tracing: %v", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			logger.Error("main: Error flushing spans", "error", err)
+		}
+	}()
+
+	shutdownMetrics, err := initMetrics(context.Background())
+	if err != nil {
+		log.Fatalf("main: Error initializing metrics: %v", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownMetrics(ctx); err != nil {
+			logger.Error("main: Error flushing metrics", "error", err)
+		}
+	}()
+
 	location = os.Getenv("VERTEXAI_LOCATION")
 	projectID = os.Getenv("VERTEXAI_PROJECT")
 
@@ -334,30 +647,23 @@ func main() {
 		log.Fatal("VERTEXAI_LOCATION and VERTEXAI_PROJECT env vars must be set")
 	}
 
-	var baseURL string
-	if location == "global" {
-		// Use the global endpoint format
-		baseURL = fmt.Sprintf(
-			"https://aiplatform.googleapis.com/v1/projects/%s/locations/global/endpoints/openapi",
-			projectID,
-		)
-	} else {
-		// Construct the target URL for regional endpoints
-		proxyHost := fmt.Sprintf(vertexAIAPIHostFormat, location)
-		baseURL = fmt.Sprintf(
-			"https://%s/v1/projects/%s/locations/%s/endpoints/openapi",
-			proxyHost, projectID, location,
-		)
-	}
-
+	baseURL := vertexAIBaseURL(projectID, location)
 	target, err := url.Parse(baseURL)
 	if err != nil {
 		log.Fatalf("main: Error parsing target baseURL '%s': %v", baseURL, err)
 	}
 	logger.Info("main: Proxy target URL configured", "url", target.String())
 
+	proxy := makeProxy(target)
 	http.HandleFunc("/v1/models", handleModels)
-	http.Handle("/v1/", makeProxy(target))
+	if fileStore != nil {
+		registerFileRoutes(http.DefaultServeMux, fileStore)
+		if err := initBatches(proxy); err != nil {
+			log.Fatalf("main: Error initializing batches: %v", err)
+		}
+		registerBatchRoutes(http.DefaultServeMux, batches)
+	}
+	http.Handle("/v1/", proxy)
 
 	// Get port from environment variable, default to 8080
 	port := os.Getenv("PORT")
@@ -367,7 +673,14 @@ func main() {
 	addr := ":" + port
 
 	logger.Info("proxy listening", "address", addr)
-	if err := http.ListenAndServe(addr, nil); err != nil {
+	// The otelhttp handler creates the server span for each request and
+	// continues the trace from an incoming traceparent header.
+	handler := otelhttp.NewHandler(auditMiddleware(http.DefaultServeMux), "proxy",
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			return r.Method + " " + r.URL.Path
+		}),
+	)
+	if err := http.ListenAndServe(addr, handler); err != nil {
 		log.Fatalf("main: ListenAndServe failed: %v", err)
 	}
 }
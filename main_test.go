@@ -1,8 +1,10 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -47,10 +49,10 @@ func (m *MockTokenSource) Token() (*oauth2.Token, error) {
 }
 
 func TestGetToken_Cached(t *testing.T) {
-	tokenMutex.Lock()
-	token = "cached_token"
-	expiry = time.Now().Add(time.Hour)
-	tokenMutex.Unlock()
+	adcTokenProvider.mu.Lock()
+	adcTokenProvider.token = "cached_token"
+	adcTokenProvider.expiry = time.Now().Add(time.Hour)
+	adcTokenProvider.mu.Unlock()
 
 	ctx := context.Background()
 	gotToken, err := getToken(ctx)
@@ -64,10 +66,10 @@ func TestGetToken_Cached(t *testing.T) {
 
 func TestGetToken_NewFetch(t *testing.T) {
 	// Reset global token state for this test
-	tokenMutex.Lock()
-	token = ""
-	expiry = time.Time{}
-	tokenMutex.Unlock()
+	adcTokenProvider.mu.Lock()
+	adcTokenProvider.token = ""
+	adcTokenProvider.expiry = time.Time{}
+	adcTokenProvider.mu.Unlock()
 
 	// Store original FindDefaultCredentials and defer its restoration
 	originalFindDefaultCredentials := googleFindDefaultCredentials
@@ -92,23 +94,33 @@ func TestGetToken_NewFetch(t *testing.T) {
 		t.Errorf("getToken() gotToken = %v, want %v", gotToken, "new_token")
 	}
 
-	tokenMutex.RLock()
-	if token != "new_token" {
-		t.Errorf("global token not set correctly, got %s, want %s", token, "new_token")
+	adcTokenProvider.mu.RLock()
+	if adcTokenProvider.token != "new_token" {
+		t.Errorf("global token not set correctly, got %s, want %s", adcTokenProvider.token, "new_token")
 	}
-	if expiry.IsZero() {
+	if adcTokenProvider.expiry.IsZero() {
 		t.Error("global expiry not set")
 	}
-	tokenMutex.RUnlock()
+	adcTokenProvider.mu.RUnlock()
+}
+
+func TestLoggedBody(t *testing.T) {
+	if got := loggedBody([]byte(`{"a":1}`)); got != `{"a":1}` {
+		t.Errorf("loggedBody() = %q, want the body unchanged", got)
+	}
+	long := bytes.Repeat([]byte("x"), maxLoggedBodyBytes+10)
+	if got, want := loggedBody(long), string(long[:maxLoggedBodyBytes])+fmt.Sprintf("... (%d bytes)", len(long)); got != want {
+		t.Errorf("loggedBody() of %d bytes = %d bytes, want %d", len(long), len(got), len(want))
+	}
 }
 
 func TestMakeProxy(t *testing.T) {
 	// Set up environment variables for the test
 	// Reset global token state for this test to ensure it fetches a new token
-	tokenMutex.Lock()
-	token = ""
-	expiry = time.Time{}
-	tokenMutex.Unlock()
+	adcTokenProvider.mu.Lock()
+	adcTokenProvider.token = ""
+	adcTokenProvider.expiry = time.Time{}
+	adcTokenProvider.mu.Unlock()
 
 	os.Setenv("VERTEXAI_LOCATION", "us-central1")
 	os.Setenv("VERTEXAI_PROJECT", "test-project")
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+)
+
+// proxyMetrics holds the instruments the proxy records to.
+type proxyMetrics struct {
+	splitRequests     metric.Int64Counter
+	splitDuration     metric.Float64Histogram
+	splitTokens       metric.Int64Counter
+	cacheRequests     metric.Int64Counter
+	coalescedRequests metric.Int64Counter
+}
+
+// metrics is resolved through the global provider, so measurements taken
+// before initMetrics completes are simply dropped.
+var metrics = newProxyMetrics(otel.Meter(instrumentationName))
+
+func newProxyMetrics(meter metric.Meter) *proxyMetrics {
+	m := &proxyMetrics{}
+	// Instrument creation only fails for invalid names, which are constants here.
+	m.splitRequests, _ = meter.Int64Counter("proxy.split.requests",
+		metric.WithDescription("Requests for traffic split aliases by variant and status code."))
+	m.splitDuration, _ = meter.Float64Histogram("proxy.split.duration",
+		metric.WithDescription("Latency of requests for traffic split aliases by variant."),
+		metric.WithUnit("s"))
+	m.splitTokens, _ = meter.Int64Counter("proxy.split.tokens",
+		metric.WithDescription("Tokens used by requests for traffic split aliases by variant and token type."))
+	m.cacheRequests, _ = meter.Int64Counter("proxy.cache.requests",
+		metric.WithDescription("Cacheable requests by cache result: hit, miss or bypass."))
+	m.coalescedRequests, _ = meter.Int64Counter("proxy.coalesce.saved_requests",
+		metric.WithDescription("Requests served from an identical in-flight request instead of a separate upstream call."))
+	return m
+}
+
+// initMetrics configures an OTLP/HTTP metric exporter when a collector is
+// configured via the standard OTEL_EXPORTER_OTLP_* environment variables.
+// The returned function flushes pending measurements.
+func initMetrics(ctx context.Context) (func(context.Context) error, error) {
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_METRICS_ENDPOINT") == "" {
+		logger.Info("initMetrics: OTLP endpoint not configured, metric export disabled")
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlpmetrichttp.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("creating OTLP metric exporter: %w", err)
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		attribute.String("service.name", serviceName()),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("creating metric resource: %w", err)
+	}
+
+	provider := sdkmetric.NewMeterProvider(
+		sdkmetric.WithReader(sdkmetric.NewPeriodicReader(exporter)),
+		sdkmetric.WithResource(res),
+	)
+	otel.SetMeterProvider(provider)
+	logger.Info("initMetrics: OTLP metric export enabled")
+	return provider.Shutdown, nil
+}
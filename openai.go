@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+)
+
+// openAIError is the body of an OpenAI API error response.
+type openAIError struct {
+	Error openAIErrorDetail `json:"error"`
+}
+
+type openAIErrorDetail struct {
+	Message string  `json:"message"`
+	Type    string  `json:"type"`
+	Param   *string `json:"param"`
+	Code    string  `json:"code,omitempty"`
+}
+
+// writeOpenAIError writes an error response in the format OpenAI clients expect.
+func writeOpenAIError(w http.ResponseWriter, status int, errType, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(openAIError{Error: openAIErrorDetail{
+		Message: message,
+		Type:    errType,
+		Code:    code,
+	}})
+}
+
+// sseTransformReader rewrites the data of each event of an SSE stream as it
+// is read. The [DONE] sentinel and non-data lines are passed through.
+type sseTransformReader struct {
+	src       io.ReadCloser
+	lines     *bufio.Reader
+	transform func(data []byte) []byte
+	buf       bytes.Buffer
+	err       error
+}
+
+func newSSETransformReader(src io.ReadCloser, transform func(data []byte) []byte) *sseTransformReader {
+	return &sseTransformReader{src: src, lines: bufio.NewReader(src), transform: transform}
+}
+
+func (s *sseTransformReader) Read(p []byte) (int, error) {
+	for s.buf.Len() == 0 && s.err == nil {
+		var line []byte
+		line, s.err = s.lines.ReadBytes('\n')
+		data, ok := bytes.CutPrefix(line, []byte("data:"))
+		trimmed := bytes.TrimSpace(data)
+		if !ok || len(trimmed) == 0 || string(trimmed) == "[DONE]" {
+			s.buf.Write(line)
+			continue
+		}
+		s.buf.WriteString("data: ")
+		s.buf.Write(s.transform(trimmed))
+		s.buf.WriteByte('\n')
+	}
+	if s.buf.Len() > 0 {
+		return s.buf.Read(p)
+	}
+	return 0, s.err
+}
+
+func (s *sseTransformReader) Close() error {
+	return s.src.Close()
+}
+
+// transformResponse rewrites the chat completion, or each chunk of a
+// streamed one, of a successful upstream response with transform.
+func transformResponse(resp *http.Response, transform func(data []byte) []byte) error {
+	if resp.StatusCode >= 300 {
+		return nil
+	}
+	if mediaType(resp.Header.Get("Content-Type")) == "text/event-stream" {
+		resp.Body = newSSETransformReader(resp.Body, transform)
+		resp.Header.Del("Content-Length")
+		resp.ContentLength = -1
+		return nil
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	setResponseBody(resp, transform(body))
+	return nil
+}
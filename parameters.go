@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Actions for chat completions request fields a model doesn't support.
+const (
+	// parameterKeep sends the field unchanged.
+	parameterKeep = "keep"
+	// parameterDrop removes the field, or rejects the request in strict mode.
+	parameterDrop = "drop"
+	// parameterReject rejects requests with the field.
+	parameterReject = "reject"
+	// parameterTranslate replaces the field by its upstream equivalent.
+	parameterTranslate = "translate"
+	// parameterRenamePrefix followed by a field name moves the value to that
+	// field, unless the request already sets it.
+	parameterRenamePrefix = "rename:"
+)
+
+// defaultParameterActions are the actions for OpenAI-only fields that the
+// OpenAI-compatible endpoint of Vertex AI rejects with INVALID_ARGUMENT.
+var defaultParameterActions = map[string]string{
+	"logit_bias":            parameterDrop,
+	"user":                  parameterDrop,
+	"service_tier":          parameterDrop,
+	"parallel_tool_calls":   parameterDrop,
+	"store":                 parameterDrop,
+	"metadata":              parameterDrop,
+	"prediction":            parameterDrop,
+	"max_completion_tokens": parameterRenamePrefix + "max_tokens",
+	"reasoning_effort":      parameterTranslate,
+}
+
+// parameterTranslations translate fields to their upstream equivalent in
+// a request.
+var parameterTranslations = map[string]func(req map[string]any, value any) error{
+	"reasoning_effort": translateReasoningEffort,
+}
+
+// thinkingBudgets maps reasoning_effort values to Gemini thinking budgets.
+var thinkingBudgets = map[string]int{
+	"none":    0,
+	"minimal": 128,
+	"low":     1024,
+	"medium":  8192,
+	"high":    24576,
+}
+
+// validateParameterActions checks the parameters entry of a model.
+func validateParameterActions(actions map[string]string) error {
+	for field, action := range actions {
+		switch {
+		case action == parameterKeep, action == parameterDrop, action == parameterReject:
+		case action == parameterTranslate:
+			if parameterTranslations[field] == nil {
+				return fmt.Errorf("%s: no translation available", field)
+			}
+		case strings.HasPrefix(action, parameterRenamePrefix) && len(action) > len(parameterRenamePrefix):
+		default:
+			return fmt.Errorf("%s: unknown action %q", field, action)
+		}
+	}
+	return nil
+}
+
+// strictParameters rejects requests with fields that would be dropped,
+// set by initParameters from VERTEXAI_STRICT_PARAMETERS.
+var strictParameters bool
+
+// initParameters reads VERTEXAI_STRICT_PARAMETERS.
+func initParameters() error {
+	strict, err := envFlag("VERTEXAI_STRICT_PARAMETERS", false)
+	if err != nil {
+		return err
+	}
+	strictParameters = strict
+	logger.Info("initParameters: Configured unsupported parameter handling", "strict", strictParameters)
+	return nil
+}
+
+// parameterActions returns the actions for the fields of requests for
+// model: the defaults, overridden by the parameters entries of the config
+// file matching model, from the least to the most specific.
+func parameterActions(model string) map[string]string {
+	patterns := make([]string, 0, len(config.Parameters))
+	for pattern := range config.Parameters {
+		patterns = append(patterns, pattern)
+	}
+	patterns = matchModelPatterns(model, patterns)
+	actions := make(map[string]string, len(defaultParameterActions))
+	for field, action := range defaultParameterActions {
+		actions[field] = action
+	}
+	for _, pattern := range patterns {
+		for field, action := range config.Parameters[pattern] {
+			actions[field] = action
+		}
+	}
+	return actions
+}
+
+// matchModelPatterns returns the patterns matching model, from the least to
+// the most specific. Patterns ending in "*" match model names by prefix.
+func matchModelPatterns(model string, patterns []string) []string {
+	var matched []string
+	for _, pattern := range patterns {
+		if pattern == model || (strings.HasSuffix(pattern, "*") && strings.HasPrefix(model, strings.TrimSuffix(pattern, "*"))) {
+			matched = append(matched, pattern)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		// An exact name is more specific than a prefix of the same length.
+		if len(matched[i]) != len(matched[j]) {
+			return len(matched[i]) < len(matched[j])
+		}
+		return strings.HasSuffix(matched[i], "*")
+	})
+	return matched
+}
+
+// adaptParameters rewrites the fields of a chat completions request that
+// the upstream of its model doesn't support, as listed by parameterActions.
+// It returns the body unchanged when there is nothing to rewrite, and an
+// error naming the field when the request must be rejected.
+func adaptParameters(ctx context.Context, body []byte) ([]byte, error) {
+	var req map[string]any
+	if json.Unmarshal(body, &req) != nil {
+		return body, nil
+	}
+	model, _ := req["model"].(string)
+	actions := parameterActions(model)
+
+	fields := make([]string, 0, len(req))
+	for field := range req {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	var changed []string
+	for _, field := range fields {
+		action, ok := actions[field]
+		if !ok || action == parameterKeep {
+			continue
+		}
+		value := req[field]
+		if value == nil {
+			delete(req, field)
+			changed = append(changed, field)
+			continue
+		}
+		switch {
+		// In strict mode, fields that would be dropped are rejected instead.
+		case action == parameterReject, action == parameterDrop && strictParameters:
+			return nil, fmt.Errorf("parameter %q is not supported by model %q", field, model)
+		case action == parameterDrop:
+			delete(req, field)
+		case action == parameterTranslate:
+			delete(req, field)
+			if err := parameterTranslations[field](req, value); err != nil {
+				return nil, err
+			}
+		default:
+			delete(req, field)
+			to := strings.TrimPrefix(action, parameterRenamePrefix)
+			if _, set := req[to]; !set {
+				req[to] = value
+			}
+		}
+		changed = append(changed, field)
+	}
+	if len(changed) == 0 {
+		return body, nil
+	}
+	out, err := json.Marshal(req)
+	if err != nil {
+		return body, nil
+	}
+	logger.DebugContext(ctx, "adaptParameters: Rewrote unsupported request fields", "model", model, "fields", changed)
+	return out, nil
+}
+
+// translateReasoningEffort sets the Gemini thinking budget matching an
+// OpenAI reasoning_effort, unless the request already sets one.
+func translateReasoningEffort(req map[string]any, value any) error {
+	effort, _ := value.(string)
+	budget, ok := thinkingBudgets[effort]
+	if !ok {
+		return fmt.Errorf("invalid reasoning_effort %v", value)
+	}
+	extra, _ := req["extra_body"].(map[string]any)
+	if extra == nil {
+		extra = map[string]any{}
+	}
+	google, _ := extra["google"].(map[string]any)
+	if google == nil {
+		google = map[string]any{}
+	}
+	thinking, _ := google["thinking_config"].(map[string]any)
+	if thinking == nil {
+		thinking = map[string]any{}
+	}
+	if _, set := thinking["thinking_budget"]; !set {
+		thinking["thinking_budget"] = budget
+	}
+	google["thinking_config"] = thinking
+	extra["google"] = google
+	req["extra_body"] = extra
+	return nil
+}
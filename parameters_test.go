@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestAdaptParameters(t *testing.T) {
+	useConfig(t, &proxyConfig{Parameters: map[string]map[string]string{
+		"google/gemini-2.0-*":     {"reasoning_effort": "drop", "logit_bias": "reject"},
+		"google/gemini-2.0-flash": {"logit_bias": "keep"},
+	}})
+
+	tests := []struct {
+		name    string
+		body    string
+		strict  bool
+		want    string
+		wantErr string
+	}{
+		{
+			name: "supported fields are untouched",
+			body: `{"model":"google/gemini-2.5-pro", "temperature":0.2}`,
+			want: `{"model":"google/gemini-2.5-pro", "temperature":0.2}`,
+		},
+		{
+			name: "OpenAI-only fields are dropped",
+			body: `{"model":"google/gemini-2.5-pro","user":"u1","store":true,"metadata":{"a":"b"},"service_tier":null}`,
+			want: `{"model":"google/gemini-2.5-pro"}`,
+		},
+		{
+			name: "max_completion_tokens is renamed",
+			body: `{"model":"google/gemini-2.5-pro","max_completion_tokens":100}`,
+			want: `{"max_tokens":100,"model":"google/gemini-2.5-pro"}`,
+		},
+		{
+			name: "max_tokens wins over max_completion_tokens",
+			body: `{"model":"google/gemini-2.5-pro","max_completion_tokens":100,"max_tokens":50}`,
+			want: `{"max_tokens":50,"model":"google/gemini-2.5-pro"}`,
+		},
+		{
+			name: "reasoning_effort sets the thinking budget",
+			body: `{"model":"google/gemini-2.5-pro","reasoning_effort":"low","extra_body":{"google":{"safety_settings":[]}}}`,
+			want: `{"extra_body":{"google":{"safety_settings":[],"thinking_config":{"thinking_budget":1024}}},"model":"google/gemini-2.5-pro"}`,
+		},
+		{
+			name: "explicit thinking budget wins",
+			body: `{"model":"google/gemini-2.5-pro","reasoning_effort":"high","extra_body":{"google":{"thinking_config":{"thinking_budget":10}}}}`,
+			want: `{"extra_body":{"google":{"thinking_config":{"thinking_budget":10}}},"model":"google/gemini-2.5-pro"}`,
+		},
+		{
+			name:    "invalid reasoning_effort",
+			body:    `{"model":"google/gemini-2.5-pro","reasoning_effort":"max"}`,
+			wantErr: "invalid reasoning_effort",
+		},
+		{
+			name: "prefix entry overrides defaults",
+			body: `{"model":"google/gemini-2.0-flash-lite","reasoning_effort":"low"}`,
+			want: `{"model":"google/gemini-2.0-flash-lite"}`,
+		},
+		{
+			name:    "prefix entry rejects",
+			body:    `{"model":"google/gemini-2.0-flash-lite","logit_bias":{"1":1}}`,
+			wantErr: `parameter "logit_bias" is not supported`,
+		},
+		{
+			name: "exact entry overrides prefix entry",
+			body: `{"model":"google/gemini-2.0-flash","logit_bias":{"1":1}}`,
+			want: `{"model":"google/gemini-2.0-flash","logit_bias":{"1":1}}`,
+		},
+		{
+			name:    "strict mode rejects dropped fields",
+			body:    `{"model":"google/gemini-2.5-pro","user":"u1"}`,
+			strict:  true,
+			wantErr: `parameter "user" is not supported by model "google/gemini-2.5-pro"`,
+		},
+		{
+			name:   "strict mode still renames",
+			body:   `{"model":"google/gemini-2.5-pro","max_completion_tokens":100,"user":null}`,
+			strict: true,
+			want:   `{"max_tokens":100,"model":"google/gemini-2.5-pro"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.strict {
+				useStrictParameters(t)
+			}
+			got, err := adaptParameters(context.Background(), []byte(tt.body))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("adaptParameters() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("adaptParameters() error = %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("adaptParameters() = %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func useStrictParameters(t *testing.T) {
+	t.Helper()
+	original := strictParameters
+	t.Cleanup(func() { strictParameters = original })
+	strictParameters = true
+}
+
+func TestInitParameters(t *testing.T) {
+	original := strictParameters
+	t.Cleanup(func() { strictParameters = original })
+	t.Setenv("VERTEXAI_STRICT_PARAMETERS", "true")
+	if err := initParameters(); err != nil || !strictParameters {
+		t.Errorf("initParameters() = %v, strict %v, want strict", err, strictParameters)
+	}
+	t.Setenv("VERTEXAI_STRICT_PARAMETERS", "yes please")
+	if err := initParameters(); err == nil {
+		t.Error("initParameters() with an invalid value succeeded, want error")
+	}
+}
+
+func TestProxy_UnsupportedParameter(t *testing.T) {
+	setCachedToken(t, "test-token")
+	useStrictParameters(t)
+	upstream, calls := newRecordingUpstream(t)
+	target, _ := url.Parse(upstream.URL + "/v1/projects/p/locations/l/endpoints/openapi")
+	proxy := makeProxy(target)
+
+	rr := httptest.NewRecorder()
+	proxy.ServeHTTP(rr, httptest.NewRequest("POST", "http://localhost/v1/chat/completions",
+		strings.NewReader(`{"model":"google/gemini-2.5-pro","store":true,"messages":[]}`)))
+	if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), `"code":"unsupported_parameter"`) {
+		t.Errorf("got %d %s, want 400 unsupported_parameter", rr.Code, rr.Body.String())
+	}
+	if len(*calls) != 0 {
+		t.Errorf("upstream called %d times, want 0", len(*calls))
+	}
+}
@@ -0,0 +1,733 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// anthropicVersion is the Messages API version Claude on Vertex AI expects.
+	anthropicVersion = "vertex-2023-10-16"
+	// anthropicDefaultMaxTokens is used when the client doesn't set max_tokens,
+	// which the Anthropic Messages API requires.
+	anthropicDefaultMaxTokens = 4096
+	// defaultPartnerPrefixes routes Claude models to the Anthropic publisher.
+	defaultPartnerPrefixes = "anthropic/"
+)
+
+// partnerRoute describes a chat completions request for a partner model that
+// is served by publishers/<publisher>/models/<model>:rawPredict rather than
+// the OpenAI-compatible endpoint.
+type partnerRoute struct {
+	publisher string
+	// model is the model ID at the publisher, e.g. "claude-sonnet-4@20250514".
+	model string
+	// requestedModel is the model name the client sent, reported back in responses.
+	requestedModel string
+	stream         bool
+}
+
+// partnerPrefixes are the model name prefixes routed to partner models,
+// each "<publisher>/", set by initPartnerPrefixes from
+// VERTEXAI_PARTNER_PREFIXES.
+var partnerPrefixes = []string{defaultPartnerPrefixes}
+
+// publisherPattern matches the publisher names of partner prefixes.
+var publisherPattern = regexp.MustCompile(`^[a-z0-9-]+$`)
+
+// initPartnerPrefixes reads VERTEXAI_PARTNER_PREFIXES, a comma-separated
+// list of publishers with or without a trailing "/".
+func initPartnerPrefixes() error {
+	v := os.Getenv("VERTEXAI_PARTNER_PREFIXES")
+	if strings.TrimSpace(v) == "" {
+		v = defaultPartnerPrefixes
+	}
+	var prefixes []string
+	for _, p := range splitList(v) {
+		if publisher := strings.TrimSuffix(p, "/"); !publisherPattern.MatchString(publisher) {
+			return fmt.Errorf("invalid VERTEXAI_PARTNER_PREFIXES entry %q: want a publisher name such as %q", p, defaultPartnerPrefixes)
+		}
+		if !strings.HasSuffix(p, "/") {
+			p += "/"
+		}
+		prefixes = append(prefixes, p)
+	}
+	partnerPrefixes = prefixes
+	logger.Info("initPartnerPrefixes: Configured partner model prefixes", "prefixes", partnerPrefixes)
+	return nil
+}
+
+// partnerPublisher returns the publisher a model is routed to, or "" when
+// the model is served by the OpenAI-compatible endpoint.
+func partnerPublisher(model string) string {
+	for _, prefix := range partnerPrefixes {
+		if strings.HasPrefix(model, prefix) && len(model) > len(prefix) {
+			return strings.TrimSuffix(prefix, "/")
+		}
+	}
+	return ""
+}
+
+// modelIDPattern matches the publisher model IDs that may be put in an
+// upstream URL path, e.g. "claude-sonnet-4@20250514".
+var modelIDPattern = regexp.MustCompile(`^[A-Za-z0-9._@-]+$`)
+
+// validModelID reports whether id is safe to use as the model segment of a
+// publisher model URL. IDs with "/", ".." or ":" could address other
+// Vertex AI resources with the proxy's credentials.
+func validModelID(id string) bool {
+	return modelIDPattern.MatchString(id) && !strings.Contains(id, "..")
+}
+
+// newPartnerRoute returns the partner route for a chat completions request
+// body, or nil if the requested model is not a partner model. It fails for
+// partner models with an invalid model ID.
+func newPartnerRoute(body []byte) (*partnerRoute, error) {
+	var req struct {
+		Model  string `json:"model"`
+		Stream bool   `json:"stream"`
+	}
+	if json.Unmarshal(body, &req) != nil {
+		return nil, nil
+	}
+	publisher := partnerPublisher(req.Model)
+	if publisher == "" {
+		return nil, nil
+	}
+	model := strings.TrimPrefix(req.Model, publisher+"/")
+	if !validModelID(model) {
+		return nil, fmt.Errorf("invalid model %q", req.Model)
+	}
+	return &partnerRoute{
+		publisher:      publisher,
+		model:          model,
+		requestedModel: req.Model,
+		stream:         req.Stream,
+	}, nil
+}
+
+// path returns the rawPredict path for the route, relative to the project
+// and location of target.
+func (r *partnerRoute) path(target *url.URL) string {
+	method := "rawPredict"
+	if r.stream {
+		method = "streamRawPredict"
+	}
+	base := strings.TrimSuffix(target.Path, "/endpoints/openapi")
+	return fmt.Sprintf("%s/publishers/%s/models/%s:%s", base, r.publisher, r.model, method)
+}
+
+// translateRequest converts an OpenAI chat completions body to the format
+// of the publisher.
+func (r *partnerRoute) translateRequest(body []byte) ([]byte, error) {
+	if r.publisher == "anthropic" {
+		return openAIToAnthropicRequest(body)
+	}
+	// Other publishers accept OpenAI-style bodies on rawPredict and only
+	// need the model name without the routing prefix.
+	var req map[string]any
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, err
+	}
+	req["model"] = r.model
+	return json.Marshal(req)
+}
+
+// translateResponse converts a response of the publisher to the OpenAI format.
+func (r *partnerRoute) translateResponse(resp *http.Response) error {
+	if r.publisher != "anthropic" {
+		return nil
+	}
+	if resp.StatusCode >= 400 {
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		setResponseBody(resp, anthropicToOpenAIError(body))
+		return nil
+	}
+	if mediaType(resp.Header.Get("Content-Type")) == "text/event-stream" {
+		resp.Body = newAnthropicStreamReader(resp.Body, r.requestedModel)
+		resp.Header.Del("Content-Length")
+		resp.ContentLength = -1
+		return nil
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	translated, err := anthropicToOpenAIResponse(body, r.requestedModel)
+	if err != nil {
+		return err
+	}
+	resp.Header.Set("Content-Type", "application/json")
+	setResponseBody(resp, translated)
+	return nil
+}
+
+// setResponseBody replaces the body of resp and fixes up its length.
+func setResponseBody(resp *http.Response, body []byte) {
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	resp.Header.Del("Content-Encoding")
+}
+
+// openAIChatRequest holds the OpenAI chat completions fields the partner
+// translation understands.
+type openAIChatRequest struct {
+	Messages            []openAIMessage `json:"messages"`
+	MaxTokens           *int            `json:"max_tokens"`
+	MaxCompletionTokens *int            `json:"max_completion_tokens"`
+	Temperature         *float64        `json:"temperature"`
+	TopP                *float64        `json:"top_p"`
+	Stop                json.RawMessage `json:"stop"`
+	Stream              bool            `json:"stream"`
+	Tools               []openAITool    `json:"tools"`
+	ToolChoice          json.RawMessage `json:"tool_choice"`
+	ParallelToolCalls   *bool           `json:"parallel_tool_calls"`
+	User                string          `json:"user"`
+}
+
+type openAIMessage struct {
+	Role       string           `json:"role"`
+	Content    json.RawMessage  `json:"content"`
+	ToolCalls  []openAIToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string           `json:"tool_call_id,omitempty"`
+}
+
+type openAIContentPart struct {
+	Type     string `json:"type"`
+	Text     string `json:"text,omitempty"`
+	ImageURL *struct {
+		URL string `json:"url"`
+	} `json:"image_url,omitempty"`
+}
+
+type openAITool struct {
+	Type     string `json:"type"`
+	Function struct {
+		Name        string          `json:"name"`
+		Description string          `json:"description,omitempty"`
+		Parameters  json.RawMessage `json:"parameters,omitempty"`
+	} `json:"function"`
+}
+
+type openAIToolCall struct {
+	Index    *int   `json:"index,omitempty"`
+	ID       string `json:"id,omitempty"`
+	Type     string `json:"type,omitempty"`
+	Function struct {
+		Name      string `json:"name,omitempty"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+type anthropicMessage struct {
+	Role    string           `json:"role"`
+	Content []map[string]any `json:"content"`
+}
+
+// openAIToAnthropicRequest converts an OpenAI chat completions body to an
+// Anthropic Messages API body for Vertex AI.
+func openAIToAnthropicRequest(body []byte) ([]byte, error) {
+	var req openAIChatRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, fmt.Errorf("parsing chat completions request: %w", err)
+	}
+
+	out := map[string]any{"anthropic_version": anthropicVersion}
+	var system []string
+	var messages []anthropicMessage
+	appendBlocks := func(role string, blocks ...map[string]any) {
+		// Anthropic expects alternating roles, so merge consecutive messages.
+		if n := len(messages); n > 0 && messages[n-1].Role == role {
+			messages[n-1].Content = append(messages[n-1].Content, blocks...)
+			return
+		}
+		messages = append(messages, anthropicMessage{Role: role, Content: blocks})
+	}
+
+	for i, m := range req.Messages {
+		switch m.Role {
+		case "system", "developer":
+			text, err := contentText(m.Content)
+			if err != nil {
+				return nil, fmt.Errorf("messages[%d]: %w", i, err)
+			}
+			system = append(system, text)
+		case "user":
+			blocks, err := anthropicContentBlocks(m.Content)
+			if err != nil {
+				return nil, fmt.Errorf("messages[%d]: %w", i, err)
+			}
+			appendBlocks("user", blocks...)
+		case "assistant":
+			blocks, err := anthropicContentBlocks(m.Content)
+			if err != nil {
+				return nil, fmt.Errorf("messages[%d]: %w", i, err)
+			}
+			for _, tc := range m.ToolCalls {
+				input := map[string]any{}
+				if tc.Function.Arguments != "" {
+					if err := json.Unmarshal([]byte(tc.Function.Arguments), &input); err != nil {
+						return nil, fmt.Errorf("messages[%d]: tool call %s has invalid arguments: %w", i, tc.ID, err)
+					}
+				}
+				blocks = append(blocks, map[string]any{"type": "tool_use", "id": tc.ID, "name": tc.Function.Name, "input": input})
+			}
+			appendBlocks("assistant", blocks...)
+		case "tool":
+			text, err := contentText(m.Content)
+			if err != nil {
+				return nil, fmt.Errorf("messages[%d]: %w", i, err)
+			}
+			appendBlocks("user", map[string]any{"type": "tool_result", "tool_use_id": m.ToolCallID, "content": text})
+		default:
+			return nil, fmt.Errorf("messages[%d]: unsupported role %q", i, m.Role)
+		}
+	}
+	if len(system) > 0 {
+		out["system"] = strings.Join(system, "\n\n")
+	}
+	out["messages"] = messages
+
+	switch {
+	case req.MaxCompletionTokens != nil:
+		out["max_tokens"] = *req.MaxCompletionTokens
+	case req.MaxTokens != nil:
+		out["max_tokens"] = *req.MaxTokens
+	default:
+		out["max_tokens"] = anthropicDefaultMaxTokens
+	}
+	if req.Temperature != nil {
+		out["temperature"] = *req.Temperature
+	}
+	if req.TopP != nil {
+		out["top_p"] = *req.TopP
+	}
+	if len(req.Stop) > 0 && string(req.Stop) != "null" {
+		var stop []string
+		if err := json.Unmarshal(req.Stop, &stop); err != nil {
+			var single string
+			if err := json.Unmarshal(req.Stop, &single); err != nil {
+				return nil, fmt.Errorf("invalid stop: %w", err)
+			}
+			stop = []string{single}
+		}
+		out["stop_sequences"] = stop
+	}
+	if req.Stream {
+		out["stream"] = true
+	}
+	if req.User != "" {
+		out["metadata"] = map[string]any{"user_id": req.User}
+	}
+
+	if len(req.Tools) > 0 {
+		tools := make([]map[string]any, 0, len(req.Tools))
+		for _, t := range req.Tools {
+			schema := t.Function.Parameters
+			if len(schema) == 0 {
+				schema = json.RawMessage(`{"type":"object","properties":{}}`)
+			}
+			tool := map[string]any{"name": t.Function.Name, "input_schema": schema}
+			if t.Function.Description != "" {
+				tool["description"] = t.Function.Description
+			}
+			tools = append(tools, tool)
+		}
+		out["tools"] = tools
+
+		choice, err := anthropicToolChoice(req.ToolChoice)
+		if err != nil {
+			return nil, err
+		}
+		if choice == nil && req.ParallelToolCalls != nil && !*req.ParallelToolCalls {
+			choice = map[string]any{"type": "auto"}
+		}
+		if choice != nil {
+			if req.ParallelToolCalls != nil && !*req.ParallelToolCalls && choice["type"] != "none" {
+				choice["disable_parallel_tool_use"] = true
+			}
+			out["tool_choice"] = choice
+		}
+	}
+	return json.Marshal(out)
+}
+
+// anthropicToolChoice converts an OpenAI tool_choice value.
+func anthropicToolChoice(raw json.RawMessage) (map[string]any, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	var mode string
+	if json.Unmarshal(raw, &mode) == nil {
+		switch mode {
+		case "auto":
+			return map[string]any{"type": "auto"}, nil
+		case "required":
+			return map[string]any{"type": "any"}, nil
+		case "none":
+			return map[string]any{"type": "none"}, nil
+		}
+		return nil, fmt.Errorf("unsupported tool_choice %q", mode)
+	}
+	var named struct {
+		Function struct {
+			Name string `json:"name"`
+		} `json:"function"`
+	}
+	if err := json.Unmarshal(raw, &named); err != nil || named.Function.Name == "" {
+		return nil, fmt.Errorf("invalid tool_choice %s", raw)
+	}
+	return map[string]any{"type": "tool", "name": named.Function.Name}, nil
+}
+
+// contentText returns the text of an OpenAI message content, which is either
+// a string or an array of text parts.
+func contentText(raw json.RawMessage) (string, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return "", nil
+	}
+	var text string
+	if json.Unmarshal(raw, &text) == nil {
+		return text, nil
+	}
+	var parts []openAIContentPart
+	if err := json.Unmarshal(raw, &parts); err != nil {
+		return "", fmt.Errorf("invalid content: %w", err)
+	}
+	var texts []string
+	for _, p := range parts {
+		if p.Type != "text" {
+			return "", fmt.Errorf("unsupported content part type %q", p.Type)
+		}
+		texts = append(texts, p.Text)
+	}
+	return strings.Join(texts, "\n"), nil
+}
+
+// anthropicContentBlocks converts an OpenAI message content to Anthropic
+// content blocks. Images are passed as base64 data or URLs.
+func anthropicContentBlocks(raw json.RawMessage) ([]map[string]any, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	var text string
+	if json.Unmarshal(raw, &text) == nil {
+		if text == "" {
+			return nil, nil
+		}
+		return []map[string]any{{"type": "text", "text": text}}, nil
+	}
+	var parts []openAIContentPart
+	if err := json.Unmarshal(raw, &parts); err != nil {
+		return nil, fmt.Errorf("invalid content: %w", err)
+	}
+	blocks := make([]map[string]any, 0, len(parts))
+	for _, p := range parts {
+		switch p.Type {
+		case "text":
+			blocks = append(blocks, map[string]any{"type": "text", "text": p.Text})
+		case "image_url":
+			if p.ImageURL == nil {
+				return nil, errors.New("image_url part without url")
+			}
+			source, err := anthropicImageSource(p.ImageURL.URL)
+			if err != nil {
+				return nil, err
+			}
+			blocks = append(blocks, map[string]any{"type": "image", "source": source})
+		default:
+			return nil, fmt.Errorf("unsupported content part type %q", p.Type)
+		}
+	}
+	return blocks, nil
+}
+
+func anthropicImageSource(u string) (map[string]any, error) {
+	if rest, ok := strings.CutPrefix(u, "data:"); ok {
+		meta, data, found := strings.Cut(rest, ",")
+		mediaType, isBase64 := strings.CutSuffix(meta, ";base64")
+		if !found || !isBase64 {
+			return nil, errors.New("image data URLs must be base64 encoded")
+		}
+		return map[string]any{"type": "base64", "media_type": mediaType, "data": data}, nil
+	}
+	return map[string]any{"type": "url", "url": u}, nil
+}
+
+// anthropicResponse is an Anthropic Messages API response.
+type anthropicResponse struct {
+	ID         string `json:"id"`
+	Model      string `json:"model"`
+	StopReason string `json:"stop_reason"`
+	Content    []struct {
+		Type  string          `json:"type"`
+		Text  string          `json:"text"`
+		ID    string          `json:"id"`
+		Name  string          `json:"name"`
+		Input json.RawMessage `json:"input"`
+	} `json:"content"`
+	Usage anthropicUsage `json:"usage"`
+}
+
+type anthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+func (u anthropicUsage) openAI() map[string]int {
+	return map[string]int{
+		"prompt_tokens":     u.InputTokens,
+		"completion_tokens": u.OutputTokens,
+		"total_tokens":      u.InputTokens + u.OutputTokens,
+	}
+}
+
+// openAIFinishReason maps an Anthropic stop_reason to an OpenAI finish_reason.
+func openAIFinishReason(stopReason string) string {
+	switch stopReason {
+	case "max_tokens":
+		return "length"
+	case "tool_use":
+		return "tool_calls"
+	case "refusal":
+		return "content_filter"
+	default:
+		return "stop"
+	}
+}
+
+// anthropicToOpenAIResponse converts an Anthropic Messages API response to
+// an OpenAI chat completion.
+func anthropicToOpenAIResponse(body []byte, model string) ([]byte, error) {
+	var resp anthropicResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, fmt.Errorf("parsing Anthropic response: %w", err)
+	}
+	message := map[string]any{"role": "assistant", "content": nil}
+	var text strings.Builder
+	var toolCalls []map[string]any
+	for _, block := range resp.Content {
+		switch block.Type {
+		case "text":
+			text.WriteString(block.Text)
+		case "tool_use":
+			args := string(block.Input)
+			if args == "" {
+				args = "{}"
+			}
+			toolCalls = append(toolCalls, map[string]any{
+				"id":       block.ID,
+				"type":     "function",
+				"function": map[string]any{"name": block.Name, "arguments": args},
+			})
+		}
+	}
+	if text.Len() > 0 {
+		message["content"] = text.String()
+	}
+	if len(toolCalls) > 0 {
+		message["tool_calls"] = toolCalls
+	}
+	return json.Marshal(map[string]any{
+		"id":      resp.ID,
+		"object":  "chat.completion",
+		"created": time.Now().Unix(),
+		"model":   model,
+		"choices": []map[string]any{{
+			"index":         0,
+			"message":       message,
+			"finish_reason": openAIFinishReason(resp.StopReason),
+		}},
+		"usage": resp.Usage.openAI(),
+	})
+}
+
+// anthropicToOpenAIError converts an Anthropic error body to the OpenAI
+// error format. Other bodies, e.g. Google API errors, are returned unchanged.
+func anthropicToOpenAIError(body []byte) []byte {
+	var e struct {
+		Type  string `json:"type"`
+		Error struct {
+			Type    string `json:"type"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(body, &e) != nil || e.Type != "error" {
+		return body
+	}
+	out, err := json.Marshal(openAIError{Error: openAIErrorDetail{Message: e.Error.Message, Type: e.Error.Type}})
+	if err != nil {
+		return body
+	}
+	return out
+}
+
+// anthropicStreamReader converts an Anthropic Messages SSE stream into an
+// OpenAI chat completions SSE stream as it is read.
+type anthropicStreamReader struct {
+	src     io.ReadCloser
+	lines   *bufio.Reader
+	model   string
+	created int64
+
+	id        string
+	usage     anthropicUsage
+	toolIndex map[int]int // Anthropic content block index -> OpenAI tool call index
+	event     string
+	buf       bytes.Buffer
+	done      bool
+}
+
+func newAnthropicStreamReader(src io.ReadCloser, model string) *anthropicStreamReader {
+	return &anthropicStreamReader{
+		src:       src,
+		lines:     bufio.NewReader(src),
+		model:     model,
+		created:   time.Now().Unix(),
+		toolIndex: map[int]int{},
+	}
+}
+
+func (s *anthropicStreamReader) Read(p []byte) (int, error) {
+	for s.buf.Len() == 0 {
+		if s.done {
+			return 0, io.EOF
+		}
+		line, err := s.lines.ReadBytes('\n')
+		if len(line) > 0 {
+			s.handleLine(bytes.TrimRight(line, "\r\n"))
+		}
+		if err == io.EOF {
+			s.finish()
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	return s.buf.Read(p)
+}
+
+func (s *anthropicStreamReader) Close() error {
+	return s.src.Close()
+}
+
+func (s *anthropicStreamReader) handleLine(line []byte) {
+	if event, ok := bytes.CutPrefix(line, []byte("event:")); ok {
+		s.event = string(bytes.TrimSpace(event))
+		return
+	}
+	data, ok := bytes.CutPrefix(line, []byte("data:"))
+	if !ok {
+		return
+	}
+	var ev struct {
+		Type    string `json:"type"`
+		Index   int    `json:"index"`
+		Message struct {
+			ID    string         `json:"id"`
+			Usage anthropicUsage `json:"usage"`
+		} `json:"message"`
+		ContentBlock struct {
+			Type string `json:"type"`
+			ID   string `json:"id"`
+			Name string `json:"name"`
+		} `json:"content_block"`
+		Delta struct {
+			Type        string `json:"type"`
+			Text        string `json:"text"`
+			PartialJSON string `json:"partial_json"`
+			StopReason  string `json:"stop_reason"`
+		} `json:"delta"`
+		Usage *anthropicUsage `json:"usage"`
+		Error struct {
+			Type    string `json:"type"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(bytes.TrimSpace(data), &ev); err != nil {
+		logger.Warn("anthropicStreamReader: Skipping malformed event", "event", s.event, "error", err)
+		return
+	}
+
+	switch ev.Type {
+	case "message_start":
+		s.id = ev.Message.ID
+		s.usage = ev.Message.Usage
+		s.writeChunk(map[string]any{"role": "assistant", "content": ""}, nil, nil)
+	case "content_block_start":
+		if ev.ContentBlock.Type == "tool_use" {
+			idx := len(s.toolIndex)
+			s.toolIndex[ev.Index] = idx
+			s.writeChunk(map[string]any{"tool_calls": []map[string]any{{
+				"index":    idx,
+				"id":       ev.ContentBlock.ID,
+				"type":     "function",
+				"function": map[string]any{"name": ev.ContentBlock.Name, "arguments": ""},
+			}}}, nil, nil)
+		}
+	case "content_block_delta":
+		switch ev.Delta.Type {
+		case "text_delta":
+			s.writeChunk(map[string]any{"content": ev.Delta.Text}, nil, nil)
+		case "input_json_delta":
+			s.writeChunk(map[string]any{"tool_calls": []map[string]any{{
+				"index":    s.toolIndex[ev.Index],
+				"function": map[string]any{"arguments": ev.Delta.PartialJSON},
+			}}}, nil, nil)
+		}
+	case "message_delta":
+		if ev.Usage != nil {
+			s.usage.OutputTokens = ev.Usage.OutputTokens
+		}
+		if ev.Delta.StopReason != "" {
+			reason := openAIFinishReason(ev.Delta.StopReason)
+			s.writeChunk(map[string]any{}, &reason, s.usage.openAI())
+		}
+	case "error":
+		payload, _ := json.Marshal(openAIError{Error: openAIErrorDetail{Message: ev.Error.Message, Type: ev.Error.Type}})
+		fmt.Fprintf(&s.buf, "data: %s\n\n", payload)
+	case "message_stop":
+		s.finish()
+	}
+}
+
+func (s *anthropicStreamReader) writeChunk(delta map[string]any, finishReason *string, usage map[string]int) {
+	chunk := map[string]any{
+		"id":      s.id,
+		"object":  "chat.completion.chunk",
+		"created": s.created,
+		"model":   s.model,
+		"choices": []map[string]any{{"index": 0, "delta": delta, "finish_reason": finishReason}},
+	}
+	if usage != nil {
+		chunk["usage"] = usage
+	}
+	payload, err := json.Marshal(chunk)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(&s.buf, "data: %s\n\n", payload)
+}
+
+func (s *anthropicStreamReader) finish() {
+	if !s.done {
+		s.done = true
+		s.buf.WriteString("data: [DONE]\n\n")
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestOpenAIToAnthropicRequest(t *testing.T) {
+	body := `{
+		"model": "anthropic/claude-sonnet-4@20250514",
+		"messages": [
+			{"role": "system", "content": "Be brief."},
+			{"role": "user", "content": [
+				{"type": "text", "text": "What is in this image?"},
+				{"type": "image_url", "image_url": {"url": "data:image/png;base64,iVBORw0KGgo="}}
+			]},
+			{"role": "assistant", "content": null, "tool_calls": [
+				{"id": "call_1", "type": "function", "function": {"name": "lookup", "arguments": "{\"q\":\"cat\"}"}}
+			]},
+			{"role": "tool", "tool_call_id": "call_1", "content": "a cat"}
+		],
+		"max_completion_tokens": 100,
+		"stop": "END",
+		"tools": [{"type": "function", "function": {"name": "lookup", "parameters": {"type": "object"}}}],
+		"tool_choice": "required",
+		"parallel_tool_calls": false
+	}`
+	out, err := openAIToAnthropicRequest([]byte(body))
+	if err != nil {
+		t.Fatalf("openAIToAnthropicRequest() error = %v", err)
+	}
+	var got map[string]any
+	if err := json.Unmarshal(out, &got); err != nil {
+		t.Fatalf("invalid JSON %s: %v", out, err)
+	}
+
+	if got["anthropic_version"] != anthropicVersion {
+		t.Errorf("anthropic_version = %v, want %v", got["anthropic_version"], anthropicVersion)
+	}
+	if _, ok := got["model"]; ok {
+		t.Errorf("model must not be sent in the body, got %v", got["model"])
+	}
+	if got["system"] != "Be brief." {
+		t.Errorf("system = %v, want %q", got["system"], "Be brief.")
+	}
+	if got["max_tokens"] != float64(100) {
+		t.Errorf("max_tokens = %v, want 100", got["max_tokens"])
+	}
+	if stop, _ := json.Marshal(got["stop_sequences"]); string(stop) != `["END"]` {
+		t.Errorf("stop_sequences = %s, want [\"END\"]", stop)
+	}
+	if choice, _ := json.Marshal(got["tool_choice"]); string(choice) != `{"disable_parallel_tool_use":true,"type":"any"}` {
+		t.Errorf("tool_choice = %s", choice)
+	}
+	if tools, _ := json.Marshal(got["tools"]); string(tools) != `[{"input_schema":{"type":"object"},"name":"lookup"}]` {
+		t.Errorf("tools = %s", tools)
+	}
+
+	messages, _ := json.Marshal(got["messages"])
+	want := `[{"content":[{"text":"What is in this image?","type":"text"},{"source":{"data":"iVBORw0KGgo=","media_type":"image/png","type":"base64"},"type":"image"}],"role":"user"},` +
+		`{"content":[{"id":"call_1","input":{"q":"cat"},"name":"lookup","type":"tool_use"}],"role":"assistant"},` +
+		`{"content":[{"content":"a cat","tool_use_id":"call_1","type":"tool_result"}],"role":"user"}]`
+	if string(messages) != want {
+		t.Errorf("messages = %s\nwant %s", messages, want)
+	}
+}
+
+func TestOpenAIToAnthropicRequest_Invalid(t *testing.T) {
+	for _, body := range []string{
+		`{"messages":[{"role":"narrator","content":"hi"}]}`,
+		`{"messages":[{"role":"user","content":[{"type":"input_audio"}]}]}`,
+		`{"messages":[{"role":"user","content":"hi"}],"tools":[{"type":"function","function":{"name":"f"}}],"tool_choice":"sometimes"}`,
+	} {
+		if _, err := openAIToAnthropicRequest([]byte(body)); err == nil {
+			t.Errorf("openAIToAnthropicRequest(%s) error = nil, want error", body)
+		}
+	}
+}
+
+func TestAnthropicToOpenAIResponse(t *testing.T) {
+	body := `{"id":"msg_1","type":"message","role":"assistant","model":"claude-sonnet-4",
+		"content":[{"type":"text","text":"Let me check."},{"type":"tool_use","id":"toolu_1","name":"lookup","input":{"q":"cat"}}],
+		"stop_reason":"tool_use","usage":{"input_tokens":10,"output_tokens":5}}`
+	out, err := anthropicToOpenAIResponse([]byte(body), "anthropic/claude-sonnet-4")
+	if err != nil {
+		t.Fatalf("anthropicToOpenAIResponse() error = %v", err)
+	}
+	var got struct {
+		ID      string `json:"id"`
+		Object  string `json:"object"`
+		Model   string `json:"model"`
+		Choices []struct {
+			Message struct {
+				Content   string           `json:"content"`
+				ToolCalls []openAIToolCall `json:"tool_calls"`
+			} `json:"message"`
+			FinishReason string `json:"finish_reason"`
+		} `json:"choices"`
+		Usage auditUsage `json:"usage"`
+	}
+	if err := json.Unmarshal(out, &got); err != nil {
+		t.Fatalf("invalid JSON %s: %v", out, err)
+	}
+	if got.Object != "chat.completion" || got.Model != "anthropic/claude-sonnet-4" || got.ID != "msg_1" {
+		t.Errorf("unexpected envelope: %s", out)
+	}
+	if len(got.Choices) != 1 {
+		t.Fatalf("got %d choices, want 1", len(got.Choices))
+	}
+	choice := got.Choices[0]
+	if choice.Message.Content != "Let me check." {
+		t.Errorf("content = %q, want %q", choice.Message.Content, "Let me check.")
+	}
+	if choice.FinishReason != "tool_calls" {
+		t.Errorf("finish_reason = %q, want tool_calls", choice.FinishReason)
+	}
+	if len(choice.Message.ToolCalls) != 1 || choice.Message.ToolCalls[0].ID != "toolu_1" || choice.Message.ToolCalls[0].Function.Arguments != `{"q":"cat"}` {
+		t.Errorf("tool_calls = %+v", choice.Message.ToolCalls)
+	}
+	if got.Usage != (auditUsage{PromptTokens: 10, CompletionTokens: 5, TotalTokens: 15}) {
+		t.Errorf("usage = %+v", got.Usage)
+	}
+}
+
+func TestAnthropicStreamReader(t *testing.T) {
+	stream := "event: message_start\n" +
+		`data: {"type":"message_start","message":{"id":"msg_1","usage":{"input_tokens":7,"output_tokens":1}}}` + "\n\n" +
+		"event: ping\ndata: {\"type\":\"ping\"}\n\n" +
+		`data: {"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}` + "\n\n" +
+		`data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hi"}}` + "\n\n" +
+		`data: {"type":"content_block_stop","index":0}` + "\n\n" +
+		`data: {"type":"content_block_start","index":1,"content_block":{"type":"tool_use","id":"toolu_1","name":"lookup","input":{}}}` + "\n\n" +
+		`data: {"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"{\"q\":"}}` + "\n\n" +
+		`data: {"type":"message_delta","delta":{"stop_reason":"tool_use"},"usage":{"output_tokens":4}}` + "\n\n" +
+		`data: {"type":"message_stop"}` + "\n\n"
+
+	out, err := io.ReadAll(newAnthropicStreamReader(io.NopCloser(strings.NewReader(stream)), "anthropic/claude"))
+	if err != nil {
+		t.Fatalf("ReadAll() error = %v", err)
+	}
+
+	var deltas []string
+	var finishReason string
+	var usage *auditUsage
+	events := strings.Split(strings.TrimSpace(string(out)), "\n\n")
+	if last := events[len(events)-1]; last != "data: [DONE]" {
+		t.Errorf("last event = %q, want data: [DONE]", last)
+	}
+	for _, ev := range events[:len(events)-1] {
+		var chunk struct {
+			Object  string `json:"object"`
+			Model   string `json:"model"`
+			Choices []struct {
+				Delta        json.RawMessage `json:"delta"`
+				FinishReason *string         `json:"finish_reason"`
+			} `json:"choices"`
+			Usage *auditUsage `json:"usage"`
+		}
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(ev, "data: ")), &chunk); err != nil {
+			t.Fatalf("invalid chunk %q: %v", ev, err)
+		}
+		if chunk.Object != "chat.completion.chunk" || chunk.Model != "anthropic/claude" {
+			t.Errorf("unexpected chunk envelope: %s", ev)
+		}
+		deltas = append(deltas, string(chunk.Choices[0].Delta))
+		if chunk.Choices[0].FinishReason != nil {
+			finishReason = *chunk.Choices[0].FinishReason
+			usage = chunk.Usage
+		}
+	}
+
+	want := []string{
+		`{"content":"","role":"assistant"}`,
+		`{"content":"Hi"}`,
+		`{"tool_calls":[{"function":{"arguments":"","name":"lookup"},"id":"toolu_1","index":0,"type":"function"}]}`,
+		`{"tool_calls":[{"function":{"arguments":"{\"q\":"},"index":0}]}`,
+		`{}`,
+	}
+	if strings.Join(deltas, "\n") != strings.Join(want, "\n") {
+		t.Errorf("deltas =\n%s\nwant\n%s", strings.Join(deltas, "\n"), strings.Join(want, "\n"))
+	}
+	if finishReason != "tool_calls" {
+		t.Errorf("finish_reason = %q, want tool_calls", finishReason)
+	}
+	if usage == nil || *usage != (auditUsage{PromptTokens: 7, CompletionTokens: 4, TotalTokens: 11}) {
+		t.Errorf("usage = %+v", usage)
+	}
+}
+
+func TestMakeProxy_PartnerModel(t *testing.T) {
+	setCachedToken(t, "test-token")
+	var gotPath string
+	var gotBody map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		json.NewDecoder(r.Body).Decode(&gotBody)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"msg_1","content":[{"type":"text","text":"Hello"}],"stop_reason":"end_turn","usage":{"input_tokens":3,"output_tokens":2}}`))
+	}))
+	defer server.Close()
+
+	targetURL, _ := url.Parse(server.URL + "/v1/projects/p/locations/us-east5/endpoints/openapi")
+	req := httptest.NewRequest("POST", "http://localhost/v1/chat/completions", strings.NewReader(
+		`{"model":"anthropic/claude-sonnet-4@20250514","messages":[{"role":"user","content":"Hi"}]}`))
+	rr := httptest.NewRecorder()
+	makeProxy(targetURL).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v. Body: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+	if want := "/v1/projects/p/locations/us-east5/publishers/anthropic/models/claude-sonnet-4@20250514:rawPredict"; gotPath != want {
+		t.Errorf("upstream path = %q, want %q", gotPath, want)
+	}
+	if gotBody["anthropic_version"] != anthropicVersion {
+		t.Errorf("upstream body = %v, want Anthropic request", gotBody)
+	}
+	var resp struct {
+		Model   string `json:"model"`
+		Choices []struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		} `json:"choices"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid response %s: %v", rr.Body.String(), err)
+	}
+	if resp.Model != "anthropic/claude-sonnet-4@20250514" || len(resp.Choices) != 1 || resp.Choices[0].Message.Content != "Hello" {
+		t.Errorf("unexpected response: %s", rr.Body.String())
+	}
+}
+
+func TestMakeProxy_PartnerModelError(t *testing.T) {
+	setCachedToken(t, "test-token")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, ":streamRawPredict") {
+			t.Errorf("upstream path = %q, want streamRawPredict", r.URL.Path)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"type":"error","error":{"type":"rate_limit_error","message":"slow down"}}`))
+	}))
+	defer server.Close()
+
+	targetURL, _ := url.Parse(server.URL)
+	req := httptest.NewRequest("POST", "http://localhost/v1/chat/completions", strings.NewReader(
+		`{"model":"anthropic/claude","stream":true,"messages":[{"role":"user","content":"Hi"}]}`))
+	rr := httptest.NewRecorder()
+	makeProxy(targetURL).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusTooManyRequests {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusTooManyRequests)
+	}
+	var got openAIError
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil || got.Error.Message != "slow down" || got.Error.Type != "rate_limit_error" {
+		t.Errorf("unexpected error body %s (err %v)", rr.Body.String(), err)
+	}
+}
+
+func TestHandleModels_PartnerModels(t *testing.T) {
+	t.Setenv("VERTEXAI_AVAILABLE_MODELS", "google/gemini-2.5-pro")
+	t.Setenv("VERTEXAI_PARTNER_MODELS", "anthropic/claude-sonnet-4@20250514")
+
+	rr := httptest.NewRecorder()
+	handleModels(rr, httptest.NewRequest("GET", "/v1/models", nil))
+
+	var list ModelList
+	if err := json.NewDecoder(rr.Body).Decode(&list); err != nil {
+		t.Fatalf("Failed to decode response body: %v", err)
+	}
+	if len(list.Data) != 2 {
+		t.Fatalf("Expected 2 models, got %+v", list.Data)
+	}
+	if got := list.Data[1]; got.ID != "anthropic/claude-sonnet-4@20250514" || got.OwnedBy != "anthropic" {
+		t.Errorf("partner model = %+v, want anthropic/claude-sonnet-4@20250514 owned by anthropic", got)
+	}
+}
+
+func TestPartnerPublisher(t *testing.T) {
+	original := partnerPrefixes
+	t.Cleanup(func() { partnerPrefixes = original })
+	t.Setenv("VERTEXAI_PARTNER_PREFIXES", "anthropic, mistralai/")
+	if err := initPartnerPrefixes(); err != nil {
+		t.Fatalf("initPartnerPrefixes() error = %v", err)
+	}
+	for model, want := range map[string]string{
+		"anthropic/claude-3-5-haiku@20241022": "anthropic",
+		"mistralai/mistral-large":             "mistralai",
+		"google/gemini-2.5-pro":               "",
+		"anthropic/":                          "",
+	} {
+		if got := partnerPublisher(model); got != want {
+			t.Errorf("partnerPublisher(%q) = %q, want %q", model, got, want)
+		}
+	}
+	for _, invalid := range []string{"anthropic/models/", "../", "Mistral AI"} {
+		t.Setenv("VERTEXAI_PARTNER_PREFIXES", invalid)
+		if err := initPartnerPrefixes(); err == nil {
+			t.Errorf("initPartnerPrefixes() with %q succeeded, want error", invalid)
+		}
+	}
+}
+
+func TestMakeProxy_PartnerModelInvalidID(t *testing.T) {
+	setCachedToken(t, "test-token")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected upstream request %s", r.URL.Path)
+	}))
+	defer server.Close()
+
+	targetURL, _ := url.Parse(server.URL + "/v1/projects/p/locations/us-east5/endpoints/openapi")
+	for _, model := range []string{"anthropic/../../../endpoints/123", "anthropic/claude:predict", "anthropic/claude/x", "anthropic/claude?x=1"} {
+		body, _ := json.Marshal(map[string]any{"model": model, "messages": []any{map[string]any{"role": "user", "content": "Hi"}}})
+		rr := httptest.NewRecorder()
+		makeProxy(targetURL).ServeHTTP(rr, httptest.NewRequest("POST", "http://localhost/v1/chat/completions", strings.NewReader(string(body))))
+		if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), `"code":"invalid_model"`) {
+			t.Errorf("%s: got %d %s, want 400 invalid_model", model, rr.Code, rr.Body.String())
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// Values of promptConfig.Override.
+const (
+	promptOverrideAllow  = "allow"
+	promptOverrideForbid = "forbid"
+)
+
+// promptVariablePattern matches the variables of prompt templates, e.g.
+// {{date}} or {{header:X-User-Id}}.
+var promptVariablePattern = regexp.MustCompile(`\{\{\s*([a-z_]+)(?::([A-Za-z0-9-]*))?\s*\}\}`)
+
+// promptConfig is a managed prompt injected into chat completions requests.
+// Its texts are templates that may use the variables {{date}} (the current
+// UTC date), {{key_name}}, {{model}} and {{header:<name>}}.
+type promptConfig struct {
+	// System is inserted as the first message of the request.
+	System string `json:"system,omitempty"`
+	// Prefix messages are inserted after the system messages, before the
+	// conversation.
+	Prefix []promptMessage `json:"prefix,omitempty"`
+	// Suffix messages are appended after the conversation.
+	Suffix []promptMessage `json:"suffix,omitempty"`
+	// Override is "allow" (the default) to keep system messages of the
+	// client after System, or "forbid" to reject requests that have them.
+	Override string `json:"override,omitempty"`
+}
+
+type promptMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+func (p *promptConfig) validate() error {
+	if p.System == "" && len(p.Prefix) == 0 && len(p.Suffix) == 0 {
+		return errors.New("system, prefix or suffix is required")
+	}
+	switch p.Override {
+	case "", promptOverrideAllow, promptOverrideForbid:
+	default:
+		return fmt.Errorf("unknown override %q, want %q or %q", p.Override, promptOverrideAllow, promptOverrideForbid)
+	}
+	if err := validatePromptTemplate(p.System); err != nil {
+		return fmt.Errorf("system: %w", err)
+	}
+	for _, f := range []struct {
+		name     string
+		messages []promptMessage
+	}{{"prefix", p.Prefix}, {"suffix", p.Suffix}} {
+		for i, m := range f.messages {
+			switch m.Role {
+			case "system", "developer", "user", "assistant":
+			default:
+				return fmt.Errorf("%s[%d]: unknown role %q", f.name, i, m.Role)
+			}
+			if err := validatePromptTemplate(m.Content); err != nil {
+				return fmt.Errorf("%s[%d]: %w", f.name, i, err)
+			}
+		}
+	}
+	return nil
+}
+
+func validatePromptTemplate(text string) error {
+	for _, m := range promptVariablePattern.FindAllStringSubmatch(text, -1) {
+		switch name, arg := m[1], m[2]; {
+		case name == "header" && arg == "":
+			return errors.New("{{header:<name>}} requires a header name")
+		case name == "header":
+		case (name == "date" || name == "key_name" || name == "model") && arg == "":
+		default:
+			return fmt.Errorf("unknown variable %s", m[0])
+		}
+	}
+	return nil
+}
+
+// injectedPrompt records where serveWithPrompts put the messages of a
+// prompt, so that serveWithTrimming never removes them.
+type injectedPrompt struct {
+	// prefixStart and prefixEnd are the index range of the prefix messages.
+	prefixStart, prefixEnd int
+	// suffix is the number of suffix messages at the end.
+	suffix int
+}
+
+type injectedPromptKey struct{}
+
+// injectedPromptFrom returns the prompt injected into the request ctx belongs
+// to, or nil.
+func injectedPromptFrom(ctx context.Context) *injectedPrompt {
+	p, _ := ctx.Value(injectedPromptKey{}).(*injectedPrompt)
+	return p
+}
+
+// promptFor returns the name and config of the prompt for requests of key,
+// which may be nil, for model: the prompt of the key, else the most specific
+// entry of model_prompts matching model.
+func promptFor(key *keyConfig, model string) (string, *promptConfig) {
+	if key != nil && key.Prompt != "" {
+		return key.Prompt, config.Prompts[key.Prompt]
+	}
+	patterns := make([]string, 0, len(config.ModelPrompts))
+	for pattern := range config.ModelPrompts {
+		patterns = append(patterns, pattern)
+	}
+	matched := matchModelPatterns(model, patterns)
+	if len(matched) == 0 {
+		return "", nil
+	}
+	name := config.ModelPrompts[matched[len(matched)-1]]
+	return name, config.Prompts[name]
+}
+
+// expandPrompt substitutes the variables of a prompt template for request r.
+// Headers missing from the request expand to empty strings.
+func expandPrompt(text string, r *http.Request, model string) string {
+	return promptVariablePattern.ReplaceAllStringFunc(text, func(v string) string {
+		m := promptVariablePattern.FindStringSubmatch(v)
+		switch m[1] {
+		case "date":
+			return time.Now().UTC().Format(time.DateOnly)
+		case "key_name":
+			return clientKeyName(r)
+		case "model":
+			return model
+		case "header":
+			return r.Header.Get(m[2])
+		}
+		return v
+	})
+}
+
+// serveWithPrompts injects the managed prompt of the client key or model
+// into chat completions requests before passing them to serve. With the
+// forbid override, requests that bring their own system messages are
+// rejected. Models are matched as the client named them, so prompts can be
+// attached to traffic split aliases. The positions of the injected messages
+// are recorded in the request context for serveWithTrimming.
+func serveWithPrompts(w http.ResponseWriter, r *http.Request, serve http.HandlerFunc) {
+	if r.URL.Path != "/v1/chat/completions" || len(config.Prompts) == 0 || r.Body == nil {
+		serve(w, r)
+		return
+	}
+	ctx := r.Context()
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "invalid_body", "Error reading request body")
+		return
+	}
+	var req map[string]any
+	if json.Unmarshal(body, &req) != nil {
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		serve(w, r)
+		return
+	}
+	model, _ := req["model"].(string)
+	name, prompt := promptFor(lookupClientKey(clientKey(r)), model)
+	if prompt == nil {
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		serve(w, r)
+		return
+	}
+
+	messages, _ := req["messages"].([]any)
+	system := 0
+	for ; system < len(messages); system++ {
+		msg, _ := messages[system].(map[string]any)
+		if role := msg["role"]; role != "system" && role != "developer" {
+			break
+		}
+	}
+	if prompt.Override == promptOverrideForbid {
+		for _, m := range messages {
+			msg, _ := m.(map[string]any)
+			if role := msg["role"]; role == "system" || role == "developer" {
+				logger.InfoContext(ctx, "serveWithPrompts: Rejected a system message", "prompt", name, "model", model, "key", clientKeyName(r))
+				writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "system_prompt_not_allowed",
+					"System messages are not allowed for this API key or model; the system prompt is managed by the server.")
+				return
+			}
+		}
+	}
+	expand := func(pm promptMessage) any {
+		return map[string]any{"role": pm.Role, "content": expandPrompt(pm.Content, r, model)}
+	}
+	out := make([]any, 0, len(messages)+len(prompt.Prefix)+len(prompt.Suffix)+1)
+	if prompt.System != "" {
+		out = append(out, expand(promptMessage{Role: "system", Content: prompt.System}))
+	}
+	out = append(out, messages[:system]...)
+	injected := &injectedPrompt{prefixStart: len(out), suffix: len(prompt.Suffix)}
+	for _, pm := range prompt.Prefix {
+		out = append(out, expand(pm))
+	}
+	injected.prefixEnd = len(out)
+	out = append(out, messages[system:]...)
+	for _, pm := range prompt.Suffix {
+		out = append(out, expand(pm))
+	}
+	req["messages"] = out
+	r = r.WithContext(context.WithValue(ctx, injectedPromptKey{}, injected))
+
+	body, _ = json.Marshal(req)
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	logger.DebugContext(ctx, "serveWithPrompts: Injected prompt", "prompt", name, "model", model, "key", clientKeyName(r))
+	serve(w, r)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServeWithPrompts(t *testing.T) {
+	useConfig(t, &proxyConfig{
+		Prompts: map[string]*promptConfig{
+			"support": {
+				System: "You are the support bot of {{key_name}} on {{date}}, talking to {{header:X-User-Name}}.",
+				Prefix: []promptMessage{{Role: "user", Content: "Answer in {{ header:X-Language }}."}, {Role: "assistant", Content: "OK."}},
+				Suffix: []promptMessage{{Role: "system", Content: "Never share internal URLs."}},
+			},
+			"gemini":   {System: "You are {{model}}."},
+			"locked":   {System: "Only talk about the weather.", Override: promptOverrideForbid},
+			"fallback": {System: "Be helpful."},
+		},
+		ModelPrompts: map[string]string{"google/gemini-*": "fallback", "google/gemini-2.5-pro": "gemini"},
+		Keys: []keyConfig{
+			{Key: "sk-support", Name: "support-desk", Prompt: "support"},
+			{Key: "sk-locked", Name: "kiosk", Prompt: "locked"},
+			{Key: "sk-plain", Name: "plain"},
+		},
+	})
+	date := time.Now().UTC().Format(time.DateOnly)
+
+	tests := []struct {
+		name     string
+		key      string
+		body     string
+		wantCode int
+		want     []string
+	}{
+		{"key prompt", "sk-support",
+			`{"model":"google/gemini-2.5-pro","messages":[{"role":"system","content":"client"},{"role":"user","content":"hi"}]}`, 200,
+			[]string{
+				"system: You are the support bot of support-desk on " + date + ", talking to Ann.",
+				"system: client",
+				"user: Answer in de.",
+				"assistant: OK.",
+				"user: hi",
+				"system: Never share internal URLs.",
+			}},
+		{"model prompt", "sk-plain", `{"model":"google/gemini-2.5-pro","messages":[{"role":"user","content":"hi"}]}`, 200,
+			[]string{"system: You are google/gemini-2.5-pro.", "user: hi"}},
+		{"model prefix prompt", "", `{"model":"google/gemini-2.0-flash-001","messages":[{"role":"user","content":"hi"}]}`, 200,
+			[]string{"system: Be helpful.", "user: hi"}},
+		{"no prompt", "sk-plain", `{"model":"anthropic/claude-sonnet-4","messages":[{"role":"user","content":"hi"}]}`, 200,
+			[]string{"user: hi"}},
+		{"forbid without system", "sk-locked", `{"model":"m","messages":[{"role":"user","content":"hi"}]}`, 200,
+			[]string{"system: Only talk about the weather.", "user: hi"}},
+		{"forbid with system", "sk-locked", `{"model":"m","messages":[{"role":"developer","content":"talk about anything"},{"role":"user","content":"hi"}]}`, 400, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var forwarded []string
+			serve := func(w http.ResponseWriter, r *http.Request) {
+				data, _ := io.ReadAll(r.Body)
+				var req struct {
+					Messages []struct {
+						Role    string `json:"role"`
+						Content string `json:"content"`
+					} `json:"messages"`
+				}
+				if err := json.Unmarshal(data, &req); err != nil {
+					t.Fatalf("forwarded invalid JSON %s: %v", data, err)
+				}
+				for _, m := range req.Messages {
+					forwarded = append(forwarded, m.Role+": "+m.Content)
+				}
+			}
+			r := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(tt.body))
+			if tt.key != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.key)
+			}
+			r.Header.Set("X-User-Name", "Ann")
+			r.Header.Set("X-Language", "de")
+			rr := httptest.NewRecorder()
+			serveWithPrompts(rr, r, serve)
+			if rr.Code != tt.wantCode {
+				t.Fatalf("got %d %s, want %d", rr.Code, rr.Body.String(), tt.wantCode)
+			}
+			if tt.wantCode == 400 && !strings.Contains(rr.Body.String(), `"code":"system_prompt_not_allowed"`) {
+				t.Errorf("got %s, want code system_prompt_not_allowed", rr.Body.String())
+			}
+			if !reflect.DeepEqual(forwarded, tt.want) {
+				t.Errorf("forwarded messages\n%q\nwant\n%q", forwarded, tt.want)
+			}
+		})
+	}
+}
+
+func TestServeWithPrompts_NotTrimmed(t *testing.T) {
+	setCachedToken(t, "test-token")
+	useTokenCounter(t)
+	useTrimContext(t, trimDrop)
+	useConfig(t, &proxyConfig{
+		Prompts: map[string]*promptConfig{"rules": {
+			Prefix: []promptMessage{{Role: "user", Content: "rule one"}, {Role: "assistant", Content: "ok"}},
+			Suffix: []promptMessage{{Role: "system", Content: "reminder"}},
+		}},
+		ModelPrompts:  map[string]string{"google/gemini-*": "rules"},
+		ContextLimits: map[string]int{"google/gemini-*": 7},
+	})
+	u, _ := newCountTokensUpstream(t)
+	upstream := &upstreamTarget{name: "default", url: u}
+
+	var forwarded []any
+	serve := func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]any
+		json.NewDecoder(r.Body).Decode(&req)
+		for _, m := range req["messages"].([]any) {
+			forwarded = append(forwarded, m.(map[string]any)["content"])
+		}
+	}
+	rr := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"google/gemini-2.0-flash-001","messages":[`+
+		`{"role":"user","content":"a b c d"},{"role":"assistant","content":"e f"},{"role":"user","content":"last"}]}`))
+	serveWithPrompts(rr, r, func(w http.ResponseWriter, r *http.Request) {
+		serveWithTrimming(w, r, upstream, serve)
+	})
+
+	// The conversation is trimmed around the prefix and suffix messages.
+	if want := []any{"rule one", "ok", "last", "reminder"}; !reflect.DeepEqual(forwarded, want) {
+		t.Errorf("forwarded messages %v, want %v", forwarded, want)
+	}
+	if got := rr.Header().Get(contextTrimmedHeader); got != "2" {
+		t.Errorf("%s = %q, want 2", contextTrimmedHeader, got)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+)
+
+// proxyRequest is the per-request state shared by the makeProxy handler, the
+// Director, the upstream transports and ModifyResponse.
+type proxyRequest struct {
+	target *upstreamTarget
+	// partner is set for chat completions of partner models, whose requests
+	// and responses are translated from and to the OpenAI format.
+	partner *partnerRoute
+	// cachedTokens is the size of the context cache referenced by the
+	// request, reported in the usage of the response.
+	cachedTokens int
+	// reasoning is set for chat completions of Gemini models that configure
+	// thinking, whose thought summaries are moved to reasoning_content.
+	reasoning bool
+	// err, when set, aborts the request before it is sent upstream. It is
+	// reported to the client by the ErrorHandler.
+	err *proxyError
+}
+
+type proxyRequestKey struct{}
+
+func withProxyRequest(ctx context.Context, pr *proxyRequest) context.Context {
+	return context.WithValue(ctx, proxyRequestKey{}, pr)
+}
+
+// proxyRequestFrom returns the state of the request ctx belongs to. It never
+// returns nil, so callers outside of makeProxy get a throwaway state.
+func proxyRequestFrom(ctx context.Context) *proxyRequest {
+	if pr, ok := ctx.Value(proxyRequestKey{}).(*proxyRequest); ok {
+		return pr
+	}
+	return &proxyRequest{}
+}
+
+// abort stops the request from being sent upstream. The Director can't
+// return errors, so it records them here for abortTransport to pick up.
+func (pr *proxyRequest) abort(err *proxyError) {
+	if pr.err == nil {
+		pr.err = err
+	}
+}
+
+// proxyError is an error reported to the client as an OpenAI error response.
+type proxyError struct {
+	status  int
+	errType string
+	code    string
+	message string
+}
+
+func (e *proxyError) Error() string {
+	return e.message
+}
+
+// abortTransport fails requests aborted by the Director before they reach
+// the next transport.
+type abortTransport struct {
+	next http.RoundTripper
+}
+
+func (t *abortTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := proxyRequestFrom(req.Context()).err; err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	return t.next.RoundTrip(req)
+}
+
+// responseBuffer is an http.ResponseWriter that keeps the response in memory,
+// for requests the proxy makes to itself.
+type responseBuffer struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newResponseBuffer() *responseBuffer {
+	return &responseBuffer{header: http.Header{}}
+}
+
+func (b *responseBuffer) Header() http.Header {
+	return b.header
+}
+
+func (b *responseBuffer) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+func (b *responseBuffer) Write(p []byte) (int, error) {
+	b.WriteHeader(http.StatusOK)
+	return b.body.Write(p)
+}
+
+// Flush is a no-op, it lets streaming responses be buffered.
+func (b *responseBuffer) Flush() {}
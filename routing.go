@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	// targetHeader lets clients without a pinned target pick one by name.
+	targetHeader = "X-Vertex-Target"
+	// defaultTargetName names the target built from VERTEXAI_PROJECT and VERTEXAI_LOCATION.
+	defaultTargetName = "default"
+)
+
+// targetConfig is a named project/location/credentials tuple in the config file.
+type targetConfig struct {
+	Project  string `json:"project"`
+	Location string `json:"location"`
+	// Credentials names the credential source. Empty means default_credentials.
+	Credentials string `json:"credentials,omitempty"`
+}
+
+// keyConfig describes a client API key in the config file.
+type keyConfig struct {
+	// Key is the API key clients send as "Authorization: Bearer <key>".
+	Key string `json:"key"`
+	// Name identifies the key in logs, the audit log and metrics.
+	Name string `json:"name"`
+	// Target pins the key to a target. When empty, the X-Vertex-Target
+	// header or the default target is used.
+	Target string `json:"target,omitempty"`
+	// NoCache opts the key out of the response cache.
+	NoCache bool `json:"no_cache,omitempty"`
+	// Prompt names the entry of Prompts injected into the chat completions
+	// requests of the key, instead of the one for their model.
+	Prompt string `json:"prompt,omitempty"`
+}
+
+// upstreamTarget is the resolved destination of a proxied request.
+type upstreamTarget struct {
+	name        string
+	url         *url.URL
+	credentials string
+	// project and location the target bills to.
+	project, location string
+}
+
+// resolveTarget picks the upstream target of r: the target pinned to the
+// client key, else the one named by the X-Vertex-Target header, else the
+// default target. The endpoint URL is built per request from the target's
+// project and location.
+func resolveTarget(r *http.Request, defaultURL *url.URL) (*upstreamTarget, error) {
+	name := r.Header.Get(targetHeader)
+	if k := lookupClientKey(clientKey(r)); k != nil && k.Target != "" {
+		name = k.Target
+	}
+	tc, ok := config.Targets[name]
+	if name == "" || (name == defaultTargetName && !ok) {
+		return &upstreamTarget{name: defaultTargetName, url: defaultURL, project: projectID, location: location}, nil
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown target %q", name)
+	}
+	return configuredTarget(name, tc)
+}
+
+// configuredTarget returns the upstream target for a target of the config file.
+func configuredTarget(name string, tc targetConfig) (*upstreamTarget, error) {
+	u, err := url.Parse(vertexAIBaseURL(tc.Project, tc.Location))
+	if err != nil {
+		return nil, fmt.Errorf("building URL for target %q: %w", name, err)
+	}
+	return &upstreamTarget{name: name, url: u, credentials: tc.Credentials, project: tc.Project, location: tc.Location}, nil
+}
+
+// lookupClientKey returns the configured entry for an API key, or nil.
+func lookupClientKey(key string) *keyConfig {
+	if key == "" {
+		return nil
+	}
+	return config.keysByValue[key]
+}
+
+// clientKey returns the API key the client sent in the Authorization header.
+func clientKey(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+// clientOwner identifies the client API key of a request as the owner of
+// files and batches: the full SHA-256 of the key, which, unlike the short
+// fingerprint of clientKeyName, can't be collided by another key. It is ""
+// for requests without a key.
+func clientOwner(r *http.Request) string {
+	key := clientKey(r)
+	if key == "" {
+		return ""
+	}
+	return keyOwner(key)
+}
+
+// keyOwner returns the owner of the files and batches of an API key.
+func keyOwner(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// requireClientKey rejects requests to h without an API key, as the
+// resources h serves belong to keys.
+func requireClientKey(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if clientKey(r) == "" {
+			writeOpenAIError(w, http.StatusUnauthorized, "invalid_request_error", "missing_api_key",
+				"An API key is required, send it as \"Authorization: Bearer <key>\".")
+			return
+		}
+		h(w, r)
+	}
+}
+
+// clientKeyName identifies the client API key of a request without exposing
+// it: the configured name of the key, or "key-" followed by a short SHA-256
+// fingerprint for keys not in the config file.
+func clientKeyName(r *http.Request) string {
+	key := clientKey(r)
+	if key == "" {
+		return ""
+	}
+	if k := lookupClientKey(key); k != nil {
+		return k.Name
+	}
+	sum := sha256.Sum256([]byte(key))
+	return "key-" + hex.EncodeToString(sum[:4])
+}
+
+func (t targetConfig) validate(cfg *proxyConfig) error {
+	if t.Project == "" || t.Location == "" {
+		return errors.New("project and location are required")
+	}
+	if t.Credentials != "" && t.Credentials != defaultCredentialsName {
+		if _, ok := cfg.Credentials[t.Credentials]; !ok {
+			return fmt.Errorf("credentials %q are not defined", t.Credentials)
+		}
+	}
+	return nil
+}
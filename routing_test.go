@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// routeVertexAITo points regional Vertex AI URLs built by vertexAIBaseURL at server.
+func routeVertexAITo(t *testing.T, server *httptest.Server) {
+	t.Helper()
+	originalScheme, originalHostFormat := vertexAIScheme, vertexAIAPIHostFormat
+	t.Cleanup(func() { vertexAIScheme, vertexAIAPIHostFormat = originalScheme, originalHostFormat })
+	u, _ := url.Parse(server.URL)
+	vertexAIScheme = u.Scheme
+	vertexAIAPIHostFormat = u.Host + "%.0s" // drop the location from the host
+}
+
+// setProviderToken pre-fills the token cache of a configured credential source.
+func setProviderToken(t *testing.T, name, tok string) {
+	t.Helper()
+	p, err := tokenProviderFor(name)
+	if err != nil {
+		t.Fatalf("tokenProviderFor(%s) error = %v", name, err)
+	}
+	p.mu.Lock()
+	p.token = tok
+	p.expiry = time.Now().Add(time.Hour)
+	p.mu.Unlock()
+}
+
+type upstreamCall struct {
+	path          string
+	authorization string
+	targetHeader  string
+}
+
+func newRecordingUpstream(t *testing.T) (*httptest.Server, *[]upstreamCall) {
+	t.Helper()
+	var calls []upstreamCall
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls = append(calls, upstreamCall{
+			path:          r.URL.Path,
+			authorization: r.Header.Get("Authorization"),
+			targetHeader:  r.Header.Get(targetHeader),
+		})
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{}`))
+	}))
+	t.Cleanup(server.Close)
+	return server, &calls
+}
+
+func setupRoutingConfig(t *testing.T) {
+	t.Helper()
+	useConfig(t, &proxyConfig{
+		Credentials: map[string]credentialConfig{
+			"team-a-creds": {Type: "metadata"},
+		},
+		Targets: map[string]targetConfig{
+			"team-a": {Project: "proj-a", Location: "europe-west4", Credentials: "team-a-creds"},
+			"team-b": {Project: "proj-b", Location: "us-east5"},
+		},
+		Keys: []keyConfig{
+			{Key: "key-a", Name: "team-a-app", Target: "team-a"},
+			{Key: "key-free", Name: "free-app"},
+		},
+	})
+	setProviderToken(t, "team-a-creds", "team-a-token")
+	setCachedToken(t, "adc-token")
+}
+
+func TestMakeProxy_RoutesByTarget(t *testing.T) {
+	server, calls := newRecordingUpstream(t)
+	routeVertexAITo(t, server)
+	setupRoutingConfig(t)
+	defaultURL, _ := url.Parse(server.URL + "/v1/projects/default-proj/locations/us-central1/endpoints/openapi")
+	proxy := makeProxy(defaultURL)
+
+	tests := []struct {
+		name       string
+		key        string
+		header     string
+		wantPath   string
+		wantBearer string
+	}{
+		{"key pinned to target", "key-a", "", "/v1/projects/proj-a/locations/europe-west4/endpoints/openapi/chat/completions", "team-a-token"},
+		{"pinned key ignores header", "key-a", "team-b", "/v1/projects/proj-a/locations/europe-west4/endpoints/openapi/chat/completions", "team-a-token"},
+		{"header selects target", "key-free", "team-b", "/v1/projects/proj-b/locations/us-east5/endpoints/openapi/chat/completions", "adc-token"},
+		{"unknown key uses default", "other", "", "/v1/projects/default-proj/locations/us-central1/endpoints/openapi/chat/completions", "adc-token"},
+		{"no key uses default", "", "", "/v1/projects/default-proj/locations/us-central1/endpoints/openapi/chat/completions", "adc-token"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			*calls = nil
+			req := httptest.NewRequest("POST", "http://localhost/v1/chat/completions", strings.NewReader(`{}`))
+			if tc.key != "" {
+				req.Header.Set("Authorization", "Bearer "+tc.key)
+			}
+			if tc.header != "" {
+				req.Header.Set(targetHeader, tc.header)
+			}
+			rr := httptest.NewRecorder()
+			proxy.ServeHTTP(rr, req)
+
+			if rr.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200: %s", rr.Code, rr.Body.String())
+			}
+			if len(*calls) != 1 {
+				t.Fatalf("upstream called %d times, want 1", len(*calls))
+			}
+			call := (*calls)[0]
+			if call.path != tc.wantPath {
+				t.Errorf("upstream path = %s, want %s", call.path, tc.wantPath)
+			}
+			if call.authorization != "Bearer "+tc.wantBearer {
+				t.Errorf("upstream Authorization = %q, want Bearer %s", call.authorization, tc.wantBearer)
+			}
+			if call.targetHeader != "" {
+				t.Errorf("%s header forwarded upstream: %q", targetHeader, call.targetHeader)
+			}
+		})
+	}
+}
+
+func TestMakeProxy_UnknownTarget(t *testing.T) {
+	server, calls := newRecordingUpstream(t)
+	setupRoutingConfig(t)
+	defaultURL, _ := url.Parse(server.URL)
+
+	req := httptest.NewRequest("POST", "http://localhost/v1/chat/completions", strings.NewReader(`{}`))
+	req.Header.Set(targetHeader, "nope")
+	rr := httptest.NewRecorder()
+	makeProxy(defaultURL).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want 400", rr.Code)
+	}
+	var body openAIError
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil || body.Error.Code != "invalid_target" {
+		t.Errorf("body = %s, want OpenAI error with code invalid_target", rr.Body.String())
+	}
+	if len(*calls) != 0 {
+		t.Errorf("upstream called %d times, want 0", len(*calls))
+	}
+}
+
+func TestClientKeyName(t *testing.T) {
+	setupRoutingConfig(t)
+	req := httptest.NewRequest("GET", "/v1/models", nil)
+	if got := clientKeyName(req); got != "" {
+		t.Errorf("clientKeyName() without key = %q, want empty", got)
+	}
+	req.Header.Set("Authorization", "Bearer key-a")
+	if got := clientKeyName(req); got != "team-a-app" {
+		t.Errorf("clientKeyName() = %q, want team-a-app", got)
+	}
+	req.Header.Set("Authorization", "Bearer unknown-key")
+	if got := clientKeyName(req); !strings.HasPrefix(got, "key-") || strings.Contains(got, "unknown-key") {
+		t.Errorf("clientKeyName() = %q, want fingerprint", got)
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+)
+
+// maxSchemaRefDepth bounds how deeply $refs are inlined. Gemini doesn't
+// support recursive schemas, so deeper references become plain objects.
+const maxSchemaRefDepth = 5
+
+// geminiSchemaKeywords are the JSON Schema keywords Gemini accepts.
+var geminiSchemaKeywords = map[string]bool{
+	"type": true, "format": true, "title": true, "description": true,
+	"nullable": true, "enum": true, "default": true, "example": true,
+	"properties": true, "required": true, "propertyOrdering": true,
+	"minProperties": true, "maxProperties": true,
+	"items": true, "minItems": true, "maxItems": true,
+	"minLength": true, "maxLength": true, "pattern": true,
+	"minimum": true, "maximum": true, "anyOf": true,
+}
+
+// geminiSchemaFormats are the string and number formats Gemini accepts.
+var geminiSchemaFormats = map[string]bool{
+	"date-time": true, "enum": true,
+	"int32": true, "int64": true, "float": true, "double": true,
+}
+
+// schemaSanitizing enables sanitizeSchemas, set by initSchemaSanitizing
+// from VERTEXAI_SANITIZE_SCHEMAS.
+var schemaSanitizing = true
+
+// initSchemaSanitizing reads VERTEXAI_SANITIZE_SCHEMAS, true by default.
+func initSchemaSanitizing() error {
+	enabled, err := envFlag("VERTEXAI_SANITIZE_SCHEMAS", true)
+	if err != nil {
+		return err
+	}
+	schemaSanitizing = enabled
+	logger.Info("initSchemaSanitizing: Configured JSON schema sanitizing", "enabled", schemaSanitizing)
+	return nil
+}
+
+// sanitizeSchemas rewrites the JSON schemas of response_format and of the
+// tool parameters of a chat completions request into the subset Gemini
+// accepts. It returns the body unchanged when there is nothing to rewrite.
+// Sanitising is disabled with VERTEXAI_SANITIZE_SCHEMAS=false.
+func sanitizeSchemas(ctx context.Context, body []byte) []byte {
+	if !schemaSanitizing {
+		return body
+	}
+	var req map[string]any
+	if json.Unmarshal(body, &req) != nil {
+		return body
+	}
+	model, _ := req["model"].(string)
+	changed := false
+	sanitize := func(parent map[string]any, key, location string) {
+		schema, ok := parent[key].(map[string]any)
+		if !ok {
+			return
+		}
+		sanitized, changes := sanitizeSchema(schema)
+		if len(changes) == 0 {
+			return
+		}
+		logger.InfoContext(ctx, "sanitizeSchemas: Rewrote JSON schema for Gemini", "model", model, "schema", location, "changes", changes)
+		parent[key] = sanitized
+		changed = true
+	}
+
+	if format, ok := req["response_format"].(map[string]any); ok {
+		if js, ok := format["json_schema"].(map[string]any); ok {
+			sanitize(js, "schema", "response_format")
+		}
+	}
+	tools, _ := req["tools"].([]any)
+	for i, t := range tools {
+		tool, _ := t.(map[string]any)
+		fn, ok := tool["function"].(map[string]any)
+		if !ok {
+			continue
+		}
+		name, _ := fn["name"].(string)
+		if name == "" {
+			name = strconv.Itoa(i)
+		}
+		sanitize(fn, "parameters", "tools["+name+"]")
+	}
+	if !changed {
+		return body
+	}
+	out, err := json.Marshal(req)
+	if err != nil {
+		return body
+	}
+	return out
+}
+
+// sanitizeSchema returns schema rewritten into the subset Gemini accepts,
+// with a description of each kind of change made. $refs to $defs or
+// definitions are inlined, nullable unions and type lists become nullable,
+// oneOf becomes anyOf, allOf is merged, const becomes enum, and unsupported
+// keywords and formats are removed.
+func sanitizeSchema(schema map[string]any) (map[string]any, []string) {
+	s := &schemaSanitizer{defs: map[string]any{}, changes: map[string]bool{}}
+	for _, key := range []string{"$defs", "definitions"} {
+		defs, _ := schema[key].(map[string]any)
+		for name, def := range defs {
+			s.defs["#/"+key+"/"+name] = def
+		}
+	}
+	out := s.walk(schema, 0)
+	changes := make([]string, 0, len(s.changes))
+	for change := range s.changes {
+		changes = append(changes, change)
+	}
+	slices.Sort(changes)
+	return out, changes
+}
+
+type schemaSanitizer struct {
+	defs    map[string]any
+	changes map[string]bool
+}
+
+func (s *schemaSanitizer) note(format string, args ...any) {
+	s.changes[fmt.Sprintf(format, args...)] = true
+}
+
+// walk returns a sanitised copy of node. refDepth is the number of $refs
+// inlined on the way to node.
+func (s *schemaSanitizer) walk(v any, refDepth int) map[string]any {
+	node, ok := v.(map[string]any)
+	if !ok {
+		// Boolean schemas: true accepts anything.
+		return map[string]any{}
+	}
+	out := make(map[string]any, len(node))
+	for k, v := range node {
+		out[k] = v
+	}
+
+	if ref, ok := out["$ref"].(string); ok {
+		delete(out, "$ref")
+		def, found := s.defs[ref]
+		switch {
+		case !found:
+			s.note("removed unresolvable $ref")
+			out["type"] = "object"
+		case refDepth >= maxSchemaRefDepth:
+			s.note("cut recursive $ref")
+			out["type"] = "object"
+		default:
+			s.note("inlined $ref")
+			resolved := map[string]any{}
+			if m, ok := def.(map[string]any); ok {
+				for k, v := range m {
+					resolved[k] = v
+				}
+			}
+			// Keywords next to the $ref, e.g. description, take precedence.
+			for k, v := range out {
+				resolved[k] = v
+			}
+			return s.walk(resolved, refDepth+1)
+		}
+	}
+
+	if types, ok := out["type"].([]any); ok {
+		var nonNull []any
+		for _, t := range types {
+			if t != "null" {
+				nonNull = append(nonNull, t)
+			}
+		}
+		if len(nonNull) < len(types) {
+			out["nullable"] = true
+		}
+		s.note("converted type list")
+		switch len(nonNull) {
+		case 0:
+			delete(out, "type")
+		case 1:
+			out["type"] = nonNull[0]
+		default:
+			delete(out, "type")
+			variants := make([]any, len(nonNull))
+			for i, t := range nonNull {
+				variants[i] = map[string]any{"type": t}
+			}
+			out["anyOf"] = variants
+		}
+	}
+
+	if c, ok := out["const"]; ok {
+		delete(out, "const")
+		if str, ok := c.(string); ok {
+			s.note("converted const to enum")
+			out["type"] = "string"
+			out["enum"] = []any{str}
+		} else {
+			s.note("removed non-string const")
+		}
+	}
+
+	if oneOf, ok := out["oneOf"]; ok {
+		delete(out, "oneOf")
+		s.note("converted oneOf to anyOf")
+		if _, exists := out["anyOf"]; !exists {
+			out["anyOf"] = oneOf
+		}
+	}
+
+	if allOf, ok := out["allOf"].([]any); ok {
+		delete(out, "allOf")
+		s.note("merged allOf")
+		for _, sub := range allOf {
+			mergeSchema(out, s.walk(sub, refDepth))
+		}
+	}
+
+	if anyOf, ok := out["anyOf"].([]any); ok {
+		var variants []any
+		for _, sub := range anyOf {
+			if m, ok := sub.(map[string]any); ok && m["type"] == "null" {
+				out["nullable"] = true
+				continue
+			}
+			variants = append(variants, s.walk(sub, refDepth))
+		}
+		if len(variants) < len(anyOf) {
+			s.note("converted nullable union")
+		}
+		delete(out, "anyOf")
+		switch len(variants) {
+		case 0:
+		case 1:
+			// A single variant is the schema itself.
+			for k, v := range variants[0].(map[string]any) {
+				if _, exists := out[k]; !exists || k == "type" {
+					out[k] = v
+				}
+			}
+		default:
+			out["anyOf"] = variants
+		}
+	}
+
+	if props, ok := out["properties"].(map[string]any); ok {
+		sanitized := make(map[string]any, len(props))
+		for name, p := range props {
+			sanitized[name] = s.walk(p, refDepth)
+		}
+		out["properties"] = sanitized
+	}
+	if items, ok := out["items"]; ok {
+		if _, isList := items.([]any); isList {
+			s.note("removed tuple items")
+			delete(out, "items")
+		} else {
+			out["items"] = s.walk(items, refDepth)
+		}
+	}
+
+	if format, ok := out["format"].(string); ok && !geminiSchemaFormats[format] {
+		s.note("removed format %s", format)
+		delete(out, "format")
+	}
+	for k := range out {
+		if !geminiSchemaKeywords[k] {
+			s.note("removed %s", k)
+			delete(out, k)
+		}
+	}
+	return out
+}
+
+// mergeSchema merges the properties and required fields of src into dst.
+// Other keywords of dst take precedence.
+func mergeSchema(dst, src map[string]any) {
+	for k, v := range src {
+		switch k {
+		case "properties":
+			props, _ := dst[k].(map[string]any)
+			if props == nil {
+				props = map[string]any{}
+			}
+			src, _ := v.(map[string]any)
+			for name, p := range src {
+				props[name] = p
+			}
+			dst[k] = props
+		case "required":
+			required, _ := dst[k].([]any)
+			src, _ := v.([]any)
+			for _, name := range src {
+				if !slices.Contains(required, name) {
+					required = append(required, name)
+				}
+			}
+			dst[k] = required
+		default:
+			if _, exists := dst[k]; !exists {
+				dst[k] = v
+			}
+		}
+	}
+}
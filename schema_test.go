@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// pydanticSchema is the schema Pydantic generates for a model with a nested
+// model, an optional field, a literal and a recursive list.
+const pydanticSchema = `{
+  "$defs": {
+    "Address": {
+      "additionalProperties": false,
+      "properties": {
+        "city": {"title": "City", "type": "string"},
+        "zip": {"anyOf": [{"type": "string", "format": "uuid"}, {"type": "null"}], "default": null, "title": "Zip"}
+      },
+      "required": ["city", "zip"],
+      "title": "Address",
+      "type": "object"
+    },
+    "Node": {
+      "properties": {"children": {"items": {"$ref": "#/$defs/Node"}, "type": "array"}},
+      "type": "object"
+    }
+  },
+  "$schema": "https://json-schema.org/draft/2020-12/schema",
+  "additionalProperties": false,
+  "properties": {
+    "address": {"$ref": "#/$defs/Address", "description": "Home address"},
+    "kind": {"const": "person"},
+    "age": {"type": ["integer", "null"], "exclusiveMinimum": 0},
+    "pet": {"oneOf": [{"type": "string"}, {"type": "integer"}]},
+    "tree": {"$ref": "#/$defs/Node"},
+    "name": {"allOf": [{"type": "string"}, {"description": "Full name"}]}
+  },
+  "required": ["address", "kind", "age"],
+  "type": "object"
+}`
+
+func TestSanitizeSchema(t *testing.T) {
+	var schema map[string]any
+	if err := json.Unmarshal([]byte(pydanticSchema), &schema); err != nil {
+		t.Fatal(err)
+	}
+	got, changes := sanitizeSchema(schema)
+
+	props := got["properties"].(map[string]any)
+	check := func(name, want string) {
+		t.Helper()
+		b, _ := json.Marshal(props[name])
+		if string(b) != want {
+			t.Errorf("properties.%s = %s\nwant %s", name, b, want)
+		}
+	}
+	check("address", `{"description":"Home address","properties":{"city":{"title":"City","type":"string"},"zip":{"default":null,"nullable":true,"title":"Zip","type":"string"}},"required":["city","zip"],"title":"Address","type":"object"}`)
+	check("kind", `{"enum":["person"],"type":"string"}`)
+	check("age", `{"nullable":true,"type":"integer"}`)
+	check("pet", `{"anyOf":[{"type":"string"},{"type":"integer"}]}`)
+	check("name", `{"description":"Full name","type":"string"}`)
+	if b, _ := json.Marshal(props["tree"]); strings.Count(string(b), `"children"`) != maxSchemaRefDepth {
+		t.Errorf("recursive schema inlined to the wrong depth: %s", b)
+	}
+	for _, key := range []string{"$defs", "$schema", "additionalProperties"} {
+		if _, ok := got[key]; ok {
+			t.Errorf("%s not removed", key)
+		}
+	}
+
+	for _, want := range []string{
+		"converted const to enum", "converted nullable union", "converted oneOf to anyOf", "converted type list",
+		"cut recursive $ref", "inlined $ref", "merged allOf", "removed $defs", "removed additionalProperties",
+		"removed exclusiveMinimum", "removed format uuid",
+	} {
+		if !slices.Contains(changes, want) {
+			t.Errorf("changes = %v, missing %q", changes, want)
+		}
+	}
+}
+
+func TestSanitizeSchemas(t *testing.T) {
+	body := `{"model":"google/gemini-2.5-flash","messages":[],` +
+		`"response_format":{"type":"json_schema","json_schema":{"name":"r","schema":{"type":"object","additionalProperties":false,"properties":{}}}},` +
+		`"tools":[{"type":"function","function":{"name":"f","parameters":{"type":"object","properties":{"x":{"type":"string","format":"email"}}}}},` +
+		`{"type":"function","function":{"name":"g","parameters":{"type":"object","properties":{}}}}]}`
+	got := string(sanitizeSchemas(context.Background(), []byte(body)))
+	want := `{"messages":[],"model":"google/gemini-2.5-flash",` +
+		`"response_format":{"json_schema":{"name":"r","schema":{"properties":{},"type":"object"}},"type":"json_schema"},` +
+		`"tools":[{"function":{"name":"f","parameters":{"properties":{"x":{"type":"string"}},"type":"object"}},"type":"function"},` +
+		`{"function":{"name":"g","parameters":{"properties":{},"type":"object"}},"type":"function"}]}`
+	if got != want {
+		t.Errorf("sanitizeSchemas() = %s\nwant %s", got, want)
+	}
+
+	compatible := `{"model":"m","tools":[{"type":"function","function":{"name":"g","parameters":{"type":"object"}}}]}`
+	if got := string(sanitizeSchemas(context.Background(), []byte(compatible))); got != compatible {
+		t.Errorf("sanitizeSchemas() changed a compatible request: %s", got)
+	}
+
+	original := schemaSanitizing
+	t.Cleanup(func() { schemaSanitizing = original })
+	t.Setenv("VERTEXAI_SANITIZE_SCHEMAS", "false")
+	if err := initSchemaSanitizing(); err != nil {
+		t.Fatalf("initSchemaSanitizing() error = %v", err)
+	}
+	if got := string(sanitizeSchemas(context.Background(), []byte(body))); got != body {
+		t.Errorf("sanitizeSchemas() rewrote the request while disabled")
+	}
+	t.Setenv("VERTEXAI_SANITIZE_SCHEMAS", "off")
+	if err := initSchemaSanitizing(); err == nil {
+		t.Error("initSchemaSanitizing() with an invalid value succeeded, want error")
+	}
+}
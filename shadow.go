@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// shadowTimeout bounds a mirrored request. It never delays the client.
+const shadowTimeout = 5 * time.Minute
+
+// shadowConfig mirrors sampled chat completions for a model to a candidate.
+type shadowConfig struct {
+	// Model receives the mirrored requests.
+	Model string `json:"model"`
+	// Target names the target the mirrored requests are sent to, e.g. in
+	// another region. Empty means the target of the original request.
+	Target string `json:"target,omitempty"`
+	// SampleRate is the fraction of requests mirrored, in (0, 1].
+	SampleRate float64 `json:"sample_rate"`
+}
+
+func (s shadowConfig) validate(cfg *proxyConfig) error {
+	if s.Model == "" {
+		return errors.New("model is required")
+	}
+	if s.SampleRate <= 0 || s.SampleRate > 1 {
+		return fmt.Errorf("sample_rate must be in (0, 1], got %v", s.SampleRate)
+	}
+	if _, ok := cfg.Targets[s.Target]; s.Target != "" && !ok && s.Target != defaultTargetName {
+		return fmt.Errorf("target %q is not defined", s.Target)
+	}
+	return nil
+}
+
+// shadowLog is the sink of mirrored request records configured by
+// initShadowLog. It is nil when mirroring is disabled.
+var shadowLog *shadowLogger
+
+type shadowLogger struct {
+	mu       sync.Mutex
+	w        io.Writer
+	slots    chan struct{}
+	redactor *redactor
+}
+
+// shadowRecord is a single line of the shadow log.
+type shadowRecord struct {
+	Time    time.Time       `json:"time"`
+	TraceID string          `json:"trace_id,omitempty"`
+	Key     string          `json:"key,omitempty"`
+	Stream  bool            `json:"stream,omitempty"`
+	Request json.RawMessage `json:"request,omitempty"`
+	Primary shadowResult    `json:"primary"`
+	Shadow  shadowResult    `json:"shadow"`
+}
+
+// shadowResult is the outcome of the primary or the mirrored request.
+type shadowResult struct {
+	Model        string      `json:"model"`
+	Target       string      `json:"target"`
+	Status       int         `json:"status"`
+	LatencyMS    int64       `json:"latency_ms"`
+	Usage        *auditUsage `json:"usage,omitempty"`
+	Output       string      `json:"output,omitempty"`
+	FinishReason string      `json:"finish_reason,omitempty"`
+	Error        string      `json:"error,omitempty"`
+}
+
+// initShadowLog configures the shadow sink from the SHADOW_LOG* environment
+// variables. Mirroring stays disabled when SHADOW_LOG is not set, even if
+// shadows are configured.
+func initShadowLog() error {
+	dest := strings.TrimSpace(os.Getenv("SHADOW_LOG"))
+	if dest == "" {
+		if len(config.Shadows) > 0 {
+			logger.Warn("initShadowLog: Shadows are configured but SHADOW_LOG is not set, mirroring disabled")
+		}
+		return nil
+	}
+
+	var w io.Writer
+	if dest == "stdout" || dest == "-" {
+		w = os.Stdout
+	} else {
+		maxSizeMB, err := envInt("SHADOW_LOG_MAX_SIZE_MB", 100)
+		if err != nil {
+			return err
+		}
+		f, err := openRotatingFile(dest, int64(maxSizeMB)<<20, 5)
+		if err != nil {
+			return fmt.Errorf("opening shadow log %s: %w", dest, err)
+		}
+		w = f
+	}
+	concurrency, err := envInt("SHADOW_MAX_CONCURRENCY", 4)
+	if err != nil {
+		return err
+	}
+	if concurrency < 1 {
+		return fmt.Errorf("invalid SHADOW_MAX_CONCURRENCY %d", concurrency)
+	}
+	r, err := newRedactorFromEnv()
+	if err != nil {
+		return err
+	}
+	shadowLog = newShadowLogger(w, concurrency, r)
+	logger.Info("initShadowLog: Shadow log enabled", "destination", dest, "max_concurrency", concurrency)
+	return nil
+}
+
+func newShadowLogger(w io.Writer, concurrency int, r *redactor) *shadowLogger {
+	return &shadowLogger{w: w, slots: make(chan struct{}, concurrency), redactor: r}
+}
+
+func (s *shadowLogger) write(ctx context.Context, record *shadowRecord) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		logger.ErrorContext(ctx, "shadowLogger: Error encoding shadow record", "error", err)
+		return
+	}
+	line = append(line, '\n')
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.w.Write(line); err != nil {
+		logger.ErrorContext(ctx, "shadowLogger: Error writing shadow record", "error", err)
+	}
+}
+
+// serveWithShadow serves a chat completions request with serve and, for a
+// sample of the requests for models with a shadow, sends a copy to the
+// shadow model with forward in the background. Both outputs are written to
+// the shadow log. The client response never waits for the mirrored request:
+// when all mirroring slots are busy the request is not mirrored.
+func serveWithShadow(w http.ResponseWriter, r *http.Request, upstream *upstreamTarget,
+	forward func(*upstreamTarget) http.HandlerFunc, serve http.HandlerFunc) {
+	sl := shadowLog
+	if sl == nil || r.URL.Path != "/v1/chat/completions" || len(config.Shadows) == 0 || r.Body == nil {
+		serve(w, r)
+		return
+	}
+	ctx := r.Context()
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		serve(w, r)
+		return
+	}
+	var req map[string]any
+	json.Unmarshal(body, &req)
+	model, _ := req["model"].(string)
+	sc, ok := config.Shadows[model]
+	if !ok || rand.Float64() >= sc.SampleRate {
+		serve(w, r)
+		return
+	}
+	select {
+	case sl.slots <- struct{}{}:
+	default:
+		logger.DebugContext(ctx, "serveWithShadow: All mirroring slots busy, not mirroring", "model", model)
+		serve(w, r)
+		return
+	}
+
+	shadowTarget := upstream
+	if sc.Target != "" {
+		if tc, ok := config.Targets[sc.Target]; ok {
+			if shadowTarget, err = configuredTarget(sc.Target, tc); err != nil {
+				<-sl.slots
+				logger.WarnContext(ctx, "serveWithShadow: Error resolving shadow target", "error", err)
+				serve(w, r)
+				return
+			}
+		}
+	}
+	req["model"] = sc.Model
+	shadowBody, _ := json.Marshal(req)
+	stream, _ := req["stream"].(bool)
+	record := &shadowRecord{
+		Time:    time.Now().UTC(),
+		Key:     clientKeyName(r),
+		Stream:  stream,
+		Request: sl.redactor.redactBody(body),
+		Primary: shadowResult{Model: model, Target: upstream.name},
+		Shadow:  shadowResult{Model: sc.Model, Target: shadowTarget.name},
+	}
+	if span := trace.SpanContextFromContext(ctx); span.HasTraceID() {
+		record.TraceID = span.TraceID().String()
+	}
+
+	primaryDone := make(chan struct{})
+	shadowCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), shadowTimeout)
+	sr := r.Clone(shadowCtx)
+	sr.Body = io.NopCloser(bytes.NewReader(shadowBody))
+	sr.ContentLength = int64(len(shadowBody))
+	sr.Header.Set("Content-Length", strconv.Itoa(len(shadowBody)))
+	sr.Header.Del("Accept-Encoding")
+	sr.Header.Del(targetHeader)
+	go func() {
+		defer func() { <-sl.slots }()
+		defer cancel()
+		start := time.Now()
+		buf := newResponseBuffer()
+		forward(shadowTarget)(buf, sr)
+		record.Shadow.fill(buf.header, buf.status, buf.body.Bytes(), time.Since(start), stream)
+		<-primaryDone
+		sl.write(shadowCtx, record)
+	}()
+
+	start := time.Now()
+	pw := &auditResponseWriter{ResponseWriter: w, status: http.StatusOK, limit: responseCaptureBytes}
+	serve(pw, r)
+	record.Primary.fill(pw.Header(), pw.status, pw.body.Bytes(), time.Since(start), stream)
+	close(primaryDone)
+}
+
+// fill records a captured chat completions response.
+func (s *shadowResult) fill(h http.Header, status int, body []byte, latency time.Duration, stream bool) {
+	s.Status = status
+	s.LatencyMS = latency.Milliseconds()
+	body = decodeResponseBody(h, body)
+	stream = stream && mediaType(h.Get("Content-Type")) == "text/event-stream"
+	if status >= 400 {
+		s.Error = string(body)
+		return
+	}
+	s.Usage = extractUsage(body, stream)
+	s.Output, s.FinishReason = responseOutput(body, stream)
+}
+
+// responseOutput returns the text and finish reason of the first choice of a
+// chat completion, or of all chunks of a streamed one.
+func responseOutput(body []byte, stream bool) (string, string) {
+	type choice struct {
+		Message struct {
+			Content string `json:"content"`
+		} `json:"message"`
+		Delta struct {
+			Content string `json:"content"`
+		} `json:"delta"`
+		FinishReason string `json:"finish_reason"`
+	}
+	var payload struct {
+		Choices []choice `json:"choices"`
+	}
+	if !stream {
+		if json.Unmarshal(body, &payload) != nil || len(payload.Choices) == 0 {
+			return "", ""
+		}
+		return payload.Choices[0].Message.Content, payload.Choices[0].FinishReason
+	}
+	var text strings.Builder
+	var finishReason string
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(make([]byte, 64*1024), len(body)+1)
+	for scanner.Scan() {
+		data, ok := bytes.CutPrefix(scanner.Bytes(), []byte("data:"))
+		if !ok {
+			continue
+		}
+		payload.Choices = nil
+		if json.Unmarshal(bytes.TrimSpace(data), &payload) != nil || len(payload.Choices) == 0 {
+			continue
+		}
+		text.WriteString(payload.Choices[0].Delta.Content)
+		if r := payload.Choices[0].FinishReason; r != "" {
+			finishReason = r
+		}
+	}
+	return text.String(), finishReason
+}
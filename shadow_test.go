@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// useShadowLog enables mirroring to a buffer for the duration of the test.
+func useShadowLog(t *testing.T, concurrency int) *syncBuffer {
+	t.Helper()
+	r, err := newRedactorFromEnv()
+	if err != nil {
+		t.Fatalf("newRedactorFromEnv() error = %v", err)
+	}
+	out := &syncBuffer{}
+	original := shadowLog
+	t.Cleanup(func() { shadowLog = original })
+	shadowLog = newShadowLogger(out, concurrency, r)
+	return out
+}
+
+func TestServeWithShadow(t *testing.T) {
+	setCachedToken(t, "test-token")
+	out := useShadowLog(t, 4)
+	release := make(chan struct{})
+	targetURL, calls := newModelUpstream(t, func(w http.ResponseWriter, model string) {
+		if model == "google/gemini-2.5-flash" {
+			<-release
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"model":"` + model + `","choices":[{"message":{"content":"from ` + model + `"},"finish_reason":"stop"}],` +
+			`"usage":{"prompt_tokens":3,"completion_tokens":2,"total_tokens":5}}`))
+	})
+	useConfig(t, &proxyConfig{Shadows: map[string]shadowConfig{
+		"google/gemini-2.5-pro": {Model: "google/gemini-2.5-flash", SampleRate: 1},
+	}})
+
+	req := httptest.NewRequest("POST", "http://localhost/v1/chat/completions", strings.NewReader(`{"model":"google/gemini-2.5-pro","messages":[{"role":"user","content":"hi"}]}`))
+	rr := httptest.NewRecorder()
+	makeProxy(targetURL).ServeHTTP(rr, req)
+
+	// The client response must not wait for the mirrored request.
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "from google/gemini-2.5-pro") {
+		t.Fatalf("unexpected primary response %d: %s", rr.Code, rr.Body.String())
+	}
+	if out.String() != "" {
+		t.Fatalf("shadow record written before the mirrored request finished: %s", out.String())
+	}
+	close(release)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for out.String() == "" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	var record shadowRecord
+	if err := json.Unmarshal([]byte(out.String()), &record); err != nil {
+		t.Fatalf("invalid shadow record %q: %v", out.String(), err)
+	}
+	if record.Primary.Model != "google/gemini-2.5-pro" || record.Primary.Output != "from google/gemini-2.5-pro" || record.Primary.Status != http.StatusOK {
+		t.Errorf("primary = %+v", record.Primary)
+	}
+	if record.Shadow.Model != "google/gemini-2.5-flash" || record.Shadow.Output != "from google/gemini-2.5-flash" || record.Shadow.FinishReason != "stop" {
+		t.Errorf("shadow = %+v", record.Shadow)
+	}
+	if record.Shadow.Usage == nil || record.Shadow.Usage.TotalTokens != 5 {
+		t.Errorf("shadow usage = %+v, want 5 total tokens", record.Shadow.Usage)
+	}
+	if !strings.Contains(string(record.Request), `"hi"`) {
+		t.Errorf("request = %s, want the original request", record.Request)
+	}
+	if len(*calls) != 2 {
+		t.Errorf("upstream called with %v, want 2 calls", *calls)
+	}
+}
+
+func TestServeWithShadow_SkipsWhenBusy(t *testing.T) {
+	setCachedToken(t, "test-token")
+	out := useShadowLog(t, 1)
+	shadowLog.slots <- struct{}{} // occupy the only slot
+	targetURL, calls := newModelUpstream(t, func(w http.ResponseWriter, model string) {
+		w.Write([]byte(`{}`))
+	})
+	useConfig(t, &proxyConfig{Shadows: map[string]shadowConfig{
+		"google/gemini-2.5-pro": {Model: "google/gemini-2.5-flash", SampleRate: 1},
+	}})
+
+	req := httptest.NewRequest("POST", "http://localhost/v1/chat/completions", strings.NewReader(`{"model":"google/gemini-2.5-pro"}`))
+	rr := httptest.NewRecorder()
+	makeProxy(targetURL).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rr.Code)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if len(*calls) != 1 || out.String() != "" {
+		t.Errorf("request mirrored while busy: calls %v, log %q", *calls, out.String())
+	}
+}
+
+func TestResponseOutput_Stream(t *testing.T) {
+	body := "data: {\"choices\":[{\"delta\":{\"role\":\"assistant\",\"content\":\"Hel\"}}]}\n\n" +
+		"data: {\"choices\":[{\"delta\":{\"content\":\"lo\"},\"finish_reason\":\"stop\"}]}\n\n" +
+		"data: [DONE]\n\n"
+	text, reason := responseOutput([]byte(body), true)
+	if text != "Hello" || reason != "stop" {
+		t.Errorf("responseOutput() = %q, %q, want Hello, stop", text, reason)
+	}
+}
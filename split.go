@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// variantHeader reports the traffic split variant that served a request.
+	variantHeader = "X-Vertex-Variant"
+	// responseCaptureBytes bounds the response body kept to read usage and outputs.
+	responseCaptureBytes = 4 << 20
+)
+
+// splitConfig splits the traffic of a model alias between variants.
+type splitConfig struct {
+	Variants []splitVariant `json:"variants"`
+	// StickyHeader names a request header, e.g. a user or conversation ID,
+	// that keeps its requests on one variant. Requests without it stick by
+	// client key, and requests without either are assigned at random.
+	StickyHeader string `json:"sticky_header,omitempty"`
+
+	totalWeight int
+}
+
+// splitVariant is a model that receives Weight parts of the traffic.
+type splitVariant struct {
+	// Name identifies the variant in logs and metrics. Defaults to Model.
+	Name   string `json:"name,omitempty"`
+	Model  string `json:"model"`
+	Weight int    `json:"weight"`
+}
+
+func (s *splitConfig) validate() error {
+	if len(s.Variants) == 0 {
+		return errors.New("variants are required")
+	}
+	names := map[string]bool{}
+	s.totalWeight = 0
+	for i := range s.Variants {
+		v := &s.Variants[i]
+		if v.Model == "" {
+			return fmt.Errorf("variants[%d]: model is required", i)
+		}
+		if v.Weight < 0 {
+			return fmt.Errorf("variants[%d]: weight must not be negative", i)
+		}
+		if v.Name == "" {
+			v.Name = v.Model
+		}
+		if names[v.Name] {
+			return fmt.Errorf("variants[%d]: duplicate name %q", i, v.Name)
+		}
+		names[v.Name] = true
+		s.totalWeight += v.Weight
+	}
+	if s.totalWeight == 0 {
+		return errors.New("at least one variant needs a positive weight")
+	}
+	return nil
+}
+
+// pick returns the variant for a request. Requests with the same non-empty
+// sticky key always get the same variant as long as the weights don't change.
+func (s *splitConfig) pick(alias, stickyKey string) *splitVariant {
+	var n int
+	if stickyKey == "" {
+		n = rand.IntN(s.totalWeight)
+	} else {
+		h := fnv.New64a()
+		io.WriteString(h, alias)
+		h.Write([]byte{0})
+		io.WriteString(h, stickyKey)
+		n = int(h.Sum64() % uint64(s.totalWeight))
+	}
+	for i := range s.Variants {
+		v := &s.Variants[i]
+		if n < v.Weight {
+			return v
+		}
+		n -= v.Weight
+	}
+	return &s.Variants[len(s.Variants)-1]
+}
+
+// serveWithSplit replaces a traffic split alias in a chat completions request
+// with the model of the variant assigned to the request, and records the
+// outcome per variant. Other requests are passed to serve unchanged.
+func serveWithSplit(w http.ResponseWriter, r *http.Request, serve http.HandlerFunc) {
+	if r.URL.Path != "/v1/chat/completions" || len(config.Splits) == 0 || r.Body == nil {
+		serve(w, r)
+		return
+	}
+	ctx := r.Context()
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "invalid_body", "Error reading request body")
+		return
+	}
+	var req map[string]any
+	json.Unmarshal(body, &req)
+	alias, _ := req["model"].(string)
+	split, ok := config.Splits[alias]
+	if !ok {
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		serve(w, r)
+		return
+	}
+
+	stickyKey := ""
+	if split.StickyHeader != "" {
+		stickyKey = r.Header.Get(split.StickyHeader)
+	}
+	if stickyKey == "" {
+		stickyKey = clientKey(r)
+	}
+	variant := split.pick(alias, stickyKey)
+	req["model"] = variant.Model
+	body, _ = json.Marshal(req)
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+
+	logger.InfoContext(ctx, "serveWithSplit: Assigned variant", "alias", alias, "variant", variant.Name, "model", variant.Model, "key", clientKeyName(r), "sticky", stickyKey != "")
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.String("proxy.split", alias),
+		attribute.String("proxy.variant", variant.Name),
+	)
+	w.Header().Set(variantHeader, variant.Name)
+
+	start := time.Now()
+	sw := &auditResponseWriter{ResponseWriter: w, status: http.StatusOK, limit: responseCaptureBytes}
+	serve(sw, r)
+
+	attrs := []attribute.KeyValue{
+		attribute.String("proxy.split", alias),
+		attribute.String("proxy.variant", variant.Name),
+		attribute.String("proxy.model", variant.Model),
+	}
+	with := func(extra ...attribute.KeyValue) metric.MeasurementOption {
+		return metric.WithAttributes(append(attrs[:len(attrs):len(attrs)], extra...)...)
+	}
+	metrics.splitRequests.Add(ctx, 1, with(attribute.Int("http.response.status_code", sw.status)))
+	metrics.splitDuration.Record(ctx, time.Since(start).Seconds(), with())
+	respBody := decodeResponseBody(sw.Header(), sw.body.Bytes())
+	if usage := extractUsage(respBody, mediaType(sw.Header().Get("Content-Type")) == "text/event-stream"); usage != nil {
+		metrics.splitTokens.Add(ctx, int64(usage.PromptTokens), with(attribute.String("proxy.token_type", "prompt")))
+		metrics.splitTokens.Add(ctx, int64(usage.CompletionTokens), with(attribute.String("proxy.token_type", "completion")))
+	}
+}
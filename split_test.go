@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+// recordMetrics makes the proxy record metrics to a reader for the duration of the test.
+func recordMetrics(t *testing.T) *sdkmetric.ManualReader {
+	t.Helper()
+	reader := sdkmetric.NewManualReader()
+	provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	original := metrics
+	t.Cleanup(func() { metrics = original })
+	metrics = newProxyMetrics(provider.Meter(instrumentationName))
+	return reader
+}
+
+// sumByAttr collects the data points of an Int64 sum metric keyed by one attribute.
+func sumByAttr(t *testing.T, reader *sdkmetric.ManualReader, name string, key attribute.Key) map[string]int64 {
+	t.Helper()
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatalf("Collect() error = %v", err)
+	}
+	got := map[string]int64{}
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name != name {
+				continue
+			}
+			for _, dp := range m.Data.(metricdata.Sum[int64]).DataPoints {
+				v, _ := dp.Attributes.Value(key)
+				got[v.Emit()] += dp.Value
+			}
+		}
+	}
+	return got
+}
+
+func TestSplitConfig_Pick(t *testing.T) {
+	split := &splitConfig{Variants: []splitVariant{
+		{Name: "control", Model: "google/gemini-2.5-pro", Weight: 80},
+		{Name: "candidate", Model: "google/gemini-2.5-flash", Weight: 20},
+		{Name: "off", Model: "google/gemini-2.0-flash", Weight: 0},
+	}}
+	if err := split.validate(); err != nil {
+		t.Fatalf("validate() error = %v", err)
+	}
+
+	counts := map[string]int{}
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("user-%d", i)
+		v := split.pick("chat", key)
+		if again := split.pick("chat", key); again != v {
+			t.Fatalf("pick(%q) is not sticky: %s then %s", key, v.Name, again.Name)
+		}
+		counts[v.Name]++
+	}
+	if counts["off"] != 0 {
+		t.Errorf("variant with zero weight picked %d times", counts["off"])
+	}
+	if counts["candidate"] < 300 || counts["candidate"] > 500 {
+		t.Errorf("candidate picked %d of 2000 times, want about 400", counts["candidate"])
+	}
+}
+
+func TestServeWithSplit(t *testing.T) {
+	setCachedToken(t, "test-token")
+	reader := recordMetrics(t)
+	useConfig(t, &proxyConfig{Splits: map[string]*splitConfig{
+		"chat": {
+			Variants: []splitVariant{
+				{Name: "control", Model: "google/gemini-2.5-pro", Weight: 1},
+				{Name: "candidate", Model: "google/gemini-2.5-flash", Weight: 1},
+			},
+			StickyHeader: "X-User-Id",
+		},
+	}})
+	targetURL, calls := newModelUpstream(t, func(w http.ResponseWriter, model string) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"model":"` + model + `","usage":{"prompt_tokens":3,"completion_tokens":2,"total_tokens":5}}`))
+	})
+	proxy := makeProxy(targetURL)
+
+	variants := map[string]string{}
+	for i := 0; i < 20; i++ {
+		for _, user := range []string{"alice", "bob", "carol", "dave"} {
+			req := httptest.NewRequest("POST", "http://localhost/v1/chat/completions", strings.NewReader(`{"model":"chat"}`))
+			req.Header.Set("X-User-Id", user)
+			rr := httptest.NewRecorder()
+			proxy.ServeHTTP(rr, req)
+
+			if rr.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200: %s", rr.Code, rr.Body.String())
+			}
+			variant := rr.Header().Get(variantHeader)
+			if prev, ok := variants[user]; ok && prev != variant {
+				t.Fatalf("user %s moved from variant %s to %s", user, prev, variant)
+			}
+			variants[user] = variant
+		}
+	}
+	for _, model := range *calls {
+		if model != "google/gemini-2.5-pro" && model != "google/gemini-2.5-flash" {
+			t.Fatalf("upstream got model %q, want a variant model", model)
+		}
+	}
+
+	requests := sumByAttr(t, reader, "proxy.split.requests", "proxy.variant")
+	tokens := sumByAttr(t, reader, "proxy.split.tokens", "proxy.variant")
+	var total int64
+	for variant, n := range requests {
+		total += n
+		if tokens[variant] != 5*n {
+			t.Errorf("variant %s used %d tokens in %d requests, want %d", variant, tokens[variant], n, 5*n)
+		}
+	}
+	if total != 80 {
+		t.Errorf("recorded %d requests, want 80: %v", total, requests)
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// structuredOutput is what the responses of a chat completions request are
+// validated against.
+type structuredOutput struct {
+	// schema validates the message content; jsonObject only requires a JSON
+	// object. Both are unset without a JSON response_format.
+	schema     map[string]any
+	jsonObject bool
+	// tools maps function names to the schemas of their arguments.
+	tools map[string]map[string]any
+}
+
+// newStructuredOutput returns what the responses of req must satisfy, or
+// nil if they are free-form.
+func newStructuredOutput(req map[string]any) *structuredOutput {
+	s := &structuredOutput{tools: map[string]map[string]any{}}
+	if format, ok := req["response_format"].(map[string]any); ok {
+		switch format["type"] {
+		case "json_schema":
+			js, _ := format["json_schema"].(map[string]any)
+			s.schema, _ = js["schema"].(map[string]any)
+			s.jsonObject = s.schema == nil
+		case "json_object":
+			s.jsonObject = true
+		}
+	}
+	tools, _ := req["tools"].([]any)
+	for _, t := range tools {
+		tool, _ := t.(map[string]any)
+		fn, _ := tool["function"].(map[string]any)
+		name, _ := fn["name"].(string)
+		if params, ok := fn["parameters"].(map[string]any); ok && name != "" {
+			s.tools[name] = params
+		}
+	}
+	if s.schema == nil && !s.jsonObject && len(s.tools) == 0 {
+		return nil
+	}
+	return s
+}
+
+// check validates the first choice of a chat completion, repairing its
+// content and tool call arguments in place where possible. When validation
+// fails, it returns the error and the messages to append to the
+// conversation to ask the model for a correction: its invalid answer and
+// the error.
+func (s *structuredOutput) check(resp map[string]any) ([]any, error) {
+	choices, _ := resp["choices"].([]any)
+	if len(choices) == 0 {
+		return nil, nil
+	}
+	choice, _ := choices[0].(map[string]any)
+	msg, _ := choice["message"].(map[string]any)
+	if msg == nil {
+		return nil, nil
+	}
+	for _, tc := range toolCalls(msg) {
+		fn, _ := tc["function"].(map[string]any)
+		name, _ := fn["name"].(string)
+		args, _ := fn["arguments"].(string)
+		schema, known := s.tools[name]
+		if !known {
+			continue
+		}
+		repaired, err := validateJSONText(args, schema, false)
+		if err != nil {
+			// Only the invalid call is kept, so that it is the only one
+			// that needs a tool result.
+			return []any{
+				map[string]any{"role": "assistant", "content": nil, "tool_calls": []any{tc}},
+				map[string]any{"role": "tool", "tool_call_id": tc["id"], "content": fmt.Sprintf(
+					"The arguments are invalid: %v. Call %s again with corrected arguments.", err, name)},
+			}, fmt.Errorf("arguments of tool call %q: %w", name, err)
+		}
+		fn["arguments"] = repaired
+	}
+	content, ok := msg["content"].(string)
+	if !ok || (s.schema == nil && !s.jsonObject) || len(toolCalls(msg)) > 0 {
+		return nil, nil
+	}
+	repaired, err := validateJSONText(content, s.schema, s.jsonObject)
+	if err != nil {
+		return []any{
+			map[string]any{"role": "assistant", "content": content},
+			map[string]any{"role": "user", "content": fmt.Sprintf(
+				"Your response is invalid: %v. Reply with only the corrected JSON.", err)},
+		}, err
+	}
+	msg["content"] = repaired
+	return nil, nil
+}
+
+func toolCalls(msg map[string]any) []map[string]any {
+	calls, _ := msg["tool_calls"].([]any)
+	out := make([]map[string]any, 0, len(calls))
+	for _, c := range calls {
+		if call, ok := c.(map[string]any); ok {
+			out = append(out, call)
+		}
+	}
+	return out
+}
+
+// validateJSONText parses text as JSON, repairing it if needed, and checks
+// it against schema, or only for being an object if jsonObject is set. It
+// returns the repaired text.
+func validateJSONText(text string, schema map[string]any, jsonObject bool) (string, error) {
+	repaired, ok := repairJSON(text)
+	if !ok {
+		return "", errors.New("not valid JSON")
+	}
+	var value any
+	if err := json.Unmarshal([]byte(repaired), &value); err != nil {
+		return "", fmt.Errorf("not valid JSON: %w", err)
+	}
+	if jsonObject {
+		if _, ok := value.(map[string]any); !ok {
+			return "", fmt.Errorf("expected a JSON object, got %s", jsonTypeName(value))
+		}
+	}
+	if schema != nil {
+		if err := validateJSONSchema(schema, value); err != nil {
+			return "", err
+		}
+	}
+	return repaired, nil
+}
+
+// repairJSON returns text as valid JSON: unchanged if it already is, else
+// with markdown code fences and surrounding prose removed, trailing commas
+// dropped, and an unterminated string and unclosed brackets of truncated
+// output closed. It reports false if that isn't enough.
+func repairJSON(text string) (string, bool) {
+	s := strings.TrimSpace(text)
+	if json.Valid([]byte(s)) {
+		return s, true
+	}
+	if rest, ok := strings.CutPrefix(s, "```"); ok {
+		// Drop the info string, e.g. ```json.
+		if _, body, found := strings.Cut(rest, "\n"); found {
+			rest = body
+		}
+		s = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(rest), "```"))
+		if json.Valid([]byte(s)) {
+			return s, true
+		}
+	}
+	start := strings.IndexAny(s, "{[")
+	if start < 0 {
+		return "", false
+	}
+
+	var out []byte
+	var stack []byte
+	inString, escaped := false, false
+	for i := start; i < len(s); i++ {
+		c := s[i]
+		if inString {
+			out = append(out, c)
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				inString = false
+			}
+			continue
+		}
+		switch c {
+		case '"':
+			inString = true
+		case '{':
+			stack = append(stack, '}')
+		case '[':
+			stack = append(stack, ']')
+		case '}', ']':
+			out = trimTrailingComma(out)
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		}
+		out = append(out, c)
+		if len(stack) == 0 {
+			// Text after the JSON value is prose.
+			break
+		}
+	}
+	if inString {
+		if escaped {
+			out = out[:len(out)-1]
+		}
+		out = append(out, '"')
+	}
+	out = trimTrailingComma(out)
+	if t := bytes.TrimRight(out, " \t\r\n"); len(t) > 0 && t[len(t)-1] == ':' {
+		out = append(t, "null"...)
+	}
+	for i := len(stack) - 1; i >= 0; i-- {
+		out = append(out, stack[i])
+	}
+	if !json.Valid(out) {
+		return "", false
+	}
+	return string(out), true
+}
+
+// trimTrailingComma removes whitespace and a comma at the end of b.
+func trimTrailingComma(b []byte) []byte {
+	t := bytes.TrimRight(b, " \t\r\n")
+	if len(t) > 0 && t[len(t)-1] == ',' {
+		return t[:len(t)-1]
+	}
+	return b
+}
+
+// Structured output validation settings, set by initValidation from
+// VERTEXAI_VALIDATE_JSON and VERTEXAI_VALIDATE_JSON_RETRIES.
+var (
+	validateJSON        bool
+	validateJSONRetries = 2
+)
+
+// initValidation reads VERTEXAI_VALIDATE_JSON and
+// VERTEXAI_VALIDATE_JSON_RETRIES, which must not be negative.
+func initValidation() error {
+	enabled, err := envFlag("VERTEXAI_VALIDATE_JSON", false)
+	if err != nil {
+		return err
+	}
+	retries, err := envInt("VERTEXAI_VALIDATE_JSON_RETRIES", 2)
+	if err != nil {
+		return err
+	}
+	if retries < 0 {
+		return fmt.Errorf("invalid VERTEXAI_VALIDATE_JSON_RETRIES %d: must not be negative", retries)
+	}
+	validateJSON, validateJSONRetries = enabled, retries
+	logger.Info("initValidation: Configured structured output validation", "enabled", validateJSON, "retries", validateJSONRetries)
+	return nil
+}
+
+// serveWithValidation serves a non-streaming chat completions request that
+// asks for JSON output or offers tools with serve, and validates the
+// message content and tool call arguments of the response against the
+// requested schemas. Broken JSON is repaired when possible. Otherwise the
+// model is asked again, with the validation error, up to
+// VERTEXAI_VALIDATE_JSON_RETRIES times, and a 422 error is returned if it
+// still fails. Validation is enabled with VERTEXAI_VALIDATE_JSON.
+func serveWithValidation(w http.ResponseWriter, r *http.Request, serve http.HandlerFunc) {
+	if !validateJSON || r.URL.Path != "/v1/chat/completions" || r.Body == nil {
+		serve(w, r)
+		return
+	}
+	ctx := r.Context()
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		serve(w, r)
+		return
+	}
+	var req map[string]any
+	if json.Unmarshal(body, &req) != nil {
+		serve(w, r)
+		return
+	}
+	stream, _ := req["stream"].(bool)
+	n, _ := req["n"].(float64)
+	spec := newStructuredOutput(req)
+	if spec == nil || stream || n > 1 {
+		serve(w, r)
+		return
+	}
+	retries := validateJSONRetries
+
+	messages, _ := req["messages"].([]any)
+	var usage map[string]any
+	var lastErr error
+	for attempt := 0; attempt <= retries; attempt++ {
+		attemptBody := body
+		if attempt > 0 {
+			attemptBody, _ = json.Marshal(req)
+		}
+		ar := r.Clone(ctx)
+		ar.Body = io.NopCloser(bytes.NewReader(attemptBody))
+		ar.ContentLength = int64(len(attemptBody))
+		ar.Header.Set("Content-Length", strconv.Itoa(len(attemptBody)))
+		// The response is parsed to validate it.
+		ar.Header.Del("Accept-Encoding")
+		buf := newResponseBuffer()
+		serve(buf, ar)
+		var resp map[string]any
+		if buf.status != http.StatusOK || json.Unmarshal(buf.body.Bytes(), &resp) != nil {
+			writeBufferedResponse(w, buf)
+			return
+		}
+		if u, ok := resp["usage"].(map[string]any); ok {
+			if usage == nil {
+				usage = map[string]any{}
+			}
+			// Every attempt is billed.
+			sumUsage(usage, u)
+			resp["usage"] = usage
+		}
+
+		retry, err := spec.check(resp)
+		if err == nil {
+			out, _ := json.Marshal(resp)
+			buf.body.Reset()
+			buf.body.Write(out)
+			writeBufferedResponse(w, buf)
+			return
+		}
+		lastErr = err
+		logger.WarnContext(ctx, "serveWithValidation: Response failed validation", "attempt", attempt+1, "error", err)
+		// Ask the model to correct its answer.
+		messages = append(messages, retry...)
+		req["messages"] = messages
+	}
+	writeOpenAIError(w, http.StatusUnprocessableEntity, "invalid_response_error", "invalid_json_output",
+		fmt.Sprintf("The model's response failed validation after %d attempts: %v", retries+1, lastErr))
+}
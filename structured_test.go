@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRepairJSON(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+		ok   bool
+	}{
+		{`{"a":1}`, `{"a":1}`, true},
+		{"```json\n{\"a\": 1}\n```", `{"a": 1}`, true},
+		{"```\n[1, 2]\n```", `[1, 2]`, true},
+		{`Here you go: {"a": [1, 2,], } Hope this helps!`, `{"a": [1, 2]}`, true},
+		{`{"a": "trunc`, `{"a": "trunc"}`, true},
+		{`{"a": {"b": [1, 2`, `{"a": {"b": [1, 2]}}`, true},
+		{`{"a": 1, "b":`, `{"a": 1, "b":null}`, true},
+		{`{"a": "x\"y", "b": "}"`, `{"a": "x\"y", "b": "}"}`, true},
+		{`no json here`, "", false},
+		{`{"a" 1}`, "", false},
+	}
+	for _, tt := range tests {
+		got, ok := repairJSON(tt.in)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("repairJSON(%q) = %q, %v, want %q, %v", tt.in, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestServeWithValidation(t *testing.T) {
+	setCachedToken(t, "test-token")
+	originalEnabled, originalRetries := validateJSON, validateJSONRetries
+	t.Cleanup(func() { validateJSON, validateJSONRetries = originalEnabled, originalRetries })
+	t.Setenv("VERTEXAI_VALIDATE_JSON", "true")
+	t.Setenv("VERTEXAI_VALIDATE_JSON_RETRIES", "1")
+	if err := initValidation(); err != nil {
+		t.Fatalf("initValidation() error = %v", err)
+	}
+	const request = `{"model":"m","messages":[{"role":"user","content":"person?"}],` +
+		`"response_format":{"type":"json_schema","json_schema":{"name":"p","schema":{"type":"object","required":["name"],"properties":{"name":{"type":"string"}}}}}}`
+
+	tests := []struct {
+		name        string
+		contents    []string
+		wantStatus  int
+		wantContent string
+		wantCalls   int
+	}{
+		{"valid", []string{`{"name":"Ann"}`}, http.StatusOK, `{"name":"Ann"}`, 1},
+		{"fenced", []string{"```json\n{\"name\":\"Ann\"}\n```"}, http.StatusOK, `{"name":"Ann"}`, 1},
+		{"re-asked", []string{`{"nom":"Ann"}`, `{"name":"Ann"}`}, http.StatusOK, `{"name":"Ann"}`, 2},
+		{"still invalid", []string{`{"nom":"Ann"}`, `not json`}, http.StatusUnprocessableEntity, "", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var requests []map[string]any
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var req map[string]any
+				json.NewDecoder(r.Body).Decode(&req)
+				mu.Lock()
+				requests = append(requests, req)
+				content := tt.contents[min(len(requests), len(tt.contents))-1]
+				mu.Unlock()
+				msg, _ := json.Marshal(content)
+				fmt.Fprintf(w, `{"choices":[{"index":0,"message":{"role":"assistant","content":%s}}],"usage":{"prompt_tokens":10,"completion_tokens":5,"total_tokens":15}}`, msg)
+			}))
+			defer server.Close()
+			target, _ := url.Parse(server.URL)
+			proxy := makeProxy(target)
+
+			rr := httptest.NewRecorder()
+			proxy.ServeHTTP(rr, httptest.NewRequest("POST", "http://localhost/v1/chat/completions", strings.NewReader(request)))
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rr.Code, tt.wantStatus, rr.Body.String())
+			}
+			if len(requests) != tt.wantCalls {
+				t.Errorf("upstream called %d times, want %d", len(requests), tt.wantCalls)
+			}
+			if tt.wantStatus != http.StatusOK {
+				if !strings.Contains(rr.Body.String(), `"code":"invalid_json_output"`) {
+					t.Errorf("body = %s, want invalid_json_output error", rr.Body.String())
+				}
+				return
+			}
+			var resp struct {
+				Choices []struct {
+					Message struct {
+						Content string `json:"content"`
+					} `json:"message"`
+				} `json:"choices"`
+				Usage auditUsage `json:"usage"`
+			}
+			json.Unmarshal(rr.Body.Bytes(), &resp)
+			if got := resp.Choices[0].Message.Content; got != tt.wantContent {
+				t.Errorf("content = %q, want %q", got, tt.wantContent)
+			}
+			if want := 15 * tt.wantCalls; resp.Usage.TotalTokens != want {
+				t.Errorf("total_tokens = %d, want %d", resp.Usage.TotalTokens, want)
+			}
+			if tt.wantCalls > 1 {
+				msgs, _ := json.Marshal(requests[1]["messages"])
+				if !strings.Contains(string(msgs), `Your response is invalid: $: missing required property \"name\"`) {
+					t.Errorf("re-ask messages = %s", msgs)
+				}
+			}
+		})
+	}
+}
+
+func TestInitValidation(t *testing.T) {
+	originalEnabled, originalRetries := validateJSON, validateJSONRetries
+	t.Cleanup(func() { validateJSON, validateJSONRetries = originalEnabled, originalRetries })
+	for _, env := range [][2]string{{"maybe", "1"}, {"true", "-1"}, {"true", "x"}} {
+		t.Setenv("VERTEXAI_VALIDATE_JSON", env[0])
+		t.Setenv("VERTEXAI_VALIDATE_JSON_RETRIES", env[1])
+		if err := initValidation(); err == nil {
+			t.Errorf("initValidation() with %q, %q succeeded, want error", env[0], env[1])
+		}
+	}
+}
+
+func TestStructuredOutput_ToolArguments(t *testing.T) {
+	spec := newStructuredOutput(map[string]any{"tools": []any{map[string]any{"type": "function", "function": map[string]any{
+		"name": "get_weather", "parameters": map[string]any{"type": "object", "required": []any{"city"}},
+	}}}})
+	resp := func(args string) map[string]any {
+		var r map[string]any
+		json.Unmarshal([]byte(fmt.Sprintf(`{"choices":[{"message":{"tool_calls":[{"id":"call_1","function":{"name":"get_weather","arguments":%q}}]}}]}`, args)), &r)
+		return r
+	}
+
+	fixed := resp(`{"city": "Paris",}`)
+	if _, err := spec.check(fixed); err != nil {
+		t.Fatalf("check() error = %v", err)
+	}
+	if args, _ := json.Marshal(fixed["choices"]); !strings.Contains(string(args), `"arguments":"{\"city\": \"Paris\"}"`) {
+		t.Errorf("arguments not repaired: %s", args)
+	}
+	retry, err := spec.check(resp(`{"town": "Paris"}`))
+	if err == nil || !strings.Contains(err.Error(), `tool call "get_weather"`) {
+		t.Errorf("check() error = %v, want invalid get_weather arguments", err)
+	}
+	want := `[{"content":null,"role":"assistant","tool_calls":[{"function":{"arguments":"{\"town\": \"Paris\"}","name":"get_weather"},"id":"call_1"}]},` +
+		`{"content":"The arguments are invalid: $: missing required property \"city\". Call get_weather again with corrected arguments.","role":"tool","tool_call_id":"call_1"}]`
+	if got, _ := json.Marshal(retry); string(got) != want {
+		t.Errorf("check() retry messages = %s\nwant %s", got, want)
+	}
+}
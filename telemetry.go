@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/ei-grad/vertexai-openapi-proxy"
+
+// tracer is resolved through the global provider, so spans started before
+// initTracing completes are simply dropped instead of panicking.
+var tracer = otel.Tracer(instrumentationName)
+
+// initTracing configures W3C trace context propagation and, when an OTLP
+// collector is configured via the standard OTEL_EXPORTER_OTLP_* environment
+// variables, an OTLP/HTTP span exporter. Propagation is always enabled so that
+// an incoming traceparent is honored and forwarded upstream even when spans
+// are not exported. The returned function flushes pending spans.
+func initTracing(ctx context.Context) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		logger.Info("initTracing: OTLP endpoint not configured, span export disabled")
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("creating OTLP trace exporter: %w", err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		attribute.String("service.name", serviceName()),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("creating trace resource: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	logger.Info("initTracing: OTLP span export enabled", "service_name", serviceName())
+	return provider.Shutdown, nil
+}
+
+// serviceName returns the service name reported in spans and metrics.
+func serviceName() string {
+	if name := os.Getenv("OTEL_SERVICE_NAME"); name != "" {
+		return name
+	}
+	return "vertexai-openapi-proxy"
+}
+
+// upstreamTransport returns the RoundTripper used for requests to Vertex AI.
+// It creates a client span per upstream round trip, injects the traceparent
+// header and records time-to-first-token for streaming responses.
+func upstreamTransport(base http.RoundTripper) http.RoundTripper {
+	return otelhttp.NewTransport(&ttftTransport{base: base},
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			return "upstream " + r.Method
+		}),
+	)
+}
+
+// ttftTransport records a "proxy.time_to_first_token" span for streamed
+// (text/event-stream) responses, starting when the request is sent and ending
+// when the first bytes of the body arrive.
+type ttftTransport struct {
+	base http.RoundTripper
+}
+
+func (t *ttftTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || resp.Body == nil {
+		return resp, err
+	}
+	if mediaType(resp.Header.Get("Content-Type")) == "text/event-stream" {
+		resp.Body = &ttftBody{ReadCloser: resp.Body, ctx: req.Context(), start: start}
+	}
+	return resp, nil
+}
+
+type ttftBody struct {
+	io.ReadCloser
+	ctx   context.Context
+	start time.Time
+	seen  bool
+}
+
+func (b *ttftBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 && !b.seen {
+		b.seen = true
+		ttft := time.Since(b.start)
+		_, span := tracer.Start(b.ctx, "proxy.time_to_first_token", trace.WithTimestamp(b.start))
+		span.SetAttributes(attribute.Int64("proxy.ttft_ms", ttft.Milliseconds()))
+		span.End()
+		logger.DebugContext(b.ctx, "ttftBody: First bytes of streamed response received", "ttft", ttft)
+	}
+	return n, err
+}
+
+// mediaType returns the media type of a Content-Type header value without parameters.
+func mediaType(contentType string) string {
+	mt, _, _ := strings.Cut(contentType, ";")
+	return strings.ToLower(strings.TrimSpace(mt))
+}
+
+// traceLogHandler adds the trace and span IDs of the span in the record's
+// context to every log record. In JSON mode it additionally emits the fields
+// Cloud Logging uses to correlate log entries with Cloud Trace.
+type traceLogHandler struct {
+	slog.Handler
+	cloudLogging bool
+	projectID    string
+}
+
+func (h *traceLogHandler) Handle(ctx context.Context, r slog.Record) error {
+	sc := trace.SpanContextFromContext(ctx)
+	if sc.IsValid() {
+		traceID := sc.TraceID().String()
+		if h.cloudLogging {
+			if h.projectID != "" {
+				r.AddAttrs(slog.String("logging.googleapis.com/trace", "projects/"+h.projectID+"/traces/"+traceID))
+			} else {
+				r.AddAttrs(slog.String("logging.googleapis.com/trace", traceID))
+			}
+			r.AddAttrs(
+				slog.String("logging.googleapis.com/spanId", sc.SpanID().String()),
+				slog.Bool("logging.googleapis.com/trace_sampled", sc.IsSampled()),
+			)
+		} else {
+			r.AddAttrs(slog.String("trace_id", traceID), slog.String("span_id", sc.SpanID().String()))
+		}
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *traceLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &traceLogHandler{Handler: h.Handler.WithAttrs(attrs), cloudLogging: h.cloudLogging, projectID: h.projectID}
+}
+
+func (h *traceLogHandler) WithGroup(name string) slog.Handler {
+	return &traceLogHandler{Handler: h.Handler.WithGroup(name), cloudLogging: h.cloudLogging, projectID: h.projectID}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// setCachedToken makes getToken return tok without fetching credentials.
+func setCachedToken(t *testing.T, tok string) {
+	t.Helper()
+	adcTokenProvider.mu.Lock()
+	adcTokenProvider.token = tok
+	adcTokenProvider.expiry = time.Now().Add(time.Hour)
+	adcTokenProvider.mu.Unlock()
+}
+
+func TestTracing_PropagatesTraceparentUpstream(t *testing.T) {
+	if _, err := initTracing(context.Background()); err != nil {
+		t.Fatalf("initTracing() error = %v", err)
+	}
+	setCachedToken(t, "test-token")
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	var gotTraceparent string
+	targetServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotTraceparent = r.Header.Get("Traceparent")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer targetServer.Close()
+
+	targetURL, _ := url.Parse(targetServer.URL)
+	handler := otelhttp.NewHandler(makeProxy(targetURL), "proxy")
+
+	req := httptest.NewRequest("POST", "http://localhost/v1/chat/completions", strings.NewReader(`{"model":"m"}`))
+	req.Header.Set("Traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if !strings.Contains(gotTraceparent, traceID) {
+		t.Errorf("upstream traceparent = %q, want trace ID %s", gotTraceparent, traceID)
+	}
+}
+
+func TestTracing_RecordsRequestSpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	originalProvider := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	defer otel.SetTracerProvider(originalProvider)
+	setCachedToken(t, "test-token")
+
+	targetServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: {}\n\ndata: [DONE]\n\n"))
+	}))
+	defer targetServer.Close()
+
+	targetURL, _ := url.Parse(targetServer.URL)
+	handler := otelhttp.NewHandler(makeProxy(targetURL), "proxy")
+
+	req := httptest.NewRequest("POST", "http://localhost/v1/chat/completions", strings.NewReader(`{"stream":true}`))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	names := map[string]bool{}
+	for _, span := range recorder.Ended() {
+		names[span.Name()] = true
+	}
+	for _, want := range []string{"proxy", "proxy.transform_body", "proxy.auth", "getToken", "upstream POST", "proxy.time_to_first_token"} {
+		if !names[want] {
+			t.Errorf("span %q not recorded, got %v", want, names)
+		}
+	}
+}
+
+func TestTraceLogHandler_CloudLoggingFields(t *testing.T) {
+	var buf bytes.Buffer
+	h := &traceLogHandler{
+		Handler:      slog.NewJSONHandler(&buf, nil),
+		cloudLogging: true,
+		projectID:    "test-project",
+	}
+	traceID, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	spanID, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+	ctx := trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.FlagsSampled,
+	}))
+
+	slog.New(h).InfoContext(ctx, "hello")
+
+	var entry map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("failed to decode log entry %q: %v", buf.String(), err)
+	}
+	if got, want := entry["logging.googleapis.com/trace"], "projects/test-project/traces/4bf92f3577b34da6a3ce929d0e0e4736"; got != want {
+		t.Errorf("trace field = %v, want %v", got, want)
+	}
+	if got, want := entry["logging.googleapis.com/spanId"], "00f067aa0ba902b7"; got != want {
+		t.Errorf("spanId field = %v, want %v", got, want)
+	}
+	if entry["logging.googleapis.com/trace_sampled"] != true {
+		t.Errorf("trace_sampled field = %v, want true", entry["logging.googleapis.com/trace_sampled"])
+	}
+}
+
+func TestTraceLogHandler_TextFields(t *testing.T) {
+	var buf bytes.Buffer
+	h := &traceLogHandler{Handler: slog.NewTextHandler(&buf, nil)}
+	traceID, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	spanID, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+	ctx := trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID: traceID,
+		SpanID:  spanID,
+	}))
+
+	slog.New(h).InfoContext(ctx, "hello")
+	if !strings.Contains(buf.String(), "trace_id=4bf92f3577b34da6a3ce929d0e0e4736") || !strings.Contains(buf.String(), "span_id=00f067aa0ba902b7") {
+		t.Errorf("log line missing trace IDs: %s", buf.String())
+	}
+
+	buf.Reset()
+	slog.New(h).Info("no context")
+	if strings.Contains(buf.String(), "trace_id") {
+		t.Errorf("log line without span context has trace IDs: %s", buf.String())
+	}
+}
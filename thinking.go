@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// thinkingBudgetHeader lets clients set the Gemini thinking budget of a
+// request in tokens, e.g. when they can't send extra_body. -1 lets the
+// model decide.
+const thinkingBudgetHeader = "X-Thinking-Budget"
+
+// Gemini returns thought summaries in the content, between these tags.
+const (
+	thoughtOpenTag  = "<thought>"
+	thoughtCloseTag = "</thought>"
+)
+
+// includeThoughts asks for thought summaries of every Gemini request, set
+// by initThinking from VERTEXAI_INCLUDE_THOUGHTS.
+var includeThoughts bool
+
+// initThinking reads VERTEXAI_INCLUDE_THOUGHTS.
+func initThinking() error {
+	include, err := envFlag("VERTEXAI_INCLUDE_THOUGHTS", false)
+	if err != nil {
+		return err
+	}
+	includeThoughts = include
+	logger.Info("initThinking: Configured thought summaries", "include_thoughts", includeThoughts)
+	return nil
+}
+
+// applyThinking configures Gemini thinking for a chat completions request:
+// the budget of budgetHeader, the value of the X-Thinking-Budget header,
+// unless the body sets one, and thought summaries when the client asks for
+// reasoning with the header or reasoning_effort, or VERTEXAI_INCLUDE_THOUGHTS
+// is set. It must run before adaptParameters translates reasoning_effort. It
+// reports whether the request configures thinking, so its response needs
+// reasoningRewriter.
+func applyThinking(budgetHeader string, body []byte) ([]byte, bool, error) {
+	var req map[string]any
+	if json.Unmarshal(body, &req) != nil {
+		return body, false, nil
+	}
+	extra, _ := req["extra_body"].(map[string]any)
+	if extra == nil {
+		extra = map[string]any{}
+	}
+	google, _ := extra["google"].(map[string]any)
+	if google == nil {
+		google = map[string]any{}
+	}
+	thinking, _ := google["thinking_config"].(map[string]any)
+	if thinking == nil {
+		thinking = map[string]any{}
+	}
+	effort, _ := req["reasoning_effort"].(string)
+	budgetHeader = strings.TrimSpace(budgetHeader)
+	include := (includeThoughts || budgetHeader != "" || effort != "") && effort != "none"
+	if budgetHeader == "" && !include {
+		return body, effort != "" || len(thinking) > 0, nil
+	}
+
+	if budgetHeader != "" {
+		budget, err := strconv.Atoi(budgetHeader)
+		if err != nil || budget < -1 {
+			return nil, false, fmt.Errorf("invalid %s %q", thinkingBudgetHeader, budgetHeader)
+		}
+		if _, set := thinking["thinking_budget"]; !set {
+			thinking["thinking_budget"] = float64(budget)
+		}
+	}
+	// Thought summaries can't be included with thinking turned off.
+	if _, set := thinking["include_thoughts"]; !set && include && thinking["thinking_budget"] != float64(0) {
+		thinking["include_thoughts"] = true
+	}
+	google["thinking_config"] = thinking
+	extra["google"] = google
+	req["extra_body"] = extra
+	out, err := json.Marshal(req)
+	if err != nil {
+		return body, true, nil
+	}
+	return out, true, nil
+}
+
+// reasoningRewriter moves Gemini thought summaries from the content of chat
+// completions and chunks to reasoning_content, and reports thinking tokens
+// as reasoning_tokens. It keeps the state of a streamed response.
+type reasoningRewriter struct {
+	choices map[float64]*thoughtSplitter
+}
+
+func newReasoningRewriter() *reasoningRewriter {
+	return &reasoningRewriter{choices: map[float64]*thoughtSplitter{}}
+}
+
+// rewrite rewrites a chat completion or the data of a chunk.
+func (rr *reasoningRewriter) rewrite(data []byte) []byte {
+	var payload map[string]any
+	if json.Unmarshal(data, &payload) != nil {
+		return data
+	}
+	changed := false
+	choices, _ := payload["choices"].([]any)
+	for _, c := range choices {
+		choice, _ := c.(map[string]any)
+		index, _ := choice["index"].(float64)
+		finished := choice["finish_reason"] != nil
+		for _, key := range []string{"message", "delta"} {
+			msg, ok := choice[key].(map[string]any)
+			if !ok {
+				continue
+			}
+			content, ok := msg["content"].(string)
+			if !ok {
+				continue
+			}
+			splitter := rr.choices[index]
+			if splitter == nil || key == "message" {
+				splitter = &thoughtSplitter{}
+				rr.choices[index] = splitter
+			}
+			reasoning, text := splitter.split(content)
+			if finished || key == "message" {
+				r, t := splitter.flush()
+				reasoning, text = reasoning+r, text+t
+			}
+			if reasoning == "" && text == content {
+				continue
+			}
+			changed = true
+			if key == "message" {
+				reasoning = strings.TrimSpace(reasoning)
+				text = strings.TrimLeft(text, "\r\n")
+			}
+			if reasoning != "" {
+				existing, _ := msg["reasoning_content"].(string)
+				msg["reasoning_content"] = existing + reasoning
+			}
+			if text == "" && key == "delta" {
+				delete(msg, "content")
+			} else {
+				msg["content"] = text
+			}
+		}
+	}
+	if usage, ok := payload["usage"].(map[string]any); ok && reportReasoningTokens(usage) {
+		changed = true
+	}
+	if !changed {
+		return data
+	}
+	out, err := json.Marshal(payload)
+	if err != nil {
+		return data
+	}
+	return out
+}
+
+// reportReasoningTokens sets usage.completion_tokens_details.reasoning_tokens
+// from the thinking tokens Gemini counts in total_tokens only, and adds them
+// to completion_tokens as OpenAI does. It reports whether usage changed.
+func reportReasoningTokens(usage map[string]any) bool {
+	details, _ := usage["completion_tokens_details"].(map[string]any)
+	if _, set := details["reasoning_tokens"]; set {
+		return false
+	}
+	prompt, _ := usage["prompt_tokens"].(float64)
+	completion, _ := usage["completion_tokens"].(float64)
+	total, ok := usage["total_tokens"].(float64)
+	thinking := total - prompt - completion
+	if !ok || thinking <= 0 {
+		return false
+	}
+	if details == nil {
+		details = map[string]any{}
+	}
+	details["reasoning_tokens"] = thinking
+	usage["completion_tokens_details"] = details
+	usage["completion_tokens"] = completion + thinking
+	return true
+}
+
+// thoughtSplitter splits the content of a choice into thought summaries and
+// answer text as it streams in. Tags may be split across chunks.
+type thoughtSplitter struct {
+	inThought bool
+	pending   string
+}
+
+// split returns the thought and answer text of the next piece of content.
+// A trailing partial tag is held back until the next piece.
+func (t *thoughtSplitter) split(s string) (reasoning, content string) {
+	var r, c strings.Builder
+	s = t.pending + s
+	t.pending = ""
+	for {
+		tag := thoughtOpenTag
+		if t.inThought {
+			tag = thoughtCloseTag
+		}
+		out := &c
+		if t.inThought {
+			out = &r
+		}
+		if i := strings.Index(s, tag); i >= 0 {
+			out.WriteString(s[:i])
+			s = s[i+len(tag):]
+			t.inThought = !t.inThought
+			continue
+		}
+		keep := 0
+		for k := len(tag) - 1; k > 0; k-- {
+			if strings.HasSuffix(s, tag[:k]) {
+				keep = k
+				break
+			}
+		}
+		out.WriteString(s[:len(s)-keep])
+		t.pending = s[len(s)-keep:]
+		return r.String(), c.String()
+	}
+}
+
+// flush returns text held back as a possible partial tag.
+func (t *thoughtSplitter) flush() (reasoning, content string) {
+	s := t.pending
+	t.pending = ""
+	if t.inThought {
+		return s, ""
+	}
+	return "", s
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestApplyThinking(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		body   string
+		env    string
+		want   string
+		// reasoning is whether the response needs rewriting.
+		reasoning bool
+		wantErr   bool
+	}{
+		{
+			name: "no thinking options",
+			body: `{"model":"m"}`,
+			want: `{"model":"m"}`,
+		},
+		{
+			name:      "budget header",
+			header:    "2048",
+			body:      `{"model":"m"}`,
+			want:      `{"extra_body":{"google":{"thinking_config":{"include_thoughts":true,"thinking_budget":2048}}},"model":"m"}`,
+			reasoning: true,
+		},
+		{
+			name:      "body budget wins",
+			header:    "2048",
+			body:      `{"model":"m","extra_body":{"google":{"thinking_config":{"thinking_budget":10}}}}`,
+			want:      `{"extra_body":{"google":{"thinking_config":{"include_thoughts":true,"thinking_budget":10}}},"model":"m"}`,
+			reasoning: true,
+		},
+		{
+			name:      "thinking turned off",
+			header:    "0",
+			body:      `{"model":"m"}`,
+			want:      `{"extra_body":{"google":{"thinking_config":{"thinking_budget":0}}},"model":"m"}`,
+			reasoning: true,
+		},
+		{
+			name:      "reasoning_effort",
+			body:      `{"model":"m","reasoning_effort":"high"}`,
+			want:      `{"extra_body":{"google":{"thinking_config":{"include_thoughts":true}}},"model":"m","reasoning_effort":"high"}`,
+			reasoning: true,
+		},
+		{
+			name:      "reasoning_effort none",
+			body:      `{"model":"m","reasoning_effort":"none"}`,
+			env:       "true",
+			want:      `{"model":"m","reasoning_effort":"none"}`,
+			reasoning: true,
+		},
+		{
+			name:      "always include thoughts",
+			body:      `{"model":"m"}`,
+			env:       "true",
+			want:      `{"extra_body":{"google":{"thinking_config":{"include_thoughts":true}}},"model":"m"}`,
+			reasoning: true,
+		},
+		{
+			name:      "body thinking config",
+			body:      `{"model":"m","extra_body":{"google":{"thinking_config":{"include_thoughts":true}}}}`,
+			want:      `{"model":"m","extra_body":{"google":{"thinking_config":{"include_thoughts":true}}}}`,
+			reasoning: true,
+		},
+		{
+			name:    "invalid header",
+			header:  "lots",
+			body:    `{"model":"m"}`,
+			wantErr: true,
+		},
+	}
+	original := includeThoughts
+	t.Cleanup(func() { includeThoughts = original })
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("VERTEXAI_INCLUDE_THOUGHTS", tt.env)
+			if err := initThinking(); err != nil {
+				t.Fatalf("initThinking() error = %v", err)
+			}
+			got, reasoning, err := applyThinking(tt.header, []byte(tt.body))
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("applyThinking() = %s, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("applyThinking() error = %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("applyThinking() = %s\nwant %s", got, tt.want)
+			}
+			if reasoning != tt.reasoning {
+				t.Errorf("applyThinking() reasoning = %v, want %v", reasoning, tt.reasoning)
+			}
+		})
+	}
+}
+
+func TestInitThinking(t *testing.T) {
+	original := includeThoughts
+	t.Cleanup(func() { includeThoughts = original })
+	t.Setenv("VERTEXAI_INCLUDE_THOUGHTS", "always")
+	if err := initThinking(); err == nil {
+		t.Error("initThinking() with an invalid value succeeded, want error")
+	}
+}
+
+func TestThoughtSplitter(t *testing.T) {
+	var s thoughtSplitter
+	var reasoning, content strings.Builder
+	for _, piece := range []string{"<thou", "ght>Let me ", "think.</th", "ought>", "The answer <", "is 42."} {
+		r, c := s.split(piece)
+		reasoning.WriteString(r)
+		content.WriteString(c)
+	}
+	r, c := s.flush()
+	reasoning.WriteString(r)
+	content.WriteString(c)
+	if reasoning.String() != "Let me think." || content.String() != "The answer <is 42." {
+		t.Errorf("split into %q and %q", reasoning.String(), content.String())
+	}
+}
+
+func TestReasoningRewriter_Completion(t *testing.T) {
+	in := `{"choices":[{"index":0,"message":{"role":"assistant","content":"<thought>Plan.</thought>\nAnswer."}}],` +
+		`"usage":{"prompt_tokens":10,"completion_tokens":5,"total_tokens":45}}`
+	want := `{"choices":[{"index":0,"message":{"content":"Answer.","reasoning_content":"Plan.","role":"assistant"}}],` +
+		`"usage":{"completion_tokens":35,"completion_tokens_details":{"reasoning_tokens":30},"prompt_tokens":10,"total_tokens":45}}`
+	if got := string(newReasoningRewriter().rewrite([]byte(in))); got != want {
+		t.Errorf("rewrite() = %s\nwant %s", got, want)
+	}
+
+	plain := `{"choices":[{"index":0,"message":{"content":"Answer."}}],"usage":{"prompt_tokens":10,"completion_tokens":5,"total_tokens":15}}`
+	if got := string(newReasoningRewriter().rewrite([]byte(plain))); got != plain {
+		t.Errorf("rewrite() changed a response without thoughts: %s", got)
+	}
+}
+
+func TestProxy_ReasoningContentStream(t *testing.T) {
+	setCachedToken(t, "test-token")
+	var upstreamBody map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&upstreamBody)
+		if r.Header.Get(thinkingBudgetHeader) != "" {
+			t.Errorf("%s sent upstream", thinkingBudgetHeader)
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, "data: {\"choices\":[{\"index\":0,\"delta\":{\"role\":\"assistant\",\"content\":\"<thought>Pla\"}}]}\n\n"+
+			"data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"n.</thought>Answer\"}}]}\n\n"+
+			"data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\".\"},\"finish_reason\":\"stop\"}],\"usage\":{\"prompt_tokens\":10,\"completion_tokens\":5,\"total_tokens\":45}}\n\n"+
+			"data: [DONE]\n\n")
+	}))
+	defer server.Close()
+	target, _ := url.Parse(server.URL + "/v1/projects/p/locations/l/endpoints/openapi")
+	proxy := makeProxy(target)
+
+	req := httptest.NewRequest("POST", "http://localhost/v1/chat/completions", strings.NewReader(`{"model":"google/gemini-2.5-pro","stream":true,"messages":[]}`))
+	req.Header.Set(thinkingBudgetHeader, "1024")
+	rr := httptest.NewRecorder()
+	proxy.ServeHTTP(rr, req)
+
+	if cfg, _ := json.Marshal(upstreamBody["extra_body"]); string(cfg) != `{"google":{"thinking_config":{"include_thoughts":true,"thinking_budget":1024}}}` {
+		t.Errorf("extra_body = %s", cfg)
+	}
+	want := "data: {\"choices\":[{\"delta\":{\"reasoning_content\":\"Pla\",\"role\":\"assistant\"},\"index\":0}]}\n\n" +
+		"data: {\"choices\":[{\"delta\":{\"content\":\"Answer\",\"reasoning_content\":\"n.\"},\"index\":0}]}\n\n" +
+		"data: {\"choices\":[{\"delta\":{\"content\":\".\"},\"finish_reason\":\"stop\",\"index\":0}],\"usage\":{\"completion_tokens\":35,\"completion_tokens_details\":{\"reasoning_tokens\":30},\"prompt_tokens\":10,\"total_tokens\":45}}\n\n" +
+		"data: [DONE]\n\n"
+	if got := rr.Body.String(); got != want {
+		t.Errorf("stream = %q\nwant %q", got, want)
+	}
+}
+
+func TestProxy_NoReasoningRewrite(t *testing.T) {
+	setCachedToken(t, "test-token")
+	const completion = `{"choices":[{"index":0,"message":{"role":"assistant","content":"Answer."}}],"usage":{"prompt_tokens":10,"completion_tokens":5,"total_tokens":45}}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept-Encoding") != "gzip" {
+			t.Errorf("Accept-Encoding = %q, want the client's gzip", r.Header.Get("Accept-Encoding"))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, completion)
+	}))
+	defer server.Close()
+	target, _ := url.Parse(server.URL + "/v1/projects/p/locations/l/endpoints/openapi")
+
+	req := httptest.NewRequest("POST", "http://localhost/v1/chat/completions", strings.NewReader(`{"model":"google/gemini-2.5-pro","messages":[]}`))
+	req.Header.Set("Accept-Encoding", "gzip")
+	rr := httptest.NewRecorder()
+	makeProxy(target).ServeHTTP(rr, req)
+
+	// Without thinking options the usage isn't rewritten.
+	if got := rr.Body.String(); got != completion {
+		t.Errorf("response = %s\nwant %s", got, completion)
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// errTokenCountUnsupported is returned for requests whose tokens can't be
+// counted, e.g. for partner models.
+var errTokenCountUnsupported = errors.New("token counting is only supported for Gemini models")
+
+// errInvalidModelID is returned for model IDs that can't be put in the
+// countTokens URL, see validModelID.
+var errInvalidModelID = errors.New("invalid model ID")
+
+// tokenCounts counts the tokens of requests for /v1/tokenize and the
+// context length checks. initTokenCounting configures its cache.
+var tokenCounts = newTokenCounter(10*time.Minute, 4<<20)
+
+// checkContextLength enables serveWithContextCheck, set by
+// initTokenCounting from VERTEXAI_CHECK_CONTEXT_LENGTH.
+var checkContextLength bool
+
+// tokenCounter counts the tokens of chat completions requests with the
+// Vertex AI countTokens method. It caches the count of every conversation
+// it sees, so the next turn of a conversation only counts the new messages.
+type tokenCounter struct {
+	client *http.Client
+	cache  cacheStore
+	ttl    time.Duration
+}
+
+// initTokenCounting configures the token count cache from the
+// TOKEN_COUNT_CACHE_* environment variables, and the context length check
+// from VERTEXAI_CHECK_CONTEXT_LENGTH.
+func initTokenCounting() error {
+	check, err := envFlag("VERTEXAI_CHECK_CONTEXT_LENGTH", false)
+	if err != nil {
+		return err
+	}
+	ttl, err := envDuration("TOKEN_COUNT_CACHE_TTL", 10*time.Minute)
+	if err != nil {
+		return err
+	}
+	sizeMB, err := envInt("TOKEN_COUNT_CACHE_SIZE_MB", 4)
+	if err != nil {
+		return err
+	}
+	tokenCounts = newTokenCounter(ttl, int64(sizeMB)<<20)
+	checkContextLength = check
+	logger.Info("initTokenCounting: Configured token counting", "cache_ttl", ttl, "cache_size_mb", sizeMB, "check_context_length", checkContextLength)
+	return nil
+}
+
+func newTokenCounter(ttl time.Duration, cacheBytes int64) *tokenCounter {
+	return &tokenCounter{
+		client: &http.Client{Timeout: 30 * time.Second},
+		cache:  newMemoryCacheStore(cacheBytes),
+		ttl:    ttl,
+	}
+}
+
+// count returns the number of prompt tokens of a chat completions request
+// sent to upstream. The messages are counted on top of the longest prefix
+// of them counted before, so counts of long conversations are estimates
+// that can be off by a few tokens.
+func (c *tokenCounter) count(ctx context.Context, upstream *upstreamTarget, req map[string]any) (int, error) {
+	base, ok := strings.CutSuffix(upstream.url.Path, "/endpoints/openapi")
+	if !ok {
+		return 0, errTokenCountUnsupported
+	}
+	model, _ := req["model"].(string)
+	publisher, modelID, found := strings.Cut(model, "/")
+	if !found {
+		publisher, modelID = "google", model
+	}
+	if publisher != "google" || modelID == "" {
+		return 0, errTokenCountUnsupported
+	}
+	if !validModelID(modelID) {
+		return 0, fmt.Errorf("%w %q", errInvalidModelID, modelID)
+	}
+	messages, _ := req["messages"].([]any)
+
+	// keys[k] identifies the conversation up to message k.
+	keys := make([]string, len(messages)+1)
+	head, _ := json.Marshal([]any{upstream.name, model, req["tools"]})
+	sum := sha256.Sum256(head)
+	keys[0] = hex.EncodeToString(sum[:])
+	for i, m := range messages {
+		data, _ := json.Marshal(m)
+		sum = sha256.Sum256(append(sum[:], data...))
+		keys[i+1] = hex.EncodeToString(sum[:])
+	}
+	n := len(messages)
+	if cached, ok := c.cached(keys[n]); ok {
+		return cached, nil
+	}
+	prefix, k := 0, n-1
+	for ; k > 0; k-- {
+		msg, _ := messages[k].(map[string]any)
+		// Tool results are counted with the calls they answer.
+		if cached, ok := c.cached(keys[k]); ok && msg["role"] != "tool" {
+			prefix = cached
+			break
+		}
+	}
+	k = max(k, 0)
+
+	countReq := map[string]any{"messages": messages[k:]}
+	if k == 0 {
+		countReq["tools"] = req["tools"]
+	}
+	body, _ := json.Marshal(countReq)
+	gemini, err := openAIToGeminiRequest(body)
+	if err != nil {
+		return 0, err
+	}
+	payload := map[string]any{"contents": gemini["contents"]}
+	for _, field := range []string{"systemInstruction", "tools"} {
+		if v, ok := gemini[field]; ok {
+			payload[field] = v
+		}
+	}
+	endpoint := upstream.url.Scheme + "://" + upstream.url.Host + base + "/publishers/google/models/" + modelID + ":countTokens"
+	counted, err := c.countTokens(ctx, endpoint, upstream.credentials, payload)
+	if err != nil {
+		return 0, err
+	}
+	total := prefix + counted
+	c.cache.Set(keys[n], &cachedResponse{Body: []byte(strconv.Itoa(total)), Created: time.Now(), Expires: time.Now().Add(c.ttl)})
+	logger.DebugContext(ctx, "tokenCounter: Counted tokens", "model", model, "messages", n, "cached_messages", k, "tokens", total)
+	return total, nil
+}
+
+func (c *tokenCounter) cached(key string) (int, bool) {
+	entry, ok := c.cache.Get(key)
+	if !ok || time.Now().After(entry.Expires) {
+		return 0, false
+	}
+	n, err := strconv.Atoi(string(entry.Body))
+	return n, err == nil
+}
+
+func (c *tokenCounter) countTokens(ctx context.Context, endpoint, credentials string, payload map[string]any) (int, error) {
+	ctx, span := tracer.Start(ctx, "proxy.count_tokens")
+	defer span.End()
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return 0, err
+	}
+	tok, err := getTokenFor(ctx, credentials)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+tok)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return 0, err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("countTokens returned %s: %s", resp.Status, bytes.TrimSpace(respBody))
+		span.SetStatus(codes.Error, err.Error())
+		return 0, err
+	}
+	var counted struct {
+		TotalTokens int `json:"totalTokens"`
+	}
+	if err := json.Unmarshal(respBody, &counted); err != nil {
+		return 0, fmt.Errorf("parsing countTokens response: %w", err)
+	}
+	span.SetAttributes(attribute.Int("proxy.counted_tokens", counted.TotalTokens))
+	return counted.TotalTokens, nil
+}
+
+// contextLimit returns the context window of model from the context_limits
+// of the config file, or 0 if it has none.
+func contextLimit(model string) int {
+	patterns := make([]string, 0, len(config.ContextLimits))
+	for pattern := range config.ContextLimits {
+		patterns = append(patterns, pattern)
+	}
+	matched := matchModelPatterns(model, patterns)
+	if len(matched) == 0 {
+		return 0
+	}
+	return config.ContextLimits[matched[len(matched)-1]]
+}
+
+// handleTokenize counts the tokens of a chat completions request, or of a
+// prompt string, for the model and target of the request:
+//
+//	{"model": "google/gemini-2.0-flash-001", "messages": [...]}
+//	{"model": "google/gemini-2.0-flash-001", "prompt": "Hello"}
+//
+// It answers {"model": ..., "count": N}, with max_model_len when the model
+// has a context limit.
+func handleTokenize(w http.ResponseWriter, r *http.Request, upstream *upstreamTarget) {
+	if r.Method != http.MethodPost {
+		writeOpenAIError(w, http.StatusMethodNotAllowed, "invalid_request_error", "method_not_allowed", "Use POST")
+		return
+	}
+	var req map[string]any
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "invalid_request", "Invalid JSON body: "+err.Error())
+		return
+	}
+	model, _ := req["model"].(string)
+	if model == "" {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "invalid_request", "model is required")
+		return
+	}
+	if prompt, ok := req["prompt"].(string); ok && req["messages"] == nil {
+		req["messages"] = []any{map[string]any{"role": "user", "content": prompt}}
+	}
+	count, err := tokenCounts.count(r.Context(), upstream, req)
+	switch {
+	case errors.Is(err, errTokenCountUnsupported):
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "unsupported_model", err.Error())
+		return
+	case errors.Is(err, errInvalidModelID):
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "invalid_model", err.Error())
+		return
+	case err != nil:
+		logger.WarnContext(r.Context(), "handleTokenize: Error counting tokens", "model", model, "error", err)
+		writeOpenAIError(w, http.StatusBadGateway, "api_error", "upstream_error", "Counting tokens: "+err.Error())
+		return
+	}
+	resp := map[string]any{"model": model, "count": count}
+	if limit := contextLimit(model); limit > 0 {
+		resp["max_model_len"] = limit
+	}
+	writeJSON(w, resp)
+}
+
+// serveWithContextCheck rejects chat completions requests whose messages and
+// max_tokens don't fit the context limit of their model with the OpenAI
+// context_length_exceeded error, before they spend quota. Requests for
+// models without a limit, and requests whose tokens can't be counted, are
+// passed to serve. The check is enabled with VERTEXAI_CHECK_CONTEXT_LENGTH.
+func serveWithContextCheck(w http.ResponseWriter, r *http.Request, upstream *upstreamTarget, serve http.HandlerFunc) {
+	if !checkContextLength || r.URL.Path != "/v1/chat/completions" || r.Body == nil || len(config.ContextLimits) == 0 {
+		serve(w, r)
+		return
+	}
+	ctx := r.Context()
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		serve(w, r)
+		return
+	}
+	var req map[string]any
+	if json.Unmarshal(body, &req) != nil {
+		serve(w, r)
+		return
+	}
+	model, _ := req["model"].(string)
+	limit := contextLimit(model)
+	if limit == 0 {
+		serve(w, r)
+		return
+	}
+	count, err := tokenCounts.count(ctx, upstream, req)
+	if err != nil {
+		logger.WarnContext(ctx, "serveWithContextCheck: Error counting tokens, skipping the check", "model", model, "error", err)
+		serve(w, r)
+		return
+	}
+	completion, ok := req["max_completion_tokens"].(float64)
+	if !ok {
+		completion, _ = req["max_tokens"].(float64)
+	}
+	if count+int(completion) <= limit {
+		serve(w, r)
+		return
+	}
+	logger.InfoContext(ctx, "serveWithContextCheck: Request exceeds the context limit", "model", model, "tokens", count, "max_tokens", int(completion), "limit", limit)
+	message := fmt.Sprintf("This model's maximum context length is %d tokens. However, your messages resulted in %d tokens. Please reduce the length of the messages.", limit, count)
+	if completion > 0 {
+		message = fmt.Sprintf("This model's maximum context length is %d tokens. However, you requested %d tokens (%d in the messages, %d in the completion). Please reduce the length of the messages or completion.",
+			limit, count+int(completion), count, int(completion))
+	}
+	writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "context_length_exceeded", message)
+}
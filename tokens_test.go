@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newCountTokensUpstream serves countTokens with one token per word of the
+// text parts, and records the request bodies. Other requests get an empty
+// chat completion.
+func newCountTokensUpstream(t *testing.T) (*url.URL, *[]string) {
+	t.Helper()
+	var counted []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if !strings.HasSuffix(r.URL.Path, ":countTokens") {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"choices":[]}`))
+			return
+		}
+		if !strings.HasPrefix(r.URL.Path, "/v1/projects/p/locations/l/publishers/google/models/") {
+			t.Errorf("countTokens path = %s", r.URL.Path)
+		}
+		counted = append(counted, string(body))
+		var req struct {
+			Contents []struct {
+				Parts []struct {
+					Text string `json:"text"`
+				} `json:"parts"`
+			} `json:"contents"`
+			SystemInstruction *struct {
+				Parts []struct {
+					Text string `json:"text"`
+				} `json:"parts"`
+			} `json:"systemInstruction"`
+		}
+		json.Unmarshal(body, &req)
+		words := 0
+		for _, c := range req.Contents {
+			for _, p := range c.Parts {
+				words += len(strings.Fields(p.Text))
+			}
+		}
+		if req.SystemInstruction != nil {
+			for _, p := range req.SystemInstruction.Parts {
+				words += len(strings.Fields(p.Text))
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]int{"totalTokens": words})
+	}))
+	t.Cleanup(server.Close)
+	u, _ := url.Parse(server.URL + "/v1/projects/p/locations/l/endpoints/openapi")
+	return u, &counted
+}
+
+func useTokenCounter(t *testing.T) {
+	t.Helper()
+	original := tokenCounts
+	t.Cleanup(func() { tokenCounts = original })
+	tokenCounts = newTokenCounter(time.Minute, 1<<20)
+}
+
+func TestTokenCounter_CachesPrefixes(t *testing.T) {
+	setCachedToken(t, "test-token")
+	useTokenCounter(t)
+	u, counted := newCountTokensUpstream(t)
+	upstream := &upstreamTarget{name: "default", url: u}
+
+	messages := []any{
+		map[string]any{"role": "system", "content": "be very brief"},
+		map[string]any{"role": "user", "content": "hello there"},
+	}
+	req := map[string]any{"model": "google/gemini-2.0-flash-001", "messages": messages}
+	if n, err := tokenCounts.count(t.Context(), upstream, req); err != nil || n != 5 {
+		t.Fatalf("count() = %d, %v, want 5", n, err)
+	}
+	if n, _ := tokenCounts.count(t.Context(), upstream, req); n != 5 || len(*counted) != 1 {
+		t.Errorf("count() of the same request = %d after %d calls, want 5 from the cache", n, len(*counted))
+	}
+
+	req["messages"] = append(messages,
+		map[string]any{"role": "assistant", "content": "hi"},
+		map[string]any{"role": "user", "content": "how are you"})
+	if n, err := tokenCounts.count(t.Context(), upstream, req); err != nil || n != 9 {
+		t.Fatalf("count() of the next turn = %d, %v, want 9", n, err)
+	}
+	if last := (*counted)[len(*counted)-1]; strings.Contains(last, "hello there") || !strings.Contains(last, "how are you") {
+		t.Errorf("next turn counted %s, want only the new messages", last)
+	}
+
+	req["model"] = "anthropic/claude-sonnet-4"
+	if _, err := tokenCounts.count(t.Context(), upstream, req); err != errTokenCountUnsupported {
+		t.Errorf("count() for a partner model error = %v, want errTokenCountUnsupported", err)
+	}
+}
+
+func TestProxy_Tokenize(t *testing.T) {
+	setCachedToken(t, "test-token")
+	useTokenCounter(t)
+	useConfig(t, &proxyConfig{ContextLimits: map[string]int{"google/gemini-*": 1000, "google/gemini-2.0-flash-001": 2000}})
+	u, _ := newCountTokensUpstream(t)
+	proxy := makeProxy(u)
+
+	rr := httptest.NewRecorder()
+	proxy.ServeHTTP(rr, httptest.NewRequest("POST", "/v1/tokenize", strings.NewReader(
+		`{"model":"google/gemini-2.0-flash-001","prompt":"one two three"}`)))
+	if rr.Code != http.StatusOK || strings.TrimSpace(rr.Body.String()) != `{"count":3,"max_model_len":2000,"model":"google/gemini-2.0-flash-001"}` {
+		t.Errorf("got %d %s", rr.Code, rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	proxy.ServeHTTP(rr, httptest.NewRequest("POST", "/v1/tokenize", strings.NewReader(
+		`{"model":"google/../../../endpoints/1","prompt":"hi"}`)))
+	if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "invalid_model") {
+		t.Errorf("model with a path got %d %s, want 400 invalid_model", rr.Code, rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	proxy.ServeHTTP(rr, httptest.NewRequest("POST", "/v1/tokenize", strings.NewReader(
+		`{"model":"anthropic/claude-sonnet-4","messages":[{"role":"user","content":"hi"}]}`)))
+	if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "unsupported_model") {
+		t.Errorf("partner model got %d %s, want 400 unsupported_model", rr.Code, rr.Body.String())
+	}
+}
+
+func TestInitTokenCounting(t *testing.T) {
+	useTokenCounter(t)
+	original := checkContextLength
+	t.Cleanup(func() { checkContextLength = original })
+	t.Setenv("VERTEXAI_CHECK_CONTEXT_LENGTH", "true")
+	if err := initTokenCounting(); err != nil || !checkContextLength {
+		t.Errorf("initTokenCounting() = %v, check %v, want check enabled", err, checkContextLength)
+	}
+	t.Setenv("VERTEXAI_CHECK_CONTEXT_LENGTH", "sometimes")
+	if err := initTokenCounting(); err == nil {
+		t.Error("initTokenCounting() with an invalid VERTEXAI_CHECK_CONTEXT_LENGTH succeeded, want error")
+	}
+}
+
+func TestProxy_ContextLengthExceeded(t *testing.T) {
+	setCachedToken(t, "test-token")
+	useTokenCounter(t)
+	original := checkContextLength
+	t.Cleanup(func() { checkContextLength = original })
+	checkContextLength = true
+	useConfig(t, &proxyConfig{ContextLimits: map[string]int{"google/gemini-*": 10}})
+	u, counted := newCountTokensUpstream(t)
+	proxy := makeProxy(u)
+
+	tests := []struct {
+		body     string
+		wantCode int
+		wantBody string
+	}{
+		{`{"model":"google/gemini-2.0-flash-001","messages":[{"role":"user","content":"a b c"}]}`, 200, ""},
+		{`{"model":"google/gemini-2.0-flash-001","max_tokens":8,"messages":[{"role":"user","content":"a b c"}]}`, 400, "you requested 11 tokens (3 in the messages, 8 in the completion)"},
+		{`{"model":"google/gemini-2.0-flash-001","messages":[{"role":"user","content":"1 2 3 4 5 6 7 8 9 10 11"}]}`, 400, "your messages resulted in 11 tokens"},
+		// Models without a limit aren't counted.
+		{`{"model":"other","messages":[{"role":"user","content":"1 2 3 4 5 6 7 8 9 10 11"}]}`, 200, ""},
+	}
+	for _, tt := range tests {
+		rr := httptest.NewRecorder()
+		proxy.ServeHTTP(rr, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(tt.body)))
+		if rr.Code != tt.wantCode || !strings.Contains(rr.Body.String(), tt.wantBody) {
+			t.Errorf("%s: got %d %s, want %d %q", tt.body, rr.Code, rr.Body.String(), tt.wantCode, tt.wantBody)
+		}
+		if tt.wantCode == 400 && !strings.Contains(rr.Body.String(), `"code":"context_length_exceeded"`) {
+			t.Errorf("%s: got %s, want code context_length_exceeded", tt.body, rr.Body.String())
+		}
+	}
+	if len(*counted) != 2 {
+		t.Errorf("countTokens called %d times, want 2 (cached by messages)", len(*counted))
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// contextTrimmedHeader reports how many messages of a request were removed
+// to fit the context limit of its model.
+const contextTrimmedHeader = "X-Context-Trimmed"
+
+// Context trimming modes, set with VERTEXAI_TRIM_CONTEXT.
+const (
+	trimDrop      = "drop"
+	trimSummarize = "summarize"
+)
+
+// trimSummaryMaxTokens bounds the summary of trimmed messages. It is
+// reserved in the context budget in summarize mode.
+const trimSummaryMaxTokens = 1024
+
+// trimMaxRounds bounds the counting rounds of trimming a request.
+const trimMaxRounds = 3
+
+// trimContext is the context trimming mode, or "" when trimming is
+// disabled, set by initTrimming from VERTEXAI_TRIM_CONTEXT.
+var trimContext string
+
+// initTrimming reads VERTEXAI_TRIM_CONTEXT, which must be empty, drop or
+// summarize.
+func initTrimming() error {
+	mode := strings.TrimSpace(os.Getenv("VERTEXAI_TRIM_CONTEXT"))
+	switch mode {
+	case "":
+		return nil
+	case trimDrop, trimSummarize:
+	default:
+		return fmt.Errorf("invalid VERTEXAI_TRIM_CONTEXT %q, want %q or %q", mode, trimDrop, trimSummarize)
+	}
+	trimContext = mode
+	logger.Info("initTrimming: Context trimming enabled", "mode", trimContext)
+	return nil
+}
+
+// serveWithTrimming removes the oldest messages of chat completions
+// requests that don't fit the context limit of their model, minus
+// max_tokens, before passing them to serve. System messages, injected
+// prompts and the last message are kept, and an assistant message with tool
+// calls is only removed together with the tool results answering it. In
+// summarize mode, the removed messages are replaced by a summary the model
+// writes. The number of removed messages is reported in the
+// X-Context-Trimmed header.
+// Trimming is enabled with VERTEXAI_TRIM_CONTEXT set to drop or summarize.
+func serveWithTrimming(w http.ResponseWriter, r *http.Request, upstream *upstreamTarget, serve http.HandlerFunc) {
+	mode := trimContext
+	if mode == "" || r.URL.Path != "/v1/chat/completions" || r.Body == nil || len(config.ContextLimits) == 0 {
+		serve(w, r)
+		return
+	}
+	ctx := r.Context()
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		serve(w, r)
+		return
+	}
+	var req map[string]any
+	if json.Unmarshal(body, &req) != nil {
+		serve(w, r)
+		return
+	}
+	model, _ := req["model"].(string)
+	limit := contextLimit(model)
+	if limit == 0 {
+		serve(w, r)
+		return
+	}
+	completion, ok := req["max_completion_tokens"].(float64)
+	if !ok {
+		completion, _ = req["max_tokens"].(float64)
+	}
+	budget := limit - int(completion)
+	if mode == trimSummarize {
+		budget -= trimSummaryMaxTokens
+	}
+
+	messages, _ := req["messages"].([]any)
+	count, err := tokenCounts.count(ctx, upstream, req)
+	if err != nil {
+		logger.WarnContext(ctx, "serveWithTrimming: Error counting tokens, not trimming", "model", model, "error", err)
+		serve(w, r)
+		return
+	}
+	if count <= budget {
+		serve(w, r)
+		return
+	}
+
+	units := trimUnits(messages, injectedPromptFrom(ctx))
+	kept := messages
+	dropped := map[int]bool{}
+	for round := 0; round < trimMaxRounds && count > budget && len(units) > 0; round++ {
+		// Estimate the tokens of the messages from their size, drop enough
+		// of them, and count again.
+		excess := float64(count-budget) / float64(count) * float64(jsonSize(kept))
+		removed := 0
+		for len(units) > 0 && float64(removed) < excess {
+			for _, i := range units[0] {
+				dropped[i] = true
+				removed += jsonSize(messages[i])
+			}
+			units = units[1:]
+		}
+		kept = make([]any, 0, len(messages)-len(dropped))
+		for i, m := range messages {
+			if !dropped[i] {
+				kept = append(kept, m)
+			}
+		}
+		req["messages"] = kept
+		if count, err = tokenCounts.count(ctx, upstream, req); err != nil {
+			logger.WarnContext(ctx, "serveWithTrimming: Error counting tokens of the trimmed request", "model", model, "error", err)
+			break
+		}
+	}
+	if len(dropped) == 0 {
+		serve(w, r)
+		return
+	}
+
+	if mode == trimSummarize {
+		var removed []any
+		for i, m := range messages {
+			if dropped[i] {
+				removed = append(removed, m)
+			}
+		}
+		if summary, err := summarizeMessages(ctx, r, serve, model, removed); err != nil {
+			logger.WarnContext(ctx, "serveWithTrimming: Error summarizing trimmed messages, dropping them", "model", model, "error", err)
+		} else {
+			kept = insertSummary(kept, summary)
+			req["messages"] = kept
+		}
+	}
+	logger.InfoContext(ctx, "serveWithTrimming: Trimmed messages to fit the context limit", "model", model, "mode", mode, "dropped", len(dropped), "tokens", count, "limit", limit)
+	out, _ := json.Marshal(req)
+	r.Body = io.NopCloser(bytes.NewReader(out))
+	r.ContentLength = int64(len(out))
+	r.Header.Set("Content-Length", strconv.Itoa(len(out)))
+	w.Header().Set(contextTrimmedHeader, strconv.Itoa(len(dropped)))
+	serve(w, r)
+}
+
+// trimUnits groups the indexes of the messages that may be removed, oldest
+// first: all but system messages, the messages of an injected prompt and the
+// last message of the client. Assistant and tool messages form a unit with
+// the user message before them, so tool results are removed with their calls
+// and the kept conversation starts with a user message.
+func trimUnits(messages []any, prompt *injectedPrompt) [][]int {
+	if prompt == nil {
+		prompt = &injectedPrompt{}
+	}
+	n := len(messages) - prompt.suffix
+	if n <= 0 {
+		return nil
+	}
+	var units [][]int
+	for i := 0; i < n-1; i++ {
+		msg, _ := messages[i].(map[string]any)
+		role, _ := msg["role"].(string)
+		switch {
+		case role == "system" || role == "developer":
+		case i >= prompt.prefixStart && i < prompt.prefixEnd:
+		case role != "user" && len(units) > 0:
+			units[len(units)-1] = append(units[len(units)-1], i)
+		default:
+			units = append(units, []int{i})
+		}
+	}
+	// The call a last tool result answers must be kept.
+	if last, _ := messages[n-1].(map[string]any); last["role"] == "tool" && len(units) > 0 {
+		units = units[:len(units)-1]
+	}
+	return units
+}
+
+func jsonSize(v any) int {
+	data, _ := json.Marshal(v)
+	return len(data)
+}
+
+// summarizeMessages asks model, through serve, for a summary of messages.
+func summarizeMessages(ctx context.Context, r *http.Request, serve http.HandlerFunc, model string, messages []any) (string, error) {
+	var transcript strings.Builder
+	for _, m := range messages {
+		msg, _ := m.(map[string]any)
+		role, _ := msg["role"].(string)
+		content, _ := json.Marshal(msg["content"])
+		text, err := contentText(content)
+		if err != nil {
+			text = "[non-text content]"
+		}
+		for _, tc := range toolCalls(msg) {
+			fn, _ := tc["function"].(map[string]any)
+			text += fmt.Sprintf("\n[called %v with %v]", fn["name"], fn["arguments"])
+		}
+		fmt.Fprintf(&transcript, "%s: %s\n\n", role, text)
+	}
+	body, _ := json.Marshal(map[string]any{
+		"model":      model,
+		"max_tokens": trimSummaryMaxTokens,
+		"messages": []any{
+			map[string]any{"role": "system", "content": "Summarize the following conversation in a few paragraphs. Keep the facts, decisions, names and open questions needed to continue it."},
+			map[string]any{"role": "user", "content": transcript.String()},
+		},
+	})
+	sr := r.Clone(ctx)
+	sr.Body = io.NopCloser(bytes.NewReader(body))
+	sr.ContentLength = int64(len(body))
+	sr.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	// The response is parsed.
+	sr.Header.Del("Accept-Encoding")
+	buf := newResponseBuffer()
+	serve(buf, sr)
+	if buf.status != http.StatusOK && buf.status != 0 {
+		return "", fmt.Errorf("summary request returned %d: %s", buf.status, bytes.TrimSpace(buf.body.Bytes()))
+	}
+	var resp struct {
+		Choices []struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		} `json:"choices"`
+	}
+	if err := json.Unmarshal(buf.body.Bytes(), &resp); err != nil || len(resp.Choices) == 0 || resp.Choices[0].Message.Content == "" {
+		return "", fmt.Errorf("summary response has no content: %s", bytes.TrimSpace(buf.body.Bytes()))
+	}
+	return strings.TrimSpace(resp.Choices[0].Message.Content), nil
+}
+
+// insertSummary adds a system message with the summary of removed messages
+// after the leading system messages.
+func insertSummary(messages []any, summary string) []any {
+	i := 0
+	for ; i < len(messages); i++ {
+		msg, _ := messages[i].(map[string]any)
+		if role := msg["role"]; role != "system" && role != "developer" {
+			break
+		}
+	}
+	out := make([]any, 0, len(messages)+1)
+	out = append(out, messages[:i]...)
+	out = append(out, map[string]any{"role": "system", "content": "Summary of the earlier conversation:\n" + summary})
+	return append(out, messages[i:]...)
+}
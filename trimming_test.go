@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTrimUnits(t *testing.T) {
+	msg := func(role string) any { return map[string]any{"role": role} }
+	tests := []struct {
+		name     string
+		messages []any
+		prompt   *injectedPrompt
+		want     [][]int
+	}{
+		{"empty", nil, nil, nil},
+		{"single", []any{msg("user")}, nil, nil},
+		{"turns", []any{msg("system"), msg("user"), msg("assistant"), msg("user"), msg("assistant"), msg("user")}, nil,
+			[][]int{{1, 2}, {3, 4}}},
+		{"tool calls", []any{msg("user"), msg("assistant"), msg("tool"), msg("tool"), msg("assistant"), msg("user")}, nil,
+			[][]int{{0, 1, 2, 3, 4}}},
+		{"last tool result", []any{msg("user"), msg("assistant"), msg("user"), msg("assistant"), msg("tool")}, nil,
+			[][]int{{0, 1}}},
+		{"injected prompt", []any{msg("system"), msg("user"), msg("assistant"), msg("user"), msg("assistant"), msg("user"), msg("assistant"), msg("user"), msg("system")},
+			&injectedPrompt{prefixStart: 1, prefixEnd: 3, suffix: 1},
+			[][]int{{3, 4}, {5, 6}}},
+	}
+	for _, tt := range tests {
+		if got := trimUnits(tt.messages, tt.prompt); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: trimUnits() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// trimmingConversation has 13 tokens counting one per word: 2 in the
+// system message and 4, 2, 2 and 3 in the others.
+const trimmingConversation = `{"model":"google/gemini-2.0-flash-001","messages":[
+	{"role":"system","content":"be brief"},
+	{"role":"user","content":"one two three four"},
+	{"role":"assistant","content":null,"tool_calls":[{"id":"call_1","type":"function","function":{"name":"lookup","arguments":"{}"}}]},
+	{"role":"tool","tool_call_id":"call_1","content":"{}"},
+	{"role":"user","content":"seven eight"},
+	{"role":"assistant","content":"nine ten"},
+	{"role":"user","content":"last question here"}]}`
+
+// serveTrimming passes body through serveWithTrimming and returns the
+// response and the messages of the request reaching the handler.
+func serveTrimming(t *testing.T, body string, summarize func(req map[string]any) string) (*httptest.ResponseRecorder, []map[string]any) {
+	t.Helper()
+	u, _ := newCountTokensUpstream(t)
+	upstream := &upstreamTarget{name: "default", url: u}
+	var forwarded []map[string]any
+	serve := func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Messages []map[string]any `json:"messages"`
+		}
+		data, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(data, &req); err != nil {
+			t.Fatalf("forwarded invalid JSON %s: %v", data, err)
+		}
+		if len(req.Messages) > 0 && strings.HasPrefix(req.Messages[0]["content"].(string), "Summarize") {
+			var summary map[string]any
+			json.Unmarshal(data, &summary)
+			json.NewEncoder(w).Encode(map[string]any{"choices": []any{
+				map[string]any{"message": map[string]any{"role": "assistant", "content": summarize(summary)}},
+			}})
+			return
+		}
+		forwarded = req.Messages
+		w.Write([]byte(`{"choices":[]}`))
+	}
+	rr := httptest.NewRecorder()
+	serveWithTrimming(rr, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body)), upstream, serve)
+	return rr, forwarded
+}
+
+func messageContents(messages []map[string]any) []any {
+	var contents []any
+	for _, m := range messages {
+		contents = append(contents, m["content"])
+	}
+	return contents
+}
+
+func useTrimContext(t *testing.T, mode string) {
+	t.Helper()
+	original := trimContext
+	t.Cleanup(func() { trimContext = original })
+	trimContext = mode
+}
+
+func TestInitTrimming(t *testing.T) {
+	original := trimContext
+	t.Cleanup(func() { trimContext = original })
+	t.Setenv("VERTEXAI_TRIM_CONTEXT", " summarize ")
+	if err := initTrimming(); err != nil || trimContext != trimSummarize {
+		t.Errorf("initTrimming() = %v, mode %q, want summarize", err, trimContext)
+	}
+	t.Setenv("VERTEXAI_TRIM_CONTEXT", "truncate")
+	if err := initTrimming(); err == nil {
+		t.Error("initTrimming() with an invalid mode succeeded, want error")
+	}
+}
+
+func TestServeWithTrimming_Drop(t *testing.T) {
+	setCachedToken(t, "test-token")
+	useTokenCounter(t)
+	useTrimContext(t, trimDrop)
+	useConfig(t, &proxyConfig{ContextLimits: map[string]int{"google/gemini-*": 10}})
+
+	rr, forwarded := serveTrimming(t, trimmingConversation, nil)
+	if got := rr.Header().Get(contextTrimmedHeader); got != "3" {
+		t.Errorf("%s = %q, want 3", contextTrimmedHeader, got)
+	}
+	want := []any{"be brief", "seven eight", "nine ten", "last question here"}
+	if got := messageContents(forwarded); !reflect.DeepEqual(got, want) {
+		t.Errorf("forwarded messages %v, want %v", got, want)
+	}
+
+	// Requests within the limit are passed as they are.
+	rr, forwarded = serveTrimming(t, strings.Replace(trimmingConversation, "one two three four", "one", 1), nil)
+	if got := rr.Header().Get(contextTrimmedHeader); got != "" || len(forwarded) != 7 {
+		t.Errorf("request within the limit got %s %q and %d messages, want none trimmed", contextTrimmedHeader, got, len(forwarded))
+	}
+}
+
+func TestServeWithTrimming_Summarize(t *testing.T) {
+	setCachedToken(t, "test-token")
+	useTokenCounter(t)
+	useTrimContext(t, trimSummarize)
+	// The budget is 1030 minus 1024 tokens reserved for the summary.
+	useConfig(t, &proxyConfig{ContextLimits: map[string]int{"google/gemini-*": 1030}})
+
+	var transcript string
+	rr, forwarded := serveTrimming(t, trimmingConversation, func(req map[string]any) string {
+		messages := req["messages"].([]any)
+		transcript = messages[1].(map[string]any)["content"].(string)
+		return "They counted to ten."
+	})
+	if got := rr.Header().Get(contextTrimmedHeader); got != "5" {
+		t.Errorf("%s = %q, want 5", contextTrimmedHeader, got)
+	}
+	for _, s := range []string{"user: one two three four", "[called lookup with {}]", "assistant: nine ten"} {
+		if !strings.Contains(transcript, s) {
+			t.Errorf("summary transcript %q doesn't contain %q", transcript, s)
+		}
+	}
+	want := []any{"be brief", "Summary of the earlier conversation:\nThey counted to ten.", "last question here"}
+	if got := messageContents(forwarded); !reflect.DeepEqual(got, want) {
+		t.Errorf("forwarded messages %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,792 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gcsBaseURL is the Cloud Storage JSON API. It's a variable to allow
+// overriding for testing.
+var gcsBaseURL = "https://storage.googleapis.com"
+
+// vertexBatchLineLabel is the request label batch prediction lines carry
+// their line index in, to match the results to the batch requests.
+const vertexBatchLineLabel = "batch_request"
+
+// vertexBatchBackend runs batches of Gemini chat completions requests as
+// Vertex AI batch prediction jobs instead of sending them one by one.
+type vertexBatchBackend struct {
+	// bucket and prefix locate the job inputs and outputs in Cloud Storage.
+	bucket, prefix    string
+	project, location string
+	// minRequests is the smallest batch sent to Vertex AI without asking
+	// for it with the backend metadata. 0 only sends batches that ask.
+	minRequests  int
+	pollInterval time.Duration
+	client       *http.Client
+}
+
+// initVertexBatch configures the Vertex AI batch prediction backend from
+// the BATCH_VERTEX_* environment variables. It returns nil unless
+// BATCH_VERTEX_BUCKET is set.
+func initVertexBatch() (*vertexBatchBackend, error) {
+	bucket := strings.TrimSpace(os.Getenv("BATCH_VERTEX_BUCKET"))
+	if bucket == "" {
+		return nil, nil
+	}
+	minRequests, err := envInt("BATCH_VERTEX_MIN_REQUESTS", 0)
+	if err != nil {
+		return nil, err
+	}
+	pollInterval, err := envDuration("BATCH_VERTEX_POLL_INTERVAL", time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	batchLocation := os.Getenv("BATCH_VERTEX_LOCATION")
+	if batchLocation == "" {
+		batchLocation = location
+	}
+	v := newVertexBatchBackend(bucket, projectID, batchLocation, minRequests, pollInterval)
+	logger.Info("initVertexBatch: Vertex AI batch prediction enabled", "bucket", v.bucket, "prefix", v.prefix, "location", v.location, "min_requests", minRequests)
+	return v, nil
+}
+
+// newVertexBatchBackend returns a backend storing its files under bucket, a
+// bucket name optionally followed by a path, with or without gs://.
+func newVertexBatchBackend(bucket, project, location string, minRequests int, pollInterval time.Duration) *vertexBatchBackend {
+	name, prefix, _ := strings.Cut(strings.TrimPrefix(bucket, "gs://"), "/")
+	return &vertexBatchBackend{
+		bucket:       name,
+		prefix:       strings.Trim(prefix, "/"),
+		project:      project,
+		location:     location,
+		minRequests:  minRequests,
+		pollInterval: pollInterval,
+		client:       &http.Client{Timeout: 5 * time.Minute},
+	}
+}
+
+// vertexBatchTarget is where the batch prediction jobs of an owner run.
+type vertexBatchTarget struct {
+	project, location, credentials string
+}
+
+// target returns where the jobs of owner run: the target pinned to its
+// client key, else the backend's project and location with the default
+// credentials.
+func (v *vertexBatchBackend) target(owner string) vertexBatchTarget {
+	if k := ownerKey(owner); k != nil && k.Target != "" {
+		if tc, ok := config.Targets[k.Target]; ok {
+			return vertexBatchTarget{project: tc.Project, location: tc.Location, credentials: tc.Credentials}
+		}
+	}
+	return vertexBatchTarget{project: v.project, location: v.location}
+}
+
+// accepts reports whether a batch of owner runs on Vertex AI: chat
+// completions batches that ask for it with the "backend": "vertex" metadata,
+// or have at least minRequests requests. Batch prediction skips the managed
+// prompts and the configured parameter actions of the proxy, so batches
+// needing them run through the proxy instead. It returns an error for
+// batches that ask for it but can't, because their requests aren't for a
+// single Gemini model or need those transforms.
+func (v *vertexBatchBackend) accepts(owner string, metadata map[string]string, endpoint string, lines []batchRequestLine) (bool, error) {
+	asked := metadata["backend"] == "vertex"
+	if !asked && (v.minRequests == 0 || len(lines) < v.minRequests) {
+		return false, nil
+	}
+	model, err := batchModel(endpoint, lines)
+	if err == nil {
+		err = batchTransforms(owner, model)
+	}
+	if err != nil && asked {
+		return false, err
+	}
+	return err == nil, nil
+}
+
+// batchTransforms returns an error when requests of owner for model need a
+// managed prompt or configured parameter actions, which batch prediction
+// doesn't apply.
+func batchTransforms(owner, model string) error {
+	if name, prompt := promptFor(ownerKey(owner), model); prompt != nil {
+		return fmt.Errorf("batch prediction doesn't apply the managed prompt %q", name)
+	}
+	patterns := make([]string, 0, len(config.Parameters))
+	for pattern := range config.Parameters {
+		patterns = append(patterns, pattern)
+	}
+	if len(matchModelPatterns(model, patterns)) > 0 {
+		return fmt.Errorf("batch prediction doesn't apply the parameter actions configured for %s", model)
+	}
+	return nil
+}
+
+// batchModel returns the Gemini model all requests of a batch are for.
+func batchModel(endpoint string, lines []batchRequestLine) (string, error) {
+	if endpoint != "/v1/chat/completions" {
+		return "", fmt.Errorf("batch prediction only supports /v1/chat/completions, not %s", endpoint)
+	}
+	var model string
+	for _, line := range lines {
+		var req struct {
+			Model string `json:"model"`
+		}
+		json.Unmarshal(line.Body, &req)
+		if model != "" && req.Model != model {
+			return "", fmt.Errorf("batch prediction needs a single model, got %s and %s", model, req.Model)
+		}
+		model = req.Model
+	}
+	if publisher, _, found := strings.Cut(model, "/"); found && publisher != "google" {
+		return "", fmt.Errorf("batch prediction only supports Gemini models, not %s", model)
+	}
+	return model, nil
+}
+
+// publisherModel returns the Vertex AI resource name of a Gemini model.
+func publisherModel(model string) string {
+	return "publishers/google/models/" + strings.TrimPrefix(model, "google/")
+}
+
+// vertexBatchJob is the part of a Vertex AI batchPredictionJob the backend
+// uses.
+type vertexBatchJob struct {
+	Name       string `json:"name"`
+	State      string `json:"state"`
+	OutputInfo struct {
+		GcsOutputDirectory string `json:"gcsOutputDirectory"`
+	} `json:"outputInfo"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+	CompletionStats struct {
+		SuccessfulCount string `json:"successfulCount"`
+		FailedCount     string `json:"failedCount"`
+	} `json:"completionStats"`
+}
+
+// run runs the requests of a batch as a batch prediction job in t, or
+// resumes polling jobName, and returns the results of the requests, by line index.
+// Requests that can't be converted fail right away. progress is called
+// with the completion counts while the job runs, and started with the job
+// name once it is created. When ctx is cancelled, the job is cancelled too.
+func (v *vertexBatchBackend) run(ctx context.Context, t vertexBatchTarget, batchID, jobName string, lines []batchRequestLine, started func(string), progress func(completed, failed int)) (map[int]*batchResultResponse, error) {
+	results := map[int]*batchResultResponse{}
+	if jobName == "" {
+		model, err := batchModel("/v1/chat/completions", lines)
+		if err != nil {
+			return nil, err
+		}
+		var input bytes.Buffer
+		for i, line := range lines {
+			req, err := openAIToGeminiRequest(line.Body)
+			if err != nil {
+				results[i] = &batchResultResponse{StatusCode: http.StatusBadRequest, Body: openAIErrorBody("invalid_request_error", "invalid_request", err.Error())}
+				continue
+			}
+			req["labels"] = map[string]string{vertexBatchLineLabel: strconv.Itoa(i)}
+			data, _ := json.Marshal(map[string]any{"request": req})
+			input.Write(data)
+			input.WriteByte('\n')
+		}
+		if input.Len() == 0 {
+			return results, nil
+		}
+		object := path.Join(v.prefix, batchID, "input.jsonl")
+		if err := v.upload(ctx, object, input.Bytes()); err != nil {
+			return nil, fmt.Errorf("uploading batch input: %w", err)
+		}
+		job, err := v.createJob(ctx, t, batchID, model, object)
+		if err != nil {
+			return nil, fmt.Errorf("creating batch prediction job: %w", err)
+		}
+		jobName = job.Name
+		logger.InfoContext(ctx, "vertexBatchBackend: Created batch prediction job", "batch_id", batchID, "job", jobName, "model", model)
+		started(jobName)
+	}
+
+	job, err := v.wait(ctx, t, jobName, progress)
+	if err != nil {
+		return nil, err
+	}
+	switch job.State {
+	case "JOB_STATE_SUCCEEDED", "JOB_STATE_PARTIALLY_SUCCEEDED":
+	case "JOB_STATE_CANCELLED":
+		return results, nil
+	default:
+		msg := job.State
+		if job.Error != nil {
+			msg += ": " + job.Error.Message
+		}
+		return nil, fmt.Errorf("batch prediction job %s failed: %s", jobName, msg)
+	}
+	if err := v.readOutput(ctx, job.OutputInfo.GcsOutputDirectory, lines, results); err != nil {
+		return nil, fmt.Errorf("reading batch prediction output: %w", err)
+	}
+	for i := range lines {
+		if results[i] == nil {
+			results[i] = &batchResultResponse{StatusCode: http.StatusInternalServerError, Body: openAIErrorBody("api_error", "missing_result", "The request has no result in the batch prediction output")}
+		}
+	}
+	return results, nil
+}
+
+// wait polls a job until it finishes, cancelling it when ctx is cancelled.
+func (v *vertexBatchBackend) wait(ctx context.Context, t vertexBatchTarget, jobName string, progress func(completed, failed int)) (*vertexBatchJob, error) {
+	cancelled := false
+	for {
+		if ctx.Err() != nil && !cancelled {
+			cancelled = true
+			logger.Info("vertexBatchBackend: Cancelling batch prediction job", "job", jobName)
+			if _, err := v.call(context.WithoutCancel(ctx), t.credentials, http.MethodPost, t.jobURL(jobName)+":cancel", "application/json", strings.NewReader("{}")); err != nil {
+				return nil, fmt.Errorf("cancelling batch prediction job: %w", err)
+			}
+		}
+		data, err := v.call(context.WithoutCancel(ctx), t.credentials, http.MethodGet, t.jobURL(jobName), "", nil)
+		if err != nil {
+			return nil, fmt.Errorf("getting batch prediction job: %w", err)
+		}
+		var job vertexBatchJob
+		if err := json.Unmarshal(data, &job); err != nil {
+			return nil, fmt.Errorf("parsing batch prediction job: %w", err)
+		}
+		switch job.State {
+		case "JOB_STATE_SUCCEEDED", "JOB_STATE_PARTIALLY_SUCCEEDED", "JOB_STATE_FAILED", "JOB_STATE_CANCELLED", "JOB_STATE_EXPIRED":
+			return &job, nil
+		}
+		completed, _ := strconv.Atoi(job.CompletionStats.SuccessfulCount)
+		failed, _ := strconv.Atoi(job.CompletionStats.FailedCount)
+		progress(completed, failed)
+		if cancelled {
+			time.Sleep(v.pollInterval)
+			continue
+		}
+		select {
+		case <-time.After(v.pollInterval):
+		case <-ctx.Done():
+		}
+	}
+}
+
+// jobsURL returns the batchPredictionJobs collection URL.
+func (t vertexBatchTarget) jobsURL() string {
+	return strings.TrimSuffix(vertexAIBaseURL(t.project, t.location), "/endpoints/openapi") + "/batchPredictionJobs"
+}
+
+// jobURL returns the URL of a job by its resource name.
+func (t vertexBatchTarget) jobURL(name string) string {
+	base, _ := url.Parse(vertexAIBaseURL(t.project, t.location))
+	return base.Scheme + "://" + base.Host + "/v1/" + name
+}
+
+func (v *vertexBatchBackend) createJob(ctx context.Context, t vertexBatchTarget, batchID, model, inputObject string) (*vertexBatchJob, error) {
+	body, _ := json.Marshal(map[string]any{
+		"displayName": "vertexai-openapi-proxy-" + batchID,
+		"model":       publisherModel(model),
+		"inputConfig": map[string]any{
+			"instancesFormat": "jsonl",
+			"gcsSource":       map[string]any{"uris": []string{"gs://" + v.bucket + "/" + inputObject}},
+		},
+		"outputConfig": map[string]any{
+			"predictionsFormat": "jsonl",
+			"gcsDestination":    map[string]any{"outputUriPrefix": "gs://" + v.bucket + "/" + path.Join(v.prefix, batchID, "output")},
+		},
+	})
+	data, err := v.call(ctx, t.credentials, http.MethodPost, t.jobsURL(), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	var job vertexBatchJob
+	if err := json.Unmarshal(data, &job); err != nil {
+		return nil, err
+	}
+	if job.Name == "" {
+		return nil, fmt.Errorf("response has no job name: %s", data)
+	}
+	return &job, nil
+}
+
+func (v *vertexBatchBackend) upload(ctx context.Context, object string, data []byte) error {
+	u := gcsBaseURL + "/upload/storage/v1/b/" + url.PathEscape(v.bucket) + "/o?uploadType=media&name=" + url.QueryEscape(object)
+	_, err := v.call(ctx, "", http.MethodPost, u, "application/jsonl", bytes.NewReader(data))
+	return err
+}
+
+// readOutput converts the prediction files in the gs:// directory dir to
+// results of lines.
+func (v *vertexBatchBackend) readOutput(ctx context.Context, dir string, lines []batchRequestLine, results map[int]*batchResultResponse) error {
+	bucket, prefix, _ := strings.Cut(strings.TrimPrefix(dir, "gs://"), "/")
+	var objects []string
+	pageToken := ""
+	for {
+		u := gcsBaseURL + "/storage/v1/b/" + url.PathEscape(bucket) + "/o?prefix=" + url.QueryEscape(prefix)
+		if pageToken != "" {
+			u += "&pageToken=" + url.QueryEscape(pageToken)
+		}
+		data, err := v.call(ctx, "", http.MethodGet, u, "", nil)
+		if err != nil {
+			return err
+		}
+		var list struct {
+			Items []struct {
+				Name string `json:"name"`
+			} `json:"items"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		if err := json.Unmarshal(data, &list); err != nil {
+			return err
+		}
+		for _, item := range list.Items {
+			if strings.HasSuffix(item.Name, ".jsonl") {
+				objects = append(objects, item.Name)
+			}
+		}
+		if pageToken = list.NextPageToken; pageToken == "" {
+			break
+		}
+	}
+	for _, object := range objects {
+		data, err := v.call(ctx, "", http.MethodGet, gcsBaseURL+"/storage/v1/b/"+url.PathEscape(bucket)+"/o/"+url.PathEscape(object)+"?alt=media", "", nil)
+		if err != nil {
+			return err
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		scanner.Buffer(nil, len(data)+1)
+		for scanner.Scan() {
+			var out struct {
+				Request struct {
+					Labels map[string]string `json:"labels"`
+				} `json:"request"`
+				Response json.RawMessage `json:"response"`
+				Status   string          `json:"status"`
+			}
+			if json.Unmarshal(scanner.Bytes(), &out) != nil {
+				continue
+			}
+			i, err := strconv.Atoi(out.Request.Labels[vertexBatchLineLabel])
+			if err != nil || i < 0 || i >= len(lines) {
+				continue
+			}
+			if out.Status != "" || len(out.Response) == 0 {
+				results[i] = &batchResultResponse{StatusCode: http.StatusInternalServerError, Body: openAIErrorBody("api_error", "prediction_failed", out.Status)}
+				continue
+			}
+			var req struct {
+				Model string `json:"model"`
+			}
+			json.Unmarshal(lines[i].Body, &req)
+			completion, err := geminiToOpenAIResponse(out.Response, req.Model)
+			if err != nil {
+				results[i] = &batchResultResponse{StatusCode: http.StatusInternalServerError, Body: openAIErrorBody("api_error", "invalid_prediction", err.Error())}
+				continue
+			}
+			results[i] = &batchResultResponse{StatusCode: http.StatusOK, Body: json.RawMessage(completion)}
+		}
+	}
+	return nil
+}
+
+// call sends a request authenticated with credentials to a Google API and
+// returns the response body, or an error for non-2xx responses. The
+// bucket is always accessed with the default credentials.
+func (v *vertexBatchBackend) call(ctx context.Context, credentials, method, u, contentType string, body io.Reader) ([]byte, error) {
+	tok, err := getTokenFor(ctx, credentials)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+tok)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("%s %s returned %s: %s", method, req.URL.Path, resp.Status, bytes.TrimSpace(data))
+	}
+	return data, nil
+}
+
+func openAIErrorBody(errType, code, message string) openAIError {
+	return openAIError{Error: openAIErrorDetail{Message: message, Type: errType, Code: code}}
+}
+
+// geminiChatRequest holds the chat completions fields converted to Gemini
+// that openAIChatRequest doesn't.
+type geminiChatRequest struct {
+	N                *int            `json:"n"`
+	Seed             *int            `json:"seed"`
+	PresencePenalty  *float64        `json:"presence_penalty"`
+	FrequencyPenalty *float64        `json:"frequency_penalty"`
+	ReasoningEffort  string          `json:"reasoning_effort"`
+	ResponseFormat   json.RawMessage `json:"response_format"`
+}
+
+// openAIToGeminiRequest converts a chat completions request to a Gemini
+// GenerateContentRequest, for batch prediction.
+func openAIToGeminiRequest(body []byte) (map[string]any, error) {
+	var req openAIChatRequest
+	var extra geminiChatRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, fmt.Errorf("parsing chat completions request: %w", err)
+	}
+	json.Unmarshal(body, &extra)
+
+	out := map[string]any{}
+	var system []map[string]any
+	var contents []map[string]any
+	appendParts := func(role string, parts ...map[string]any) {
+		// Merge consecutive messages of a role, e.g. tool results.
+		if n := len(contents); n > 0 && contents[n-1]["role"] == role {
+			contents[n-1]["parts"] = append(contents[n-1]["parts"].([]map[string]any), parts...)
+			return
+		}
+		contents = append(contents, map[string]any{"role": role, "parts": parts})
+	}
+	toolNames := map[string]string{}
+	for i, m := range req.Messages {
+		switch m.Role {
+		case "system", "developer":
+			text, err := contentText(m.Content)
+			if err != nil {
+				return nil, fmt.Errorf("messages[%d]: %w", i, err)
+			}
+			system = append(system, map[string]any{"text": text})
+		case "user", "assistant":
+			parts, err := geminiParts(m.Content)
+			if err != nil {
+				return nil, fmt.Errorf("messages[%d]: %w", i, err)
+			}
+			role := "user"
+			if m.Role == "assistant" {
+				role = "model"
+			}
+			for _, tc := range m.ToolCalls {
+				args := map[string]any{}
+				if tc.Function.Arguments != "" {
+					if err := json.Unmarshal([]byte(tc.Function.Arguments), &args); err != nil {
+						return nil, fmt.Errorf("messages[%d]: tool call %s has invalid arguments: %w", i, tc.ID, err)
+					}
+				}
+				toolNames[tc.ID] = tc.Function.Name
+				parts = append(parts, map[string]any{"functionCall": map[string]any{"name": tc.Function.Name, "args": args}})
+			}
+			if len(parts) > 0 {
+				appendParts(role, parts...)
+			}
+		case "tool":
+			text, err := contentText(m.Content)
+			if err != nil {
+				return nil, fmt.Errorf("messages[%d]: %w", i, err)
+			}
+			var response any
+			if json.Unmarshal([]byte(text), &response) != nil {
+				response = text
+			}
+			if _, ok := response.(map[string]any); !ok {
+				response = map[string]any{"content": response}
+			}
+			appendParts("user", map[string]any{"functionResponse": map[string]any{"name": toolNames[m.ToolCallID], "response": response}})
+		default:
+			return nil, fmt.Errorf("messages[%d]: unsupported role %q", i, m.Role)
+		}
+	}
+	if len(system) > 0 {
+		out["systemInstruction"] = map[string]any{"parts": system}
+	}
+	out["contents"] = contents
+
+	generationConfig := map[string]any{}
+	switch {
+	case req.MaxCompletionTokens != nil:
+		generationConfig["maxOutputTokens"] = *req.MaxCompletionTokens
+	case req.MaxTokens != nil:
+		generationConfig["maxOutputTokens"] = *req.MaxTokens
+	}
+	if req.Temperature != nil {
+		generationConfig["temperature"] = *req.Temperature
+	}
+	if req.TopP != nil {
+		generationConfig["topP"] = *req.TopP
+	}
+	if extra.N != nil {
+		generationConfig["candidateCount"] = *extra.N
+	}
+	if extra.Seed != nil {
+		generationConfig["seed"] = *extra.Seed
+	}
+	if extra.PresencePenalty != nil {
+		generationConfig["presencePenalty"] = *extra.PresencePenalty
+	}
+	if extra.FrequencyPenalty != nil {
+		generationConfig["frequencyPenalty"] = *extra.FrequencyPenalty
+	}
+	if len(req.Stop) > 0 && string(req.Stop) != "null" {
+		var stop []string
+		if err := json.Unmarshal(req.Stop, &stop); err != nil {
+			var single string
+			if err := json.Unmarshal(req.Stop, &single); err != nil {
+				return nil, fmt.Errorf("invalid stop: %w", err)
+			}
+			stop = []string{single}
+		}
+		generationConfig["stopSequences"] = stop
+	}
+	if budget, ok := thinkingBudgets[extra.ReasoningEffort]; ok {
+		generationConfig["thinkingConfig"] = map[string]any{"thinkingBudget": budget}
+	}
+	if len(extra.ResponseFormat) > 0 {
+		var format struct {
+			Type       string `json:"type"`
+			JSONSchema struct {
+				Schema map[string]any `json:"schema"`
+			} `json:"json_schema"`
+		}
+		if err := json.Unmarshal(extra.ResponseFormat, &format); err != nil {
+			return nil, fmt.Errorf("invalid response_format: %w", err)
+		}
+		if format.Type == "json_object" || format.Type == "json_schema" {
+			generationConfig["responseMimeType"] = "application/json"
+		}
+		if format.JSONSchema.Schema != nil {
+			generationConfig["responseSchema"], _ = sanitizeSchema(format.JSONSchema.Schema)
+		}
+	}
+	if len(generationConfig) > 0 {
+		out["generationConfig"] = generationConfig
+	}
+
+	if len(req.Tools) > 0 {
+		declarations := make([]map[string]any, 0, len(req.Tools))
+		for _, t := range req.Tools {
+			decl := map[string]any{"name": t.Function.Name}
+			if t.Function.Description != "" {
+				decl["description"] = t.Function.Description
+			}
+			var params map[string]any
+			if json.Unmarshal(t.Function.Parameters, &params) == nil && params != nil {
+				decl["parameters"], _ = sanitizeSchema(params)
+			}
+			declarations = append(declarations, decl)
+		}
+		out["tools"] = []map[string]any{{"functionDeclarations": declarations}}
+		if choice, err := geminiToolConfig(req.ToolChoice); err != nil {
+			return nil, err
+		} else if choice != nil {
+			out["toolConfig"] = map[string]any{"functionCallingConfig": choice}
+		}
+	}
+	return out, nil
+}
+
+// geminiToolConfig converts an OpenAI tool_choice value to a Gemini
+// functionCallingConfig.
+func geminiToolConfig(raw json.RawMessage) (map[string]any, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	var mode string
+	if json.Unmarshal(raw, &mode) == nil {
+		switch mode {
+		case "auto":
+			return map[string]any{"mode": "AUTO"}, nil
+		case "none":
+			return map[string]any{"mode": "NONE"}, nil
+		case "required":
+			return map[string]any{"mode": "ANY"}, nil
+		}
+		return nil, fmt.Errorf("unsupported tool_choice %q", mode)
+	}
+	var choice struct {
+		Function struct {
+			Name string `json:"name"`
+		} `json:"function"`
+	}
+	if err := json.Unmarshal(raw, &choice); err != nil || choice.Function.Name == "" {
+		return nil, errors.New("invalid tool_choice")
+	}
+	return map[string]any{"mode": "ANY", "allowedFunctionNames": []string{choice.Function.Name}}, nil
+}
+
+// geminiParts converts an OpenAI message content to Gemini parts. Data URLs
+// are sent inline and other URLs, e.g. gs://, as file references.
+func geminiParts(raw json.RawMessage) ([]map[string]any, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	var text string
+	if json.Unmarshal(raw, &text) == nil {
+		if text == "" {
+			return nil, nil
+		}
+		return []map[string]any{{"text": text}}, nil
+	}
+	var parts []struct {
+		Type     string `json:"type"`
+		Text     string `json:"text"`
+		ImageURL *struct {
+			URL string `json:"url"`
+		} `json:"image_url"`
+		InputAudio *struct {
+			Data   string `json:"data"`
+			Format string `json:"format"`
+		} `json:"input_audio"`
+	}
+	if err := json.Unmarshal(raw, &parts); err != nil {
+		return nil, fmt.Errorf("invalid content: %w", err)
+	}
+	out := make([]map[string]any, 0, len(parts))
+	for _, p := range parts {
+		switch {
+		case p.Type == "text":
+			out = append(out, map[string]any{"text": p.Text})
+		case p.Type == "image_url" && p.ImageURL != nil:
+			if rest, ok := strings.CutPrefix(p.ImageURL.URL, "data:"); ok {
+				meta, data, found := strings.Cut(rest, ",")
+				mimeType, isBase64 := strings.CutSuffix(meta, ";base64")
+				if !found || !isBase64 {
+					return nil, errors.New("image data URLs must be base64 encoded")
+				}
+				out = append(out, map[string]any{"inlineData": map[string]any{"mimeType": mimeType, "data": data}})
+				continue
+			}
+			mimeType := mime.TypeByExtension(path.Ext(p.ImageURL.URL))
+			if mimeType == "" {
+				mimeType = "image/jpeg"
+			}
+			out = append(out, map[string]any{"fileData": map[string]any{"mimeType": mediaType(mimeType), "fileUri": p.ImageURL.URL}})
+		case p.Type == "input_audio" && p.InputAudio != nil:
+			out = append(out, map[string]any{"inlineData": map[string]any{"mimeType": "audio/" + p.InputAudio.Format, "data": p.InputAudio.Data}})
+		default:
+			return nil, fmt.Errorf("unsupported content part type %q", p.Type)
+		}
+	}
+	return out, nil
+}
+
+// geminiResponse is a Gemini GenerateContentResponse.
+type geminiResponse struct {
+	ResponseID string `json:"responseId"`
+	Candidates []struct {
+		Index   int `json:"index"`
+		Content struct {
+			Parts []struct {
+				Text         string `json:"text"`
+				Thought      bool   `json:"thought"`
+				FunctionCall *struct {
+					Name string          `json:"name"`
+					Args json.RawMessage `json:"args"`
+				} `json:"functionCall"`
+			} `json:"parts"`
+		} `json:"content"`
+		FinishReason string `json:"finishReason"`
+	} `json:"candidates"`
+	UsageMetadata struct {
+		PromptTokenCount     int `json:"promptTokenCount"`
+		CandidatesTokenCount int `json:"candidatesTokenCount"`
+		ThoughtsTokenCount   int `json:"thoughtsTokenCount"`
+		TotalTokenCount      int `json:"totalTokenCount"`
+	} `json:"usageMetadata"`
+}
+
+// geminiFinishReason maps a Gemini finishReason to an OpenAI finish_reason.
+func geminiFinishReason(reason string) string {
+	switch reason {
+	case "MAX_TOKENS":
+		return "length"
+	case "SAFETY", "RECITATION", "BLOCKLIST", "PROHIBITED_CONTENT", "SPII":
+		return "content_filter"
+	default:
+		return "stop"
+	}
+}
+
+// geminiToOpenAIResponse converts a Gemini GenerateContentResponse to an
+// OpenAI chat completion.
+func geminiToOpenAIResponse(body []byte, model string) ([]byte, error) {
+	var resp geminiResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, fmt.Errorf("parsing Gemini response: %w", err)
+	}
+	choices := make([]map[string]any, 0, len(resp.Candidates))
+	for _, c := range resp.Candidates {
+		message := map[string]any{"role": "assistant", "content": nil}
+		var text, reasoning strings.Builder
+		var toolCalls []map[string]any
+		for _, p := range c.Content.Parts {
+			switch {
+			case p.FunctionCall != nil:
+				args := string(p.FunctionCall.Args)
+				if args == "" {
+					args = "{}"
+				}
+				toolCalls = append(toolCalls, map[string]any{
+					"id":       fmt.Sprintf("call_%d_%d", c.Index, len(toolCalls)),
+					"type":     "function",
+					"function": map[string]any{"name": p.FunctionCall.Name, "arguments": args},
+				})
+			case p.Thought:
+				reasoning.WriteString(p.Text)
+			default:
+				text.WriteString(p.Text)
+			}
+		}
+		if text.Len() > 0 {
+			message["content"] = text.String()
+		}
+		if reasoning.Len() > 0 {
+			message["reasoning_content"] = reasoning.String()
+		}
+		finishReason := geminiFinishReason(c.FinishReason)
+		if len(toolCalls) > 0 {
+			message["tool_calls"] = toolCalls
+			finishReason = "tool_calls"
+		}
+		choices = append(choices, map[string]any{"index": c.Index, "message": message, "finish_reason": finishReason})
+	}
+	u := resp.UsageMetadata
+	usage := map[string]any{
+		"prompt_tokens":     u.PromptTokenCount,
+		"completion_tokens": u.CandidatesTokenCount + u.ThoughtsTokenCount,
+		"total_tokens":      u.TotalTokenCount,
+	}
+	if u.ThoughtsTokenCount > 0 {
+		usage["completion_tokens_details"] = map[string]any{"reasoning_tokens": u.ThoughtsTokenCount}
+	}
+	id := resp.ResponseID
+	if id == "" {
+		id = newBatchID("chatcmpl-")
+	}
+	return json.Marshal(map[string]any{
+		"id":      id,
+		"object":  "chat.completion",
+		"created": time.Now().Unix(),
+		"model":   model,
+		"choices": choices,
+		"usage":   usage,
+	})
+}
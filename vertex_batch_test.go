@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeVertexBatch stands in for Cloud Storage and the Vertex AI
+// batchPredictionJobs API. Jobs succeed on the second poll, answering every
+// request with its last message, or fail the requests containing "fail".
+type fakeVertexBatch struct {
+	t       *testing.T
+	mu      sync.Mutex
+	objects map[string][]byte
+	jobs    map[string]map[string]any
+	polls   int
+	created []map[string]any
+}
+
+func newFakeVertexBatch(t *testing.T) *httptest.Server {
+	f := &fakeVertexBatch{t: t, objects: map[string][]byte{}, jobs: map[string]map[string]any{}}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	original := gcsBaseURL
+	t.Cleanup(func() { gcsBaseURL = original })
+	gcsBaseURL = server.URL
+	routeVertexAITo(t, server)
+	setCachedToken(t, "test-token")
+	return server
+}
+
+func (f *fakeVertexBatch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.Header.Get("Authorization") != "Bearer test-token" {
+		http.Error(w, "unauthenticated", http.StatusUnauthorized)
+		return
+	}
+	var body bytes.Buffer
+	body.ReadFrom(r.Body)
+	jobPrefix := "/v1/projects/p/locations/l/batchPredictionJobs"
+	switch {
+	case r.URL.Path == "/upload/storage/v1/b/bucket/o":
+		f.objects[r.URL.Query().Get("name")] = body.Bytes()
+		w.Write([]byte(`{}`))
+	case r.URL.Path == "/storage/v1/b/bucket/o":
+		var items []map[string]string
+		for name := range f.objects {
+			if strings.HasPrefix(name, r.URL.Query().Get("prefix")) {
+				items = append(items, map[string]string{"name": name})
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]any{"items": items})
+	case strings.HasPrefix(r.URL.Path, "/storage/v1/b/bucket/o/"):
+		w.Write(f.objects[strings.TrimPrefix(r.URL.Path, "/storage/v1/b/bucket/o/")])
+	case r.Method == "POST" && r.URL.Path == jobPrefix:
+		var job map[string]any
+		json.Unmarshal(body.Bytes(), &job)
+		f.created = append(f.created, job)
+		job["name"] = "projects/p/locations/l/batchPredictionJobs/1"
+		job["state"] = "JOB_STATE_PENDING"
+		f.jobs[job["name"].(string)] = job
+		json.NewEncoder(w).Encode(job)
+	case r.Method == "POST" && strings.HasSuffix(r.URL.Path, ":cancel"):
+		f.jobs[strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/v1/"), ":cancel")]["state"] = "JOB_STATE_CANCELLED"
+		w.Write([]byte(`{}`))
+	case r.Method == "GET" && strings.HasPrefix(r.URL.Path, jobPrefix+"/"):
+		job := f.jobs[strings.TrimPrefix(r.URL.Path, "/v1/")]
+		if job == nil {
+			http.NotFound(w, r)
+			return
+		}
+		f.polls++
+		if job["state"] == "JOB_STATE_PENDING" {
+			job["state"] = "JOB_STATE_RUNNING"
+		} else if job["state"] == "JOB_STATE_RUNNING" {
+			f.complete(job)
+		}
+		json.NewEncoder(w).Encode(job)
+	default:
+		f.t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeVertexBatch) complete(job map[string]any) {
+	input := job["inputConfig"].(map[string]any)["gcsSource"].(map[string]any)["uris"].([]any)[0].(string)
+	outputDir := job["outputConfig"].(map[string]any)["gcsDestination"].(map[string]any)["outputUriPrefix"].(string) + "/prediction-model-1"
+	var out bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(f.objects[strings.TrimPrefix(input, "gs://bucket/")]))
+	for scanner.Scan() {
+		var line struct {
+			Request struct {
+				Contents []struct {
+					Parts []struct {
+						Text string `json:"text"`
+					} `json:"parts"`
+				} `json:"contents"`
+			} `json:"request"`
+		}
+		json.Unmarshal(scanner.Bytes(), &line)
+		var raw map[string]any
+		json.Unmarshal(scanner.Bytes(), &raw)
+		contents := line.Request.Contents
+		text := contents[len(contents)-1].Parts[0].Text
+		result := map[string]any{"request": raw["request"], "status": ""}
+		if strings.Contains(text, "fail") {
+			result["status"] = "Bad Request: invalid argument"
+		} else {
+			result["response"] = map[string]any{
+				"candidates":    []any{map[string]any{"content": map[string]any{"role": "model", "parts": []any{map[string]any{"text": text}}}, "finishReason": "STOP"}},
+				"usageMetadata": map[string]any{"promptTokenCount": 3, "candidatesTokenCount": 2, "totalTokenCount": 5},
+			}
+		}
+		data, _ := json.Marshal(result)
+		out.Write(append(data, '\n'))
+	}
+	f.objects[strings.TrimPrefix(outputDir, "gs://bucket/")+"/predictions.jsonl"] = out.Bytes()
+	job["state"] = "JOB_STATE_SUCCEEDED"
+	job["outputInfo"] = map[string]any{"gcsOutputDirectory": outputDir}
+}
+
+func TestBatches_Vertex(t *testing.T) {
+	newFakeVertexBatch(t)
+	s, _ := newTestFileStore(t)
+	m, mux := newTestBatchManager(t, s, func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request sent locally for a Vertex AI batch")
+	})
+	m.vertex = newVertexBatchBackend("gs://bucket/jobs/", "p", "l", 0, time.Millisecond)
+
+	input := strings.ReplaceAll(batchInput("hello", "fail", "world"), `"model":"m"`, `"model":"google/gemini-2.0-flash-001"`) +
+		`{"custom_id":"bad-role","method":"POST","url":"/v1/chat/completions","body":{"model":"google/gemini-2.0-flash-001","messages":[{"role":"robot","content":"x"}]}}` + "\n"
+	rr := uploadFile(t, mux, "key-a", "input.jsonl", "batch", []byte(input))
+	var f fileObject
+	json.Unmarshal(rr.Body.Bytes(), &f)
+	var created batchObject
+	json.Unmarshal(createBatch(t, mux, f.ID, `{"backend":"vertex"}`).Body.Bytes(), &created)
+	m.wait()
+
+	b := getBatch(t, mux, created.ID)
+	if b.Status != batchCompleted || b.RequestCounts != (batchRequestCounts{Total: 4, Completed: 2, Failed: 2}) {
+		t.Fatalf("batch = %+v, want completed with 2 completed and 2 failed", b)
+	}
+	output := readResults(t, s, keyOwner("key-a"), b.OutputFileID)
+	body, _ := json.Marshal(output["world"].Response.Body)
+	if len(output) != 2 || !strings.Contains(string(body), `"content":"world"`) || !strings.Contains(string(body), `"model":"google/gemini-2.0-flash-001"`) {
+		t.Errorf("output = %+v, body %s", output, body)
+	}
+	errs := readResults(t, s, keyOwner("key-a"), b.ErrorFileID)
+	if errs["fail"].Response.StatusCode != http.StatusInternalServerError || errs["bad-role"].Response.StatusCode != http.StatusBadRequest {
+		t.Errorf("errors = %+v", errs)
+	}
+
+	m.mu.Lock()
+	vertexJob := m.jobs[created.ID].VertexJob
+	m.mu.Unlock()
+	if vertexJob != "projects/p/locations/l/batchPredictionJobs/1" {
+		t.Errorf("VertexJob = %q", vertexJob)
+	}
+}
+
+func TestVertexBatchBackend_Accepts(t *testing.T) {
+	useConfig(t, &proxyConfig{
+		Prompts:    map[string]*promptConfig{"rules": {System: "Follow the rules."}},
+		Keys:       []keyConfig{{Key: "key-a", Name: "a"}, {Key: "key-p", Name: "p", Prompt: "rules"}},
+		Parameters: map[string]map[string]string{"google/gemini-2.5-*": {"logit_bias": "drop"}},
+	})
+	lines := func(models ...string) []batchRequestLine {
+		var out []batchRequestLine
+		for _, m := range models {
+			out = append(out, batchRequestLine{Body: json.RawMessage(`{"model":"` + m + `"}`)})
+		}
+		return out
+	}
+	v := newVertexBatchBackend("bucket", "p", "l", 3, time.Second)
+	vertex := map[string]string{"backend": "vertex"}
+	owner, prompted := keyOwner("key-a"), keyOwner("key-p")
+	tests := []struct {
+		name     string
+		owner    string
+		metadata map[string]string
+		endpoint string
+		lines    []batchRequestLine
+		want     bool
+		wantErr  bool
+	}{
+		{"asked", owner, vertex, "/v1/chat/completions", lines("google/gemini-2.0-flash-001"), true, false},
+		{"small", owner, nil, "/v1/chat/completions", lines("gemini-2.0-flash-001"), false, false},
+		{"large", owner, nil, "/v1/chat/completions", lines("m", "m", "m"), true, false},
+		{"large mixed", owner, nil, "/v1/chat/completions", lines("a", "b", "a"), false, false},
+		{"asked mixed", owner, vertex, "/v1/chat/completions", lines("a", "b"), false, true},
+		{"asked partner", owner, vertex, "/v1/chat/completions", lines("anthropic/claude-sonnet-4"), false, true},
+		{"asked embeddings", owner, vertex, "/v1/embeddings", lines("text-embedding-005"), false, true},
+		{"large prompted", prompted, nil, "/v1/chat/completions", lines("m", "m", "m"), false, false},
+		{"asked prompted", prompted, vertex, "/v1/chat/completions", lines("google/gemini-2.0-flash-001"), false, true},
+		{"large parameters", owner, nil, "/v1/chat/completions", lines("google/gemini-2.5-pro", "google/gemini-2.5-pro", "google/gemini-2.5-pro"), false, false},
+		{"asked parameters", owner, vertex, "/v1/chat/completions", lines("google/gemini-2.5-pro"), false, true},
+	}
+	for _, tt := range tests {
+		got, err := v.accepts(tt.owner, tt.metadata, tt.endpoint, tt.lines)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("%s: accepts() = %v, %v, want %v, error %v", tt.name, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestVertexBatchBackend_Target(t *testing.T) {
+	setupRoutingConfig(t)
+	v := newVertexBatchBackend("bucket", "p", "l", 0, time.Second)
+	if got, want := v.target(keyOwner("key-a")), (vertexBatchTarget{project: "proj-a", location: "europe-west4", credentials: "team-a-creds"}); got != want {
+		t.Errorf("target(key-a) = %+v, want %+v", got, want)
+	}
+	if got, want := v.target(keyOwner("key-free")), (vertexBatchTarget{project: "p", location: "l"}); got != want {
+		t.Errorf("target(key-free) = %+v, want %+v", got, want)
+	}
+	if got, want := v.target(keyOwner("key-a")).jobsURL(), "/v1/projects/proj-a/locations/europe-west4/batchPredictionJobs"; !strings.HasSuffix(got, want) {
+		t.Errorf("jobsURL() = %s, want suffix %s", got, want)
+	}
+}
+
+func TestOpenAIToGeminiRequest(t *testing.T) {
+	body := `{"model":"google/gemini-2.0-flash-001","max_tokens":100,"temperature":0.5,"stop":"END","n":2,"reasoning_effort":"low",
+		"response_format":{"type":"json_schema","json_schema":{"name":"x","schema":{"type":"object","additionalProperties":false,"properties":{"a":{"type":"string"}}}}},
+		"tools":[{"type":"function","function":{"name":"get_weather","parameters":{"type":"object","properties":{"city":{"type":"string"}}}}}],
+		"tool_choice":"required",
+		"messages":[
+			{"role":"system","content":"Be brief."},
+			{"role":"user","content":[{"type":"text","text":"Look"},{"type":"image_url","image_url":{"url":"data:image/png;base64,AAAA"}},{"type":"image_url","image_url":{"url":"gs://b/cat.png"}}]},
+			{"role":"assistant","content":null,"tool_calls":[{"id":"call_1","type":"function","function":{"name":"get_weather","arguments":"{\"city\":\"Paris\"}"}}]},
+			{"role":"tool","tool_call_id":"call_1","content":"{\"temp\":20}"}]}`
+	req, err := openAIToGeminiRequest([]byte(body))
+	if err != nil {
+		t.Fatalf("openAIToGeminiRequest() error = %v", err)
+	}
+	got, _ := json.Marshal(req)
+	for _, want := range []string{
+		`"systemInstruction":{"parts":[{"text":"Be brief."}]}`,
+		`{"inlineData":{"data":"AAAA","mimeType":"image/png"}}`,
+		`{"fileData":{"fileUri":"gs://b/cat.png","mimeType":"image/png"}}`,
+		`{"parts":[{"functionCall":{"args":{"city":"Paris"},"name":"get_weather"}}],"role":"model"}`,
+		`{"parts":[{"functionResponse":{"name":"get_weather","response":{"temp":20}}}],"role":"user"}`,
+		`"maxOutputTokens":100`,
+		`"stopSequences":["END"]`,
+		`"candidateCount":2`,
+		`"thinkingConfig":{"thinkingBudget":1024}`,
+		`"responseMimeType":"application/json"`,
+		`"toolConfig":{"functionCallingConfig":{"mode":"ANY"}}`,
+	} {
+		if !strings.Contains(string(got), want) {
+			t.Errorf("openAIToGeminiRequest() = %s, want %s", got, want)
+		}
+	}
+	if strings.Contains(string(got), "additionalProperties") {
+		t.Errorf("openAIToGeminiRequest() = %s, want the schema sanitised", got)
+	}
+}
+
+func TestGeminiToOpenAIResponse(t *testing.T) {
+	body := `{"responseId":"r1","candidates":[{"index":0,"finishReason":"STOP","content":{"parts":[
+		{"text":"Planning.","thought":true},{"text":"Let me check."},{"functionCall":{"name":"get_weather","args":{"city":"Paris"}}}]}}],
+		"usageMetadata":{"promptTokenCount":10,"candidatesTokenCount":5,"thoughtsTokenCount":7,"totalTokenCount":22}}`
+	got, err := geminiToOpenAIResponse([]byte(body), "google/gemini-2.5-flash")
+	if err != nil {
+		t.Fatalf("geminiToOpenAIResponse() error = %v", err)
+	}
+	for _, want := range []string{
+		`"id":"r1"`,
+		`"content":"Let me check."`,
+		`"reasoning_content":"Planning."`,
+		`"arguments":"{\"city\":\"Paris\"}"`,
+		`"finish_reason":"tool_calls"`,
+		`"completion_tokens":12`,
+		`"reasoning_tokens":7`,
+	} {
+		if !strings.Contains(string(got), want) {
+			t.Errorf("geminiToOpenAIResponse() = %s, want %s", got, want)
+		}
+	}
+}